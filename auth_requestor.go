@@ -19,7 +19,58 @@
 
 package secboot
 
-// AuthRequestor is an interface for requesting credentials.
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrAuthRequestNoInput can be returned from AuthRequestor implementations
+// if no credential was supplied, eg, because the user submitted an empty
+// response. The ActivateVolumeWith* functions don't count this against the
+// number of permitted passphrase or recovery key tries, and request the
+// credential again. After 5 consecutive requests return this error, they
+// stop requesting the credential and fail with an error that wraps this one.
+var ErrAuthRequestNoInput = errors.New("no credential was supplied")
+
+// ErrAuthRequestTimeout can be returned from AuthRequestor implementations
+// if a credential was not supplied within the configured time limit. This
+// counts against the number of permitted tries.
+var ErrAuthRequestTimeout = errors.New("timed out waiting for a credential")
+
+// AuthRequestFailedError can be returned from AuthRequestor implementations
+// if the mechanism used to request a credential fails, such as the helper
+// process exiting with an error. The ActivateVolumeWith* functions don't
+// make any further requests for the same type of credential when this
+// happens.
+type AuthRequestFailedError struct {
+	err error
+}
+
+func (e *AuthRequestFailedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *AuthRequestFailedError) Unwrap() error {
+	return e.err
+}
+
+// isAuthRequestFailedError indicates whether the supplied error is or wraps
+// an *AuthRequestFailedError.
+func isAuthRequestFailedError(err error) bool {
+	var e *AuthRequestFailedError
+	return xerrors.As(err, &e)
+}
+
+// AuthRequestor is an interface for requesting credentials. It is supplied
+// to the ActivateVolumeWith* family of functions, which don't interact with
+// the user directly.
+//
+// NewSystemdAuthRequestor provides an implementation that uses
+// systemd-ask-password. Environments without systemd (eg, a minimal
+// initramfs or one that uses plymouth or a custom console reader) can
+// supply their own implementation.
 type AuthRequestor interface {
 	// RequestPassphrase is used to request the passphrase for a platform
 	// protected key that is being used to unlock the container at the
@@ -30,3 +81,89 @@ type AuthRequestor interface {
 	// container at the specified sourceDevicePath.
 	RequestRecoveryKey(volumeName, sourceDevicePath string) (RecoveryKey, error)
 }
+
+// ContextAuthRequestor is an optional extension to AuthRequestor for
+// implementations that can abandon a request for credentials when the
+// supplied context is cancelled or its deadline expires. It is used by
+// the ActivateVolumeWith*Context family of functions if the supplied
+// AuthRequestor implements it.
+type ContextAuthRequestor interface {
+	AuthRequestor
+
+	// RequestPassphraseWithContext is the same as RequestPassphrase, but
+	// should return ctx.Err() if ctx is done before a passphrase is obtained.
+	RequestPassphraseWithContext(ctx context.Context, volumeName, sourceDevicePath string) (string, error)
+
+	// RequestRecoveryKeyWithContext is the same as RequestRecoveryKey, but
+	// should return ctx.Err() if ctx is done before a recovery key is obtained.
+	RequestRecoveryKeyWithContext(ctx context.Context, volumeName, sourceDevicePath string) (RecoveryKey, error)
+}
+
+// AuthRequestPrompt customizes the prompt used by a PromptAuthRequestor
+// for a single request.
+type AuthRequestPrompt struct {
+	// Message is a template used to compose the message that is
+	// displayed, which is executed with the same parameters as the
+	// templates supplied to NewSystemdAuthRequestor. If this is empty,
+	// the implementation's default message is used.
+	Message string
+
+	// Icon is the name of the icon that is displayed. If this is
+	// empty, the implementation's default icon is used.
+	Icon string
+}
+
+// PromptAuthRequestor is an optional extension to ContextAuthRequestor for
+// implementations that permit the prompt to be customized for each request.
+// It is used by the ActivateVolumeWith* family of functions when the
+// PromptMessage or PromptIcon fields of ActivateVolumeOptions are set. The
+// AuthRequestor returned from NewSystemdAuthRequestor implements it.
+type PromptAuthRequestor interface {
+	ContextAuthRequestor
+
+	// RequestPassphraseWithPrompt is the same as
+	// RequestPassphraseWithContext, but uses the supplied prompt.
+	RequestPassphraseWithPrompt(ctx context.Context, volumeName, sourceDevicePath string, prompt *AuthRequestPrompt) (string, error)
+
+	// RequestRecoveryKeyWithPrompt is the same as
+	// RequestRecoveryKeyWithContext, but uses the supplied prompt.
+	RequestRecoveryKeyWithPrompt(ctx context.Context, volumeName, sourceDevicePath string, prompt *AuthRequestPrompt) (RecoveryKey, error)
+}
+
+// promptAuthRequestor adapts a PromptAuthRequestor so that every request
+// uses a fixed prompt.
+type promptAuthRequestor struct {
+	PromptAuthRequestor
+	passphrasePrompt  *AuthRequestPrompt
+	recoveryKeyPrompt *AuthRequestPrompt
+}
+
+func (r *promptAuthRequestor) RequestPassphrase(volumeName, sourceDevicePath string) (string, error) {
+	return r.RequestPassphraseWithContext(context.Background(), volumeName, sourceDevicePath)
+}
+
+func (r *promptAuthRequestor) RequestPassphraseWithContext(ctx context.Context, volumeName, sourceDevicePath string) (string, error) {
+	return r.RequestPassphraseWithPrompt(ctx, volumeName, sourceDevicePath, r.passphrasePrompt)
+}
+
+func (r *promptAuthRequestor) RequestRecoveryKey(volumeName, sourceDevicePath string) (RecoveryKey, error) {
+	return r.RequestRecoveryKeyWithContext(context.Background(), volumeName, sourceDevicePath)
+}
+
+func (r *promptAuthRequestor) RequestRecoveryKeyWithContext(ctx context.Context, volumeName, sourceDevicePath string) (RecoveryKey, error) {
+	return r.RequestRecoveryKeyWithPrompt(ctx, volumeName, sourceDevicePath, r.recoveryKeyPrompt)
+}
+
+func requestPassphrase(ctx context.Context, r AuthRequestor, volumeName, sourceDevicePath string) (string, error) {
+	if r, ok := r.(ContextAuthRequestor); ok {
+		return r.RequestPassphraseWithContext(ctx, volumeName, sourceDevicePath)
+	}
+	return r.RequestPassphrase(volumeName, sourceDevicePath)
+}
+
+func requestRecoveryKey(ctx context.Context, r AuthRequestor, volumeName, sourceDevicePath string) (RecoveryKey, error) {
+	if r, ok := r.(ContextAuthRequestor); ok {
+		return r.RequestRecoveryKeyWithContext(ctx, volumeName, sourceDevicePath)
+	}
+	return r.RequestRecoveryKey(volumeName, sourceDevicePath)
+}
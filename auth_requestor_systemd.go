@@ -21,12 +21,15 @@ package secboot
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"text/template"
+	"time"
 
 	"golang.org/x/xerrors"
 )
@@ -38,55 +41,146 @@ type askPasswordMsgParams struct {
 	// LUKS2Label string
 }
 
+const defaultSystemdAskPasswordIcon = "drive-harddisk"
+
 type systemdAuthRequestor struct {
 	passphraseTmpl  *template.Template
 	recoveryKeyTmpl *template.Template
+	icon            string
+	timeout         time.Duration
 }
 
-func (r *systemdAuthRequestor) askPassword(sourceDevicePath, msg string) (string, error) {
-	cmd := exec.Command(
+// timeoutArg returns the --timeout argument for systemd-ask-password. This is
+// always supplied, because systemd-ask-password otherwise applies its own
+// default timeout of 90 seconds and exits with an error that would be
+// indistinguishable from any other failure. The timeout is rounded up to a
+// whole number of seconds so that the context deadline is normally reached
+// first.
+func (r *systemdAuthRequestor) timeoutArg() string {
+	secs := int64(0)
+	if r.timeout > 0 {
+		secs = int64((r.timeout + time.Second - 1) / time.Second)
+	}
+	return fmt.Sprintf("--timeout=%d", secs)
+}
+
+func (r *systemdAuthRequestor) askPassword(ctx context.Context, icon, sourceDevicePath, msg string) (string, error) {
+	cmdCtx := ctx
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	// The child process is killed if cmdCtx is done before it exits.
+	cmd := exec.CommandContext(cmdCtx,
 		"systemd-ask-password",
-		"--icon", "drive-harddisk",
+		"--icon", icon,
 		"--id", filepath.Base(os.Args[0])+":"+sourceDevicePath,
+		r.timeoutArg(),
 		msg)
 	out := new(bytes.Buffer)
 	cmd.Stdout = out
 	cmd.Stdin = os.Stdin
+	start := time.Now()
 	if err := cmd.Run(); err != nil {
-		return "", xerrors.Errorf("cannot execute systemd-ask-password: %v", err)
+		switch {
+		case ctx.Err() != nil:
+			return "", ctx.Err()
+		case cmdCtx.Err() == context.DeadlineExceeded:
+			return "", ErrAuthRequestTimeout
+		case r.timeout > 0 && time.Since(start) >= r.timeout:
+			// systemd-ask-password timed out just before
+			// the context deadline.
+			return "", ErrAuthRequestTimeout
+		}
+		return "", &AuthRequestFailedError{xerrors.Errorf("cannot execute systemd-ask-password: %v", err)}
+	}
+	if out.Len() == 0 {
+		return "", ErrAuthRequestNoInput
 	}
 	result, err := out.ReadString('\n')
 	if err != nil {
 		// The only error returned from bytes.Buffer.ReadString is io.EOF.
 		return "", errors.New("systemd-ask-password output is missing terminating newline")
 	}
-	return strings.TrimRight(result, "\n"), nil
+	result = strings.TrimRight(result, "\n")
+	if result == "" {
+		return "", ErrAuthRequestNoInput
+	}
+	return result, nil
 }
 
 func (r *systemdAuthRequestor) RequestPassphrase(volumeName, sourceDevicePath string) (string, error) {
+	return r.RequestPassphraseWithContext(context.Background(), volumeName, sourceDevicePath)
+}
+
+func (r *systemdAuthRequestor) RequestPassphraseWithContext(ctx context.Context, volumeName, sourceDevicePath string) (string, error) {
+	return r.RequestPassphraseWithPrompt(ctx, volumeName, sourceDevicePath, nil)
+}
+
+// prompt returns the message template and icon to use for a request, given
+// the default template and the optional per-request prompt.
+func (r *systemdAuthRequestor) prompt(tmpl *template.Template, prompt *AuthRequestPrompt) (*template.Template, string, error) {
+	icon := r.icon
+	if prompt == nil {
+		return tmpl, icon, nil
+	}
+	if prompt.Icon != "" {
+		icon = prompt.Icon
+	}
+	if prompt.Message != "" {
+		var err error
+		tmpl, err = template.New("promptMsg").Parse(prompt.Message)
+		if err != nil {
+			return nil, "", xerrors.Errorf("cannot parse prompt message template: %w", err)
+		}
+	}
+	return tmpl, icon, nil
+}
+
+func (r *systemdAuthRequestor) RequestPassphraseWithPrompt(ctx context.Context, volumeName, sourceDevicePath string, prompt *AuthRequestPrompt) (string, error) {
+	tmpl, icon, err := r.prompt(r.passphraseTmpl, prompt)
+	if err != nil {
+		return "", err
+	}
+
 	params := askPasswordMsgParams{
 		VolumeName:       volumeName,
 		SourceDevicePath: sourceDevicePath}
 
 	msg := new(bytes.Buffer)
-	if err := r.passphraseTmpl.Execute(msg, params); err != nil {
+	if err := tmpl.Execute(msg, params); err != nil {
 		return "", xerrors.Errorf("cannot execute message template: %w", err)
 	}
 
-	return r.askPassword(sourceDevicePath, msg.String())
+	return r.askPassword(ctx, icon, sourceDevicePath, msg.String())
 }
 
 func (r *systemdAuthRequestor) RequestRecoveryKey(volumeName, sourceDevicePath string) (RecoveryKey, error) {
+	return r.RequestRecoveryKeyWithContext(context.Background(), volumeName, sourceDevicePath)
+}
+
+func (r *systemdAuthRequestor) RequestRecoveryKeyWithContext(ctx context.Context, volumeName, sourceDevicePath string) (RecoveryKey, error) {
+	return r.RequestRecoveryKeyWithPrompt(ctx, volumeName, sourceDevicePath, nil)
+}
+
+func (r *systemdAuthRequestor) RequestRecoveryKeyWithPrompt(ctx context.Context, volumeName, sourceDevicePath string, prompt *AuthRequestPrompt) (RecoveryKey, error) {
+	tmpl, icon, err := r.prompt(r.recoveryKeyTmpl, prompt)
+	if err != nil {
+		return RecoveryKey{}, err
+	}
+
 	params := askPasswordMsgParams{
 		VolumeName:       volumeName,
 		SourceDevicePath: sourceDevicePath}
 
 	msg := new(bytes.Buffer)
-	if err := r.recoveryKeyTmpl.Execute(msg, params); err != nil {
+	if err := tmpl.Execute(msg, params); err != nil {
 		return RecoveryKey{}, xerrors.Errorf("cannot execute message template: %w", err)
 	}
 
-	passphrase, err := r.askPassword(sourceDevicePath, msg.String())
+	passphrase, err := r.askPassword(ctx, icon, sourceDevicePath, msg.String())
 	if err != nil {
 		return RecoveryKey{}, err
 	}
@@ -99,13 +193,52 @@ func (r *systemdAuthRequestor) RequestRecoveryKey(volumeName, sourceDevicePath s
 	return key, nil
 }
 
+// SystemdAuthRequestorOptions provides options to
+// NewSystemdAuthRequestorWithOptions.
+type SystemdAuthRequestorOptions struct {
+	// Icon is the name of the icon that is passed to systemd-ask-password.
+	// If this is empty, "drive-harddisk" is used.
+	Icon string
+
+	// Timeout is the maximum amount of time to wait for each
+	// credential to be supplied. If this is zero, there is no time
+	// limit, and systemd-ask-password's own default timeout is
+	// disabled. If the time limit is exceeded, ErrAuthRequestTimeout
+	// is returned.
+	Timeout time.Duration
+}
+
 // NewSystemdAuthRequestor creates an implementation of AuthRequestor that
-// delegates to the systemd-ask-password binary. The supplied templates are
-// used to compose the messages that will be displayed when requesting a
-// credential. The template will be executed with the following parameters:
+// delegates to the systemd-ask-password binary. The returned AuthRequestor
+// also implements ContextAuthRequestor, and the systemd-ask-password process
+// is terminated if the context is done before it exits. It also implements
+// PromptAuthRequestor, so the message and icon can be overridden with the
+// PromptMessage and PromptIcon fields of ActivateVolumeOptions. An empty
+// response results in ErrAuthRequestNoInput, and a systemd-ask-password
+// process that exits with an error results in an *AuthRequestFailedError
+// error. The supplied templates are used to compose the messages that will
+// be displayed when requesting a credential. The template will be executed
+// with the following parameters:
 // - .VolumeName: The name that the LUKS container will be mapped to.
 // - .SourceDevicePath: The device path of the LUKS container.
 func NewSystemdAuthRequestor(passphraseTmpl, recoveryKeyTmpl string) (AuthRequestor, error) {
+	return NewSystemdAuthRequestorWithOptions(passphraseTmpl, recoveryKeyTmpl, nil)
+}
+
+// NewSystemdAuthRequestorWithOptions creates an implementation of
+// AuthRequestor that delegates to the systemd-ask-password binary, in the
+// same way as NewSystemdAuthRequestor. The supplied options can be used to
+// customize the prompt further. If options is nil, the defaults are used.
+func NewSystemdAuthRequestorWithOptions(passphraseTmpl, recoveryKeyTmpl string, options *SystemdAuthRequestorOptions) (AuthRequestor, error) {
+	if options == nil {
+		options = new(SystemdAuthRequestorOptions)
+	}
+
+	icon := options.Icon
+	if icon == "" {
+		icon = defaultSystemdAskPasswordIcon
+	}
+
 	pt, err := template.New("passphraseMsg").Parse(passphraseTmpl)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot parse passphrase message template: %w", err)
@@ -118,5 +251,7 @@ func NewSystemdAuthRequestor(passphraseTmpl, recoveryKeyTmpl string) (AuthReques
 
 	return &systemdAuthRequestor{
 		passphraseTmpl:  pt,
-		recoveryKeyTmpl: rkt}, nil
+		recoveryKeyTmpl: rkt,
+		icon:            icon,
+		timeout:         options.Timeout}, nil
 }
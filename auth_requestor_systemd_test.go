@@ -20,10 +20,12 @@
 package secboot_test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	snapd_testutil "github.com/snapcore/snapd/testutil"
 
@@ -78,7 +80,7 @@ func (s *authRequestorSystemdSuite) testRequestPassphrase(c *C, data *testReques
 
 	c.Check(s.mockSdAskPassword.Calls(), HasLen, 1)
 	c.Check(s.mockSdAskPassword.Calls()[0], DeepEquals, []string{"systemd-ask-password", "--icon", "drive-harddisk",
-		"--id", filepath.Base(os.Args[0]) + ":" + data.sourceDevicePath, data.expectedMsg})
+		"--id", filepath.Base(os.Args[0]) + ":" + data.sourceDevicePath, "--timeout=0", data.expectedMsg})
 }
 
 func (s *authRequestorSystemdSuite) TestRequestPassphrase(c *C) {
@@ -142,6 +144,93 @@ func (s *authRequestorSystemdSuite) TestRequestPassphraseFailure(c *C) {
 
 	_, err = requestor.RequestPassphrase("data", "/dev/sda1")
 	c.Check(err, ErrorMatches, "cannot execute systemd-ask-password: exit status 1")
+	c.Check(err, FitsTypeOf, &AuthRequestFailedError{})
+}
+
+func (s *authRequestorSystemdSuite) TestRequestPassphraseEmpty(c *C) {
+	s.setPassphrase(c, "")
+
+	requestor, err := NewSystemdAuthRequestor("", "")
+	c.Assert(err, IsNil)
+
+	_, err = requestor.RequestPassphrase("data", "/dev/sda1")
+	c.Check(err, Equals, ErrAuthRequestNoInput)
+}
+
+func (s *authRequestorSystemdSuite) TestRequestPassphraseNoOutput(c *C) {
+	c.Assert(ioutil.WriteFile(s.passwordFile, nil, 0600), IsNil)
+
+	requestor, err := NewSystemdAuthRequestor("", "")
+	c.Assert(err, IsNil)
+
+	_, err = requestor.RequestPassphrase("data", "/dev/sda1")
+	c.Check(err, Equals, ErrAuthRequestNoInput)
+}
+
+func (s *authRequestorSystemdSuite) TestRequestPassphraseKilled(c *C) {
+	mockSdAskPassword := snapd_testutil.MockCommand(c, "systemd-ask-password", "kill -9 $$")
+	defer mockSdAskPassword.Restore()
+
+	requestor, err := NewSystemdAuthRequestor("", "")
+	c.Assert(err, IsNil)
+
+	_, err = requestor.RequestPassphrase("data", "/dev/sda1")
+	c.Check(err, ErrorMatches, "cannot execute systemd-ask-password: signal: killed")
+	c.Check(err, FitsTypeOf, &AuthRequestFailedError{})
+}
+
+func (s *authRequestorSystemdSuite) TestRequestPassphraseTimeout(c *C) {
+	mockSdAskPassword := snapd_testutil.MockCommand(c, "systemd-ask-password", "exec sleep 10")
+	defer mockSdAskPassword.Restore()
+
+	requestor, err := NewSystemdAuthRequestorWithOptions("", "",
+		&SystemdAuthRequestorOptions{Timeout: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	start := time.Now()
+	_, err = requestor.RequestPassphrase("data", "/dev/sda1")
+	c.Check(err, Equals, ErrAuthRequestTimeout)
+	c.Check(time.Since(start) < 5*time.Second, testutil.IsTrue)
+}
+
+func (s *authRequestorSystemdSuite) TestRequestPassphraseDefaultTimeout(c *C) {
+	// Emulate systemd-ask-password's own default timeout, which applies
+	// unless it is explicitly disabled.
+	mockSdAskPassword := snapd_testutil.MockCommand(c, "systemd-ask-password", fmt.Sprintf(`
+for arg in "$@"; do
+	if [ "$arg" = "--timeout=0" ]; then
+		exec cat %s
+	fi
+done
+exit 1`, s.passwordFile))
+	defer mockSdAskPassword.Restore()
+
+	s.setPassphrase(c, "password")
+
+	requestor, err := NewSystemdAuthRequestor("Enter passphrase for {{.SourceDevicePath}}:", "")
+	c.Assert(err, IsNil)
+
+	passphrase, err := requestor.RequestPassphrase("data", "/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(passphrase, Equals, "password")
+	c.Check(mockSdAskPassword.Calls(), DeepEquals, [][]string{
+		{"systemd-ask-password", "--icon", "drive-harddisk", "--id", filepath.Base(os.Args[0]) + ":/dev/sda1",
+			"--timeout=0", "Enter passphrase for /dev/sda1:"}})
+}
+
+func (s *authRequestorSystemdSuite) TestRequestPassphraseTimeoutArg(c *C) {
+	s.setPassphrase(c, "password")
+
+	requestor, err := NewSystemdAuthRequestorWithOptions("Enter passphrase for {{.SourceDevicePath}}:", "",
+		&SystemdAuthRequestorOptions{Timeout: 1500 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	passphrase, err := requestor.RequestPassphrase("data", "/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(passphrase, Equals, "password")
+	c.Check(s.mockSdAskPassword.Calls(), DeepEquals, [][]string{
+		{"systemd-ask-password", "--icon", "drive-harddisk", "--id", filepath.Base(os.Args[0]) + ":/dev/sda1",
+			"--timeout=2", "Enter passphrase for /dev/sda1:"}})
 }
 
 type testRequestRecoveryKeyData struct {
@@ -168,7 +257,7 @@ func (s *authRequestorSystemdSuite) testRequestRecoveryKey(c *C, data *testReque
 
 	c.Check(s.mockSdAskPassword.Calls(), HasLen, 1)
 	c.Check(s.mockSdAskPassword.Calls()[0], DeepEquals, []string{"systemd-ask-password", "--icon", "drive-harddisk",
-		"--id", filepath.Base(os.Args[0]) + ":" + data.sourceDevicePath, data.expectedMsg})
+		"--id", filepath.Base(os.Args[0]) + ":" + data.sourceDevicePath, "--timeout=0", data.expectedMsg})
 }
 
 func (s *authRequestorSystemdSuite) TestRequestRecoveryKey(c *C) {
@@ -277,4 +366,146 @@ func (s *authRequestorSystemdSuite) TestRequestRecoveryKeyFailure(c *C) {
 
 	_, err = requestor.RequestRecoveryKey("data", "/dev/sda1")
 	c.Check(err, ErrorMatches, "cannot execute systemd-ask-password: exit status 1")
+	c.Check(err, FitsTypeOf, &AuthRequestFailedError{})
+}
+
+func (s *authRequestorSystemdSuite) TestRequestRecoveryKeyEmpty(c *C) {
+	s.setPassphrase(c, "")
+
+	requestor, err := NewSystemdAuthRequestor("", "")
+	c.Assert(err, IsNil)
+
+	_, err = requestor.RequestRecoveryKey("data", "/dev/sda1")
+	c.Check(err, Equals, ErrAuthRequestNoInput)
+}
+
+func (s *authRequestorSystemdSuite) TestRequestRecoveryKeyTimeout(c *C) {
+	mockSdAskPassword := snapd_testutil.MockCommand(c, "systemd-ask-password", "exec sleep 10")
+	defer mockSdAskPassword.Restore()
+
+	requestor, err := NewSystemdAuthRequestorWithOptions("", "",
+		&SystemdAuthRequestorOptions{Timeout: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	_, err = requestor.RequestRecoveryKey("data", "/dev/sda1")
+	c.Check(err, Equals, ErrAuthRequestTimeout)
+}
+
+func (s *authRequestorSystemdSuite) TestRequestPassphraseWithCustomIcon(c *C) {
+	s.setPassphrase(c, "password")
+
+	requestor, err := NewSystemdAuthRequestorWithOptions("Enter passphrase for {{.SourceDevicePath}}:", "",
+		&SystemdAuthRequestorOptions{Icon: "dialog-password"})
+	c.Assert(err, IsNil)
+
+	passphrase, err := requestor.RequestPassphrase("data", "/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(passphrase, Equals, "password")
+
+	c.Check(s.mockSdAskPassword.Calls(), DeepEquals, [][]string{
+		{"systemd-ask-password", "--icon", "dialog-password", "--id", filepath.Base(os.Args[0]) + ":/dev/sda1",
+			"--timeout=0", "Enter passphrase for /dev/sda1:"}})
+}
+
+func (s *authRequestorSystemdSuite) TestRequestRecoveryKeyWithDefaultOptions(c *C) {
+	var key RecoveryKey
+	{
+		k := testutil.DecodeHexString(c, "e73232a995f8c96988fbd4b4824e34f4")
+		copy(key[:], k)
+	}
+	s.setPassphrase(c, key.String())
+
+	requestor, err := NewSystemdAuthRequestorWithOptions("", "Enter recovery key for {{.SourceDevicePath}}:",
+		&SystemdAuthRequestorOptions{})
+	c.Assert(err, IsNil)
+
+	rkey, err := requestor.RequestRecoveryKey("data", "/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(rkey, Equals, key)
+
+	c.Check(s.mockSdAskPassword.Calls(), DeepEquals, [][]string{
+		{"systemd-ask-password", "--icon", "drive-harddisk", "--id", filepath.Base(os.Args[0]) + ":/dev/sda1",
+			"--timeout=0", "Enter recovery key for /dev/sda1:"}})
+}
+
+func (s *authRequestorSystemdSuite) TestRequestRecoveryKeyWithPrompt(c *C) {
+	var key RecoveryKey
+	{
+		k := testutil.DecodeHexString(c, "e73232a995f8c96988fbd4b4824e34f4")
+		copy(key[:], k)
+	}
+	s.setPassphrase(c, key.String())
+
+	requestor, err := NewSystemdAuthRequestor("", "Enter recovery key for {{.SourceDevicePath}}:")
+	c.Assert(err, IsNil)
+	c.Assert(requestor, Implements, new(PromptAuthRequestor))
+
+	rkey, err := requestor.(PromptAuthRequestor).RequestRecoveryKeyWithPrompt(context.Background(), "data", "/dev/sda1",
+		&AuthRequestPrompt{Message: "Recovery key for {{.VolumeName}}:", Icon: "dialog-password"})
+	c.Check(err, IsNil)
+	c.Check(rkey, Equals, key)
+
+	c.Check(s.mockSdAskPassword.Calls(), DeepEquals, [][]string{
+		{"systemd-ask-password", "--icon", "dialog-password", "--id", filepath.Base(os.Args[0]) + ":/dev/sda1",
+			"--timeout=0", "Recovery key for data:"}})
+}
+
+func (s *authRequestorSystemdSuite) TestRequestPassphraseWithPromptIconOnly(c *C) {
+	s.setPassphrase(c, "password")
+
+	requestor, err := NewSystemdAuthRequestor("Enter passphrase for {{.SourceDevicePath}}:", "")
+	c.Assert(err, IsNil)
+
+	passphrase, err := requestor.(PromptAuthRequestor).RequestPassphraseWithPrompt(context.Background(), "data", "/dev/sda1",
+		&AuthRequestPrompt{Icon: "dialog-password"})
+	c.Check(err, IsNil)
+	c.Check(passphrase, Equals, "password")
+
+	c.Check(s.mockSdAskPassword.Calls(), DeepEquals, [][]string{
+		{"systemd-ask-password", "--icon", "dialog-password", "--id", filepath.Base(os.Args[0]) + ":/dev/sda1",
+			"--timeout=0", "Enter passphrase for /dev/sda1:"}})
+}
+
+func (s *authRequestorSystemdSuite) TestRequestRecoveryKeyWithInvalidPrompt(c *C) {
+	requestor, err := NewSystemdAuthRequestor("", "")
+	c.Assert(err, IsNil)
+
+	_, err = requestor.(PromptAuthRequestor).RequestRecoveryKeyWithPrompt(context.Background(), "data", "/dev/sda1",
+		&AuthRequestPrompt{Message: "{{.VolumeName"})
+	c.Check(err, ErrorMatches, "cannot parse prompt message template: .*")
+	c.Check(s.mockSdAskPassword.Calls(), HasLen, 0)
+}
+
+func (s *authRequestorSystemdSuite) TestRequestPassphraseWithContextCancelled(c *C) {
+	mockSdAskPassword := snapd_testutil.MockCommand(c, "systemd-ask-password", "exec sleep 10")
+	defer mockSdAskPassword.Restore()
+
+	requestor, err := NewSystemdAuthRequestor("Enter passphrase for {{.SourceDevicePath}}:", "")
+	c.Assert(err, IsNil)
+	r, ok := requestor.(ContextAuthRequestor)
+	c.Assert(ok, testutil.IsTrue)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = r.RequestPassphraseWithContext(ctx, "data", "/dev/sda1")
+	c.Check(err, Equals, context.DeadlineExceeded)
+	c.Check(time.Since(start) < 5*time.Second, testutil.IsTrue)
+}
+
+func (s *authRequestorSystemdSuite) TestRequestRecoveryKeyWithContextCancelled(c *C) {
+	mockSdAskPassword := snapd_testutil.MockCommand(c, "systemd-ask-password", "exec sleep 10")
+	defer mockSdAskPassword.Restore()
+
+	requestor, err := NewSystemdAuthRequestor("", "Enter recovery key for {{.SourceDevicePath}}:")
+	c.Assert(err, IsNil)
+	r, ok := requestor.(ContextAuthRequestor)
+	c.Assert(ok, testutil.IsTrue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = r.RequestRecoveryKeyWithContext(ctx, "data", "/dev/sda1")
+	c.Check(err, Equals, context.Canceled)
 }
@@ -21,17 +21,27 @@ package secboot
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/snapcore/snapd/asserts"
 
 	"golang.org/x/xerrors"
 
-	"github.com/snapcore/secboot/internal/keyring"
 	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/luksview"
 )
@@ -42,16 +52,32 @@ var (
 	// required features.
 	ErrMissingCryptsetupFeature = luks2.ErrMissingCryptsetupFeature
 
+	// ErrDMIntegrityUnavailable is returned from the ActivateVolumeWith*
+	// functions, wrapped in other errors, if a container that uses
+	// dm-integrity could not be activated with a correct key because
+	// the kernel does not support dm-integrity.
+	ErrDMIntegrityUnavailable = luks2.ErrDMIntegrityUnavailable
+
 	luks2Activate        = luks2.Activate
 	luks2AddKey          = luks2.AddKey
+	luks2BackupHeader    = luks2.BackupHeader
+	luks2ChangeKey       = luks2.ChangeKey
 	luks2Deactivate      = luks2.Deactivate
 	luks2Format          = luks2.Format
 	luks2ImportToken     = luks2.ImportToken
+	luks2IsLUKS2         = luks2.IsLUKS2
 	luks2KillSlot        = luks2.KillSlot
 	luks2RemoveToken     = luks2.RemoveToken
+	luks2RestoreHeader   = luks2.RestoreHeader
 	luks2SetSlotPriority = luks2.SetSlotPriority
+	luks2TestKey         = luks2.TestKey
+
+	luks2ActivateWithKeyFile      = luks2.ActivateWithKeyFile
+	luks2ActiveVolumeSourceDevice = luks2.ActiveVolumeSourceDevice
 
 	newLUKSView = luksview.NewView
+
+	timeSleep = time.Sleep
 )
 
 const (
@@ -59,15 +85,262 @@ const (
 	defaultRecoveryKeyslotName = "default-recovery"
 )
 
+// maxConsecutiveAuthRequestsWithNoInput is the maximum number of consecutive
+// credential requests that can return ErrAuthRequestNoInput before activation
+// stops requesting a credential. This prevents an endless loop with an
+// AuthRequestor that can never obtain any input, eg, because there is no tty
+// or password agent available.
+const maxConsecutiveAuthRequestsWithNoInput = 5
+
+// newAuthRequestNoInputLimitError returns the error for when the limit of
+// consecutive requests with no input has been reached.
+func newAuthRequestNoInputLimitError() error {
+	return xerrors.Errorf("giving up after %d consecutive requests: %w", maxConsecutiveAuthRequestsWithNoInput, ErrAuthRequestNoInput)
+}
+
+const (
+	// defaultFormatBusyRetries is the default number of times that
+	// InitializeLUKS2Container retries formatting a busy device.
+	defaultFormatBusyRetries = 3
+
+	// defaultFormatBusyRetryDelay is the default delay before the first
+	// retry of formatting a busy device. The delay doubles for each
+	// subsequent retry.
+	defaultFormatBusyRetryDelay = 250 * time.Millisecond
+)
+
+const (
+	// recoveryKeyGroupDigits is the number of base-10 digits in each group
+	// of a formatted recovery key. Each group encodes 2 bytes.
+	recoveryKeyGroupDigits = 5
+
+	// minExtendedRecoveryKeySize is the minimum size in bytes of an
+	// ExtendedRecoveryKey.
+	minExtendedRecoveryKeySize = 16
+
+	// maxExtendedRecoveryKeySize is the maximum size in bytes of an
+	// ExtendedRecoveryKey.
+	maxExtendedRecoveryKeySize = 64
+
+	// recoveryKeyChecksumDigits is the number of check digits that
+	// may follow a formatted RecoveryKey.
+	recoveryKeyChecksumDigits = 2
+
+	// maxFormattedRecoveryKeySize is the size in bytes of the longest valid
+	// formatted recovery key that can be read from a reader - an
+	// ExtendedRecoveryKey with 32 groups of 5 digits separated by '-', plus
+	// "\r\n". Anything beyond that is rejected by the parsing functions, so
+	// there's no need to read more.
+	maxFormattedRecoveryKeySize = (maxExtendedRecoveryKeySize/2)*(recoveryKeyGroupDigits+1) + 2
+)
+
+// ErrRecoveryKeyChecksumMismatch is returned from ParseRecoveryKey, wrapped in a
+// *RecoveryKeyFormatError, if a formatted recovery key contains check digits that
+// don't match the rest of the key.
+var ErrRecoveryKeyChecksumMismatch = errors.New("checksum mismatch")
+
+// recoveryKeyChecksum computes the ISO 7064 MOD 97-10 check digits over the
+// digits of the formatted version of the supplied recovery key.
+func recoveryKeyChecksum(key []byte) string {
+	return fmt.Sprintf("%02d", recoveryKeyChecksumValue(key))
+}
+
+// recoveryKeyChecksumValue computes the check digits in the same way as
+// recoveryKeyChecksum, but returns them as an integer. The digits of each group
+// are computed arithmetically so that no formatted copy of the key is created.
+func recoveryKeyChecksumValue(key []byte) int {
+	var r int
+	for i := 0; i < len(key)/2; i++ {
+		x := int(binary.LittleEndian.Uint16(key[i*2:]))
+		for d := 10000; d > 0; d /= 10 {
+			r = (r*10 + (x/d)%10) % 97
+		}
+	}
+	r = (r * 100) % 97
+	return 98 - r
+}
+
+// formatRecoveryKey returns the formatted version of the supplied recovery key,
+// consisting of one 5-digit zero-extended base-10 number for every 2 bytes of
+// the key, separated by '-'. The supplied key must have an even length.
+func formatRecoveryKey(key []byte) string {
+	var s bytes.Buffer
+	for i := 0; i < len(key)/2; i++ {
+		if i > 0 {
+			s.WriteByte('-')
+		}
+		fmt.Fprintf(&s, "%05d", binary.LittleEndian.Uint16(key[i*2:]))
+	}
+	return s.String()
+}
+
+// RecoveryKeyFormatError is returned from ParseRecoveryKey and ParseExtendedRecoveryKey
+// if the supplied string is not a correctly formatted recovery key. It may also be
+// returned from the activation functions when a recovery key obtained from an
+// AuthRequestor cannot be parsed.
+type RecoveryKeyFormatError struct {
+	err error
+}
+
+func (e *RecoveryKeyFormatError) Error() string {
+	return "incorrectly formatted: " + e.err.Error()
+}
+
+func (e *RecoveryKeyFormatError) Unwrap() error {
+	return e.err
+}
+
+// RecoveryKeyIncorrectError is returned from the activation functions if a correctly
+// formatted recovery key was obtained but it could not be used to activate the volume,
+// which is normally because it is not the correct recovery key.
+type RecoveryKeyIncorrectError struct {
+	err error
+}
+
+func (e *RecoveryKeyIncorrectError) Error() string {
+	return "cannot activate volume: " + e.err.Error()
+}
+
+func (e *RecoveryKeyIncorrectError) Unwrap() error {
+	return e.err
+}
+
+// ErrRecoveryKeyTriesExhausted can be used with xerrors.Is to test whether an
+// error returned from one of the activation functions indicates that every
+// permitted attempt to activate a volume with a recovery key failed. The
+// returned error wraps the error from the last attempt.
+var ErrRecoveryKeyTriesExhausted = errors.New("all recovery key tries were exhausted")
+
+type recoveryKeyTriesExhaustedError struct {
+	err error
+}
+
+func (e *recoveryKeyTriesExhaustedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *recoveryKeyTriesExhaustedError) Unwrap() error {
+	return e.err
+}
+
+func (e *recoveryKeyTriesExhaustedError) Is(target error) bool {
+	return target == ErrRecoveryKeyTriesExhausted
+}
+
+// parseRecoveryKeyGroups interprets the groups of digits at the start of the
+// supplied formatted recovery key and writes the binary form of the key to dst.
+// If groups is greater than zero, the formatted key must start with exactly this
+// number of groups of digits. If groups is zero or less, the number of groups is
+// inferred from the supplied key, which must fit in dst. It returns the number
+// of bytes written to dst and any remaining characters.
+//
+// This doesn't allocate any memory for the key, so that the caller controls
+// where copies of it are stored.
+func parseRecoveryKeyGroups(dst, s []byte, groups int) (n int, rest []byte, err error) {
+	for i := 0; groups <= 0 || i < groups; i++ {
+		if groups <= 0 && len(s) == 0 {
+			break
+		}
+		if len(s) < recoveryKeyGroupDigits {
+			return 0, nil, &RecoveryKeyFormatError{errors.New("insufficient characters")}
+		}
+		if n+2 > len(dst) {
+			return 0, nil, &RecoveryKeyFormatError{errors.New("too many characters")}
+		}
+		x, err := parseRecoveryKeyGroup(s[0:recoveryKeyGroupDigits])
+		if err != nil {
+			return 0, nil, &RecoveryKeyFormatError{err}
+		}
+		binary.LittleEndian.PutUint16(dst[n:], x)
+		n += 2
+
+		// Move to the next 5 digits
+		s = s[recoveryKeyGroupDigits:]
+		// Permit each set of 5 digits to be separated by an optional '-', but don't allow the formatted key to end or begin with one.
+		if len(s) > 1 && s[0] == '-' {
+			s = s[1:]
+		}
+	}
+
+	return n, s, nil
+}
+
+// parseRecoveryKeyGroup interprets a single group of base-10 digits. This
+// behaves like strconv.ParseUint(string(s), 10, 16), and returns the same
+// errors, but it only converts the group to a string if it is invalid.
+func parseRecoveryKeyGroup(s []byte) (uint16, error) {
+	if len(s) == 0 {
+		return 0, &strconv.NumError{Func: "ParseUint", Num: string(s), Err: strconv.ErrSyntax}
+	}
+	var x uint32
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, &strconv.NumError{Func: "ParseUint", Num: string(s), Err: strconv.ErrSyntax}
+		}
+		x = x*10 + uint32(c-'0')
+	}
+	if x > math.MaxUint16 {
+		return 0, &strconv.NumError{Func: "ParseUint", Num: string(s), Err: strconv.ErrRange}
+	}
+	return uint16(x), nil
+}
+
 // RecoveryKey corresponds to a 16-byte recovery key in its binary form.
 type RecoveryKey [16]byte
 
 func (k RecoveryKey) String() string {
-	var u16 [8]uint16
-	for i := 0; i < 8; i++ {
-		u16[i] = binary.LittleEndian.Uint16(k[i*2:])
+	return formatRecoveryKey(k[:])
+}
+
+// StringWithChecksum returns the formatted version of this recovery key in the
+// same way as String, followed by a separate group of 2 check digits computed
+// over the rest of the key using ISO 7064 MOD 97-10, eg:
+//
+// "61665-00531-54469-09783-47273-19035-40077-28287-NN"
+//
+// The check digits permit ParseRecoveryKey to detect most typing errors, such
+// as a single incorrect digit or 2 transposed adjacent digits, without having
+// to attempt activation.
+func (k RecoveryKey) StringWithChecksum() string {
+	return k.String() + "-" + recoveryKeyChecksum(k[:])
+}
+
+// Format returns the formatted version of this recovery key with its 40 digits
+// divided in to groups of the specified number of digits, separated by '-'. The
+// final group may be shorter if groupSize doesn't divide 40 exactly. If groupSize
+// is zero or less, the digits are not separated. Format(5) returns the same
+// string as String.
+//
+// This only affects how the key is displayed. It can be parsed with
+// ParseRecoveryKeyWithGroups using the same group size.
+func (k RecoveryKey) Format(groupSize int) string {
+	digits := strings.Replace(k.String(), "-", "", -1)
+	if groupSize <= 0 {
+		return digits
+	}
+
+	var s bytes.Buffer
+	for i := 0; i < len(digits); i += groupSize {
+		if i > 0 {
+			s.WriteByte('-')
+		}
+		end := i + groupSize
+		if end > len(digits) {
+			end = len(digits)
+		}
+		s.WriteString(digits[i:end])
+	}
+	return s.String()
+}
+
+// NewRecoveryKey returns a new RecoveryKey generated by the system's
+// cryptographically secure random number generator. It is safe to call
+// this from multiple goroutines.
+func NewRecoveryKey() (out RecoveryKey, err error) {
+	if _, err := rand.Read(out[:]); err != nil {
+		return RecoveryKey{}, xerrors.Errorf("cannot obtain random bytes: %w", err)
 	}
-	return fmt.Sprintf("%05d-%05d-%05d-%05d-%05d-%05d-%05d-%05d", u16[0], u16[1], u16[2], u16[3], u16[4], u16[5], u16[6], u16[7])
+	return out, nil
 }
 
 // ParseRecoveryKey interprets the supplied string and returns the corresponding RecoveryKey. The recovery key is a
@@ -77,30 +350,245 @@ func (k RecoveryKey) String() string {
 // "61665-00531-54469-09783-47273-19035-40077-28287"
 //
 // The formatted version of the recovery key is designed to be able to be inputted on a numeric keypad.
+//
+// The formatted key may optionally be followed by the 2 check digits produced by RecoveryKey.StringWithChecksum,
+// which may also be separated by an optional '-'. If these are present and don't match the rest of the key, a
+// *RecoveryKeyFormatError error that wraps ErrRecoveryKeyChecksumMismatch will be returned.
+//
+// This only parses 16-byte keys. Use ParseExtendedRecoveryKey for keys that are longer than this, which infers
+// the length of the key from the number of groups.
+//
+// If the supplied string is not correctly formatted, a *RecoveryKeyFormatError error will be returned.
 func ParseRecoveryKey(s string) (out RecoveryKey, err error) {
-	for i := 0; i < 8; i++ {
-		if len(s) < 5 {
-			return RecoveryKey{}, errors.New("incorrectly formatted: insufficient characters")
+	formatted := []byte(s)
+	defer wipeBytes(formatted)
+
+	if err := parseRecoveryKeyInto(out[:], formatted); err != nil {
+		return RecoveryKey{}, err
+	}
+	return out, nil
+}
+
+// parseRecoveryKeyInto interprets the supplied formatted recovery key in the
+// same way as ParseRecoveryKey, and writes the binary form of the key to dst,
+// which must be 16 bytes long.
+func parseRecoveryKeyInto(dst, s []byte) error {
+	n, rest, err := parseRecoveryKeyGroups(dst, s, len(dst)/2)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(rest) == 0:
+		// No checksum
+	case len(rest) == recoveryKeyChecksumDigits && len(bytes.Trim(rest, "0123456789")) == 0:
+		if recoveryKeyChecksumValue(dst[:n]) != int(rest[0]-'0')*10+int(rest[1]-'0') {
+			return &RecoveryKeyFormatError{ErrRecoveryKeyChecksumMismatch}
 		}
-		x, err := strconv.ParseUint(s[0:5], 10, 16)
-		if err != nil {
-			return RecoveryKey{}, xerrors.Errorf("incorrectly formatted: %w", err)
+	default:
+		return &RecoveryKeyFormatError{errors.New("too many characters")}
+	}
+
+	return nil
+}
+
+// ParseRecoveryKeyWithGroups interprets the supplied string, which was formatted by
+// RecoveryKey.Format with the specified group size, and returns the corresponding
+// RecoveryKey. Each group of groupSize digits may be separated by an optional '-',
+// but separators aren't permitted anywhere else. If groupSize is zero or less, the
+// digits must not be separated.
+//
+// If the supplied string is not correctly formatted, a *RecoveryKeyFormatError error
+// will be returned.
+func ParseRecoveryKeyWithGroups(s string, groupSize int) (RecoveryKey, error) {
+	var digits bytes.Buffer
+	for len(s) > 0 {
+		n := groupSize
+		if n <= 0 || n > len(s) {
+			n = len(s)
+		}
+		if strings.Contains(s[:n], "-") {
+			return RecoveryKey{}, &RecoveryKeyFormatError{errors.New("unexpected separator")}
 		}
-		binary.LittleEndian.PutUint16(out[i*2:], uint16(x))
+		digits.WriteString(s[:n])
 
-		// Move to the next 5 digits
-		s = s[5:]
-		// Permit each set of 5 digits to be separated by an optional '-', but don't allow the formatted key to end or begin with one.
+		s = s[n:]
 		if len(s) > 1 && s[0] == '-' {
 			s = s[1:]
 		}
 	}
 
-	if len(s) > 0 {
-		return RecoveryKey{}, errors.New("incorrectly formatted: too many characters")
+	return ParseRecoveryKey(digits.String())
+}
+
+// ReadRecoveryKey reads a formatted recovery key from the supplied reader and returns
+// the corresponding RecoveryKey. This applies the same parsing rules that are used when
+// reading recovery keys during activation, so it can be used by callers that implement
+// their own prompts. A single trailing newline ("\n" or "\r\n") is stripped, and the
+// remaining data is interpreted by ParseRecoveryKey, so the 5-digit groups may optionally
+// be separated by '-'. Any other trailing data after the key results in an error.
+//
+// If the data read from the reader is not correctly formatted, a *RecoveryKeyFormatError
+// error will be returned.
+func ReadRecoveryKey(r io.Reader) (out RecoveryKey, err error) {
+	var buf [maxFormattedRecoveryKeySize]byte
+	defer wipeBytes(buf[:])
+
+	formatted, err := readFormattedRecoveryKey(buf[:], r)
+	if err != nil {
+		return RecoveryKey{}, xerrors.Errorf("cannot read recovery key: %w", err)
+	}
+	if err := parseRecoveryKeyInto(out[:], formatted); err != nil {
+		return RecoveryKey{}, err
+	}
+	return out, nil
+}
+
+// readFormattedRecoveryKey reads a formatted recovery key from the supplied
+// reader in to buf and strips a single trailing newline. The returned slice
+// refers to buf, which should be maxFormattedRecoveryKeySize bytes long.
+func readFormattedRecoveryKey(buf []byte, r io.Reader) ([]byte, error) {
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		// The input is shorter than buf.
+	case err != nil:
+		return nil, err
+	}
+
+	formatted := buf[:n]
+	switch {
+	case bytes.HasSuffix(formatted, []byte("\r\n")):
+		formatted = formatted[:len(formatted)-2]
+	case bytes.HasSuffix(formatted, []byte("\n")):
+		formatted = formatted[:len(formatted)-1]
+	}
+
+	return formatted, nil
+}
+
+// ExtendedRecoveryKey corresponds to a variable length recovery key in its binary
+// form. It must be between 16 and 64 bytes long and have an even length. It can be
+// used for deployments that require recovery keys that are longer than RecoveryKey.
+type ExtendedRecoveryKey []byte
+
+// checkExtendedRecoveryKeySize returns an error if the supplied size is not
+// valid for an ExtendedRecoveryKey.
+func checkExtendedRecoveryKeySize(sz int) error {
+	switch {
+	case sz < minExtendedRecoveryKeySize:
+		return fmt.Errorf("too short (got %d bytes, expected at least %d)", sz, minExtendedRecoveryKeySize)
+	case sz > maxExtendedRecoveryKeySize:
+		return fmt.Errorf("too long (got %d bytes, expected at most %d)", sz, maxExtendedRecoveryKeySize)
+	case sz%2 != 0:
+		return fmt.Errorf("odd length (%d bytes)", sz)
+	}
+	return nil
+}
+
+// NewExtendedRecoveryKey returns a new ExtendedRecoveryKey of the specified size
+// in bytes, generated by the system's cryptographically secure random number
+// generator. The size must be between 16 and 64 and must be even.
+func NewExtendedRecoveryKey(sz int) (ExtendedRecoveryKey, error) {
+	if err := checkExtendedRecoveryKeySize(sz); err != nil {
+		return nil, xerrors.Errorf("invalid size: %w", err)
+	}
+	key := make(ExtendedRecoveryKey, sz)
+	if _, err := rand.Read(key); err != nil {
+		return nil, xerrors.Errorf("cannot obtain random bytes: %w", err)
+	}
+	return key, nil
+}
+
+// String returns the formatted version of this recovery key, which consists of one
+// 5-digit zero-extended base-10 number for every 2 bytes of the key, separated by '-'.
+//
+// This will panic if the key does not have a valid length.
+func (k ExtendedRecoveryKey) String() string {
+	if err := checkExtendedRecoveryKeySize(len(k)); err != nil {
+		panic(fmt.Sprintf("invalid extended recovery key: %v", err))
+	}
+	return formatRecoveryKey(k)
+}
+
+// ParseExtendedRecoveryKey interprets the supplied string and returns the corresponding
+// ExtendedRecoveryKey. The formatted version of the key is represented as a sequence of
+// 5-digit zero-extended base-10 numbers (each with a range of 00000-65535) which may be
+// separated by an optional '-', in the same way as for ParseRecoveryKey. The length of
+// the returned key is inferred from the number of 5-digit groups, with each group
+// corresponding to 2 bytes. Between 8 and 32 groups must be supplied.
+//
+// If the supplied string is not correctly formatted, a *RecoveryKeyFormatError error will
+// be returned.
+func ParseExtendedRecoveryKey(s string) (ExtendedRecoveryKey, error) {
+	formatted := []byte(s)
+	defer wipeBytes(formatted)
+
+	key := make(ExtendedRecoveryKey, maxExtendedRecoveryKeySize)
+	n, err := parseExtendedRecoveryKeyInto(key, formatted)
+	if err != nil {
+		wipeBytes(key)
+		return nil, err
+	}
+	return key[:n], nil
+}
+
+// parseExtendedRecoveryKeyInto interprets the supplied formatted recovery key in
+// the same way as ParseExtendedRecoveryKey, and writes the binary form of the key
+// to dst, which must be at least 64 bytes long. It returns the length of the key.
+func parseExtendedRecoveryKeyInto(dst, s []byte) (int, error) {
+	if len(s) > maxFormattedRecoveryKeySize-2 {
+		return 0, &RecoveryKeyFormatError{errors.New("too many characters")}
+	}
+	n, _, err := parseRecoveryKeyGroups(dst[:maxExtendedRecoveryKeySize], s, 0)
+	if err != nil {
+		return 0, err
+	}
+	if n < minExtendedRecoveryKeySize {
+		return 0, &RecoveryKeyFormatError{errors.New("insufficient characters")}
+	}
+	return n, nil
+}
+
+// ReadExtendedRecoveryKey reads a formatted recovery key from the supplied reader and
+// returns the corresponding ExtendedRecoveryKey. This behaves in the same way as
+// ReadRecoveryKey, except that the data is interpreted by ParseExtendedRecoveryKey.
+//
+// If the data read from the reader is not correctly formatted, a *RecoveryKeyFormatError
+// error will be returned.
+func ReadExtendedRecoveryKey(r io.Reader) (ExtendedRecoveryKey, error) {
+	var buf [maxFormattedRecoveryKeySize]byte
+	defer wipeBytes(buf[:])
+
+	formatted, err := readFormattedRecoveryKey(buf[:], r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read recovery key: %w", err)
+	}
+
+	key := make(ExtendedRecoveryKey, maxExtendedRecoveryKeySize)
+	n, err := parseExtendedRecoveryKeyInto(key, formatted)
+	if err != nil {
+		wipeBytes(key)
+		return nil, err
 	}
+	return key[:n], nil
+}
 
-	return
+// parseAnyRecoveryKeyInto interprets the supplied formatted recovery key as
+// either a RecoveryKey or an ExtendedRecoveryKey, and writes the binary form of
+// the key to dst, which must be at least 64 bytes long. It returns the length of
+// the key. If the key can't be interpreted as either, dst is wiped and the error
+// from ParseRecoveryKey is returned.
+func parseAnyRecoveryKeyInto(dst, s []byte) (int, error) {
+	err := parseRecoveryKeyInto(dst[:len(RecoveryKey{})], s)
+	if err == nil {
+		return len(RecoveryKey{}), nil
+	}
+	if n, extErr := parseExtendedRecoveryKeyInto(dst, s); extErr == nil {
+		return n, nil
+	}
+	wipeBytes(dst)
+	return 0, err
 }
 
 type activateWithKeyDataError struct {
@@ -122,16 +610,28 @@ type keyDataAndError struct {
 }
 
 type activateWithKeyDataState struct {
+	ctx              context.Context
 	volumeName       string
 	sourceDevicePath string
+	activateOptions  *luks2.ActivateOptions
 	model            SnapModel
+	modelRole        string
 	keyringPrefix    string
+	keyringKeyName   string
+	addToKeyring     bool
+	keyringTarget    KeyringTarget
 
 	authRequestor   AuthRequestor
 	kdf             KDF
 	passphraseTries int
 
+	maxConcurrentKeyRecoveries int
+
 	keys []*keyDataAndError
+
+	unlockKey     DiskUnlockKey // the key used for successful activation
+	unlockKeyData *KeyData      // the KeyData used for successful activation
+	munlockKey    func()        // unlocks the memory containing unlockKey, if it was locked
 }
 
 func (s *activateWithKeyDataState) errors() (out []*activateWithKeyDataError) {
@@ -144,9 +644,56 @@ func (s *activateWithKeyDataState) errors() (out []*activateWithKeyDataError) {
 	return out
 }
 
-func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(keyData *KeyData, key DiskUnlockKey, auxKey AuxiliaryKey) error {
+// newActivateVolumeWithKeyDataError returns an error containing the errors
+// associated with each key, the supplied error from running the state
+// machine and the supplied error associated with the recovery key.
+func (s *activateWithKeyDataState) newActivateVolumeWithKeyDataError(runErr, recoveryKeyErr error) error {
+	var kdErrs []error
+	for _, e := range s.errors() {
+		kdErrs = append(kdErrs, e)
+	}
+	if runErr != nil {
+		kdErrs = append(kdErrs, runErr)
+	}
+	return &activateVolumeWithKeyDataError{kdErrs, recoveryKeyErr}
+}
+
+// wipeUnlockKey wipes the key used for successful activation and unlocks the
+// memory containing it if it was locked.
+func (s *activateWithKeyDataState) wipeUnlockKey() {
+	s.unlockKey.Wipe()
+	if s.munlockKey != nil {
+		s.munlockKey()
+	}
+}
+
+// tryActivateWithRecoveredKey attempts to activate the volume with the supplied
+// recovered key. The auxiliary key is wiped before returning. The unlock key is
+// also wiped on failure - on success, it is retained in s.unlockKey and the
+// caller is responsible for wiping it with wipeUnlockKey.
+func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(keyData *KeyData, key DiskUnlockKey, auxKey AuxiliaryKey) (err error) {
+	// The keys are likely to share pages, so these are only unlocked
+	// once both have been wiped.
+	munlock := func() {}
+	if shouldLockKeyMemory(s.activateOptions) {
+		munlockKey := lockKeyMemory(key)
+		munlockAuxKey := lockKeyMemory(auxKey)
+		munlock = func() {
+			munlockKey()
+			munlockAuxKey()
+		}
+	}
+
+	defer func() {
+		auxKey.Wipe()
+		if err != nil {
+			key.Wipe()
+			munlock()
+		}
+	}()
+
 	if s.model != SkipSnapModelCheck {
-		authorized, err := keyData.IsSnapModelAuthorized(auxKey, s.model)
+		authorized, err := keyData.IsSnapModelAuthorizedForRole(auxKey, s.modelRole, s.model)
 		switch {
 		case err != nil:
 			return xerrors.Errorf("cannot check if snap model is authorized: %w", err)
@@ -155,16 +702,22 @@ func (s *activateWithKeyDataState) tryActivateWithRecoveredKey(keyData *KeyData,
 		}
 	}
 
-	if err := luks2Activate(s.volumeName, s.sourceDevicePath, key); err != nil {
+	if err := luks2Activate(s.volumeName, s.sourceDevicePath, key, s.activateOptions); err != nil {
 		return xerrors.Errorf("cannot activate volume: %w", err)
 	}
 
-	if err := keyring.AddKeyToUserKeyring(key, s.sourceDevicePath, keyringPurposeDiskUnlock, s.keyringPrefix); err != nil {
-		fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
+	s.unlockKey = key
+	s.unlockKeyData = keyData
+	s.munlockKey = munlock
+
+	if !s.addToKeyring {
+		return nil
 	}
 
-	if err := keyring.AddKeyToUserKeyring(auxKey, s.sourceDevicePath, keyringPurposeAuxiliary, s.keyringPrefix); err != nil {
-		fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
+	addKeyToKernel(key, s.sourceDevicePath, keyringPurposeDiskUnlock, s.keyringPrefix, s.keyringTarget)
+	addKeyToKernel(auxKey, s.sourceDevicePath, keyringPurposeAuxiliary, s.keyringPrefix, s.keyringTarget)
+	if s.keyringKeyName != "" {
+		addKeyToKernel(key, keyringNamedKeyID(s.keyringKeyName), keyringPurposeDiskUnlock, s.keyringPrefix, s.keyringTarget)
 	}
 
 	return nil
@@ -179,6 +732,115 @@ func (s *activateWithKeyDataState) tryKeyDataAuthModeNone(k *KeyData) error {
 	return s.tryActivateWithRecoveredKey(k, key, auxKey)
 }
 
+// tryKeysAuthModeNone tries each of the supplied keys that don't require
+// any additional authentication in turn, in the order in which they are
+// supplied.
+func (s *activateWithKeyDataState) tryKeysAuthModeNone(keys []*keyDataAndError) (success bool, err error) {
+	for _, k := range keys {
+		if err := s.ctx.Err(); err != nil {
+			return false, err
+		}
+
+		if err := s.tryKeyDataAuthModeNone(k.KeyData); err != nil {
+			k.err = err
+			continue
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+type recoveredKeyDataResult struct {
+	k      *keyDataAndError
+	key    DiskUnlockKey
+	auxKey AuxiliaryKey
+	err    error
+}
+
+// tryKeysAuthModeNoneConcurrently tries the supplied keys that don't require
+// any additional authentication, recovering the keys from up to
+// maxConcurrentKeyRecoveries of them concurrently. Activation is attempted
+// from this goroutine with each recovered key in the order in which recovery
+// completes, so only the key that successfully activates the volume is added
+// to the keyring. Once the volume is activated, recovery isn't started for
+// any remaining keys.
+func (s *activateWithKeyDataState) tryKeysAuthModeNoneConcurrently(keys []*keyDataAndError) (success bool, err error) {
+	done := make(chan struct{})
+	results := make(chan *recoveredKeyDataResult)
+	sem := make(chan struct{}, s.maxConcurrentKeyRecoveries)
+
+	var wg sync.WaitGroup
+	for _, k := range keys {
+		wg.Add(1)
+		go func(k *keyDataAndError) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			defer func() { <-sem }()
+
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if s.ctx.Err() != nil {
+				return
+			}
+
+			key, auxKey, err := k.RecoverKeys()
+			select {
+			case results <- &recoveredKeyDataResult{k: k, key: key, auxKey: auxKey, err: err}:
+			case <-done:
+			}
+		}(k)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	defer func() {
+		// Stop any recoveries that haven't started yet and wait
+		// for the ones in progress to finish.
+		close(done)
+		for r := range results {
+			r.key.Wipe()
+			r.auxKey.Wipe()
+		}
+	}()
+
+	for r := range results {
+		if err := s.ctx.Err(); err != nil {
+			r.key.Wipe()
+			r.auxKey.Wipe()
+			return false, err
+		}
+
+		if r.err != nil {
+			r.k.err = xerrors.Errorf("cannot recover key: %w", r.err)
+			continue
+		}
+
+		if err := s.tryActivateWithRecoveredKey(r.k.KeyData, r.key, r.auxKey); err != nil {
+			r.k.err = err
+			continue
+		}
+
+		return true, nil
+	}
+
+	if err := s.ctx.Err(); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
 func (s *activateWithKeyDataState) tryKeyDataAuthModePassphrase(k *KeyData, passphrase string) error {
 	key, auxKey, err := k.RecoverKeysWithPassphrase(passphrase, s.kdf)
 	if err != nil {
@@ -191,29 +853,38 @@ func (s *activateWithKeyDataState) tryKeyDataAuthModePassphrase(k *KeyData, pass
 func (s *activateWithKeyDataState) run() (success bool, err error) {
 	numPassphraseKeys := 0
 
-	// Try keys that don't require any additional authentication first
+	var noneKeys []*keyDataAndError
 	for _, k := range s.keys {
 		if k.AuthMode()&AuthModePassphrase > 0 {
 			numPassphraseKeys += 1
 		}
-
-		if k.AuthMode() != AuthModeNone {
-			continue
-		}
-
-		if err := s.tryKeyDataAuthModeNone(k.KeyData); err != nil {
-			k.err = err
-			continue
+		if k.AuthMode() == AuthModeNone {
+			noneKeys = append(noneKeys, k)
 		}
+	}
 
+	// Try keys that don't require any additional authentication first
+	tryKeys := s.tryKeysAuthModeNone
+	if s.maxConcurrentKeyRecoveries > 1 && len(noneKeys) > 1 {
+		tryKeys = s.tryKeysAuthModeNoneConcurrently
+	}
+	switch success, err := tryKeys(noneKeys); {
+	case err != nil:
+		return false, err
+	case success:
 		return true, nil
 	}
 
 	// Try keys that require a passphrase
 	tries := s.passphraseTries
 	var passphraseErr error
+	noInput := 0
 
 	for tries > 0 && numPassphraseKeys > 0 {
+		if err := s.ctx.Err(); err != nil {
+			return false, err
+		}
+
 		tries -= 1
 
 		// Request a passphrase first and then try each key with it. One downside of
@@ -224,11 +895,30 @@ func (s *activateWithKeyDataState) run() (success bool, err error) {
 		// a maximum of 2 keys with passphrases enabled (Ubuntu Core based desktop on
 		// a UEFI+TPM platform with run+recovery and recovery-only protectors for
 		// ubuntu-data).
-		passphrase, err := s.authRequestor.RequestPassphrase(s.volumeName, s.sourceDevicePath)
+		passphrase, err := requestPassphrase(s.ctx, s.authRequestor, s.volumeName, s.sourceDevicePath)
 		if err != nil {
+			if ctxErr := s.ctx.Err(); ctxErr != nil {
+				return false, ctxErr
+			}
+			switch {
+			case xerrors.Is(err, ErrAuthRequestNoInput):
+				noInput += 1
+				if noInput >= maxConsecutiveAuthRequestsWithNoInput {
+					return false, xerrors.Errorf("cannot obtain passphrase: %w", newAuthRequestNoInputLimitError())
+				}
+				// Don't consume a try if nothing was entered.
+				tries += 1
+				continue
+			case isAuthRequestFailedError(err):
+				// Don't make any further requests if the requestor
+				// is broken.
+				return false, xerrors.Errorf("cannot obtain passphrase: %w", err)
+			}
+			noInput = 0
 			passphraseErr = xerrors.Errorf("cannot obtain passphrase: %w", err)
 			continue
 		}
+		noInput = 0
 
 		for _, k := range s.keys {
 			if k.AuthMode()&AuthModePassphrase == 0 {
@@ -256,50 +946,275 @@ func (s *activateWithKeyDataState) run() (success bool, err error) {
 	return false, passphraseErr
 }
 
-func newActivateWithKeyDataState(volumeName, sourceDevicePath string, keyringPrefix string, model SnapModel, keys []*KeyData, authRequestor AuthRequestor, kdf KDF, passphraseTries int) *activateWithKeyDataState {
+func newActivateWithKeyDataState(ctx context.Context, volumeName, sourceDevicePath string, activateOptions *luks2.ActivateOptions, keyringPrefix, keyringKeyName string, addToKeyring bool, keyringTarget KeyringTarget, model SnapModel, modelRole string, keys []*KeyData, authRequestor AuthRequestor, kdf KDF, passphraseTries, maxConcurrentKeyRecoveries int) *activateWithKeyDataState {
 	s := &activateWithKeyDataState{
+		ctx:              ctx,
 		volumeName:       volumeName,
 		sourceDevicePath: sourceDevicePath,
+		activateOptions:  activateOptions,
 		keyringPrefix:    keyringPrefixOrDefault(keyringPrefix),
+		keyringKeyName:   keyringKeyName,
+		addToKeyring:     addToKeyring,
+		keyringTarget:    keyringTarget,
 		model:            model,
+		modelRole:        modelRole,
 		authRequestor:    authRequestor,
 		kdf:              kdf,
-		passphraseTries:  passphraseTries}
+		passphraseTries:  passphraseTries,
+
+		maxConcurrentKeyRecoveries: maxConcurrentKeyRecoveries}
 	for _, k := range keys {
 		s.keys = append(s.keys, &keyDataAndError{KeyData: k})
 	}
 	return s
 }
 
-func activateWithRecoveryKey(volumeName, sourceDevicePath string, authRequestor AuthRequestor, tries int, keyringPrefix string) error {
-	if tries == 0 {
-		return errors.New("no recovery key tries permitted")
-	}
+// recoveryKeyBuffer holds a recovery key during activation, both in its
+// formatted form as it is read and in its binary form. Recovery keys are read
+// and parsed directly in to this rather than in to temporary allocations, so
+// that the memory can be locked when LockKeyMemory is set and so that no
+// unwiped copies of the key are left behind.
+type recoveryKeyBuffer struct {
+	formatted [maxFormattedRecoveryKeySize]byte
+	key       [maxExtendedRecoveryKeySize]byte
+}
 
-	var lastErr error
+// lock locks the buffer in to memory, returning a function to unlock it again.
+func (b *recoveryKeyBuffer) lock() (unlock func()) {
+	unlockFormatted := lockKeyMemory(b.formatted[:])
+	unlockKey := lockKeyMemory(b.key[:])
+	return func() {
+		unlockKey()
+		unlockFormatted()
+	}
+}
 
-	for ; tries > 0; tries-- {
-		lastErr = nil
+// wipe clears the contents of the buffer.
+func (b *recoveryKeyBuffer) wipe() {
+	wipeBytes(b.formatted[:])
+	wipeBytes(b.key[:])
+}
 
-		key, err := authRequestor.RequestRecoveryKey(volumeName, sourceDevicePath)
-		if err != nil {
-			lastErr = xerrors.Errorf("cannot obtain recovery key: %w", err)
-			continue
-		}
+// setKey copies the supplied binary key in to the buffer and returns the
+// copy. The supplied key is wiped.
+func (b *recoveryKeyBuffer) setKey(key []byte) []byte {
+	n := copy(b.key[:], key)
+	wipeBytes(key)
+	return b.key[:n]
+}
 
-		if err := luks2Activate(volumeName, sourceDevicePath, key[:]); err != nil {
-			lastErr = xerrors.Errorf("cannot activate volume: %w", err)
-			continue
-		}
+// readRecoveryKeyFile reads a formatted recovery key from the file at the
+// specified path in to the buffer. It returns false if the file doesn't exist
+// or is empty.
+func (b *recoveryKeyBuffer) readRecoveryKeyFile(path string) (key []byte, ok bool, err error) {
+	f, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, false, nil
+	case err != nil:
+		return nil, false, err
+	}
+	defer f.Close()
+	defer wipeBytes(b.formatted[:])
 
-		if err := keyring.AddKeyToUserKeyring(key[:], sourceDevicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(keyringPrefix)); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: Cannot add key to user keyring: %v\n", err)
+	formatted, err := readFormattedRecoveryKey(b.formatted[:], f)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(bytes.TrimSpace(formatted)) == 0 {
+		return nil, false, nil
+	}
+
+	n, err := parseAnyRecoveryKeyInto(b.key[:], formatted)
+	if err != nil {
+		return nil, false, err
+	}
+	return b.key[:n], true, nil
+}
+
+// readAnyRecoveryKey reads a formatted RecoveryKey or ExtendedRecoveryKey from
+// the supplied reader in to the buffer and returns the binary form of the key.
+func (b *recoveryKeyBuffer) readAnyRecoveryKey(r io.Reader) ([]byte, error) {
+	defer wipeBytes(b.formatted[:])
+
+	formatted, err := readFormattedRecoveryKey(b.formatted[:], r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read recovery key: %w", err)
+	}
+
+	n, err := parseAnyRecoveryKeyInto(b.key[:], formatted)
+	if err != nil {
+		return nil, err
+	}
+	return b.key[:n], nil
+}
+
+// RecoveryKeySource describes where the recovery key used to activate a
+// volume was obtained from.
+type RecoveryKeySource int
+
+const (
+	// RecoveryKeySourceReader indicates that the recovery key was read
+	// from one of the RecoveryKeyReaders supplied via ActivateVolumeOptions.
+	RecoveryKeySourceReader RecoveryKeySource = iota + 1
+
+	// RecoveryKeySourceFile indicates that the recovery key was read from
+	// the RecoveryKeyFile supplied via ActivateVolumeOptions.
+	RecoveryKeySourceFile
+
+	// RecoveryKeySourceAuthRequestor indicates that the recovery key was
+	// requested via the supplied AuthRequestor.
+	RecoveryKeySourceAuthRequestor
+)
+
+// RecoveryKeyActivationResult provides information about a successful
+// activation with a recovery key.
+type RecoveryKeyActivationResult struct {
+	// Source is where the recovery key that activated the volume was
+	// obtained from.
+	Source RecoveryKeySource
+
+	// TriesUsed is the number of the tries permitted by RecoveryKeyTries
+	// that were consumed, including the successful one. Keys read from
+	// RecoveryKeyReaders don't consume any tries, so this is zero if
+	// Source is RecoveryKeySourceReader.
+	TriesUsed int
+}
+
+func activateWithRecoveryKey(ctx context.Context, volumeName, sourceDevicePath string, activateOptions *luks2.ActivateOptions, authRequestor AuthRequestor, tries int, recoveryKeyReaders []io.Reader, recoveryKeyFile string, keyringPrefix, keyringKeyName string, addToKeyring bool, keyringTarget KeyringTarget) (*RecoveryKeyActivationResult, error) {
+	// All recovery keys are read in to the same buffer, which is locked
+	// for the duration of this function rather than for each attempt, as
+	// locks on a page aren't reference counted.
+	buf := new(recoveryKeyBuffer)
+	if shouldLockKeyMemory(activateOptions) {
+		defer buf.lock()()
+	}
+	defer buf.wipe()
+
+	activate := func(key []byte) error {
+		defer wipeBytes(key)
+
+		if err := luks2Activate(volumeName, sourceDevicePath, key, activateOptions); err != nil {
+			return &RecoveryKeyIncorrectError{err}
+		}
+
+		if !addToKeyring {
+			return nil
+		}
+
+		addKeyToKernel(key, sourceDevicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(keyringPrefix), keyringTarget)
+		if keyringKeyName != "" {
+			addKeyToKernel(key, keyringNamedKeyID(keyringKeyName), keyringPurposeDiskUnlock, keyringPrefixOrDefault(keyringPrefix), keyringTarget)
+		}
+		return nil
+	}
+
+	// Try each of the pre-supplied candidate keys first. These don't
+	// consume any of the tries and don't require user interaction.
+	for _, r := range recoveryKeyReaders {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		key, err := buf.readAnyRecoveryKey(r)
+		if err != nil {
+			continue
+		}
+		if err := activate(key); err != nil {
+			continue
+		}
+		return &RecoveryKeyActivationResult{Source: RecoveryKeySourceReader}, nil
+	}
+
+	if tries == 0 {
+		if len(recoveryKeyReaders) > 0 {
+			return nil, errors.New("none of the candidate recovery keys could activate the volume and no recovery key tries permitted")
+		}
+		return nil, errors.New("no recovery key tries permitted")
+	}
+
+	var lastErr error
+	var result *RecoveryKeyActivationResult
+	triedRecoveryKeyFile := recoveryKeyFile == ""
+	origTries := tries
+	noInput := 0
+
+	for ; tries > 0; tries-- {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		lastErr = nil
+
+		// The recovery key file is read when it is first needed rather than
+		// up front so that a file that appears after activation has started
+		// is still used. A missing or empty file doesn't consume a try.
+		var key []byte
+		var keyFromFile bool
+		if !triedRecoveryKeyFile {
+			triedRecoveryKeyFile = true
+
+			var err error
+			key, keyFromFile, err = buf.readRecoveryKeyFile(recoveryKeyFile)
+			if err != nil {
+				lastErr = xerrors.Errorf("cannot read recovery key from file: %w", err)
+				continue
+			}
+		}
+
+		var err error
+		if !keyFromFile {
+			if authRequestor == nil {
+				// This is only permitted if there are candidate keys
+				// or a recovery key file, which have failed.
+				return nil, errors.New("cannot request recovery key: nil authRequestor")
+			}
+			var k RecoveryKey
+			k, err = requestRecoveryKey(ctx, authRequestor, volumeName, sourceDevicePath)
+			key = buf.setKey(k[:])
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			switch {
+			case xerrors.Is(err, ErrAuthRequestNoInput):
+				noInput += 1
+				if noInput >= maxConsecutiveAuthRequestsWithNoInput {
+					return nil, xerrors.Errorf("cannot obtain recovery key: %w", newAuthRequestNoInputLimitError())
+				}
+				// Don't consume a try if nothing was entered.
+				tries += 1
+				continue
+			case isAuthRequestFailedError(err):
+				// Don't make any further requests if the requestor
+				// is broken.
+				return nil, xerrors.Errorf("cannot obtain recovery key: %w", err)
+			}
+			noInput = 0
+			lastErr = xerrors.Errorf("cannot obtain recovery key: %w", err)
+			continue
+		}
+		noInput = 0
+
+		if err := activate(key); err != nil {
+			lastErr = err
+			continue
 		}
 
+		result = &RecoveryKeyActivationResult{
+			Source:    RecoveryKeySourceAuthRequestor,
+			TriesUsed: origTries - tries + 1}
+		if keyFromFile {
+			result.Source = RecoveryKeySourceFile
+		}
 		break
 	}
 
-	return lastErr
+	if lastErr != nil {
+		return nil, &recoveryKeyTriesExhaustedError{lastErr}
+	}
+	return result, nil
 }
 
 type nullSnapModel struct{}
@@ -352,10 +1267,76 @@ type ActivateVolumeOptions struct {
 	// the fallback recovery key.
 	RecoveryKeyTries int
 
+	// RecoveryKeyFile is an optional path to a file containing a
+	// formatted recovery key, which may be a RecoveryKey or an
+	// ExtendedRecoveryKey. If set, the file is read when the
+	// fallback recovery key is first required, and if it exists and
+	// is not empty, the key it contains is tried before requesting a
+	// recovery key via the AuthRequestor. A missing or empty file
+	// does not consume any of the tries specified by RecoveryKeyTries.
+	RecoveryKeyFile string
+
+	// RecoveryKeyReaders is an optional set of readers, each of which
+	// supplies a formatted candidate recovery key, which may be a
+	// RecoveryKey or an ExtendedRecoveryKey. If set, each
+	// candidate is tried in turn when the fallback recovery key is first
+	// required, before the key from RecoveryKeyFile and before requesting
+	// a recovery key via the AuthRequestor. This permits a pool of
+	// pre-known recovery keys to be supplied for headless recovery.
+	// Candidates that are incorrectly formatted or which don't unlock
+	// the volume are skipped, and do not consume any of the tries
+	// specified by RecoveryKeyTries. Each reader is read at most once.
+	//
+	// The candidates are still tried if RecoveryKeyTries is zero or
+	// NoInteractive is set, as they don't require user interaction. If
+	// any candidates or a RecoveryKeyFile are supplied, an AuthRequestor
+	// is only required if the volume can't be activated without one.
+	RecoveryKeyReaders []io.Reader
+
 	// KeyringPrefix is the prefix used for the description of any
 	// kernel keys created during activation.
 	KeyringPrefix string
 
+	// KeyringKeyName is an optional name under which the key used to
+	// unlock the volume, which may be the recovery key, is also added
+	// to the kernel keyring after successful activation. This is in
+	// addition to the entry associated with the source device path,
+	// and allows the key to be retrieved with
+	// GetDiskUnlockKeyFromKernelByName by callers that know the role
+	// of the volume but not its path.
+	KeyringKeyName string
+
+	// KeyringInsertionPolicy specifies how keys are added to the
+	// user keyring after successful activation. The default is
+	// KeyringInsertionBestEffort. See the documentation for
+	// KeyringInsertionPolicy for details of which keyring failures
+	// are tolerated.
+	KeyringInsertionPolicy KeyringInsertionPolicy
+
+	// KeyringTarget specifies which kernel keyring keys are added to
+	// after successful activation. The default is KeyringTargetUser.
+	// The KeyringInsertionPolicy applies to the selected keyring.
+	KeyringTarget KeyringTarget
+
+	// UnlockKeyWriter is an optional writer to which the disk unlock
+	// key recovered from a KeyData is written after successful
+	// activation, for use by an external consumer. The key is written
+	// in its binary form and the buffer containing it is cleared
+	// afterwards.
+	//
+	// WARNING: This exports the disk unlock key outside of this
+	// package. The caller is responsible for ensuring that the
+	// supplied writer (eg, the write end of a pipe) is only accessible
+	// to the intended consumer.
+	//
+	// If writing the key fails, an error will be returned but the
+	// volume will remain activated.
+	//
+	// The key is not written if the volume is activated with the
+	// fallback recovery key. It is ignored by
+	// ActivateVolumeWithRecoveryKey.
+	UnlockKeyWriter io.Writer
+
 	// Model is the snap device model that will access the data
 	// on the encrypted container. The ActivateVolumeWith* functions
 	// will check that this model is authorized via the KeyData
@@ -370,6 +1351,166 @@ type ActivateVolumeOptions struct {
 	// It is ignored by ActivateVolumeWithRecoveryKey, and it is
 	// ok to leave it set as nil in this case.
 	Model SnapModel
+
+	// SnapModelRole is the role for which Model must be authorized
+	// via the KeyData binding. The default is DefaultSnapModelRole.
+	//
+	// It is ignored by ActivateVolumeWithRecoveryKey, and it is
+	// ignored if Model is set to SkipSnapModelCheck.
+	SnapModelRole string
+
+	// HeaderPath is the path of a detached LUKS2 header for the
+	// container, which is passed to systemd-cryptsetup. If this is
+	// empty, the header is read from the source device. If it is set,
+	// the path must exist.
+	//
+	// Functions that manage keyslots, such as AddLUKS2ContainerUnlockKey
+	// and AddLUKS2ContainerRecoveryKey, operate directly on the header,
+	// so the path of a detached header should be supplied to these
+	// in place of the path of the source device.
+	HeaderPath string
+
+	// SystemdCryptsetupOptions are additional options to pass to
+	// systemd-cryptsetup, in the format used by crypttab(5), eg,
+	// "discard". Options that conflict with the way that this package
+	// drives systemd-cryptsetup, such as "tries=", "header=",
+	// "key-file=" and "keyfile-offset=", are rejected with an error.
+	SystemdCryptsetupOptions []string
+
+	// SystemdCryptsetupPath is the path of the systemd-cryptsetup
+	// binary used for activation. If this is empty, the default
+	// location (/lib/systemd/systemd-cryptsetup) is used. This is
+	// useful for callers that bundle their own systemd-cryptsetup,
+	// such as tools running from an initramfs or chroot.
+	SystemdCryptsetupPath string
+
+	// CryptsetupPath is the path of the cryptsetup binary used to
+	// test the key when activation fails, in order to determine
+	// whether the failure was caused by the kernel not supporting
+	// dm-integrity. If this is empty, cryptsetup is found via PATH.
+	CryptsetupPath string
+
+	// PromptMessage is a template used to compose the message that is
+	// displayed when requesting a recovery key, in place of the
+	// recovery key template supplied to NewSystemdAuthRequestor. It is
+	// executed with the same parameters as that template. Prompts for
+	// a passphrase are not affected. If this is empty, the AuthRequestor's
+	// default message is used.
+	//
+	// This and PromptIcon are only used if the supplied AuthRequestor
+	// implements PromptAuthRequestor, and are ignored otherwise.
+	PromptMessage string
+
+	// PromptIcon is the name of the icon that is displayed when
+	// requesting a passphrase or recovery key, eg, the icon passed to
+	// systemd-ask-password. If this is empty, the AuthRequestor's
+	// default icon is used.
+	PromptIcon string
+
+	// NoInteractive disables all user interaction. If this is set,
+	// the supplied AuthRequestor is never used to request a passphrase
+	// or recovery key, and PassphraseTries and RecoveryKeyTries are
+	// ignored. Keys that require a passphrase are skipped. If activation
+	// with the platform protected keys fails, any RecoveryKeyReaders are
+	// tried, and if none of these succeed, an error that can be tested
+	// with xerrors.Is(err, ErrManualRecoveryRequired) is returned.
+	//
+	// It is ignored by ActivateVolumeWithRecoveryKey.
+	NoInteractive bool
+
+	// MaxConcurrentKeyRecoveries specifies the maximum number of
+	// protected keys that don't require a passphrase from which
+	// recovery of the disk unlock key is attempted concurrently. This
+	// can reduce the time taken to activate a volume with many keys
+	// protected by a slow platform device.
+	//
+	// If this is 0 or 1, keys are tried one at a time in the order in
+	// which they are supplied. If it is greater than 1, activation
+	// is performed with the first recovered key that succeeds, which
+	// may not be the first key supplied. Recovery is not started for
+	// any remaining keys once activation succeeds. Keys that require
+	// a passphrase and the fallback recovery key are always tried
+	// sequentially afterwards.
+	//
+	// It is ignored by ActivateVolumeWithRecoveryKey.
+	MaxConcurrentKeyRecoveries int
+
+	// LockKeyMemory requests that the memory holding key material
+	// during activation is locked with mlock(2) so that it is not
+	// written to swap. This covers the disk unlock and auxiliary keys
+	// recovered from a KeyData and the recovery key, which are also
+	// wiped and unlocked again afterwards. Recovery keys from
+	// RecoveryKeyReaders and RecoveryKeyFile are read and parsed
+	// directly in to a single locked buffer. Keys are passed to
+	// systemd-cryptsetup directly via a pipe rather than being
+	// copied through an intermediate buffer.
+	//
+	// This is best effort - key material produced by a platform
+	// before it is returned to this package is not covered, and
+	// neither are any copies of a recovery key that are made by an
+	// AuthRequestor before it is returned, or by readers supplied via
+	// RecoveryKeyReaders. If the memory cannot be locked (eg, because
+	// RLIMIT_MEMLOCK is too low), a warning is printed and activation
+	// continues.
+	LockKeyMemory bool
+}
+
+// requiresRecoveryKeyAuthRequestor indicates whether an AuthRequestor is
+// always required in order to obtain a recovery key. If candidate recovery
+// keys or a recovery key file are supplied, an AuthRequestor is only needed
+// if these fail.
+func (o *ActivateVolumeOptions) requiresRecoveryKeyAuthRequestor() bool {
+	return o.RecoveryKeyTries > 0 && len(o.RecoveryKeyReaders) == 0 && o.RecoveryKeyFile == ""
+}
+
+// promptAuthRequestor returns an AuthRequestor that uses the prompt
+// customizations from these options, if any are set and the supplied
+// AuthRequestor supports them. Otherwise, the supplied AuthRequestor is
+// returned.
+func (o *ActivateVolumeOptions) promptAuthRequestor(authRequestor AuthRequestor) (AuthRequestor, error) {
+	if o.PromptMessage == "" && o.PromptIcon == "" {
+		return authRequestor, nil
+	}
+	if _, err := template.New("promptMessage").Parse(o.PromptMessage); err != nil {
+		return nil, xerrors.Errorf("cannot parse prompt message template: %w", err)
+	}
+
+	r, ok := authRequestor.(PromptAuthRequestor)
+	if !ok {
+		return authRequestor, nil
+	}
+	return &promptAuthRequestor{
+		PromptAuthRequestor: r,
+		passphrasePrompt:    &AuthRequestPrompt{Icon: o.PromptIcon},
+		recoveryKeyPrompt:   &AuthRequestPrompt{Message: o.PromptMessage, Icon: o.PromptIcon}}, nil
+}
+
+func (o *ActivateVolumeOptions) luks2ActivateOptions() (*luks2.ActivateOptions, error) {
+	if o == nil || (o.HeaderPath == "" && len(o.SystemdCryptsetupOptions) == 0 && o.SystemdCryptsetupPath == "" && o.CryptsetupPath == "" && !o.LockKeyMemory) {
+		return nil, nil
+	}
+
+	opts := &luks2.ActivateOptions{
+		HeaderPath:            o.HeaderPath,
+		Options:               o.SystemdCryptsetupOptions,
+		SystemdCryptsetupPath: o.SystemdCryptsetupPath,
+		CryptsetupPath:        o.CryptsetupPath,
+		LockKeyMemory:         o.LockKeyMemory}
+	if err := opts.Validate(); err != nil {
+		return nil, xerrors.Errorf("invalid activation options: %w", err)
+	}
+
+	if o.HeaderPath != "" {
+		if _, err := os.Stat(o.HeaderPath); err != nil {
+			return nil, xerrors.Errorf("cannot access detached header: %w", err)
+		}
+	}
+	if o.SystemdCryptsetupPath != "" {
+		if _, err := os.Stat(o.SystemdCryptsetupPath); err != nil {
+			return nil, xerrors.Errorf("cannot access systemd-cryptsetup: %w", err)
+		}
+	}
+	return opts, nil
 }
 
 type activateVolumeWithKeyDataError struct {
@@ -387,6 +1528,34 @@ func (e *activateVolumeWithKeyDataError) Error() string {
 	return s.String()
 }
 
+// Is permits xerrors.Is to match any of the errors associated with each
+// key and the error associated with the recovery key.
+func (e *activateVolumeWithKeyDataError) Is(target error) bool {
+	for _, err := range e.keyDataErrs {
+		if xerrors.Is(err, target) {
+			return true
+		}
+	}
+	return xerrors.Is(e.recoveryKeyUsageErr, target)
+}
+
+// As permits xerrors.As to match any of the errors associated with each
+// key and the error associated with the recovery key.
+func (e *activateVolumeWithKeyDataError) As(target interface{}) bool {
+	for _, err := range e.keyDataErrs {
+		if xerrors.As(err, target) {
+			return true
+		}
+	}
+	return xerrors.As(e.recoveryKeyUsageErr, target)
+}
+
+// ErrManualRecoveryRequired is returned from the ActivateVolumeWith* functions
+// if the platform protected keys cannot be used for activation and the
+// NoInteractive option is set, so that no attempt is made to request a
+// passphrase or recovery key.
+var ErrManualRecoveryRequired = errors.New("manual recovery is required but user interaction is disabled")
+
 // ErrRecoveryKeyUsed is returned from ActivateVolumeWithKeyData and
 // ActivateVolumeWithMultipleKeyData if the volume could not be activated with
 // any platform protected keys but activation with the recovery key was
@@ -419,45 +1588,117 @@ var ErrRecoveryKeyUsed = errors.New("cannot activate with platform protected key
 // is returned), then the supplied SnapModel is authorized to access the data on
 // this volume.
 func ActivateVolumeWithMultipleKeyData(volumeName, sourceDevicePath string, keys []*KeyData, authRequestor AuthRequestor, kdf KDF, options *ActivateVolumeOptions) error {
+	_, err := activateVolumeWithMultipleKeyData(context.Background(), volumeName, sourceDevicePath, keys, authRequestor, kdf, options)
+	return err
+}
+
+// ActivateVolumeWithMultipleKeyDataResult is the same as
+// ActivateVolumeWithMultipleKeyData, but also returns the KeyData that was used
+// to successfully activate the volume. This is useful for callers that need to
+// log or audit which key was used.
+//
+// If the fallback recovery key is used for activation, no KeyData is returned
+// along with the ErrRecoveryKeyUsed error. No KeyData is returned if activation
+// fails.
+func ActivateVolumeWithMultipleKeyDataResult(volumeName, sourceDevicePath string, keys []*KeyData, authRequestor AuthRequestor, kdf KDF, options *ActivateVolumeOptions) (*KeyData, error) {
+	return activateVolumeWithMultipleKeyData(context.Background(), volumeName, sourceDevicePath, keys, authRequestor, kdf, options)
+}
+
+// ActivateVolumeWithMultipleKeyDataContext is the same as
+// ActivateVolumeWithMultipleKeyData, but stops trying to activate the volume
+// and returns ctx.Err() if the supplied context is cancelled or its deadline
+// expires before activation succeeds.
+//
+// The context is checked before each attempt to recover a key from the
+// platform's secure device, but an attempt that is already in progress is not
+// interrupted. If the supplied AuthRequestor implements ContextAuthRequestor,
+// then outstanding requests for a passphrase or recovery key are abandoned
+// when the context is done - the AuthRequestor returned from
+// NewSystemdAuthRequestor terminates the systemd-ask-password process in this
+// case. Other implementations will only be interrupted after they return.
+func ActivateVolumeWithMultipleKeyDataContext(ctx context.Context, volumeName, sourceDevicePath string, keys []*KeyData, authRequestor AuthRequestor, kdf KDF, options *ActivateVolumeOptions) error {
+	_, err := activateVolumeWithMultipleKeyData(ctx, volumeName, sourceDevicePath, keys, authRequestor, kdf, options)
+	return err
+}
+
+func activateVolumeWithMultipleKeyData(ctx context.Context, volumeName, sourceDevicePath string, keys []*KeyData, authRequestor AuthRequestor, kdf KDF, options *ActivateVolumeOptions) (*KeyData, error) {
 	if len(keys) == 0 {
-		return errors.New("no keys provided")
+		return nil, errors.New("no keys provided")
 	}
 	if options.PassphraseTries < 0 {
-		return errors.New("invalid PassphraseTries")
+		return nil, errors.New("invalid PassphraseTries")
 	}
 	if options.RecoveryKeyTries < 0 {
-		return errors.New("invalid RecoveryKeyTries")
+		return nil, errors.New("invalid RecoveryKeyTries")
 	}
 	if options.Model == nil {
-		return errors.New("nil Model")
+		return nil, errors.New("nil Model")
+	}
+
+	passphraseTries := options.PassphraseTries
+	if options.NoInteractive {
+		passphraseTries = 0
+	} else {
+		if (options.PassphraseTries > 0 || options.requiresRecoveryKeyAuthRequestor()) && authRequestor == nil {
+			return nil, errors.New("nil authRequestor")
+		}
+		if options.PassphraseTries > 0 && kdf == nil {
+			return nil, errors.New("nil kdf")
+		}
+	}
+
+	activateOptions, err := options.luks2ActivateOptions()
+	if err != nil {
+		return nil, err
 	}
 
-	if (options.PassphraseTries > 0 || options.RecoveryKeyTries > 0) && authRequestor == nil {
-		return errors.New("nil authRequestor")
+	authRequestor, err = options.promptAuthRequestor(authRequestor)
+	if err != nil {
+		return nil, err
 	}
-	if options.PassphraseTries > 0 && kdf == nil {
-		return errors.New("nil kdf")
+
+	addToKeyring, err := shouldInsertKeysIntoKeyring(options.KeyringInsertionPolicy, options.KeyringTarget)
+	if err != nil {
+		return nil, err
 	}
 
-	s := newActivateWithKeyDataState(volumeName, sourceDevicePath, options.KeyringPrefix, options.Model, keys, authRequestor, kdf, options.PassphraseTries)
+	s := newActivateWithKeyDataState(ctx, volumeName, sourceDevicePath, activateOptions, options.KeyringPrefix, options.KeyringKeyName, addToKeyring, options.KeyringTarget, options.Model, options.SnapModelRole, keys, authRequestor, kdf, passphraseTries, options.MaxConcurrentKeyRecoveries)
 	success, err := s.run()
 	switch {
 	case success:
-		return nil
-	default: // failed - try recovery key
-		if rErr := activateWithRecoveryKey(volumeName, sourceDevicePath, authRequestor, options.RecoveryKeyTries, options.KeyringPrefix); rErr != nil {
-			// failed with recovery key - return errors
-			var kdErrs []error
-			for _, e := range s.errors() {
-				kdErrs = append(kdErrs, e)
+		defer s.wipeUnlockKey()
+		if options.UnlockKeyWriter == nil {
+			return s.unlockKeyData, nil
+		}
+		_, err := options.UnlockKeyWriter.Write(s.unlockKey)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot write unlock key: %w", err)
+		}
+		return s.unlockKeyData, nil
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case options.NoInteractive:
+		// failed and we're not permitted to request a recovery key - try
+		// any candidate recovery keys, which don't require user interaction.
+		if len(options.RecoveryKeyReaders) > 0 {
+			if _, rErr := activateWithRecoveryKey(ctx, volumeName, sourceDevicePath, activateOptions, nil, 0, options.RecoveryKeyReaders, "", options.KeyringPrefix, options.KeyringKeyName, addToKeyring, options.KeyringTarget); rErr == nil {
+				return nil, ErrRecoveryKeyUsed
 			}
-			if err != nil {
-				kdErrs = append(kdErrs, err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+		}
+		return nil, s.newActivateVolumeWithKeyDataError(err, ErrManualRecoveryRequired)
+	default: // failed - try recovery key
+		if _, rErr := activateWithRecoveryKey(ctx, volumeName, sourceDevicePath, activateOptions, authRequestor, options.RecoveryKeyTries, options.RecoveryKeyReaders, options.RecoveryKeyFile, options.KeyringPrefix, options.KeyringKeyName, addToKeyring, options.KeyringTarget); rErr != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
 			}
-			return &activateVolumeWithKeyDataError{kdErrs, rErr}
+			// failed with recovery key - return errors
+			return nil, s.newActivateVolumeWithKeyDataError(err, rErr)
 		}
 		// succeeded with recovery key
-		return ErrRecoveryKeyUsed
+		return nil, ErrRecoveryKeyUsed
 	}
 }
 
@@ -486,7 +1727,15 @@ func ActivateVolumeWithMultipleKeyData(volumeName, sourceDevicePath string, keys
 // If activation with the supplied KeyData object succeeds (ie, no error is returned),
 // then the supplied SnapModel is authorized to access the data on this volume.
 func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, key *KeyData, authRequestor AuthRequestor, kdf KDF, options *ActivateVolumeOptions) error {
-	return ActivateVolumeWithMultipleKeyData(volumeName, sourceDevicePath, []*KeyData{key}, authRequestor, kdf, options)
+	return ActivateVolumeWithKeyDataContext(context.Background(), volumeName, sourceDevicePath, key, authRequestor, kdf, options)
+}
+
+// ActivateVolumeWithKeyDataContext is the same as ActivateVolumeWithKeyData,
+// but stops trying to activate the volume and returns ctx.Err() if the supplied
+// context is cancelled or its deadline expires before activation succeeds. See
+// ActivateVolumeWithMultipleKeyDataContext for details.
+func ActivateVolumeWithKeyDataContext(ctx context.Context, volumeName, sourceDevicePath string, key *KeyData, authRequestor AuthRequestor, kdf KDF, options *ActivateVolumeOptions) error {
+	return ActivateVolumeWithMultipleKeyDataContext(ctx, volumeName, sourceDevicePath, []*KeyData{key}, authRequestor, kdf, options)
 }
 
 // ActivateVolumeWithRecoveryKey attempts to activate the LUKS encrypted volume at
@@ -494,120 +1743,701 @@ func ActivateVolumeWithKeyData(volumeName, sourceDevicePath string, key *KeyData
 // recovery key. This makes use of systemd-cryptsetup.
 //
 // The recovery key is requested via the supplied AuthRequestor. If an AuthRequestor
-// is not supplied, an error will be returned. The RecoveryKeyTries field of options
+// is not supplied, an error will be returned unless the RecoveryKeyReaders or
+// RecoveryKeyFile fields of options are set, in which case an error is only returned
+// if these can't be used to activate the volume. The RecoveryKeyTries field of options
 // specifies how many attempts to request and use the recovery key will be made before
 // failing.
 //
 // If the RecoveryKeyTries field of options is less than zero, an error will be
 // returned.
+//
+// If the last recovery key obtained from the AuthRequestor could not be used to
+// activate the volume, a *RecoveryKeyIncorrectError error will be returned. If it
+// could not be obtained because it was incorrectly formatted, the returned error
+// will wrap a *RecoveryKeyFormatError error.
 func ActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath string, authRequestor AuthRequestor, options *ActivateVolumeOptions) error {
-	if authRequestor == nil {
-		return errors.New("nil authRequestor")
+	_, err := ActivateVolumeWithRecoveryKeyResult(volumeName, sourceDevicePath, authRequestor, options)
+	return err
+}
+
+// ActivateVolumeWithRecoveryKeyResult behaves in the same way as
+// ActivateVolumeWithRecoveryKey, but on success also returns information about
+// how the volume was activated, such as where the recovery key was obtained from
+// and how many of the tries permitted by the RecoveryKeyTries field of options
+// were consumed.
+func ActivateVolumeWithRecoveryKeyResult(volumeName, sourceDevicePath string, authRequestor AuthRequestor, options *ActivateVolumeOptions) (*RecoveryKeyActivationResult, error) {
+	if authRequestor == nil && options.requiresRecoveryKeyAuthRequestor() {
+		return nil, errors.New("nil authRequestor")
 	}
 	if options.RecoveryKeyTries < 0 {
-		return errors.New("invalid RecoveryKeyTries")
+		return nil, errors.New("invalid RecoveryKeyTries")
+	}
+
+	activateOptions, err := options.luks2ActivateOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	authRequestor, err = options.promptAuthRequestor(authRequestor)
+	if err != nil {
+		return nil, err
+	}
+
+	addToKeyring, err := shouldInsertKeysIntoKeyring(options.KeyringInsertionPolicy, options.KeyringTarget)
+	if err != nil {
+		return nil, err
 	}
 
-	return activateWithRecoveryKey(volumeName, sourceDevicePath, authRequestor, options.RecoveryKeyTries, options.KeyringPrefix)
+	return activateWithRecoveryKey(context.Background(), volumeName, sourceDevicePath, activateOptions, authRequestor, options.RecoveryKeyTries, options.RecoveryKeyReaders, options.RecoveryKeyFile, options.KeyringPrefix, options.KeyringKeyName, addToKeyring, options.KeyringTarget)
 }
 
 // ActivateVolumeWithKey attempts to activate the LUKS encrypted volume at
 // sourceDevicePath and create a mapping with the name volumeName, using the
 // provided key. This makes use of systemd-cryptsetup.
+//
+// Note that volumes that are in the process of being reencrypted can be
+// activated by this and the other ActivateVolumeWith* functions, as
+// systemd-cryptsetup handles this case. Functions that modify keyslots
+// will return a LUKS2ReencryptionInProgressError for these volumes.
+//
+// If the supplied key is empty or longer than the maximum key size accepted by
+// cryptsetup (8MiB), an *InvalidKeyLengthError error will be returned without
+// attempting to activate the volume.
 func ActivateVolumeWithKey(volumeName, sourceDevicePath string, key []byte, options *ActivateVolumeOptions) error {
-	return luks2Activate(volumeName, sourceDevicePath, key)
+	if len(key) == 0 || len(key) > maxLUKS2KeySize {
+		return &InvalidKeyLengthError{Length: len(key)}
+	}
+
+	activateOptions, err := options.luks2ActivateOptions()
+	if err != nil {
+		return err
+	}
+
+	return luks2Activate(volumeName, sourceDevicePath, key, activateOptions)
 }
 
-// DeactivateVolume attempts to deactivate the LUKS encrypted volumeName.
-// This makes use of systemd-cryptsetup.
-func DeactivateVolume(volumeName string) error {
-	return luks2Deactivate(volumeName)
+// ActivateVolumeWithKeyFile attempts to activate the LUKS encrypted volume at
+// sourceDevicePath and create a mapping with the name volumeName, using the
+// key contained in the file at keyFilePath. The key is keyFileSize bytes long
+// and starts at keyFileOffset bytes from the start of the file. This is an
+// alternative to ActivateVolumeWithKey that avoids the caller having to load
+// the key in to memory, as the key file path, offset and size are passed
+// directly to systemd-cryptsetup.
+//
+// If keyFileSize is not positive or is longer than the maximum key size
+// accepted by cryptsetup (8MiB), an *InvalidKeyLengthError error will be
+// returned without attempting to activate the volume. An error will also be
+// returned without attempting to activate the volume if keyFileOffset is
+// negative or if the specified range extends beyond the end of the file.
+func ActivateVolumeWithKeyFile(volumeName, sourceDevicePath, keyFilePath string, keyFileOffset, keyFileSize int64, options *ActivateVolumeOptions) error {
+	if keyFileSize <= 0 || keyFileSize > maxLUKS2KeySize {
+		return &InvalidKeyLengthError{Length: int(keyFileSize)}
+	}
+
+	activateOptions, err := options.luks2ActivateOptions()
+	if err != nil {
+		return err
+	}
+
+	return luks2ActivateWithKeyFile(volumeName, sourceDevicePath, keyFilePath, keyFileOffset, keyFileSize, activateOptions)
 }
 
-// InitializeLUKS2ContainerOptions carries options for initializing LUKS2
-// containers.
-type InitializeLUKS2ContainerOptions struct {
-	// MetadataKiBSize sets the size of the metadata area in KiB. This
-	//
-	// MetadataKiBSize sets the size of the metadata area in KiB. 4KiB of
-	// this is used for the fixed-size binary header, with the remaining
-	// space being used for the JSON area. Setting this to zero causes
-	// the container to be initialized with the default metadata area size.
-	// If set to a non zero value, it must be a power of 2 between 16KiB
-	// and 4MiB.
-	MetadataKiBSize int
+// maxLUKS2KeySize is the maximum size of a key that can be used to unlock a
+// keyslot, which is the default maximum key file size used by cryptsetup.
+const maxLUKS2KeySize = 8192 * 1024
 
-	// KeyslotsAreaKiBSize sets the size of the binary keyslot area in KiB.
-	// Setting this to zero causes the container to be initialized with
-	// the default keyslots area size. If set to a non-zero value, the
-	// value must be a multiple of 4KiB up to a maximum of 128MiB.
-	KeyslotsAreaKiBSize int
+// InvalidKeyLengthError is returned from ActivateVolumeWithKey and
+// ActivateVolumeWithKeyFile if the supplied key has a length that cannot be
+// valid for any keyslot.
+type InvalidKeyLengthError struct {
+	Length int // The length of the supplied key in bytes
+}
 
-	// KDFOptions sets the KDF options for the initial keyslot. If this
-	// is nil then the default settings defined by this package are used
-	// (4 iterations and a memory cost of 32KiB).
-	KDFOptions *KDFOptions
+func (e *InvalidKeyLengthError) Error() string {
+	return fmt.Sprintf("invalid key length (%d bytes)", e.Length)
+}
 
-	// InitialKeyslotName sets the name that will be used to identify
-	// the initial keyslot. If this is empty, then the name will be
-	// set to "default".
-	InitialKeyslotName string
+// SystemdCryptsetupError is returned (wrapped) from the ActivateVolumeWith*
+// functions, DeactivateVolume and DeactivateVolumeAndRemoveKeys if
+// systemd-cryptsetup fails. Its Args field contains the argument vector
+// that systemd-cryptsetup was invoked with, which can be logged safely for
+// debugging because keys are never passed on the command line.
+type SystemdCryptsetupError = luks2.SystemdCryptsetupError
+
+// ErrVolumeNotActive is returned from DeactivateVolume and
+// DeactivateVolumeAndRemoveKeys if the specified volume is not active.
+var ErrVolumeNotActive = luks2.ErrVolumeNotActive
+
+// VolumeActivationConflictError is returned from EnsureVolumeActivated if a
+// volume with the requested name is already active, but with a different
+// source device.
+type VolumeActivationConflictError struct {
+	VolumeName             string
+	SourceDevicePath       string // The requested source device
+	ActiveSourceDevicePath string // The source device of the active volume
 }
 
-func (o *InitializeLUKS2ContainerOptions) formatOpts() *luks2.FormatOptions {
-	return &luks2.FormatOptions{
-		MetadataKiBSize:     o.MetadataKiBSize,
-		KeyslotsAreaKiBSize: o.KeyslotsAreaKiBSize,
-		KDFOptions:          o.KDFOptions.luksOpts()}
+func (e *VolumeActivationConflictError) Error() string {
+	return fmt.Sprintf("volume %s is already active with source device %s rather than %s", e.VolumeName, e.ActiveSourceDevicePath, e.SourceDevicePath)
 }
 
-// InitializeLUKS2Container will initialize the partition at the specified devicePath
-// as a new LUKS2 container. This can only be called on a partition that isn't mapped.
-// The label for the new LUKS2 container is provided via the label argument.
+// isSameDevice determines whether the supplied paths refer to the same
+// device, following any symbolic links.
+func isSameDevice(a, b string) bool {
+	if resolved, err := filepath.EvalSymlinks(a); err == nil {
+		a = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(b); err == nil {
+		b = resolved
+	}
+	return a == b
+}
+
+// EnsureVolumeActivated ensures that the LUKS encrypted volume at
+// sourceDevicePath is activated with the name volumeName. If a volume with
+// this name is already active with the same source device, this returns
+// successfully without calling the supplied activate function, so that the
+// volume isn't activated again and the user isn't prompted for a passphrase
+// or recovery key. Otherwise, the supplied activate function is called to
+// activate the volume, eg:
 //
-// The container will be configured to encrypt data with AES-256 and XTS block cipher
-// mode.
+//	err := EnsureVolumeActivated("data", "/dev/sda1", func() error {
+//		return ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, authRequestor, kdf, options)
+//	})
 //
-// The initial key used for unlocking the container is provided via the key argument,
-// and must be a cryptographically secure random number of at least 32-bytes.
+// If a volume with the supplied name is already active with a different
+// source device, a *VolumeActivationConflictError error is returned.
 //
-// The initial keyslot will be created with the name specified in the
-// InitialKeyslotName field of options. If this is empty, "default" will be used.
+// This makes it safe to perform activation from units that may be run more
+// than once.
+func EnsureVolumeActivated(volumeName, sourceDevicePath string, activate func() error) error {
+	dev, err := luks2ActiveVolumeSourceDevice(volumeName)
+	switch {
+	case err == ErrVolumeNotActive:
+		return activate()
+	case err != nil:
+		return xerrors.Errorf("cannot determine if volume is active: %w", err)
+	case !isSameDevice(dev, sourceDevicePath):
+		return &VolumeActivationConflictError{
+			VolumeName:             volumeName,
+			SourceDevicePath:       sourceDevicePath,
+			ActiveSourceDevicePath: dev}
+	}
+
+	return nil
+}
+
+// DeactivateVolume attempts to deactivate the LUKS encrypted volumeName.
+// This makes use of systemd-cryptsetup. It is equivalent to calling
+// DeactivateVolumeWithOptions with nil options.
 //
-// The initial key should be protected by some platform-specific mechanism in order
-// to create a KeyData object. The KeyData object can be saved to the
-// keyslot using LUKS2KeyDataWriter.
+// Once the volume has been deactivated, the disk unlock key and auxiliary key
+// that were added to the kernel keyring with the default prefix when the volume
+// was activated are removed. Keys are associated with the source device path
+// that was supplied during activation, and this function can only determine
+// the kernel name of the source device (eg, /dev/sda1). If the volume was
+// activated using a different path or a custom KeyringPrefix, or with
+// ActivateVolumeOptions.KeyringKeyName set, use DeactivateVolumeAndRemoveKeys
+// instead.
 //
-// On failure, this will return an error containing the output of the cryptsetup command.
+// If the volume is not active, an ErrVolumeNotActive error will be returned.
+func DeactivateVolume(volumeName string) error {
+	return DeactivateVolumeWithOptions(volumeName, nil)
+}
+
+// DeactivateVolumeOptions provides options to DeactivateVolumeWithOptions.
+type DeactivateVolumeOptions struct {
+	// SystemdCryptsetupPath is the path of the systemd-cryptsetup
+	// binary used for deactivation. If this is empty, the default
+	// location (/lib/systemd/systemd-cryptsetup) is used.
+	SystemdCryptsetupPath string
+
+	// SourceDevicePath is the source device path that was supplied
+	// when the volume was activated, and is used to identify the keys
+	// to remove from the kernel keyring. If this is empty, the kernel
+	// name of the source device of the active volume is used.
+	SourceDevicePath string
+
+	// KeyringPrefix is the prefix that was supplied via
+	// ActivateVolumeOptions.KeyringPrefix when the volume was
+	// activated. If this is empty, the default prefix is used.
+	KeyringPrefix string
+
+	// KeyringKeyNames are the names that were supplied via
+	// ActivateVolumeOptions.KeyringKeyName when the volume was
+	// activated, so that the additional entries added under these
+	// names are also removed.
+	KeyringKeyNames []string
+}
+
+func (o *DeactivateVolumeOptions) luks2DeactivateOptions() *luks2.DeactivateOptions {
+	if o.SystemdCryptsetupPath == "" {
+		return nil
+	}
+	return &luks2.DeactivateOptions{SystemdCryptsetupPath: o.SystemdCryptsetupPath}
+}
+
+// DeactivateVolumeWithOptions is the same as DeactivateVolume, but permits
+// the caller to choose the systemd-cryptsetup binary and to identify the keys
+// that were added to the kernel keyring when the volume was activated. If the
+// SourceDevicePath field of options is set, the source device of the active
+// volume isn't looked up.
 //
-// WARNING: This function is destructive. Calling this on an existing LUKS container
-// will make the data contained inside of it irretrievable.
-func InitializeLUKS2Container(devicePath, label string, key DiskUnlockKey, options *InitializeLUKS2ContainerOptions) error {
-	if len(key) < 32 {
-		return fmt.Errorf("expected a key length of at least 256-bits (got %d)", len(key)*8)
+// If the volume is not active, an ErrVolumeNotActive error will be returned
+// and no keys will be removed.
+func DeactivateVolumeWithOptions(volumeName string, options *DeactivateVolumeOptions) error {
+	if options == nil {
+		options = &DeactivateVolumeOptions{}
 	}
 
-	// Use a reduced cost for the KDF. This is done because we have a high entropy key rather
-	// than a low entropy passphrase. Setting a higher cost provides no security benefit but
-	// does slow down unlocking. If an adversary is going to attempt to brute force this key,
+	sourceDevicePath := options.SourceDevicePath
+	if sourceDevicePath == "" {
+		var err error
+		sourceDevicePath, err = luks2ActiveVolumeSourceDevice(volumeName)
+		switch {
+		case err == ErrVolumeNotActive:
+			return err
+		case err != nil:
+			// Don't let this prevent the volume from being deactivated.
+			fmt.Fprintf(os.Stderr, "secboot: Cannot determine source device for %s, keys will not be removed from keyring: %v\n", volumeName, err)
+		}
+	}
+
+	if err := luks2Deactivate(volumeName, options.luks2DeactivateOptions()); err != nil {
+		return err
+	}
+
+	if sourceDevicePath == "" {
+		return nil
+	}
+	if err := RemoveKeysFromKernel(options.KeyringPrefix, sourceDevicePath, options.KeyringKeyNames...); err != nil {
+		return xerrors.Errorf("cannot remove keys from keyring: %w", err)
+	}
+
+	return nil
+}
+
+// DeactivateVolumeAndRemoveKeys attempts to deactivate the LUKS encrypted
+// volumeName in the same way as DeactivateVolume, and then removes the disk
+// unlock key and auxiliary key that were added to the user keyring when the
+// volume was activated. The sourceDevicePath and keyringPrefix arguments must
+// match the values supplied to the ActivateVolumeWith* function that activated
+// the volume.
+//
+// If the volume was activated with ActivateVolumeOptions.KeyringKeyName set,
+// the name should be supplied via the keyringKeyNames argument so that the
+// additional entry added under that name is also removed.
+//
+// Keys that aren't present in the user keyring are ignored, as they might never
+// have been added or might have already been removed.
+//
+// If the volume is not active, an ErrVolumeNotActive error will be returned and
+// no keys will be removed.
+//
+// Use DeactivateVolumeWithOptions to choose the systemd-cryptsetup binary.
+func DeactivateVolumeAndRemoveKeys(volumeName, sourceDevicePath, keyringPrefix string, keyringKeyNames ...string) error {
+	return DeactivateVolumeWithOptions(volumeName, &DeactivateVolumeOptions{
+		SourceDevicePath: sourceDevicePath,
+		KeyringPrefix:    keyringPrefix,
+		KeyringKeyNames:  keyringKeyNames})
+}
+
+// ErrKeyDataUnlockKeyMismatch is returned from CheckKeyDataUnlockKey if the
+// disk unlock key protected by a KeyData doesn't match the supplied key.
+var ErrKeyDataUnlockKeyMismatch = errors.New("the disk unlock key protected by the KeyData does not match the supplied key")
+
+// CheckKeyDataUnlockKey recovers the disk unlock key protected by the supplied
+// KeyData and checks that it matches the supplied key. This is intended to be
+// used during provisioning to verify that the key about to be used with
+// InitializeLUKS2Container or AddLUKS2ContainerUnlockKey is the same key that
+// the KeyData protects, before any destructive operation is performed. If the
+// keys don't match, ErrKeyDataUnlockKeyMismatch is returned.
+//
+// If the KeyData has a passphrase, then the passphrase and a KDF must be
+// supplied. These are ignored if the KeyData doesn't have a passphrase.
+//
+// This requires access to the platform's secure device.
+func CheckKeyDataUnlockKey(keyData *KeyData, key DiskUnlockKey, passphrase string, kdf KDF) error {
+	var recoveredKey DiskUnlockKey
+	var err error
+	switch keyData.AuthMode() {
+	case AuthModeNone:
+		recoveredKey, _, err = keyData.RecoverKeys()
+	case AuthModePassphrase:
+		recoveredKey, _, err = keyData.RecoverKeysWithPassphrase(passphrase, kdf)
+	default:
+		return errors.New("unexpected auth mode")
+	}
+	if err != nil {
+		return xerrors.Errorf("cannot recover key: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare(recoveredKey, key) != 1 {
+		return ErrKeyDataUnlockKeyMismatch
+	}
+
+	return nil
+}
+
+// LUKS2KDFType specifies the KDF algorithm used to protect a LUKS2 keyslot.
+type LUKS2KDFType string
+
+const (
+	// LUKS2KDFTypeArgon2i indicates that the argon2i KDF is used. This is
+	// the default.
+	LUKS2KDFTypeArgon2i LUKS2KDFType = "argon2i"
+
+	// LUKS2KDFTypeArgon2id indicates that the argon2id KDF is used.
+	LUKS2KDFTypeArgon2id LUKS2KDFType = "argon2id"
+
+	// LUKS2KDFTypePBKDF2 indicates that the PBKDF2 KDF is used. The memory
+	// cost and parallelism cannot be specified for this KDF.
+	LUKS2KDFTypePBKDF2 LUKS2KDFType = "pbkdf2"
+)
+
+// LUKS2ProgressFunc is a callback used to report the progress of operations
+// on LUKS2 containers, which can take several seconds to complete because of
+// the cost of the KDF. It is called with a short description of each step
+// before that step is performed. It does not affect the outcome of the
+// operation.
+type LUKS2ProgressFunc func(event string)
+
+func (fn LUKS2ProgressFunc) report(event string) {
+	if fn == nil {
+		return
+	}
+	fn(event)
+}
+
+// InitializeLUKS2ContainerOptions carries options for initializing LUKS2
+// containers.
+type InitializeLUKS2ContainerOptions struct {
+	// MetadataKiBSize sets the size of the metadata area in KiB. This
+	//
+	// MetadataKiBSize sets the size of the metadata area in KiB. 4KiB of
+	// this is used for the fixed-size binary header, with the remaining
+	// space being used for the JSON area. Setting this to zero causes
+	// the container to be initialized with the default metadata area size.
+	// If set to a non zero value, it must be a power of 2 between 16KiB
+	// and 4MiB.
+	MetadataKiBSize int
+
+	// KeyslotsAreaKiBSize sets the size of the binary keyslot area in KiB.
+	// Setting this to zero causes the container to be initialized with
+	// the default keyslots area size. If set to a non-zero value, the
+	// value must be a multiple of 4KiB up to a maximum of 128MiB.
+	KeyslotsAreaKiBSize int
+
+	// KDFOptions sets the KDF options for the initial keyslot. If this
+	// is nil then the default settings defined by this package are used
+	// (4 iterations and a memory cost of 32KiB, or 1000 iterations if
+	// KDFType is LUKS2KDFTypePBKDF2).
+	KDFOptions *KDFOptions
+
+	// KDFType sets the KDF algorithm for the initial keyslot. If this is
+	// empty, LUKS2KDFTypeArgon2i is used. The MemoryKiB and Parallel
+	// fields of KDFOptions must not be set for LUKS2KDFTypePBKDF2.
+	KDFType LUKS2KDFType
+
+	// InitialKeyslotName sets the name that will be used to identify
+	// the initial keyslot. If this is empty, then the name will be
+	// set to "default".
+	InitialKeyslotName string
+
+	// HeaderPath is the path of a device or file in which to store a
+	// detached LUKS2 header. If this is empty, the header is stored on
+	// the device being initialized. When a detached header is used, the
+	// same path must be supplied via ActivateVolumeOptions.HeaderPath
+	// for activation, and in place of the device path to functions that
+	// manage keyslots.
+	HeaderPath string
+
+	// Cipher sets the cipher used to encrypt data, in the format
+	// accepted by cryptsetup's --cipher option (eg,
+	// "xchacha20,aes-adiantum-plain64" for platforms without AES
+	// acceleration). If this is empty, AES with XTS block cipher mode
+	// (aes-xts-plain64) is used.
+	Cipher string
+
+	// KeySizeBits sets the size of the volume key in bits. If this is
+	// zero, the default for the cipher is used, which is 512 bits for
+	// XTS modes and 256 bits for Adiantum. It must be set for other
+	// ciphers. XTS modes require a key size of 256, 384 or 512 bits,
+	// and Adiantum requires a key size of 256 bits.
+	KeySizeBits int
+
+	// Integrity enables authenticated encryption using dm-integrity,
+	// so that modification of the encrypted data is detected, and sets
+	// the integrity algorithm in the format accepted by cryptsetup's
+	// --integrity option. If this is empty, integrity protection is not
+	// enabled. Supported values are "hmac-sha256" and "hmac-sha512" with
+	// non-AEAD ciphers, "aead" with AEAD ciphers such as
+	// "aes-gcm-random", and "poly1305" with "chacha20-random". AEAD
+	// ciphers require an integrity algorithm to be set.
+	//
+	// Note that dm-integrity has a significant cost. Initialization
+	// has to write to the entire device, which may take a long time,
+	// and the journal used to keep data and integrity tags consistent
+	// roughly halves write throughput and reduces the usable capacity of
+	// the device. systemd-cryptsetup sets up the additional integrity
+	// device during activation, which requires kernel support for
+	// dm-integrity.
+	Integrity string
+
+	// Progress is an optional callback used to report the progress of
+	// initialization.
+	Progress LUKS2ProgressFunc
+
+	// BusyRetries sets the number of times that formatting is
+	// retried if cryptsetup fails because the device is busy, which can
+	// happen transiently when the device has only just been created and
+	// udev is still processing it. Other errors are not retried. If this
+	// is zero, a default of 3 retries is used. Set this to a negative
+	// value to disable retries.
+	BusyRetries int
+
+	// BusyRetryDelay sets the delay before the first retry of
+	// formatting a busy device. The delay is doubled for each subsequent
+	// retry. If this is zero, a default of 250ms is used.
+	BusyRetryDelay time.Duration
+
+	// ExtraFormatArgs are additional arguments appended to the
+	// cryptsetup luksFormat command line. This permits the use of
+	// cryptsetup options that are not otherwise supported by this
+	// package, such as "--integrity-no-wipe". Each argument must be a
+	// long option with any value supplied in the same argument (eg,
+	// "--offset=2048"). Options that are managed by this package, such
+	// as "--type", "--key-file" and "--cipher", are rejected and must be
+	// configured with the corresponding field of these options instead.
+	ExtraFormatArgs []string
+
+	// SectorSize sets the encryption sector size in bytes. If this is
+	// zero, the cryptsetup default is used, which is normally 512 bytes.
+	// Otherwise, it must be 512, 1024, 2048 or 4096. A 4096 byte sector
+	// size can significantly improve performance on devices with 4KiB
+	// physical sectors, such as many NVMe drives. The sector size of an
+	// existing container can be obtained with GetLUKS2ContainerInfo.
+	SectorSize int
+
+	// CryptsetupPath is the path of the cryptsetup binary used for
+	// every step of initializing the container, including checking for
+	// an existing container, importing the initial token and setting
+	// the keyslot priority. If this is empty, cryptsetup is found via
+	// PATH. This is useful for callers that bundle their own
+	// cryptsetup, such as tools running from an initramfs or chroot.
+	CryptsetupPath string
+
+	// RefuseExisting makes InitializeLUKS2Container return a
+	// *LUKS2ContainerExistsError error rather than formatting a device
+	// that already contains a LUKS2 container.
+	RefuseExisting bool
+}
+
+// luks2CommandOptions returns the options for running cryptsetup for the
+// operations other than formatting, so that these use the same binary.
+func (o *InitializeLUKS2ContainerOptions) luks2CommandOptions() *luks2.CommandOptions {
+	if o == nil {
+		return nil
+	}
+	return newLUKS2CommandOptions(o.CryptsetupPath)
+}
+
+func (o *InitializeLUKS2ContainerOptions) luks2ImportTokenOptions() *luks2.ImportTokenOptions {
+	return newLUKS2ImportTokenOptions(o.luks2CommandOptions())
+}
+
+// LUKS2CommandOptions provides options for running cryptsetup to modify or
+// test a LUKS2 container.
+type LUKS2CommandOptions struct {
+	// CryptsetupPath is the path of the cryptsetup binary to use. If
+	// this is empty, cryptsetup is found via PATH. This is useful for
+	// callers that bundle their own cryptsetup, such as tools running
+	// from an initramfs or chroot.
+	CryptsetupPath string
+}
+
+func (o *LUKS2CommandOptions) luks2CommandOptions() *luks2.CommandOptions {
+	if o == nil {
+		return nil
+	}
+	return newLUKS2CommandOptions(o.CryptsetupPath)
+}
+
+// newLUKS2CommandOptions returns the options for running the cryptsetup
+// binary at the specified path, or nil if the path is empty so that the
+// default is used.
+func newLUKS2CommandOptions(cryptsetupPath string) *luks2.CommandOptions {
+	if cryptsetupPath == "" {
+		return nil
+	}
+	return &luks2.CommandOptions{CryptsetupPath: cryptsetupPath}
+}
+
+// newLUKS2ImportTokenOptions returns the options for importing a new token
+// with the supplied command options.
+func newLUKS2ImportTokenOptions(cmdOptions *luks2.CommandOptions) *luks2.ImportTokenOptions {
+	if cmdOptions == nil {
+		return nil
+	}
+	return &luks2.ImportTokenOptions{Id: luks2.AnyId, CommandOptions: *cmdOptions}
+}
+
+func (o *InitializeLUKS2ContainerOptions) formatOpts() *luks2.FormatOptions {
+	kdfOptions := o.KDFOptions.luksOpts()
+	kdfOptions.Type = luks2.KDFType(o.KDFType)
+
+	return &luks2.FormatOptions{
+		MetadataKiBSize:     o.MetadataKiBSize,
+		KeyslotsAreaKiBSize: o.KeyslotsAreaKiBSize,
+		KDFOptions:          kdfOptions,
+		HeaderPath:          o.HeaderPath,
+		Cipher:              o.Cipher,
+		KeySizeBits:         o.KeySizeBits,
+		Integrity:           o.Integrity,
+		ExtraArgs:           o.ExtraFormatArgs,
+		SectorSize:          o.SectorSize,
+		CryptsetupPath:      o.CryptsetupPath}
+}
+
+// withDefaults returns a copy of these options with defaults applied.
+func (o *InitializeLUKS2ContainerOptions) withDefaults() *InitializeLUKS2ContainerOptions {
+	// Use a reduced cost for the KDF. This is done because we have a high entropy key rather
+	// than a low entropy passphrase. Setting a higher cost provides no security benefit but
+	// does slow down unlocking. If an adversary is going to attempt to brute force this key,
 	// then they could instead turn their attention to one of the other keys involved in the
 	// protection of this key, some of which can be verified without running a KDF. For
 	// example, with a TPM sealed object, you can verify the parent storage key's seed by
 	// computing the key object's HMAC key and verifying the integrity value on the outer wrapper.
-	if options == nil {
-		var defaultOptions InitializeLUKS2ContainerOptions
-		options = &defaultOptions
-	} else {
-		// copy options to avoid modification of the supplied struct
-		options = &InitializeLUKS2ContainerOptions{
-			MetadataKiBSize:     options.MetadataKiBSize,
-			KeyslotsAreaKiBSize: options.KeyslotsAreaKiBSize,
-			KDFOptions:          options.KDFOptions,
-			InitialKeyslotName:  options.InitialKeyslotName}
+	if o == nil {
+		o = &InitializeLUKS2ContainerOptions{}
 	}
 
+	// copy options to avoid modification of the supplied struct
+	options := &InitializeLUKS2ContainerOptions{
+		MetadataKiBSize:     o.MetadataKiBSize,
+		KeyslotsAreaKiBSize: o.KeyslotsAreaKiBSize,
+		KDFOptions:          o.KDFOptions,
+		KDFType:             o.KDFType,
+		InitialKeyslotName:  o.InitialKeyslotName,
+		HeaderPath:          o.HeaderPath,
+		Cipher:              o.Cipher,
+		KeySizeBits:         o.KeySizeBits,
+		Integrity:           o.Integrity,
+		Progress:            o.Progress,
+		BusyRetries:         o.BusyRetries,
+		BusyRetryDelay:      o.BusyRetryDelay,
+		ExtraFormatArgs:     o.ExtraFormatArgs,
+		SectorSize:          o.SectorSize,
+		CryptsetupPath:      o.CryptsetupPath,
+		RefuseExisting:      o.RefuseExisting}
+
 	if options.KDFOptions == nil {
-		options.KDFOptions = &KDFOptions{MemoryKiB: 32, ForceIterations: 4}
+		switch options.KDFType {
+		case LUKS2KDFTypePBKDF2:
+			// cryptsetup requires at least 1000 iterations for PBKDF2.
+			options.KDFOptions = &KDFOptions{ForceIterations: 1000}
+		default:
+			options.KDFOptions = &KDFOptions{MemoryKiB: 32, ForceIterations: 4}
+		}
+	}
+
+	return options
+}
+
+// format formats the device at the specified path, retrying if the device
+// is busy.
+func (o *InitializeLUKS2ContainerOptions) format(devicePath, label string, key DiskUnlockKey) error {
+	retries := o.BusyRetries
+	switch {
+	case retries == 0:
+		retries = defaultFormatBusyRetries
+	case retries < 0:
+		retries = 0
+	}
+
+	delay := o.BusyRetryDelay
+	if delay == 0 {
+		delay = defaultFormatBusyRetryDelay
+	}
+
+	for i := 0; ; i++ {
+		o.Progress.report("formatting")
+		err := luks2Format(devicePath, label, key, o.formatOpts())
+		if err == nil || i >= retries || !xerrors.Is(err, luks2.ErrDeviceBusy) {
+			return err
+		}
+
+		o.Progress.report(fmt.Sprintf("device busy, retrying in %v", delay))
+		timeSleep(delay)
+		delay *= 2
+	}
+}
+
+// InitializeLUKS2ContainerCommand returns the cryptsetup command line that
+// InitializeLUKS2Container would execute in order to format the device at the
+// specified path with the supplied label and options, without executing it. The
+// first element of the returned slice is the name of the cryptsetup binary. The
+// key is not part of the command line because it is supplied to cryptsetup via
+// its stdin.
+//
+// InitializeLUKS2Container performs some additional operations on the container
+// header after formatting it which are not described by the returned command line.
+func InitializeLUKS2ContainerCommand(devicePath, label string, options *InitializeLUKS2ContainerOptions) ([]string, error) {
+	return luks2.FormatCommand(devicePath, label, options.withDefaults().formatOpts())
+}
+
+// InitializeLUKS2Container will initialize the partition at the specified devicePath
+// as a new LUKS2 container. This can only be called on a partition that isn't mapped.
+// The label for the new LUKS2 container is provided via the label argument.
+//
+// The container will be configured to encrypt data with AES-256 and XTS block cipher
+// mode, unless a different cipher or key size is specified via the Cipher and
+// KeySizeBits fields of options.
+//
+// The initial key used for unlocking the container is provided via the key argument,
+// and must be a cryptographically secure random number of at least 32-bytes.
+//
+// The initial keyslot will be created with the name specified in the
+// InitialKeyslotName field of options. If this is empty, "default" will be used.
+//
+// The initial key should be protected by some platform-specific mechanism in order
+// to create a KeyData object. The KeyData object can be saved to the
+// keyslot using LUKS2KeyDataWriter. CheckKeyDataUnlockKey can be used to verify
+// that the KeyData protects the supplied key before calling this function.
+//
+// If the RefuseExisting field of options is set and the device, or the detached header
+// specified via the HeaderPath field of options, already contains a LUKS2 container, a
+// *LUKS2ContainerExistsError error will be returned.
+//
+// On failure, this will return an error containing the output of the cryptsetup command.
+//
+// WARNING: This function is destructive. Calling this on an existing LUKS container
+// without the RefuseExisting option will make the data contained inside of it irretrievable.
+func InitializeLUKS2Container(devicePath, label string, key DiskUnlockKey, options *InitializeLUKS2ContainerOptions) error {
+	if len(key) < 32 {
+		return fmt.Errorf("expected a key length of at least 256-bits (got %d)", len(key)*8)
+	}
+
+	options = options.withDefaults()
+
+	if options.RefuseExisting {
+		paths := []string{devicePath}
+		if options.HeaderPath != "" {
+			// The detached header may not have been created yet.
+			if _, err := os.Stat(options.HeaderPath); err == nil {
+				paths = append(paths, options.HeaderPath)
+			}
+		}
+		for _, path := range paths {
+			isLUKS2, err := luks2IsLUKS2(path, options.luks2CommandOptions())
+			switch {
+			case err != nil:
+				return xerrors.Errorf("cannot determine if %s is a LUKS2 container: %w", path, err)
+			case isLUKS2:
+				return &LUKS2ContainerExistsError{DevicePath: path}
+			}
+		}
 	}
 
 	initialKeyslotName := options.InitialKeyslotName
@@ -615,54 +2445,183 @@ func InitializeLUKS2Container(devicePath, label string, key DiskUnlockKey, optio
 		initialKeyslotName = defaultKeyslotName
 	}
 
-	if err := luks2Format(devicePath, label, key, options.formatOpts()); err != nil {
+	if err := options.format(devicePath, label, key); err != nil {
 		return xerrors.Errorf("cannot format: %w", err)
 	}
 
+	// The remaining operations only modify the header.
+	headerPath := devicePath
+	if options.HeaderPath != "" {
+		headerPath = options.HeaderPath
+	}
+
 	token := luksview.KeyDataToken{
 		TokenBase: luksview.TokenBase{
 			TokenKeyslot: 0,
 			TokenName:    initialKeyslotName}}
-	if err := luks2ImportToken(devicePath, &token, nil); err != nil {
+	options.Progress.report("importing token")
+	if err := luks2ImportToken(headerPath, &token, options.luks2ImportTokenOptions()); err != nil {
 		return xerrors.Errorf("cannot import token: %w", err)
 	}
 
-	if err := luks2SetSlotPriority(devicePath, 0, luks2.SlotPriorityHigh); err != nil {
+	options.Progress.report("setting keyslot priority")
+	if err := luks2SetSlotPriority(headerPath, 0, luks2.SlotPriorityHigh, options.luks2CommandOptions()); err != nil {
 		return xerrors.Errorf("cannot change keyslot priority: %w", err)
 	}
 
 	return nil
 }
 
-func removeOrphanedTokens(devicePath string, view *luksview.View) {
+// LUKS2ContainerInfo contains information about a LUKS2 container.
+type LUKS2ContainerInfo struct {
+	UUID      string // The UUID of the container
+	Label     string // The label of the container
+	Subsystem string // The subsystem label of the container
+
+	// Cipher is the encryption algorithm used for the data segment in
+	// dm-crypt notation, eg, "aes-xts-plain64".
+	Cipher string
+
+	// SectorSize is the encryption sector size of the data segment in
+	// bytes.
+	SectorSize int
+}
+
+// NotLUKS2ContainerError is returned from GetLUKS2ContainerInfo if the
+// specified device doesn't contain a LUKS2 header.
+type NotLUKS2ContainerError struct {
+	DevicePath string
+}
+
+func (e *NotLUKS2ContainerError) Error() string {
+	return e.DevicePath + " is not a LUKS2 container"
+}
+
+// LUKS2ContainerExistsError is returned from InitializeLUKS2Container if the
+// specified device already contains a LUKS2 container.
+type LUKS2ContainerExistsError struct {
+	DevicePath string
+}
+
+func (e *LUKS2ContainerExistsError) Error() string {
+	return e.DevicePath + " is already a LUKS2 container"
+}
+
+// IsLUKS2Container indicates whether the specified device or detached header
+// contains a LUKS2 container. This returns false for devices that are
+// unformatted or that contain something other than a LUKS2 container. An error
+// is only returned if the device cannot be accessed or checked.
+func IsLUKS2Container(devicePath string) (bool, error) {
+	return IsLUKS2ContainerWithOptions(devicePath, nil)
+}
+
+// IsLUKS2ContainerWithOptions is the same as IsLUKS2Container, but permits the
+// caller to choose the cryptsetup binary.
+func IsLUKS2ContainerWithOptions(devicePath string, options *LUKS2CommandOptions) (bool, error) {
+	isLUKS2, err := luks2IsLUKS2(devicePath, options.luks2CommandOptions())
+	if err != nil {
+		return false, xerrors.Errorf("cannot check device: %w", err)
+	}
+	return isLUKS2, nil
+}
+
+// GetLUKS2ContainerInfo returns information about the LUKS2 container at the
+// specified path, such as its UUID and label. If the device does not contain
+// a LUKS2 header, a *NotLUKS2ContainerError error will be returned.
+func GetLUKS2ContainerInfo(devicePath string) (*LUKS2ContainerInfo, error) {
+	hdr, err := luks2.ReadHeader(devicePath, luks2.LockModeBlocking)
+	var e *luks2.NoHeaderError
+	switch {
+	case xerrors.As(err, &e):
+		return nil, &NotLUKS2ContainerError{DevicePath: devicePath}
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read header: %w", err)
+	}
+
+	info := &LUKS2ContainerInfo{
+		UUID:      hdr.UUID,
+		Label:     hdr.Label,
+		Subsystem: hdr.Subsystem}
+
+	var ids []int
+	for id := range hdr.Metadata.Segments {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		segment := hdr.Metadata.Segments[id]
+		if segment.Type != "crypt" {
+			continue
+		}
+		info.Cipher = segment.Encryption
+		info.SectorSize = segment.SectorSize
+		break
+	}
+
+	return info, nil
+}
+
+// LUKS2ReencryptionInProgressError is returned from functions that modify the
+// keyslots of a LUKS2 container if the container is in the process of being
+// reencrypted. The reencryption must be completed before retrying the operation.
+type LUKS2ReencryptionInProgressError struct {
+	DevicePath string
+}
+
+func (e *LUKS2ReencryptionInProgressError) Error() string {
+	return "cannot modify keyslots on " + e.DevicePath + " because reencryption is in progress and must be completed first"
+}
+
+func removeOrphanedTokens(devicePath string, view *luksview.View, cmdOptions *luks2.CommandOptions) {
 	for _, id := range view.OrphanedTokenIds() {
-		luks2RemoveToken(devicePath, id)
+		luks2RemoveToken(devicePath, id, cmdOptions)
 	}
 }
 
-func addLUKS2ContainerKey(devicePath, keyslotName string, existingKey, newKey DiskUnlockKey, options *KDFOptions,
-	newToken func(base *luksview.TokenBase) luks2.Token, priority luks2.SlotPriority) error {
+func addLUKS2ContainerKey(devicePath, keyslotName string, existingKey, newKey DiskUnlockKey, kdfOptions luks2.KDFOptions,
+	newToken func(base *luksview.TokenBase) luks2.Token, slot int, priority luks2.SlotPriority, progress LUKS2ProgressFunc,
+	cmdOptions *luks2.CommandOptions) (int, error) {
+	if slot < 0 && slot != luks2.AnySlot {
+		return 0, fmt.Errorf("invalid keyslot %d", slot)
+	}
+
 	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
 	if err != nil {
-		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+		return 0, xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	if view.ReencryptionInProgress() {
+		return 0, &LUKS2ReencryptionInProgressError{DevicePath: devicePath}
 	}
 
 	if _, _, exists := view.TokenByName(keyslotName); exists {
-		return errors.New("the specified name is already in use")
+		return 0, errors.New("the specified name is already in use")
+	}
+
+	if _, exists := view.KeyslotPriority(slot); exists {
+		return 0, fmt.Errorf("keyslot %d is already in use", slot)
 	}
 
-	removeOrphanedTokens(devicePath, view)
+	removeOrphanedTokens(devicePath, view, cmdOptions)
 
-	freeSlot := 0
-	for _, slot := range view.UsedKeyslots() {
-		if slot != freeSlot {
-			break
+	freeSlot := slot
+	if freeSlot == luks2.AnySlot {
+		freeSlot = 0
+		for _, slot := range view.UsedKeyslots() {
+			if slot != freeSlot {
+				break
+			}
+			freeSlot++
 		}
-		freeSlot++
 	}
 
-	if err := luks2AddKey(devicePath, existingKey, newKey, &luks2.AddKeyOptions{KDFOptions: options.luksOpts(), Slot: freeSlot}); err != nil {
-		return xerrors.Errorf("cannot add key: %w", err)
+	addKeyOptions := &luks2.AddKeyOptions{KDFOptions: kdfOptions, Slot: freeSlot}
+	if cmdOptions != nil {
+		addKeyOptions.CommandOptions = *cmdOptions
+	}
+	progress.report(fmt.Sprintf("adding keyslot %d", freeSlot))
+	if err := luks2AddKey(devicePath, existingKey, newKey, addKeyOptions); err != nil {
+		return 0, xerrors.Errorf("cannot add key: %w", err)
 	}
 
 	// XXX: If we fail between AddKey and ImportToken, then we end up with a
@@ -699,15 +2658,17 @@ func addLUKS2ContainerKey(devicePath, keyslotName string, existingKey, newKey Di
 	tokenBase := luksview.TokenBase{
 		TokenName:    keyslotName,
 		TokenKeyslot: freeSlot}
-	if err := luks2ImportToken(devicePath, newToken(&tokenBase), nil); err != nil {
-		return xerrors.Errorf("cannot import token: %w", err)
+	progress.report("importing token")
+	if err := luks2ImportToken(devicePath, newToken(&tokenBase), newLUKS2ImportTokenOptions(cmdOptions)); err != nil {
+		return 0, xerrors.Errorf("cannot import token: %w", err)
 	}
 
-	if err := luks2SetSlotPriority(devicePath, freeSlot, priority); err != nil {
-		return xerrors.Errorf("cannot change keyslot priority: %w", err)
+	progress.report("setting keyslot priority")
+	if err := luks2SetSlotPriority(devicePath, freeSlot, priority, cmdOptions); err != nil {
+		return 0, xerrors.Errorf("cannot change keyslot priority: %w", err)
 	}
 
-	return nil
+	return freeSlot, nil
 }
 
 func listLUKS2ContainerKeyNames(devicePath string, tokenType luks2.TokenType) ([]string, error) {
@@ -748,14 +2709,82 @@ func listLUKS2ContainerKeyNames(devicePath string, tokenType luks2.TokenType) ([
 // order to create a KeyData object. The KeyData object can be saved to the
 // keyslot using LUKS2KeyDataWriter.
 func AddLUKS2ContainerUnlockKey(devicePath, keyslotName string, existingKey, newKey DiskUnlockKey, options *KDFOptions) error {
+	_, err := AddLUKS2ContainerUnlockKeyWithOptions(devicePath, keyslotName, existingKey, newKey, &AddLUKS2ContainerUnlockKeyOptions{
+		KDFOptions: options,
+		Slot:       LUKS2AnyKeyslot,
+		Priority:   LUKS2KeyslotPriorityHigh})
+	return err
+}
+
+// AddLUKS2ContainerUnlockKeyOptions provides options to
+// AddLUKS2ContainerUnlockKeyWithOptions.
+type AddLUKS2ContainerUnlockKeyOptions struct {
+	// KDFOptions specifies the KDF options for the new keyslot. If this
+	// is nil, the same reduced cost defaults are used as for
+	// AddLUKS2ContainerUnlockKey, which are appropriate for high entropy
+	// keys.
+	KDFOptions *KDFOptions
+
+	// Slot specifies the keyslot to create. Set this to LUKS2AnyKeyslot
+	// to use the first free keyslot. An error is returned if the specified
+	// keyslot is already in use, so an existing keyslot cannot be
+	// overwritten.
+	Slot int
+
+	// Priority specifies the priority of the new keyslot, and must be
+	// either LUKS2KeyslotPriorityNormal or LUKS2KeyslotPriorityHigh.
+	Priority LUKS2KeyslotPriority
+
+	// Progress is an optional callback used to report the progress of
+	// adding the key.
+	Progress LUKS2ProgressFunc
+
+	// CryptsetupPath is the path of the cryptsetup binary used to add
+	// the key. If this is empty, cryptsetup is found via PATH.
+	CryptsetupPath string
+}
+
+// AddLUKS2ContainerUnlockKeyWithOptions is the same as
+// AddLUKS2ContainerUnlockKey, but permits the caller to choose the keyslot
+// and keyslot priority. This can be used to add additional platform protected
+// keys, such as a secondary TPM sealed key. If options is nil, the first free
+// keyslot is used and the keyslot is created with a high priority.
+//
+// On success, the number of the keyslot that was created is returned.
+func AddLUKS2ContainerUnlockKeyWithOptions(devicePath, keyslotName string, existingKey, newKey DiskUnlockKey, options *AddLUKS2ContainerUnlockKeyOptions) (int, error) {
 	if len(newKey) < 32 {
-		return fmt.Errorf("expected a key length of at least 256-bits (got %d)", len(newKey)*8)
+		return 0, fmt.Errorf("expected a key length of at least 256-bits (got %d)", len(newKey)*8)
+	}
+
+	if options == nil {
+		options = &AddLUKS2ContainerUnlockKeyOptions{
+			Slot:     LUKS2AnyKeyslot,
+			Priority: LUKS2KeyslotPriorityHigh}
+	}
+
+	switch options.Priority {
+	case LUKS2KeyslotPriorityNormal, LUKS2KeyslotPriorityHigh:
+	default:
+		return 0, fmt.Errorf("invalid keyslot priority %d", options.Priority)
 	}
 
 	if keyslotName == "" {
 		keyslotName = defaultKeyslotName
 	}
 
+	kdfOptions := options.KDFOptions
+	if kdfOptions == nil {
+		kdfOptions = defaultUnlockKeyKDFOptions()
+	}
+
+	return addLUKS2ContainerKey(devicePath, keyslotName, existingKey, newKey, kdfOptions.luksOpts(), func(base *luksview.TokenBase) luks2.Token {
+		return &luksview.KeyDataToken{TokenBase: *base}
+	}, options.Slot, options.Priority, options.Progress, newLUKS2CommandOptions(options.CryptsetupPath))
+}
+
+// defaultUnlockKeyKDFOptions returns the KDF options used for keyslots
+// containing a platform protected unlock key if none are supplied.
+func defaultUnlockKeyKDFOptions() *KDFOptions {
 	// Use a reduced cost for the KDF. This is done because we have a high entropy key rather
 	// than a low entropy passphrase. Setting a higher cost provides no security benefit but
 	// does slow down unlocking. If an adversary is going to attempt to brute force this key,
@@ -763,13 +2792,94 @@ func AddLUKS2ContainerUnlockKey(devicePath, keyslotName string, existingKey, new
 	// protection of this key, some of which can be verified without running a KDF. For
 	// example, with a TPM sealed object, you can verify the parent storage key's seed by
 	// computing the key object's HMAC key and verifying the integrity value on the outer wrapper.
+	return &KDFOptions{MemoryKiB: 32, ForceIterations: 4}
+}
+
+// ChangeLUKS2ContainerUnlockKey changes the key protecting the unlock keyslot
+// with the specified name on the LUKS2 container at the specified path, without
+// needing the recovery key. The new key is stored in the same keyslot, so the
+// keyslot name and any KeyData stored in the associated token are retained,
+// and the priority of the keyslot is preserved. This is intended to be used when
+// rotating a platform protected key whilst the old key is still available.
+//
+// The keyslot must have been created with InitializeLUKS2Container or
+// AddLUKS2ContainerUnlockKey. If the supplied existing key is not valid for the
+// keyslot, an error will be returned.
+//
+// The new key should be a cryptographically strong random number of at least
+// 32-bytes. If options is nil, the same reduced cost KDF options are used as for
+// AddLUKS2ContainerUnlockKey.
+//
+// Note that any KeyData associated with the keyslot will need to be updated
+// to protect the new key.
+func ChangeLUKS2ContainerUnlockKey(devicePath, keyslotName string, existingKey, newKey DiskUnlockKey, options *KDFOptions) error {
+	return ChangeLUKS2ContainerUnlockKeyWithOptions(devicePath, keyslotName, existingKey, newKey, &ChangeLUKS2ContainerUnlockKeyOptions{KDFOptions: options})
+}
+
+// ChangeLUKS2ContainerUnlockKeyOptions provides options to
+// ChangeLUKS2ContainerUnlockKeyWithOptions.
+type ChangeLUKS2ContainerUnlockKeyOptions struct {
+	// KDFOptions specifies the KDF options for the keyslot. If this is
+	// nil, the same reduced cost defaults are used as for
+	// AddLUKS2ContainerUnlockKey.
+	KDFOptions *KDFOptions
+
+	// CryptsetupPath is the path of the cryptsetup binary used to
+	// change the key. If this is empty, cryptsetup is found via PATH.
+	CryptsetupPath string
+}
+
+// ChangeLUKS2ContainerUnlockKeyWithOptions is the same as
+// ChangeLUKS2ContainerUnlockKey, but permits the caller to choose the
+// cryptsetup binary.
+func ChangeLUKS2ContainerUnlockKeyWithOptions(devicePath, keyslotName string, existingKey, newKey DiskUnlockKey, options *ChangeLUKS2ContainerUnlockKeyOptions) error {
+	if len(newKey) < 32 {
+		return fmt.Errorf("expected a key length of at least 256-bits (got %d)", len(newKey)*8)
+	}
+
+	if keyslotName == "" {
+		keyslotName = defaultKeyslotName
+	}
+
 	if options == nil {
-		options = &KDFOptions{MemoryKiB: 32, ForceIterations: 4}
+		options = &ChangeLUKS2ContainerUnlockKeyOptions{}
 	}
+	kdfOptions := options.KDFOptions
+	if kdfOptions == nil {
+		kdfOptions = defaultUnlockKeyKDFOptions()
+	}
+	cmdOptions := newLUKS2CommandOptions(options.CryptsetupPath)
 
-	return addLUKS2ContainerKey(devicePath, keyslotName, existingKey, newKey, options, func(base *luksview.TokenBase) luks2.Token {
-		return &luksview.KeyDataToken{TokenBase: *base}
-	}, luks2.SlotPriorityHigh)
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	if view.ReencryptionInProgress() {
+		return &LUKS2ReencryptionInProgressError{DevicePath: devicePath}
+	}
+
+	token, _, exists := view.TokenByName(keyslotName)
+	if !exists {
+		return errors.New("no key with the specified name exists")
+	}
+	if token.Type() != luksview.KeyDataTokenType {
+		return errors.New("the specified key is not an unlock key")
+	}
+
+	slot := token.Keyslots()[0]
+	priority, _ := view.KeyslotPriority(slot)
+
+	luksKDFOptions := kdfOptions.luksOpts()
+	if err := luks2ChangeKey(devicePath, slot, existingKey, newKey, &luksKDFOptions, cmdOptions); err != nil {
+		return xerrors.Errorf("cannot change key: %w", err)
+	}
+
+	if err := luks2SetSlotPriority(devicePath, slot, priority, cmdOptions); err != nil {
+		return xerrors.Errorf("cannot restore keyslot priority: %w", err)
+	}
+
+	return nil
 }
 
 // ListLUKS2ContainerUnlockKeyNames lists the names of keyslots on the specified
@@ -796,17 +2906,314 @@ func ListLUKS2ContainerUnlockKeyNames(devicePath string) ([]string, error) {
 //
 // In order to perform this action, an existing key must be supplied.
 func AddLUKS2ContainerRecoveryKey(devicePath, keyslotName string, existingKey DiskUnlockKey, recoveryKey RecoveryKey, options *KDFOptions) error {
+	_, err := AddLUKS2ContainerRecoveryKeyWithOptions(devicePath, keyslotName, existingKey, recoveryKey, &AddLUKS2ContainerRecoveryKeyOptions{
+		KDFOptions: options,
+		Slot:       LUKS2AnyKeyslot,
+		Priority:   LUKS2KeyslotPriorityNormal})
+	return err
+}
+
+// LUKS2AnyKeyslot can be used in AddLUKS2ContainerUnlockKeyOptions and
+// AddLUKS2ContainerRecoveryKeyOptions to indicate that the first free keyslot
+// should be used.
+const LUKS2AnyKeyslot = luks2.AnySlot
+
+// AddLUKS2ContainerRecoveryKeyOptions provides options to
+// AddLUKS2ContainerRecoveryKeyWithOptions.
+type AddLUKS2ContainerRecoveryKeyOptions struct {
+	// KDFOptions specifies the KDF options for the new keyslot. If this
+	// is nil, the defaults are used.
+	KDFOptions *KDFOptions
+
+	// KDFType specifies the KDF algorithm for the new keyslot. If this is
+	// empty, LUKS2KDFTypeArgon2i is used. LUKS2KDFTypeArgon2id offers better
+	// resistance to side-channel and GPU based attacks and is recommended
+	// for new keyslots. The MemoryKiB and Parallel fields of KDFOptions
+	// must not be set for LUKS2KDFTypePBKDF2. If the system's cryptsetup
+	// doesn't support the requested KDF, the error from cryptsetup is
+	// returned.
+	KDFType LUKS2KDFType
+
+	// Slot specifies the keyslot to create. Set this to LUKS2AnyKeyslot
+	// to use the first free keyslot. An error is returned if the specified
+	// keyslot is already in use.
+	Slot int
+
+	// Priority specifies the priority of the new keyslot, and must be
+	// either LUKS2KeyslotPriorityNormal or LUKS2KeyslotPriorityHigh.
+	// Keyslots created by InitializeLUKS2Container and
+	// AddLUKS2ContainerUnlockKey have a high priority, so that they are
+	// tried first.
+	Priority LUKS2KeyslotPriority
+
+	// Progress is an optional callback used to report the progress of
+	// adding the recovery key.
+	Progress LUKS2ProgressFunc
+
+	// CryptsetupPath is the path of the cryptsetup binary used to add
+	// the recovery key. If this is empty, cryptsetup is found via PATH.
+	CryptsetupPath string
+}
+
+// AddLUKS2ContainerRecoveryKeyWithOptions is the same as
+// AddLUKS2ContainerRecoveryKey, but permits the caller to choose the keyslot
+// and keyslot priority. If options is nil, the first free keyslot is used and
+// the keyslot is created with a normal priority.
+//
+// On success, the number of the keyslot that was created is returned. This can
+// be recorded in order to later remove the recovery key with
+// DeleteLUKS2ContainerRecoveryKeyslot.
+func AddLUKS2ContainerRecoveryKeyWithOptions(devicePath, keyslotName string, existingKey DiskUnlockKey, recoveryKey RecoveryKey, options *AddLUKS2ContainerRecoveryKeyOptions) (int, error) {
+	return addLUKS2ContainerRecoveryKey(devicePath, keyslotName, existingKey, recoveryKey[:], options)
+}
+
+// AddLUKS2ContainerExtendedRecoveryKey is the same as
+// AddLUKS2ContainerRecoveryKeyWithOptions, but adds an ExtendedRecoveryKey. An
+// error is returned if the supplied recovery key does not have a valid length.
+//
+// The new keyslot can be unlocked with a key supplied via the RecoveryKeyReaders
+// or RecoveryKeyFile fields of ActivateVolumeOptions.
+func AddLUKS2ContainerExtendedRecoveryKey(devicePath, keyslotName string, existingKey DiskUnlockKey, recoveryKey ExtendedRecoveryKey, options *AddLUKS2ContainerRecoveryKeyOptions) (int, error) {
+	if err := checkExtendedRecoveryKeySize(len(recoveryKey)); err != nil {
+		return 0, xerrors.Errorf("invalid recovery key: %w", err)
+	}
+	return addLUKS2ContainerRecoveryKey(devicePath, keyslotName, existingKey, recoveryKey, options)
+}
+
+func addLUKS2ContainerRecoveryKey(devicePath, keyslotName string, existingKey DiskUnlockKey, recoveryKey []byte, options *AddLUKS2ContainerRecoveryKeyOptions) (int, error) {
+	if options == nil {
+		options = &AddLUKS2ContainerRecoveryKeyOptions{
+			Slot:     LUKS2AnyKeyslot,
+			Priority: LUKS2KeyslotPriorityNormal}
+	}
+
+	luksKDFOptions, err := options.luksKDFOptions()
+	if err != nil {
+		return 0, err
+	}
+
 	if keyslotName == "" {
 		keyslotName = defaultRecoveryKeyslotName
 	}
 
+	return addLUKS2ContainerKey(devicePath, keyslotName, existingKey, recoveryKey, luksKDFOptions, newRecoveryToken, options.Slot, options.Priority, options.Progress,
+		newLUKS2CommandOptions(options.CryptsetupPath))
+}
+
+// luksKDFOptions validates these options and returns the KDF options for the
+// new keyslot.
+func (o *AddLUKS2ContainerRecoveryKeyOptions) luksKDFOptions() (luks2.KDFOptions, error) {
+	switch o.Priority {
+	case LUKS2KeyslotPriorityNormal, LUKS2KeyslotPriorityHigh:
+	default:
+		return luks2.KDFOptions{}, fmt.Errorf("invalid keyslot priority %d", o.Priority)
+	}
+
+	kdfOptions := o.KDFOptions
+	if kdfOptions == nil {
+		kdfOptions = &KDFOptions{}
+	}
+
+	luksKDFOptions := kdfOptions.luksOpts()
+	luksKDFOptions.Type = luks2.KDFType(o.KDFType)
+	if err := luksKDFOptions.Validate(); err != nil {
+		return luks2.KDFOptions{}, xerrors.Errorf("invalid KDF options: %w", err)
+	}
+
+	return luksKDFOptions, nil
+}
+
+func newRecoveryToken(base *luksview.TokenBase) luks2.Token {
+	return &luksview.RecoveryToken{TokenBase: *base}
+}
+
+// LUKS2ContainerRecoveryKeyslot describes a recovery key to be added by
+// AddLUKS2ContainerRecoveryKeys.
+type LUKS2ContainerRecoveryKeyslot struct {
+	// Name is the name of the new keyslot. If this is empty, the name
+	// "default-recovery" is used.
+	Name string
+
+	// Key is the recovery key to add, which must be generated by a
+	// cryptographically strong random number source.
+	Key RecoveryKey
+}
+
+// AddLUKS2ContainerRecoveryKeysError is returned from AddLUKS2ContainerRecoveryKeys
+// if one of the supplied recovery keys could not be added. The keys that precede it
+// were added successfully, and the keys that follow it were not added.
+type AddLUKS2ContainerRecoveryKeysError struct {
+	Name  string   // The name of the keyslot that could not be added
+	Added []string // The names of the keyslots that were added successfully
+	err   error
+}
+
+func (e *AddLUKS2ContainerRecoveryKeysError) Error() string {
+	return fmt.Sprintf("cannot add recovery key %q: %v", e.Name, e.err)
+}
+
+func (e *AddLUKS2ContainerRecoveryKeysError) Unwrap() error {
+	return e.err
+}
+
+// AddLUKS2ContainerRecoveryKeys creates a fallback recovery keyslot for each of
+// the supplied recovery keys on the LUKS2 container at the specified path, in the
+// same way as AddLUKS2ContainerRecoveryKeyWithOptions. This is useful for adding
+// several recovery keys, eg, one for an administrator and one for a help desk. The
+// supplied options apply to every new keyslot. The Slot field of options must be
+// LUKS2AnyKeyslot if more than one key is supplied.
+//
+// The options and the keyslot names are validated before any keyslots are created.
+// Each key is then added in turn with the supplied existing key. Each new keyslot
+// still requires its own KDF to be run.
+//
+// On success, the numbers of the keyslots that were created are returned in the
+// same order as the supplied keys. If a key cannot be added, an
+// *AddLUKS2ContainerRecoveryKeysError error is returned, and the returned keyslot
+// numbers are those of the keys that were added successfully before the failure.
+func AddLUKS2ContainerRecoveryKeys(devicePath string, existingKey DiskUnlockKey, keys []LUKS2ContainerRecoveryKeyslot, options *AddLUKS2ContainerRecoveryKeyOptions) ([]int, error) {
+	if options == nil {
+		options = &AddLUKS2ContainerRecoveryKeyOptions{
+			Slot:     LUKS2AnyKeyslot,
+			Priority: LUKS2KeyslotPriorityNormal}
+	}
+
+	if len(keys) > 1 && options.Slot != LUKS2AnyKeyslot {
+		return nil, errors.New("a specific keyslot cannot be requested when adding more than one recovery key")
+	}
+
+	luksKDFOptions, err := options.luksKDFOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		name := key.Name
+		if name == "" {
+			name = defaultRecoveryKeyslotName
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate keyslot name %q", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+	for _, name := range names {
+		if _, _, exists := view.TokenByName(name); exists {
+			return nil, fmt.Errorf("the name %q is already in use", name)
+		}
+	}
+
+	var slots []int
+	for i, key := range keys {
+		slot, err := addLUKS2ContainerKey(devicePath, names[i], existingKey, key.Key[:], luksKDFOptions, newRecoveryToken, options.Slot, options.Priority, options.Progress,
+			newLUKS2CommandOptions(options.CryptsetupPath))
+		if err != nil {
+			return slots, &AddLUKS2ContainerRecoveryKeysError{Name: names[i], Added: names[:i], err: err}
+		}
+		slots = append(slots, slot)
+	}
+
+	return slots, nil
+}
+
+// ReformatLUKS2ContainerOptions provides options to ReformatLUKS2Container.
+type ReformatLUKS2ContainerOptions struct {
+	// InitializeOptions are the options used to initialize the new
+	// container, which may specify a different metadata size or cipher
+	// to the existing container. If its HeaderPath field is set, the new
+	// header will be detached and stored at the specified path.
+	InitializeOptions *InitializeLUKS2ContainerOptions
+
+	// CurrentHeaderPath is the path of the detached header of the
+	// existing container, used to verify the supplied keys before
+	// reformatting. If this is empty, the existing header is read from
+	// the device being reformatted.
+	CurrentHeaderPath string
+
+	// RecoveryKeyslotName is the name of the recovery keyslot created
+	// on the new container. If this is empty, "default-recovery" is
+	// used.
+	RecoveryKeyslotName string
+
+	// RecoveryKDFOptions specifies the KDF options for the recovery
+	// keyslot created on the new container. If this is nil, the
+	// defaults are used.
+	RecoveryKDFOptions *KDFOptions
+}
+
+// ReformatLUKS2Container reinitializes the LUKS2 container at the specified
+// path with a new header, which may have different options to the existing
+// one, and then adds the supplied key and recovery key to it. This is
+// equivalent to calling InitializeLUKS2Container with the supplied key
+// followed by AddLUKS2ContainerRecoveryKey with the supplied recovery key,
+// so KeyData objects that protect the supplied key remain usable with the
+// new container, although they will need to be saved to the new keyslot
+// using LUKS2KeyDataWriter.
+//
+// Before making any changes, the supplied key and recovery key are both
+// tested against the existing container. If either of them cannot unlock
+// it, an error is returned and the container is not modified. The
+// CryptsetupPath field of InitializeOptions applies to every step,
+// including these checks.
+//
+// WARNING: This function is destructive. The new container has a new master
+// key, so any data contained inside of the existing container will be
+// irretrievable afterwards. Any data that needs to be retained must be backed
+// up first and restored once the new container has been activated.
+func ReformatLUKS2Container(devicePath, label string, key DiskUnlockKey, recoveryKey RecoveryKey, options *ReformatLUKS2ContainerOptions) error {
 	if options == nil {
-		options = &KDFOptions{}
+		options = &ReformatLUKS2ContainerOptions{}
+	}
+
+	currentHeaderPath := devicePath
+	if options.CurrentHeaderPath != "" {
+		currentHeaderPath = options.CurrentHeaderPath
+	}
+
+	for _, k := range []struct {
+		name string
+		key  []byte
+	}{
+		{name: "key", key: key},
+		{name: "recovery key", key: recoveryKey[:]},
+	} {
+		switch err := luks2TestKey(currentHeaderPath, luks2.AnySlot, k.key, options.InitializeOptions.luks2CommandOptions()); {
+		case err == luks2.ErrIncorrectKey:
+			return fmt.Errorf("the supplied %s cannot unlock the existing container", k.name)
+		case err != nil:
+			return xerrors.Errorf("cannot test %s: %w", k.name, err)
+		}
+	}
+
+	initOptions := options.InitializeOptions.withDefaults()
+	// The existing container has been checked above.
+	initOptions.RefuseExisting = false
+	if err := InitializeLUKS2Container(devicePath, label, key, initOptions); err != nil {
+		return xerrors.Errorf("cannot initialize new container: %w", err)
+	}
+
+	headerPath := devicePath
+	if initOptions.HeaderPath != "" {
+		headerPath = initOptions.HeaderPath
+	}
+
+	if _, err := AddLUKS2ContainerRecoveryKeyWithOptions(headerPath, options.RecoveryKeyslotName, key, recoveryKey, &AddLUKS2ContainerRecoveryKeyOptions{
+		KDFOptions:     options.RecoveryKDFOptions,
+		Slot:           LUKS2AnyKeyslot,
+		Priority:       LUKS2KeyslotPriorityNormal,
+		CryptsetupPath: initOptions.CryptsetupPath}); err != nil {
+		return xerrors.Errorf("cannot add recovery key to new container: %w", err)
 	}
 
-	return addLUKS2ContainerKey(devicePath, keyslotName, existingKey, recoveryKey[:], options, func(base *luksview.TokenBase) luks2.Token {
-		return &luksview.RecoveryToken{TokenBase: *base}
-	}, luks2.SlotPriorityNormal)
+	return nil
 }
 
 // ListLUKS2ContainerRecoveryKeyNames lists the names of keyslots on the specified
@@ -815,33 +3222,86 @@ func ListLUKS2ContainerRecoveryKeyNames(devicePath string) ([]string, error) {
 	return listLUKS2ContainerKeyNames(devicePath, luksview.RecoveryTokenType)
 }
 
-// DeleteLUKS2ContainerKey deletes the keyslot with the specified name from the
-// LUKS2 container at the specified path. An existing key associated with a different
-// keyslot must be supplied. This will return an error if the container only has a
-// single keyslot remaining.
-func DeleteLUKS2ContainerKey(devicePath, keyslotName string, existingKey DiskUnlockKey) error {
+// LUKS2KeyslotPriority describes the priority of a LUKS2 keyslot.
+type LUKS2KeyslotPriority = luks2.SlotPriority
+
+const (
+	// LUKS2KeyslotPriorityIgnore indicates that cryptsetup will not use
+	// the keyslot unless it is explicitly requested.
+	LUKS2KeyslotPriorityIgnore = luks2.SlotPriorityIgnore
+
+	// LUKS2KeyslotPriorityNormal is the default keyslot priority.
+	LUKS2KeyslotPriorityNormal = luks2.SlotPriorityNormal
+
+	// LUKS2KeyslotPriorityHigh indicates that cryptsetup will try the
+	// keyslot before any keyslots with a normal priority.
+	LUKS2KeyslotPriorityHigh = luks2.SlotPriorityHigh
+)
+
+// LUKS2KeyslotInfo describes an active keyslot on a LUKS2 container.
+type LUKS2KeyslotInfo struct {
+	Slot     int                  // The keyslot number
+	Priority LUKS2KeyslotPriority // The priority of the keyslot
+}
+
+// ListLUKS2ContainerKeyslots returns information about the active keyslots
+// on the LUKS2 container at the specified path, sorted by keyslot number.
+// This includes keyslots that aren't associated with a named key.
+func ListLUKS2ContainerKeyslots(devicePath string) ([]LUKS2KeyslotInfo, error) {
 	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
 	if err != nil {
-		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+		return nil, xerrors.Errorf("cannot obtain LUKS header view: %w", err)
 	}
 
-	token, id, exists := view.TokenByName(keyslotName)
-	if !exists {
-		return errors.New("no key with the specified name exists")
+	keyslots := []LUKS2KeyslotInfo{}
+	for _, slot := range view.UsedKeyslots() {
+		priority, _ := view.KeyslotPriority(slot)
+		keyslots = append(keyslots, LUKS2KeyslotInfo{Slot: slot, Priority: priority})
+	}
+
+	return keyslots, nil
+}
+
+// TestLUKS2ContainerKey tests whether the supplied key can unlock any keyslot
+// on the LUKS2 container at the specified path, without activating the
+// container. This returns false with a nil error if the key is incorrect, and
+// an error if the key could not be tested because of some other problem, such
+// as the device not being accessible.
+func TestLUKS2ContainerKey(devicePath string, key []byte) (bool, error) {
+	return TestLUKS2ContainerKeyWithOptions(devicePath, key, nil)
+}
+
+// TestLUKS2ContainerKeyWithOptions is the same as TestLUKS2ContainerKey, but
+// permits the caller to choose the cryptsetup binary.
+func TestLUKS2ContainerKeyWithOptions(devicePath string, key []byte, options *LUKS2CommandOptions) (bool, error) {
+	switch err := luks2TestKey(devicePath, luks2.AnySlot, key, options.luks2CommandOptions()); {
+	case err == luks2.ErrIncorrectKey:
+		return false, nil
+	case err != nil:
+		return false, xerrors.Errorf("cannot test key: %w", err)
 	}
 
+	return true, nil
+}
+
+// ErrLastLUKS2ContainerKeyslot is returned from DeleteLUKS2ContainerKey and
+// DeleteLUKS2ContainerRecoveryKeyslot when attempting to delete the last
+// remaining named keyslot from a LUKS2 container.
+var ErrLastLUKS2ContainerKeyslot = errors.New("cannot kill last remaining slot")
+
+func deleteLUKS2ContainerKey(devicePath string, view *luksview.View, token luksview.NamedToken, id int, existingKey DiskUnlockKey, cmdOptions *luks2.CommandOptions) error {
 	if len(view.TokenNames()) == 1 {
 		// This is stricter than not permitting the deletion of the last keyslot
 		// - it intentionally does not permit deleting the last secboot named
 		// keyslot, even if the container has other keyslots that might have
 		// been created outside of this package.
-		return errors.New("cannot kill last remaining slot")
+		return ErrLastLUKS2ContainerKeyslot
 	}
 
-	removeOrphanedTokens(devicePath, view)
+	removeOrphanedTokens(devicePath, view, cmdOptions)
 
 	slot := token.Keyslots()[0]
-	if err := luks2KillSlot(devicePath, slot, existingKey); err != nil {
+	if err := luks2KillSlot(devicePath, slot, existingKey, cmdOptions); err != nil {
 		return xerrors.Errorf("cannot kill existing slot %d: %w", slot, err)
 	}
 
@@ -849,22 +3309,180 @@ func DeleteLUKS2ContainerKey(devicePath, keyslotName string, existingKey DiskUnl
 	// that we can identify it as orphaned and complete the transaction in
 	// the future if we are interrupted between KillSlot and RemoveToken.
 
-	if err := luks2RemoveToken(devicePath, id); err != nil {
+	if err := luks2RemoveToken(devicePath, id, cmdOptions); err != nil {
 		return xerrors.Errorf("cannot remove existing token %d: %w", id, err)
 	}
 
 	return nil
 }
 
+// DeleteLUKS2ContainerKey deletes the keyslot with the specified name from the
+// LUKS2 container at the specified path. An existing key associated with a different
+// keyslot must be supplied. This will return ErrLastLUKS2ContainerKeyslot if the
+// container only has a single keyslot remaining.
+func DeleteLUKS2ContainerKey(devicePath, keyslotName string, existingKey DiskUnlockKey) error {
+	return DeleteLUKS2ContainerKeyWithOptions(devicePath, keyslotName, existingKey, nil)
+}
+
+// DeleteLUKS2ContainerKeyWithOptions is the same as DeleteLUKS2ContainerKey,
+// but permits the caller to choose the cryptsetup binary.
+func DeleteLUKS2ContainerKeyWithOptions(devicePath, keyslotName string, existingKey DiskUnlockKey, options *LUKS2CommandOptions) error {
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	if view.ReencryptionInProgress() {
+		return &LUKS2ReencryptionInProgressError{DevicePath: devicePath}
+	}
+
+	token, id, exists := view.TokenByName(keyslotName)
+	if !exists {
+		return errors.New("no key with the specified name exists")
+	}
+
+	return deleteLUKS2ContainerKey(devicePath, view, token, id, existingKey, options.luks2CommandOptions())
+}
+
+// DeleteLUKS2ContainerRecoveryKeyslot deletes the recovery keyslot with the
+// specified keyslot number from the LUKS2 container at the specified path. This
+// is an alternative to DeleteLUKS2ContainerKey for callers that identify keyslots
+// by number, eg, from the output of ListLUKS2ContainerKeyslots. The keyslot must
+// have been created with AddLUKS2ContainerRecoveryKey.
+//
+// An existing key associated with a different keyslot must be supplied. This will
+// return ErrLastLUKS2ContainerKeyslot if the container only has a single keyslot
+// remaining.
+func DeleteLUKS2ContainerRecoveryKeyslot(devicePath string, slot int, existingKey DiskUnlockKey) error {
+	return DeleteLUKS2ContainerRecoveryKeyslotWithOptions(devicePath, slot, existingKey, nil)
+}
+
+// DeleteLUKS2ContainerRecoveryKeyslotWithOptions is the same as
+// DeleteLUKS2ContainerRecoveryKeyslot, but permits the caller to choose the
+// cryptsetup binary.
+func DeleteLUKS2ContainerRecoveryKeyslotWithOptions(devicePath string, slot int, existingKey DiskUnlockKey, options *LUKS2CommandOptions) error {
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	if view.ReencryptionInProgress() {
+		return &LUKS2ReencryptionInProgressError{DevicePath: devicePath}
+	}
+
+	for _, name := range view.TokenNames() {
+		token, id, inUse := view.TokenByName(name)
+		if !inUse || token.Keyslots()[0] != slot {
+			continue
+		}
+		if token.Type() != luksview.RecoveryTokenType {
+			return fmt.Errorf("keyslot %d is not a recovery keyslot", slot)
+		}
+
+		return deleteLUKS2ContainerKey(devicePath, view, token, id, existingKey, options.luks2CommandOptions())
+	}
+
+	return fmt.Errorf("no recovery key exists in keyslot %d", slot)
+}
+
+// PruneLUKS2ContainerRecoveryKeyslots removes recovery keyslots from the LUKS2
+// container at the specified path that cannot be unlocked with any of the
+// supplied known recovery keys. Only keyslots created with
+// AddLUKS2ContainerRecoveryKey are considered - keyslots for platform protected
+// keys and keyslots created outside of this package are never removed. An existing
+// key associated with a keyslot that is not going to be removed must be supplied.
+//
+// If dryRun is true, the container is not modified and this function just returns
+// the names of the keyslots that would be removed.
+//
+// At least one known recovery key must be supplied. To ensure that the container
+// always retains a recovery keyslot that is known to be usable, this will return an
+// error without removing any keyslots if none of the supplied known keys can unlock
+// any of the recovery keyslots.
+//
+// The names of the removed keyslots are returned.
+func PruneLUKS2ContainerRecoveryKeyslots(devicePath string, knownKeys []RecoveryKey, existingKey DiskUnlockKey, dryRun bool) ([]string, error) {
+	return PruneLUKS2ContainerRecoveryKeyslotsWithOptions(devicePath, knownKeys, existingKey, dryRun, nil)
+}
+
+// PruneLUKS2ContainerRecoveryKeyslotsWithOptions is the same as
+// PruneLUKS2ContainerRecoveryKeyslots, but permits the caller to choose the
+// cryptsetup binary used to test the known keys and to remove keyslots.
+func PruneLUKS2ContainerRecoveryKeyslotsWithOptions(devicePath string, knownKeys []RecoveryKey, existingKey DiskUnlockKey, dryRun bool, options *LUKS2CommandOptions) ([]string, error) {
+	if len(knownKeys) == 0 {
+		return nil, errors.New("no known recovery keys supplied")
+	}
+
+	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain LUKS header view: %w", err)
+	}
+
+	if view.ReencryptionInProgress() {
+		return nil, &LUKS2ReencryptionInProgressError{DevicePath: devicePath}
+	}
+
+	var names []string
+	retained := false
+	for _, name := range view.TokenNames() {
+		token, _, _ := view.TokenByName(name)
+		if token.Type() != luksview.RecoveryTokenType {
+			continue
+		}
+
+		slot := token.Keyslots()[0]
+		known := false
+		for _, key := range knownKeys {
+			err := luks2TestKey(devicePath, slot, key[:], options.luks2CommandOptions())
+			if err == nil {
+				known = true
+				break
+			}
+			if err != luks2.ErrIncorrectKey {
+				return nil, xerrors.Errorf("cannot test key for slot %d: %w", slot, err)
+			}
+		}
+		if known {
+			retained = true
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	if !retained {
+		return nil, errors.New("none of the supplied known recovery keys can unlock a recovery keyslot")
+	}
+
+	if dryRun {
+		return names, nil
+	}
+
+	for i, name := range names {
+		if err := DeleteLUKS2ContainerKeyWithOptions(devicePath, name, existingKey, options); err != nil {
+			return names[:i], xerrors.Errorf("cannot delete keyslot %s: %w", name, err)
+		}
+	}
+
+	return names, nil
+}
+
 // RenameLUKS2Container key renames the keyslot with the specified oldName on
 // the LUKS2 container at the specified path.
 func RenameLUKS2ContainerKey(devicePath, oldName, newName string) error {
+	return RenameLUKS2ContainerKeyWithOptions(devicePath, oldName, newName, nil)
+}
+
+// RenameLUKS2ContainerKeyWithOptions is the same as RenameLUKS2ContainerKey,
+// but permits the caller to choose the cryptsetup binary.
+func RenameLUKS2ContainerKeyWithOptions(devicePath, oldName, newName string, options *LUKS2CommandOptions) error {
 	view, err := newLUKSView(devicePath, luks2.LockModeBlocking)
 	if err != nil {
 		return xerrors.Errorf("cannot obtain LUKS header view: %w", err)
 	}
 
-	removeOrphanedTokens(devicePath, view)
+	cmdOptions := options.luks2CommandOptions()
+	removeOrphanedTokens(devicePath, view, cmdOptions)
 
 	token, id, exists := view.TokenByName(oldName)
 	if !exists {
@@ -894,9 +3512,104 @@ func RenameLUKS2ContainerKey(devicePath, oldName, newName string) error {
 		return errors.New("cannot rename key with unexpected token type")
 	}
 
-	if err := luks2ImportToken(devicePath, newToken, &luks2.ImportTokenOptions{Id: id, Replace: true}); err != nil {
+	importOptions := &luks2.ImportTokenOptions{Id: id, Replace: true}
+	if cmdOptions != nil {
+		importOptions.CommandOptions = *cmdOptions
+	}
+	if err := luks2ImportToken(devicePath, newToken, importOptions); err != nil {
 		return xerrors.Errorf("cannot import new token: %w", err)
 	}
 
 	return nil
 }
+
+// BackupLUKS2Header writes a copy of the header of the LUKS2 container at the
+// specified path to outFile. The backup includes the keyslots area, and so it
+// can be used to recover access to the container with any key that was valid
+// at the time that the backup was made. The backup file must not already
+// exist.
+//
+// The backup file should be protected appropriately, as removing a keyslot from
+// the container doesn't prevent the associated key from being used with the
+// backup.
+func BackupLUKS2Header(devicePath, outFile string) error {
+	return BackupLUKS2HeaderWithOptions(devicePath, outFile, nil)
+}
+
+// BackupLUKS2HeaderWithOptions is the same as BackupLUKS2Header, but permits
+// the caller to choose the cryptsetup binary.
+func BackupLUKS2HeaderWithOptions(devicePath, outFile string, options *LUKS2CommandOptions) error {
+	if _, err := luks2.ReadHeader(devicePath, luks2.LockModeBlocking); err != nil {
+		var e *luks2.NoHeaderError
+		if xerrors.As(err, &e) {
+			return &NotLUKS2ContainerError{DevicePath: devicePath}
+		}
+		return xerrors.Errorf("cannot read header: %w", err)
+	}
+
+	if err := luks2BackupHeader(devicePath, outFile, options.luks2CommandOptions()); err != nil {
+		return xerrors.Errorf("cannot backup header: %w", err)
+	}
+
+	return nil
+}
+
+// RestoreLUKS2HeaderOptions provides the options for RestoreLUKS2Header.
+type RestoreLUKS2HeaderOptions struct {
+	// Force permits the header to be restored even if the backup has
+	// a different UUID to the existing header, or if the existing
+	// header cannot be read.
+	Force bool
+
+	// CryptsetupPath is the path of the cryptsetup binary used to
+	// restore the header. If this is empty, cryptsetup is found via
+	// PATH.
+	CryptsetupPath string
+}
+
+// LUKS2HeaderUUIDMismatchError is returned from RestoreLUKS2Header if the
+// header backup has a different UUID to the existing header.
+type LUKS2HeaderUUIDMismatchError struct {
+	UUID       string // The UUID of the existing header
+	BackupUUID string // The UUID of the header backup
+}
+
+func (e *LUKS2HeaderUUIDMismatchError) Error() string {
+	return fmt.Sprintf("header backup UUID (%s) does not match the UUID of the existing header (%s)", e.BackupUUID, e.UUID)
+}
+
+// RestoreLUKS2Header replaces the header of the LUKS2 container at the specified
+// path with the one contained in inFile, which should have been created previously
+// with BackupLUKS2Header. This replaces all of the container's keyslots with those
+// contained in the backup.
+//
+// To avoid accidentally overwriting the keyslots of the wrong container, this will
+// fail with a *LUKS2HeaderUUIDMismatchError error if the backup has a different UUID
+// to the existing header, or with an error if the existing header cannot be read,
+// unless the Force field of options is set.
+func RestoreLUKS2Header(devicePath, inFile string, options *RestoreLUKS2HeaderOptions) error {
+	if options == nil {
+		options = &RestoreLUKS2HeaderOptions{}
+	}
+
+	backup, err := luks2.ReadHeader(inFile, luks2.LockModeBlocking)
+	if err != nil {
+		return xerrors.Errorf("cannot read header backup: %w", err)
+	}
+
+	if !options.Force {
+		hdr, err := luks2.ReadHeader(devicePath, luks2.LockModeBlocking)
+		if err != nil {
+			return xerrors.Errorf("cannot read existing header: %w", err)
+		}
+		if hdr.UUID != backup.UUID {
+			return &LUKS2HeaderUUIDMismatchError{UUID: hdr.UUID, BackupUUID: backup.UUID}
+		}
+	}
+
+	if err := luks2RestoreHeader(devicePath, inFile, newLUKS2CommandOptions(options.CryptsetupPath)); err != nil {
+		return xerrors.Errorf("cannot restore header: %w", err)
+	}
+
+	return nil
+}
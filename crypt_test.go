@@ -21,21 +21,30 @@ package secboot_test
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	snapd_testutil "github.com/snapcore/snapd/testutil"
 
+	"golang.org/x/xerrors"
+
 	. "gopkg.in/check.v1"
 
 	. "github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/keyring"
 	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/luks2/luks2test"
 	"github.com/snapcore/secboot/internal/luksview"
@@ -43,6 +52,26 @@ import (
 	"github.com/snapcore/secboot/internal/testutil"
 )
 
+// cancelingAuthRequestor is an AuthRequestor that cancels the associated
+// context on each request, to simulate a deadline expiring whilst the user
+// is being asked for a credential.
+type cancelingAuthRequestor struct {
+	cancel   context.CancelFunc
+	requests int
+}
+
+func (r *cancelingAuthRequestor) RequestPassphrase(volumeName, sourceDevicePath string) (string, error) {
+	r.requests += 1
+	r.cancel()
+	return "", errors.New("cancelled")
+}
+
+func (r *cancelingAuthRequestor) RequestRecoveryKey(volumeName, sourceDevicePath string) (RecoveryKey, error) {
+	r.requests += 1
+	r.cancel()
+	return RecoveryKey{}, errors.New("cancelled")
+}
+
 type cryptTestBase struct{}
 
 func (ctb *cryptTestBase) newPrimaryKey() []byte {
@@ -71,6 +100,23 @@ type mockAuthRequestor struct {
 	}
 }
 
+// noInputAuthRequestor is an AuthRequestor that never obtains any input, like
+// systemd-ask-password when there is no tty or password agent.
+type noInputAuthRequestor struct {
+	passphraseRequests  int
+	recoveryKeyRequests int
+}
+
+func (r *noInputAuthRequestor) RequestPassphrase(volumeName, sourceDevicePath string) (string, error) {
+	r.passphraseRequests += 1
+	return "", ErrAuthRequestNoInput
+}
+
+func (r *noInputAuthRequestor) RequestRecoveryKey(volumeName, sourceDevicePath string) (RecoveryKey, error) {
+	r.recoveryKeyRequests += 1
+	return RecoveryKey{}, ErrAuthRequestNoInput
+}
+
 func (r *mockAuthRequestor) RequestPassphrase(volumeName, sourceDevicePath string) (string, error) {
 	r.passphraseRequests = append(r.passphraseRequests, struct {
 		volumeName       string
@@ -121,10 +167,38 @@ func (r *mockAuthRequestor) RequestRecoveryKey(volumeName, sourceDevicePath stri
 	}
 }
 
+// mockPromptAuthRequestor is a mockAuthRequestor that also implements
+// PromptAuthRequestor and records the prompt supplied with each request.
+type mockPromptAuthRequestor struct {
+	mockAuthRequestor
+	passphrasePrompts  []*AuthRequestPrompt
+	recoveryKeyPrompts []*AuthRequestPrompt
+}
+
+func (r *mockPromptAuthRequestor) RequestPassphraseWithContext(ctx context.Context, volumeName, sourceDevicePath string) (string, error) {
+	return r.RequestPassphraseWithPrompt(ctx, volumeName, sourceDevicePath, nil)
+}
+
+func (r *mockPromptAuthRequestor) RequestRecoveryKeyWithContext(ctx context.Context, volumeName, sourceDevicePath string) (RecoveryKey, error) {
+	return r.RequestRecoveryKeyWithPrompt(ctx, volumeName, sourceDevicePath, nil)
+}
+
+func (r *mockPromptAuthRequestor) RequestPassphraseWithPrompt(ctx context.Context, volumeName, sourceDevicePath string, prompt *AuthRequestPrompt) (string, error) {
+	r.passphrasePrompts = append(r.passphrasePrompts, prompt)
+	return r.RequestPassphrase(volumeName, sourceDevicePath)
+}
+
+func (r *mockPromptAuthRequestor) RequestRecoveryKeyWithPrompt(ctx context.Context, volumeName, sourceDevicePath string, prompt *AuthRequestPrompt) (RecoveryKey, error) {
+	r.recoveryKeyPrompts = append(r.recoveryKeyPrompts, prompt)
+	return r.RequestRecoveryKey(volumeName, sourceDevicePath)
+}
+
 // mockLUKS2Container represents a LUKS2 container and its associated state
 type mockLUKS2Container struct {
-	keyslots map[int][]byte
-	tokens   map[int]luks2.Token
+	keyslots     map[int][]byte
+	priorities   map[int]luks2.SlotPriority
+	tokens       map[int]luks2.Token
+	reencrypting bool
 }
 
 func (c *mockLUKS2Container) ReadHeader() (*luks2.HeaderInfo, error) {
@@ -134,11 +208,18 @@ func (c *mockLUKS2Container) ReadHeader() (*luks2.HeaderInfo, error) {
 			Tokens:   make(map[int]luks2.Token)}}
 
 	for id := range c.keyslots {
-		hdr.Metadata.Keyslots[id] = new(luks2.Keyslot)
+		priority, ok := c.priorities[id]
+		if !ok {
+			priority = luks2.SlotPriorityNormal
+		}
+		hdr.Metadata.Keyslots[id] = &luks2.Keyslot{Priority: priority}
 	}
 	for id, token := range c.tokens {
 		hdr.Metadata.Tokens[id] = token
 	}
+	if c.reencrypting {
+		hdr.Metadata.Config.Requirements = []string{"online-reencrypt-v2"}
+	}
 
 	return hdr, nil
 }
@@ -189,13 +270,18 @@ func (l *mockLUKS2) enableMocks() (restore func()) {
 	var restores []func()
 
 	restores = append(restores, MockLUKS2Activate(l.activate))
+	restores = append(restores, MockLUKS2ActivateWithKeyFile(l.activateWithKeyFile))
+	restores = append(restores, MockLUKS2ActiveVolumeSourceDevice(l.activeVolumeSourceDevice))
 	restores = append(restores, MockLUKS2AddKey(l.addKey))
+	restores = append(restores, MockLUKS2ChangeKey(l.changeKey))
 	restores = append(restores, MockLUKS2Deactivate(l.deactivate))
 	restores = append(restores, MockLUKS2Format(l.format))
 	restores = append(restores, MockLUKS2ImportToken(l.importToken))
+	restores = append(restores, MockLUKS2IsLUKS2(l.isLUKS2))
 	restores = append(restores, MockLUKS2KillSlot(l.killSlot))
 	restores = append(restores, MockLUKS2RemoveToken(l.removeToken))
 	restores = append(restores, MockLUKS2SetSlotPriority(l.setSlotPriority))
+	restores = append(restores, MockLUKS2TestKey(l.testKey))
 	restores = append(restores, MockNewLUKSView(l.newLUKSView))
 
 	return func() {
@@ -205,14 +291,62 @@ func (l *mockLUKS2) enableMocks() (restore func()) {
 	}
 }
 
-func (l *mockLUKS2) activate(volumeName, sourceDevicePath string, key []byte) error {
-	l.operations = append(l.operations, "Activate("+volumeName+","+sourceDevicePath+")")
+func (l *mockLUKS2) activateWithKeyFile(volumeName, sourceDevicePath, keyFilePath string, offset, size int64, options *luks2.ActivateOptions) error {
+	op := fmt.Sprintf("ActivateWithKeyFile(%s,%s,%s,%d,%d", volumeName, sourceDevicePath, keyFilePath, offset, size)
+	headerPath := sourceDevicePath
+	if options != nil && options.HeaderPath != "" {
+		op += "," + options.HeaderPath
+		headerPath = options.HeaderPath
+	}
+	l.operations = append(l.operations, op+")")
+
+	data, err := ioutil.ReadFile(keyFilePath)
+	if err != nil {
+		return err
+	}
+	if offset+size > int64(len(data)) {
+		return errors.New("key file offset and size exceed the length of the file")
+	}
+	key := data[offset : offset+size]
+
+	if _, exists := l.activated[volumeName]; exists {
+		return errors.New("systemd-cryptsetup failed with: exit status 1")
+	}
+
+	dev, ok := l.devices[headerPath]
+	if !ok {
+		return errors.New("systemd-cryptsetup failed with: exit status 1")
+	}
+
+	for _, k := range dev.keyslots {
+		if bytes.Equal(k, key) {
+			l.activated[volumeName] = sourceDevicePath
+			return nil
+		}
+	}
+
+	return errors.New("systemd-cryptsetup failed with: exit status 1")
+}
+
+func (l *mockLUKS2) activate(volumeName, sourceDevicePath string, key []byte, options *luks2.ActivateOptions) error {
+	headerPath := sourceDevicePath
+	switch {
+	case options != nil && len(options.Options) > 0:
+		l.operations = append(l.operations, "Activate("+volumeName+","+sourceDevicePath+","+options.HeaderPath+","+strings.Join(options.Options, ",")+")")
+	case options != nil:
+		l.operations = append(l.operations, "Activate("+volumeName+","+sourceDevicePath+","+options.HeaderPath+")")
+	default:
+		l.operations = append(l.operations, "Activate("+volumeName+","+sourceDevicePath+")")
+	}
+	if options != nil && options.HeaderPath != "" {
+		headerPath = options.HeaderPath
+	}
 
 	if _, exists := l.activated[volumeName]; exists {
 		return errors.New("systemd-cryptsetup failed with: exit status 1")
 	}
 
-	dev, ok := l.devices[sourceDevicePath]
+	dev, ok := l.devices[headerPath]
 	if !ok {
 		return errors.New("systemd-cryptsetup failed with: exit status 1")
 	}
@@ -267,26 +401,45 @@ func (l *mockLUKS2) addKey(devicePath string, existingKey, key []byte, options *
 	return nil
 }
 
-func (l *mockLUKS2) deactivate(volumeName string) error {
+func (l *mockLUKS2) deactivate(volumeName string, options *luks2.DeactivateOptions) error {
 	l.operations = append(l.operations, "Deactivate("+volumeName+")")
 
 	if _, exists := l.activated[volumeName]; !exists {
-		return errors.New("systemd-cryptsetup failed with: exit status 1")
+		return luks2.ErrVolumeNotActive
 	}
 
 	delete(l.activated, volumeName)
 	return nil
 }
 
+func (l *mockLUKS2) activeVolumeSourceDevice(volumeName string) (string, error) {
+	l.operations = append(l.operations, "ActiveVolumeSourceDevice("+volumeName+")")
+
+	sourceDevicePath, exists := l.activated[volumeName]
+	if !exists {
+		return "", luks2.ErrVolumeNotActive
+	}
+	return sourceDevicePath, nil
+}
+
 func (l *mockLUKS2) format(devicePath, label string, key []byte, options *luks2.FormatOptions) error {
 	l.operations = append(l.operations, fmt.Sprint("Format(", devicePath, ",", label, ",", options, ")"))
 
+	if options.HeaderPath != "" {
+		devicePath = options.HeaderPath
+	}
+
 	l.devices[devicePath] = &mockLUKS2Container{
 		keyslots: map[int][]byte{0: key},
 		tokens:   make(map[int]luks2.Token)}
 	return nil
 }
 
+func (l *mockLUKS2) isLUKS2(devicePath string, options *luks2.CommandOptions) (bool, error) {
+	_, ok := l.devices[devicePath]
+	return ok, nil
+}
+
 func (l *mockLUKS2) importToken(devicePath string, token luks2.Token, options *luks2.ImportTokenOptions) error {
 	l.operations = append(l.operations, fmt.Sprint("ImportToken(", devicePath, ",", options, ")"))
 
@@ -316,7 +469,27 @@ func (l *mockLUKS2) importToken(devicePath string, token luks2.Token, options *l
 	return nil
 }
 
-func (l *mockLUKS2) killSlot(devicePath string, slot int, key []byte) error {
+func (l *mockLUKS2) changeKey(devicePath string, slot int, existingKey, key []byte, options *luks2.KDFOptions, cmdOptions *luks2.CommandOptions) error {
+	l.operations = append(l.operations, fmt.Sprint("ChangeKey(", devicePath, ",", slot, ",", options, ")"))
+
+	dev, ok := l.devices[devicePath]
+	if !ok {
+		return errors.New("no container")
+	}
+
+	k, exists := dev.keyslots[slot]
+	if !exists {
+		return errors.New("no slot")
+	}
+	if !bytes.Equal(k, existingKey) {
+		return luks2.ErrIncorrectKey
+	}
+
+	dev.keyslots[slot] = key
+	return nil
+}
+
+func (l *mockLUKS2) killSlot(devicePath string, slot int, key []byte, options *luks2.CommandOptions) error {
 	l.operations = append(l.operations, fmt.Sprint("KillSlot(", devicePath, ",", slot, ")"))
 
 	if slot < 0 {
@@ -353,10 +526,11 @@ func (l *mockLUKS2) killSlot(devicePath string, slot int, key []byte) error {
 	}
 
 	delete(dev.keyslots, slot)
+	delete(dev.priorities, slot)
 	return nil
 }
 
-func (l *mockLUKS2) removeToken(devicePath string, id int) error {
+func (l *mockLUKS2) removeToken(devicePath string, id int, options *luks2.CommandOptions) error {
 	l.operations = append(l.operations, "RemoveToken("+devicePath+","+strconv.Itoa(id)+")")
 
 	dev, ok := l.devices[devicePath]
@@ -372,15 +546,40 @@ func (l *mockLUKS2) removeToken(devicePath string, id int) error {
 	return nil
 }
 
-func (l *mockLUKS2) setSlotPriority(devicePath string, slot int, priority luks2.SlotPriority) error {
+func (l *mockLUKS2) setSlotPriority(devicePath string, slot int, priority luks2.SlotPriority, options *luks2.CommandOptions) error {
 	l.operations = append(l.operations, fmt.Sprint("SetSlotPriority(", devicePath, ",", slot, ",", priority, ")"))
 
-	if _, ok := l.devices[devicePath]; !ok {
+	dev, ok := l.devices[devicePath]
+	if !ok {
 		return errors.New("no container")
 	}
+	if dev.priorities == nil {
+		dev.priorities = make(map[int]luks2.SlotPriority)
+	}
+	dev.priorities[slot] = priority
 	return nil
 }
 
+func (l *mockLUKS2) testKey(devicePath string, slot int, key []byte, options *luks2.CommandOptions) error {
+	l.operations = append(l.operations, fmt.Sprint("TestKey(", devicePath, ",", slot, ")"))
+
+	dev, ok := l.devices[devicePath]
+	if !ok {
+		return errors.New("no container")
+	}
+
+	for i, k := range dev.keyslots {
+		if slot != luks2.AnySlot && i != slot {
+			continue
+		}
+		if bytes.Equal(k, key) {
+			return nil
+		}
+	}
+
+	return luks2.ErrIncorrectKey
+}
+
 func (l *mockLUKS2) newLUKSView(devicePath string, lockMode luks2.LockMode) (*luksview.View, error) {
 	l.operations = append(l.operations, fmt.Sprint("newLUKSView(", devicePath, ",", lockMode, ")"))
 
@@ -492,6 +691,8 @@ type testActivateVolumeWithRecoveryKeyData struct {
 	sourceDevicePath string
 	tries            int
 	keyringPrefix    string
+	recoveryKeyFile  string
+	candidates       []io.Reader
 	authResponses    []interface{}
 	activateTries    int
 }
@@ -500,7 +701,7 @@ func (s *cryptSuite) testActivateVolumeWithRecoveryKey(c *C, data *testActivateV
 	s.addMockKeyslot(data.sourceDevicePath, data.recoveryKey[:])
 
 	authRequestor := &mockAuthRequestor{recoveryKeyResponses: data.authResponses}
-	options := ActivateVolumeOptions{RecoveryKeyTries: data.tries, KeyringPrefix: data.keyringPrefix}
+	options := ActivateVolumeOptions{RecoveryKeyTries: data.tries, RecoveryKeyFile: data.recoveryKeyFile, RecoveryKeyReaders: data.candidates, KeyringPrefix: data.keyringPrefix}
 
 	c.Assert(ActivateVolumeWithRecoveryKey(data.volumeName, data.sourceDevicePath, authRequestor, &options), IsNil)
 
@@ -586,126 +787,825 @@ func (s *cryptSuite) TestActivateVolumeWithRecoveryKey5(c *C) {
 	})
 }
 
-type testParseRecoveryKeyData struct {
-	formatted string
-	expected  []byte
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyNoInput(c *C) {
+	// Test that a request where nothing was entered doesn't consume a try.
+	recoveryKey := s.newRecoveryKey()
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:      recoveryKey,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		tries:            1,
+		authResponses:    []interface{}{ErrAuthRequestNoInput, ErrAuthRequestNoInput, recoveryKey},
+		activateTries:    1,
+	})
 }
 
-func (s *cryptSuite) testParseRecoveryKey(c *C, data *testParseRecoveryKeyData) {
-	k, err := ParseRecoveryKey(data.formatted)
-	c.Check(err, IsNil)
-	c.Check(k[:], DeepEquals, data.expected)
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyNoInputLimit(c *C) {
+	// Test that requests stop after too many consecutive requests where
+	// nothing was entered.
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := new(noInputAuthRequestor)
+	err := ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &ActivateVolumeOptions{RecoveryKeyTries: 3})
+	c.Check(err, ErrorMatches, "cannot obtain recovery key: giving up after 5 consecutive requests: no credential was supplied")
+	c.Check(err, testutil.ErrorIs, ErrAuthRequestNoInput)
+	c.Check(authRequestor.recoveryKeyRequests, Equals, 5)
+	c.Check(s.luks2.operations, HasLen, 0)
 }
 
-func (s *cryptSuite) TestParseRecoveryKey1(c *C) {
-	s.testParseRecoveryKey(c, &testParseRecoveryKeyData{
-		formatted: "00000-00000-00000-00000-00000-00000-00000-00000",
-		expected:  testutil.DecodeHexString(c, "00000000000000000000000000000000"),
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyFile(c *C) {
+	// Test that the recovery key is read from the supplied file
+	recoveryKey := s.newRecoveryKey()
+	path := filepath.Join(c.MkDir(), "recovery-key")
+	c.Assert(ioutil.WriteFile(path, []byte(recoveryKey.String()+"\n"), 0600), IsNil)
+
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:      recoveryKey,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		tries:            1,
+		recoveryKeyFile:  path,
+		activateTries:    1,
 	})
 }
 
-func (s *cryptSuite) TestParseRecoveryKey2(c *C) {
-	s.testParseRecoveryKey(c, &testParseRecoveryKeyData{
-		formatted: "61665-00531-54469-09783-47273-19035-40077-28287",
-		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyFileChecksumMismatch(c *C) {
+	// Test that a recovery key with incorrect check digits is rejected
+	// without attempting activation with it.
+	// The check digits are never "00".
+	recoveryKey := s.newRecoveryKey()
+	formatted := recoveryKey.String() + "-00"
+	path := filepath.Join(c.MkDir(), "recovery-key")
+	c.Assert(ioutil.WriteFile(path, []byte(formatted), 0600), IsNil)
+
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:      recoveryKey,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		tries:            2,
+		recoveryKeyFile:  path,
+		authResponses:    []interface{}{recoveryKey},
+		activateTries:    1,
 	})
 }
 
-func (s *cryptSuite) TestParseRecoveryKey3(c *C) {
-	s.testParseRecoveryKey(c, &testParseRecoveryKeyData{
-		formatted: "6166500531544690978347273190354007728287",
-		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyFileMissing(c *C) {
+	// Test that a missing recovery key file doesn't consume a try
+	recoveryKey := s.newRecoveryKey()
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:      recoveryKey,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		tries:            1,
+		recoveryKeyFile:  filepath.Join(c.MkDir(), "recovery-key"),
+		authResponses:    []interface{}{recoveryKey},
+		activateTries:    1,
 	})
 }
 
-type testParseRecoveryKeyErrorHandlingData struct {
-	formatted      string
-	errChecker     Checker
-	errCheckerArgs []interface{}
-}
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyFileEmpty(c *C) {
+	// Test that an empty recovery key file doesn't consume a try
+	recoveryKey := s.newRecoveryKey()
+	path := filepath.Join(c.MkDir(), "recovery-key")
+	c.Assert(ioutil.WriteFile(path, nil, 0600), IsNil)
 
-func (s *cryptSuite) testParseRecoveryKeyErrorHandling(c *C, data *testParseRecoveryKeyErrorHandlingData) {
-	_, err := ParseRecoveryKey(data.formatted)
-	c.Check(err, data.errChecker, data.errCheckerArgs...)
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:      recoveryKey,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		tries:            1,
+		recoveryKeyFile:  path,
+		authResponses:    []interface{}{recoveryKey},
+		activateTries:    1,
+	})
 }
 
-func (s *cryptSuite) TestParseRecoveryKeyErrorHandling1(c *C) {
-	s.testParseRecoveryKeyErrorHandling(c, &testParseRecoveryKeyErrorHandlingData{
-		formatted:      "00000-1234",
-		errChecker:     ErrorMatches,
-		errCheckerArgs: []interface{}{"incorrectly formatted: insufficient characters"},
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyFileIncorrect(c *C) {
+	// Test that the recovery key is requested if the one in the supplied file is incorrect
+	recoveryKey := s.newRecoveryKey()
+	path := filepath.Join(c.MkDir(), "recovery-key")
+	c.Assert(ioutil.WriteFile(path, []byte(RecoveryKey{}.String()), 0600), IsNil)
+
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:      recoveryKey,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		tries:            2,
+		recoveryKeyFile:  path,
+		authResponses:    []interface{}{recoveryKey},
+		activateTries:    2,
 	})
 }
 
-func (s *cryptSuite) TestParseRecoveryKeyErrorHandling2(c *C) {
-	s.testParseRecoveryKeyErrorHandling(c, &testParseRecoveryKeyErrorHandlingData{
-		formatted:      "00000-123bc",
-		errChecker:     ErrorMatches,
-		errCheckerArgs: []interface{}{"incorrectly formatted: strconv.ParseUint: parsing \"123bc\": invalid syntax"},
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyCandidates(c *C) {
+	// Test that pre-supplied candidate recovery keys are tried without
+	// consuming a try, skipping those that are invalid or incorrect.
+	recoveryKey := s.newRecoveryKey()
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:      recoveryKey,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		tries:            1,
+		candidates: []io.Reader{
+			strings.NewReader("1234"),
+			strings.NewReader(s.newRecoveryKey().String()),
+			strings.NewReader(recoveryKey.String() + "\n"),
+		},
+		activateTries: 2,
 	})
 }
 
-func (s *cryptSuite) TestParseRecoveryKeyErrorHandling3(c *C) {
-	s.testParseRecoveryKeyErrorHandling(c, &testParseRecoveryKeyErrorHandlingData{
-		formatted:      "00000-00000-00000-00000-00000-00000-00000-00000-00000",
-		errChecker:     ErrorMatches,
-		errCheckerArgs: []interface{}{"incorrectly formatted: too many characters"},
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyCandidatesIncorrect(c *C) {
+	// Test that the recovery key is requested if none of the candidates
+	// are correct, and that the candidates don't consume any tries.
+	recoveryKey := s.newRecoveryKey()
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:      recoveryKey,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		tries:            1,
+		candidates: []io.Reader{
+			strings.NewReader(s.newRecoveryKey().String()),
+			strings.NewReader(s.newRecoveryKey().String()),
+		},
+		authResponses: []interface{}{recoveryKey},
+		activateTries: 3,
 	})
 }
 
-func (s *cryptSuite) TestParseRecoveryKeyErrorHandling4(c *C) {
-	s.testParseRecoveryKeyErrorHandling(c, &testParseRecoveryKeyErrorHandlingData{
-		formatted:      "-00000-00000-00000-00000-00000-00000-00000-00000",
-		errChecker:     ErrorMatches,
-		errCheckerArgs: []interface{}{"incorrectly formatted: strconv.ParseUint: parsing \"-0000\": invalid syntax"},
-	})
+type testActivateVolumeWithRecoveryKeyResultData struct {
+	recoveryKey     RecoveryKey
+	tries           int
+	recoveryKeyFile string
+	candidates      []io.Reader
+	authResponses   []interface{}
+	expected        *RecoveryKeyActivationResult
 }
 
-func (s *cryptSuite) TestParseRecoveryKeyErrorHandling5(c *C) {
-	s.testParseRecoveryKeyErrorHandling(c, &testParseRecoveryKeyErrorHandlingData{
-		formatted:      "00000-00000-00000-00000-00000-00000-00000-00000-",
-		errChecker:     ErrorMatches,
-		errCheckerArgs: []interface{}{"incorrectly formatted: too many characters"},
-	})
+func (s *cryptSuite) testActivateVolumeWithRecoveryKeyResult(c *C, data *testActivateVolumeWithRecoveryKeyResultData) {
+	s.addMockKeyslot("/dev/sda1", data.recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: data.authResponses}
+	options := &ActivateVolumeOptions{RecoveryKeyTries: data.tries, RecoveryKeyFile: data.recoveryKeyFile, RecoveryKeyReaders: data.candidates}
+
+	result, err := ActivateVolumeWithRecoveryKeyResult("data", "/dev/sda1", authRequestor, options)
+	c.Assert(err, IsNil)
+	c.Check(result, DeepEquals, data.expected)
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
 }
 
-type testRecoveryKeyStringifyData struct {
-	key      []byte
-	expected string
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyResultReader(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.testActivateVolumeWithRecoveryKeyResult(c, &testActivateVolumeWithRecoveryKeyResultData{
+		recoveryKey: recoveryKey,
+		tries:       1,
+		candidates: []io.Reader{
+			strings.NewReader(s.newRecoveryKey().String()),
+			strings.NewReader(recoveryKey.String()),
+		},
+		expected: &RecoveryKeyActivationResult{Source: RecoveryKeySourceReader}})
 }
 
-func (s *cryptSuite) testRecoveryKeyStringify(c *C, data *testRecoveryKeyStringifyData) {
-	var key RecoveryKey
-	copy(key[:], data.key)
-	c.Check(key.String(), Equals, data.expected)
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyResultFile(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	path := filepath.Join(c.MkDir(), "recovery-key")
+	c.Assert(ioutil.WriteFile(path, []byte(recoveryKey.String()), 0600), IsNil)
+
+	s.testActivateVolumeWithRecoveryKeyResult(c, &testActivateVolumeWithRecoveryKeyResultData{
+		recoveryKey:     recoveryKey,
+		tries:           1,
+		recoveryKeyFile: path,
+		expected:        &RecoveryKeyActivationResult{Source: RecoveryKeySourceFile, TriesUsed: 1}})
 }
 
-func (s *cryptSuite) TestRecoveryKeyStringify1(c *C) {
-	s.testRecoveryKeyStringify(c, &testRecoveryKeyStringifyData{
-		expected: "00000-00000-00000-00000-00000-00000-00000-00000",
-	})
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyResultAuthRequestor(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.testActivateVolumeWithRecoveryKeyResult(c, &testActivateVolumeWithRecoveryKeyResultData{
+		recoveryKey:   recoveryKey,
+		tries:         3,
+		authResponses: []interface{}{recoveryKey},
+		expected:      &RecoveryKeyActivationResult{Source: RecoveryKeySourceAuthRequestor, TriesUsed: 1}})
 }
 
-func (s *cryptSuite) TestRecoveryKeyStringify2(c *C) {
-	s.testRecoveryKeyStringify(c, &testRecoveryKeyStringifyData{
-		key:      testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
-		expected: "61665-00531-54469-09783-47273-19035-40077-28287",
-	})
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyResultAuthRequestorAfterFile(c *C) {
+	// Test that the tries consumed by an incorrect key in the recovery
+	// key file and an incorrect key from the AuthRequestor are counted.
+	recoveryKey := s.newRecoveryKey()
+	path := filepath.Join(c.MkDir(), "recovery-key")
+	c.Assert(ioutil.WriteFile(path, []byte(s.newRecoveryKey().String()), 0600), IsNil)
+
+	s.testActivateVolumeWithRecoveryKeyResult(c, &testActivateVolumeWithRecoveryKeyResultData{
+		recoveryKey:     recoveryKey,
+		tries:           3,
+		recoveryKeyFile: path,
+		authResponses:   []interface{}{RecoveryKey{}, recoveryKey},
+		expected:        &RecoveryKeyActivationResult{Source: RecoveryKeySourceAuthRequestor, TriesUsed: 3}})
 }
 
-type testActivateVolumeWithRecoveryKeyErrorHandlingData struct {
-	tries         int
-	authRequestor *mockAuthRequestor
-	activateTries int
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyResultFailure(c *C) {
+	s.addMockKeyslot("/dev/sda1", s.newRecoveryKey()[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{RecoveryKey{}}}
+	options := &ActivateVolumeOptions{RecoveryKeyTries: 1}
+
+	result, err := ActivateVolumeWithRecoveryKeyResult("data", "/dev/sda1", authRequestor, options)
+	c.Check(err, ErrorMatches, "cannot activate volume: systemd-cryptsetup failed with: exit status 1")
+	c.Check(result, IsNil)
 }
 
-func (s *cryptSuite) testActivateVolumeWithRecoveryKeyErrorHandling(c *C, data *testActivateVolumeWithRecoveryKeyErrorHandlingData) error {
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyCandidatesBeforeFile(c *C) {
+	// Test that the candidates are tried before the recovery key file.
 	recoveryKey := s.newRecoveryKey()
-	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+	path := filepath.Join(c.MkDir(), "recovery-key")
+	c.Assert(ioutil.WriteFile(path, []byte(RecoveryKey{}.String()), 0600), IsNil)
 
-	var authRequestor AuthRequestor
-	var numResponses int
-	if data.authRequestor != nil {
+	s.testActivateVolumeWithRecoveryKey(c, &testActivateVolumeWithRecoveryKeyData{
+		recoveryKey:      recoveryKey,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		tries:            1,
+		recoveryKeyFile:  path,
+		candidates:       []io.Reader{strings.NewReader(recoveryKey.String())},
+		activateTries:    1,
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyKeyringUnavailable(c *C) {
+	// Test that activation succeeds without adding keys when the user keyring is unavailable.
+	s.AddCleanup(MockKeyringCheckUserKeyringAvailable(func() error {
+		return errors.New("cannot obtain user keyring ID: operation not permitted")
+	}))
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1)"})
+
+	_, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyKeyringRequiredUnavailable(c *C) {
+	s.AddCleanup(MockKeyringCheckUserKeyringAvailable(func() error {
+		return errors.New("cannot obtain user keyring ID: operation not permitted")
+	}))
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, KeyringInsertionPolicy: KeyringInsertionRequired}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &options), ErrorMatches,
+		"user keyring is unavailable: cannot obtain user keyring ID: operation not permitted")
+	c.Check(s.luks2.operations, HasLen, 0)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyKeyringDisabled(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, KeyringInsertionPolicy: KeyringInsertionDisabled}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1)"})
+
+	_, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyInvalidKeyringInsertionPolicy(c *C) {
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, KeyringInsertionPolicy: 10}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", &mockAuthRequestor{}, &options), ErrorMatches,
+		"invalid KeyringInsertionPolicy")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyKeyringTargetSession(c *C) {
+	s.AddCleanup(func() {
+		c.Check(RemoveKeysFromKernel("", "/dev/sda1"), IsNil)
+	})
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, KeyringTarget: KeyringTargetSession}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1)"})
+
+	key, err := keyring.GetKeyFromKeyring("/dev/sda1", "unlock", "ubuntu-fde", keyring.SessionKeyring)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, recoveryKey[:])
+
+	key, err = GetDiskUnlockKeyFromKernel("", "/dev/sda1", true)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, DiskUnlockKey(recoveryKey[:]))
+
+	_, err = GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyKeyringKeyName(c *C) {
+	s.AddCleanup(func() {
+		c.Check(RemoveKeysFromKernel("", "/dev/sda1", "data"), IsNil)
+	})
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, KeyringTarget: KeyringTargetSession, KeyringKeyName: "data"}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1)"})
+
+	key, err := GetDiskUnlockKeyFromKernelByName("", "data", true)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, DiskUnlockKey(recoveryKey[:]))
+
+	_, err = GetDiskUnlockKeyFromKernelByName("", "data", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+
+	// The path based entry should still exist.
+	key, err = GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, DiskUnlockKey(recoveryKey[:]))
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataKeyringKeyName(c *C) {
+	s.AddCleanup(func() {
+		c.Check(RemoveKeysFromKernel("", "/dev/sda1", "data"), IsNil)
+	})
+
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	options := &ActivateVolumeOptions{
+		KeyringTarget:  KeyringTargetSession,
+		KeyringKeyName: "data",
+		Model:          SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+
+	key2, err := GetDiskUnlockKeyFromKernelByName("", "data", true)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyKeyringTargetRequiredUnavailable(c *C) {
+	s.AddCleanup(MockKeyringCheckKeyringAvailable(func(id int) error {
+		c.Check(id, Equals, keyring.SessionKeyring)
+		return errors.New("cannot obtain keyring ID: operation not permitted")
+	}))
+
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := ActivateVolumeOptions{
+		RecoveryKeyTries:       1,
+		KeyringInsertionPolicy: KeyringInsertionRequired,
+		KeyringTarget:          KeyringTargetSession}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, &options), ErrorMatches,
+		"session keyring is unavailable: cannot obtain keyring ID: operation not permitted")
+	c.Check(s.luks2.operations, HasLen, 0)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyInvalidKeyringTarget(c *C) {
+	options := ActivateVolumeOptions{RecoveryKeyTries: 1, KeyringTarget: 10}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", &mockAuthRequestor{}, &options), ErrorMatches,
+		"invalid KeyringTarget")
+}
+
+type testParseRecoveryKeyData struct {
+	formatted string
+	expected  []byte
+}
+
+func (s *cryptSuite) testParseRecoveryKey(c *C, data *testParseRecoveryKeyData) {
+	k, err := ParseRecoveryKey(data.formatted)
+	c.Check(err, IsNil)
+	c.Check(k[:], DeepEquals, data.expected)
+}
+
+func (s *cryptSuite) TestParseRecoveryKey1(c *C) {
+	s.testParseRecoveryKey(c, &testParseRecoveryKeyData{
+		formatted: "00000-00000-00000-00000-00000-00000-00000-00000",
+		expected:  testutil.DecodeHexString(c, "00000000000000000000000000000000"),
+	})
+}
+
+func (s *cryptSuite) TestParseRecoveryKey2(c *C) {
+	s.testParseRecoveryKey(c, &testParseRecoveryKeyData{
+		formatted: "61665-00531-54469-09783-47273-19035-40077-28287",
+		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+	})
+}
+
+func (s *cryptSuite) TestParseRecoveryKey3(c *C) {
+	s.testParseRecoveryKey(c, &testParseRecoveryKeyData{
+		formatted: "6166500531544690978347273190354007728287",
+		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+	})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyWithChecksum(c *C) {
+	s.testParseRecoveryKey(c, &testParseRecoveryKeyData{
+		formatted: "61665-00531-54469-09783-47273-19035-40077-28287-08",
+		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+	})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyWithChecksumNoHyphens(c *C) {
+	s.testParseRecoveryKey(c, &testParseRecoveryKeyData{
+		formatted: "616650053154469097834727319035400772828708",
+		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+	})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyChecksumMismatch(c *C) {
+	_, err := ParseRecoveryKey("61665-00531-54469-09783-47273-19035-40077-28287-09")
+	c.Check(err, ErrorMatches, "incorrectly formatted: checksum mismatch")
+	c.Check(err, FitsTypeOf, &RecoveryKeyFormatError{})
+	c.Check(xerrors.Is(err, ErrRecoveryKeyChecksumMismatch), testutil.IsTrue)
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyChecksumMismatchTransposedDigits(c *C) {
+	_, err := ParseRecoveryKey("16665-00531-54469-09783-47273-19035-40077-28287-08")
+	c.Check(err, ErrorMatches, "incorrectly formatted: checksum mismatch")
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyInvalidChecksum(c *C) {
+	_, err := ParseRecoveryKey("61665-00531-54469-09783-47273-19035-40077-28287-0a")
+	c.Check(err, ErrorMatches, "incorrectly formatted: too many characters")
+}
+
+type testReadRecoveryKeyData struct {
+	formatted string
+	expected  []byte
+}
+
+func (s *cryptSuite) testReadRecoveryKey(c *C, data *testReadRecoveryKeyData) {
+	k, err := ReadRecoveryKey(bytes.NewReader([]byte(data.formatted)))
+	c.Check(err, IsNil)
+	c.Check(k[:], DeepEquals, data.expected)
+}
+
+func (s *cryptSuite) TestReadRecoveryKey(c *C) {
+	s.testReadRecoveryKey(c, &testReadRecoveryKeyData{
+		formatted: "61665-00531-54469-09783-47273-19035-40077-28287",
+		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+	})
+}
+
+func (s *cryptSuite) TestReadRecoveryKeyNoHyphens(c *C) {
+	s.testReadRecoveryKey(c, &testReadRecoveryKeyData{
+		formatted: "6166500531544690978347273190354007728287",
+		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+	})
+}
+
+func (s *cryptSuite) TestReadRecoveryKeyTrailingNewline(c *C) {
+	s.testReadRecoveryKey(c, &testReadRecoveryKeyData{
+		formatted: "61665-00531-54469-09783-47273-19035-40077-28287\n",
+		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+	})
+}
+
+func (s *cryptSuite) TestReadRecoveryKeyTrailingCRLF(c *C) {
+	s.testReadRecoveryKey(c, &testReadRecoveryKeyData{
+		formatted: "6166500531544690978347273190354007728287\r\n",
+		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+	})
+}
+
+func (s *cryptSuite) TestReadRecoveryKeyMultipleNewlines(c *C) {
+	_, err := ReadRecoveryKey(bytes.NewReader([]byte("61665-00531-54469-09783-47273-19035-40077-28287\n\n")))
+	c.Check(err, ErrorMatches, "incorrectly formatted: too many characters")
+}
+
+func (s *cryptSuite) TestReadRecoveryKeyTrailingGarbage(c *C) {
+	_, err := ReadRecoveryKey(bytes.NewReader([]byte("61665-00531-54469-09783-47273-19035-40077-28287 foo\n")))
+	c.Check(err, ErrorMatches, "incorrectly formatted: too many characters")
+}
+
+type testParseRecoveryKeyErrorHandlingData struct {
+	formatted      string
+	errChecker     Checker
+	errCheckerArgs []interface{}
+}
+
+func (s *cryptSuite) testParseRecoveryKeyErrorHandling(c *C, data *testParseRecoveryKeyErrorHandlingData) {
+	_, err := ParseRecoveryKey(data.formatted)
+	c.Check(err, data.errChecker, data.errCheckerArgs...)
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyErrorHandling1(c *C) {
+	s.testParseRecoveryKeyErrorHandling(c, &testParseRecoveryKeyErrorHandlingData{
+		formatted:      "00000-1234",
+		errChecker:     ErrorMatches,
+		errCheckerArgs: []interface{}{"incorrectly formatted: insufficient characters"},
+	})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyErrorHandling2(c *C) {
+	s.testParseRecoveryKeyErrorHandling(c, &testParseRecoveryKeyErrorHandlingData{
+		formatted:      "00000-123bc",
+		errChecker:     ErrorMatches,
+		errCheckerArgs: []interface{}{"incorrectly formatted: strconv.ParseUint: parsing \"123bc\": invalid syntax"},
+	})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyErrorHandling3(c *C) {
+	s.testParseRecoveryKeyErrorHandling(c, &testParseRecoveryKeyErrorHandlingData{
+		formatted:      "00000-00000-00000-00000-00000-00000-00000-00000-00000",
+		errChecker:     ErrorMatches,
+		errCheckerArgs: []interface{}{"incorrectly formatted: too many characters"},
+	})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyErrorHandling4(c *C) {
+	s.testParseRecoveryKeyErrorHandling(c, &testParseRecoveryKeyErrorHandlingData{
+		formatted:      "-00000-00000-00000-00000-00000-00000-00000-00000",
+		errChecker:     ErrorMatches,
+		errCheckerArgs: []interface{}{"incorrectly formatted: strconv.ParseUint: parsing \"-0000\": invalid syntax"},
+	})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyErrorHandling5(c *C) {
+	s.testParseRecoveryKeyErrorHandling(c, &testParseRecoveryKeyErrorHandlingData{
+		formatted:      "00000-00000-00000-00000-00000-00000-00000-00000-",
+		errChecker:     ErrorMatches,
+		errCheckerArgs: []interface{}{"incorrectly formatted: too many characters"},
+	})
+}
+
+type testRecoveryKeyStringifyData struct {
+	key      []byte
+	expected string
+}
+
+func (s *cryptSuite) testRecoveryKeyStringify(c *C, data *testRecoveryKeyStringifyData) {
+	var key RecoveryKey
+	copy(key[:], data.key)
+	c.Check(key.String(), Equals, data.expected)
+}
+
+func (s *cryptSuite) TestRecoveryKeyStringify1(c *C) {
+	s.testRecoveryKeyStringify(c, &testRecoveryKeyStringifyData{
+		expected: "00000-00000-00000-00000-00000-00000-00000-00000",
+	})
+}
+
+func (s *cryptSuite) TestRecoveryKeyStringify2(c *C) {
+	s.testRecoveryKeyStringify(c, &testRecoveryKeyStringifyData{
+		key:      testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+		expected: "61665-00531-54469-09783-47273-19035-40077-28287",
+	})
+}
+
+func (s *cryptSuite) TestRecoveryKeyFormatDefaultGroups(c *C) {
+	key := RecoveryKey{0xe1, 0xf0, 0x13, 0x02, 0xc5, 0xd4, 0x37, 0x26, 0xa9, 0xb8, 0x5b, 0x4a, 0x8d, 0x9c, 0x7f, 0x6e}
+	c.Check(key.Format(5), Equals, key.String())
+}
+
+func (s *cryptSuite) TestRecoveryKeyFormatGroups4(c *C) {
+	key := RecoveryKey{0xe1, 0xf0, 0x13, 0x02, 0xc5, 0xd4, 0x37, 0x26, 0xa9, 0xb8, 0x5b, 0x4a, 0x8d, 0x9c, 0x7f, 0x6e}
+	c.Check(key.Format(4), Equals, "6166-5005-3154-4690-9783-4727-3190-3540-0772-8287")
+}
+
+func (s *cryptSuite) TestRecoveryKeyFormatGroups6(c *C) {
+	key := RecoveryKey{0xe1, 0xf0, 0x13, 0x02, 0xc5, 0xd4, 0x37, 0x26, 0xa9, 0xb8, 0x5b, 0x4a, 0x8d, 0x9c, 0x7f, 0x6e}
+	c.Check(key.Format(6), Equals, "616650-053154-469097-834727-319035-400772-8287")
+}
+
+func (s *cryptSuite) TestRecoveryKeyFormatNoGroups(c *C) {
+	key := RecoveryKey{0xe1, 0xf0, 0x13, 0x02, 0xc5, 0xd4, 0x37, 0x26, 0xa9, 0xb8, 0x5b, 0x4a, 0x8d, 0x9c, 0x7f, 0x6e}
+	c.Check(key.Format(0), Equals, "6166500531544690978347273190354007728287")
+}
+
+type testParseRecoveryKeyWithGroupsData struct {
+	formatted string
+	groupSize int
+}
+
+func (s *cryptSuite) testParseRecoveryKeyWithGroups(c *C, data *testParseRecoveryKeyWithGroupsData) {
+	k, err := ParseRecoveryKeyWithGroups(data.formatted, data.groupSize)
+	c.Check(err, IsNil)
+	c.Check(k[:], DeepEquals, testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"))
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyWithGroups4(c *C) {
+	s.testParseRecoveryKeyWithGroups(c, &testParseRecoveryKeyWithGroupsData{
+		formatted: "6166-5005-3154-4690-9783-4727-3190-3540-0772-8287",
+		groupSize: 4})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyWithGroups6(c *C) {
+	s.testParseRecoveryKeyWithGroups(c, &testParseRecoveryKeyWithGroupsData{
+		formatted: "616650-053154-469097-834727-319035-400772-8287",
+		groupSize: 6})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyWithGroupsNoSeparators(c *C) {
+	s.testParseRecoveryKeyWithGroups(c, &testParseRecoveryKeyWithGroupsData{
+		formatted: "6166500531544690978347273190354007728287",
+		groupSize: 4})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyWithGroupsNoGroups(c *C) {
+	s.testParseRecoveryKeyWithGroups(c, &testParseRecoveryKeyWithGroupsData{
+		formatted: "6166500531544690978347273190354007728287",
+		groupSize: 0})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyWithGroupsWrongGroupSize(c *C) {
+	_, err := ParseRecoveryKeyWithGroups("6166-5005-3154-4690-9783-4727-3190-3540-0772-8287", 5)
+	c.Check(err, ErrorMatches, "incorrectly formatted: unexpected separator")
+	c.Check(err, FitsTypeOf, &RecoveryKeyFormatError{})
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyWithGroupsTrailingSeparator(c *C) {
+	_, err := ParseRecoveryKeyWithGroups("6166-5005-3154-4690-9783-4727-3190-3540-0772-8287-", 4)
+	c.Check(err, ErrorMatches, "incorrectly formatted: unexpected separator")
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyWithGroupsTooShort(c *C) {
+	_, err := ParseRecoveryKeyWithGroups("6166-5005-3154-4690-9783-4727-3190-3540-0772", 4)
+	c.Check(err, ErrorMatches, "incorrectly formatted: insufficient characters")
+}
+
+func (s *cryptSuite) TestRecoveryKeyStringWithChecksum(c *C) {
+	key := RecoveryKey{0xe1, 0xf0, 0x13, 0x02, 0xc5, 0xd4, 0x37, 0x26, 0xa9, 0xb8, 0x5b, 0x4a, 0x8d, 0x9c, 0x7f, 0x6e}
+	c.Check(key.StringWithChecksum(), Equals, "61665-00531-54469-09783-47273-19035-40077-28287-08")
+	c.Check(RecoveryKey{}.StringWithChecksum(), Equals, "00000-00000-00000-00000-00000-00000-00000-00000-98")
+}
+
+func (s *cryptSuite) TestRecoveryKeyStringWithChecksumRoundTrip(c *C) {
+	key := s.newRecoveryKey()
+	parsed, err := ParseRecoveryKey(key.StringWithChecksum())
+	c.Check(err, IsNil)
+	c.Check(parsed, Equals, key)
+}
+
+func (s *cryptSuite) TestNewRecoveryKey(c *C) {
+	key1, err := NewRecoveryKey()
+	c.Check(err, IsNil)
+	key2, err := NewRecoveryKey()
+	c.Check(err, IsNil)
+
+	c.Check(key1, Not(DeepEquals), RecoveryKey{})
+	c.Check(key1, Not(DeepEquals), key2)
+}
+
+type testParseExtendedRecoveryKeyData struct {
+	formatted string
+	expected  []byte
+}
+
+func (s *cryptSuite) testParseExtendedRecoveryKey(c *C, data *testParseExtendedRecoveryKeyData) {
+	k, err := ParseExtendedRecoveryKey(data.formatted)
+	c.Check(err, IsNil)
+	c.Check([]byte(k), DeepEquals, data.expected)
+}
+
+func (s *cryptSuite) TestParseExtendedRecoveryKey16(c *C) {
+	s.testParseExtendedRecoveryKey(c, &testParseExtendedRecoveryKeyData{
+		formatted: "61665-00531-54469-09783-47273-19035-40077-28287",
+		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e"),
+	})
+}
+
+func (s *cryptSuite) TestParseExtendedRecoveryKey24(c *C) {
+	s.testParseExtendedRecoveryKey(c, &testParseExtendedRecoveryKeyData{
+		formatted: "61665-00531-54469-09783-47273-19035-40077-28287-00000-65535-00001-00256",
+		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e0000ffff01000001"),
+	})
+}
+
+func (s *cryptSuite) TestParseExtendedRecoveryKey32NoSeparators(c *C) {
+	s.testParseExtendedRecoveryKey(c, &testParseExtendedRecoveryKeyData{
+		formatted: "61665005315446909783472731903540077282876166500531544690978347273190354007728287",
+		expected:  testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6ee1f01302c5d43726a9b85b4a8d9c7f6e"),
+	})
+}
+
+func (s *cryptSuite) TestParseExtendedRecoveryKeyTooShort(c *C) {
+	_, err := ParseExtendedRecoveryKey("61665-00531-54469-09783-47273-19035-40077")
+	c.Check(err, ErrorMatches, "incorrectly formatted: insufficient characters")
+}
+
+func (s *cryptSuite) TestParseRecoveryKeyFormatErrorType(c *C) {
+	_, err := ParseRecoveryKey("61665-00531-54469-09783-47273-19035-40077-2828a")
+	c.Check(err, testutil.ConvertibleTo, &RecoveryKeyFormatError{})
+	c.Check(err, ErrorMatches, "incorrectly formatted: strconv.ParseUint: parsing \"2828a\": invalid syntax")
+}
+
+func (s *cryptSuite) TestParseExtendedRecoveryKeyIncompleteGroup(c *C) {
+	_, err := ParseExtendedRecoveryKey("61665-00531-54469-09783-47273-19035-40077-28287-123")
+	c.Check(err, ErrorMatches, "incorrectly formatted: insufficient characters")
+}
+
+func (s *cryptSuite) TestParseExtendedRecoveryKeyTrailingSeparator(c *C) {
+	_, err := ParseExtendedRecoveryKey("61665-00531-54469-09783-47273-19035-40077-28287-")
+	c.Check(err, ErrorMatches, "incorrectly formatted: insufficient characters")
+}
+
+func (s *cryptSuite) TestExtendedRecoveryKeyStringify(c *C) {
+	key := ExtendedRecoveryKey(testutil.DecodeHexString(c, "e1f01302c5d43726a9b85b4a8d9c7f6e0000ffff01000001"))
+	c.Check(key.String(), Equals, "61665-00531-54469-09783-47273-19035-40077-28287-00000-65535-00001-00256")
+}
+
+func (s *cryptSuite) TestExtendedRecoveryKeyStringifyInvalidLength(c *C) {
+	c.Check(func() { _ = ExtendedRecoveryKey(make([]byte, 17)).String() }, PanicMatches,
+		"invalid extended recovery key: odd length \\(17 bytes\\)")
+	c.Check(func() { _ = ExtendedRecoveryKey(make([]byte, 66)).String() }, PanicMatches,
+		"invalid extended recovery key: too long \\(got 66 bytes, expected at most 64\\)")
+}
+
+func (s *cryptSuite) TestParseExtendedRecoveryKeyTooLong(c *C) {
+	var groups []string
+	for i := 0; i < 33; i++ {
+		groups = append(groups, "12345")
+	}
+	_, err := ParseExtendedRecoveryKey(strings.Join(groups, ""))
+	c.Check(err, ErrorMatches, "incorrectly formatted: too many characters")
+	_, err = ParseExtendedRecoveryKey(strings.Join(groups, "-"))
+	c.Check(err, ErrorMatches, "incorrectly formatted: too many characters")
+}
+
+func (s *cryptSuite) TestNewExtendedRecoveryKey(c *C) {
+	key1, err := NewExtendedRecoveryKey(24)
+	c.Check(err, IsNil)
+	c.Check(key1, HasLen, 24)
+	key2, err := NewExtendedRecoveryKey(24)
+	c.Check(err, IsNil)
+	c.Check(key1, Not(DeepEquals), key2)
+
+	key3, err := ParseExtendedRecoveryKey(key1.String())
+	c.Check(err, IsNil)
+	c.Check(key3, DeepEquals, key1)
+
+	_, err = NewExtendedRecoveryKey(25)
+	c.Check(err, ErrorMatches, "invalid size: odd length \\(25 bytes\\)")
+}
+
+func (s *cryptSuite) TestReadExtendedRecoveryKey(c *C) {
+	key, err := NewExtendedRecoveryKey(64)
+	c.Assert(err, IsNil)
+
+	key2, err := ReadExtendedRecoveryKey(strings.NewReader(key.String() + "\r\n"))
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithExtendedRecoveryKeyReader(c *C) {
+	recoveryKey, err := NewExtendedRecoveryKey(32)
+	c.Assert(err, IsNil)
+	s.addMockKeyslot("/dev/sda1", recoveryKey)
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries:   1,
+		RecoveryKeyReaders: []io.Reader{strings.NewReader(recoveryKey.String())}}
+	result, err := ActivateVolumeWithRecoveryKeyResult("data", "/dev/sda1", &mockAuthRequestor{}, options)
+	c.Check(err, IsNil)
+	c.Check(result, DeepEquals, &RecoveryKeyActivationResult{Source: RecoveryKeySourceReader})
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithExtendedRecoveryKeyFile(c *C) {
+	recoveryKey, err := NewExtendedRecoveryKey(24)
+	c.Assert(err, IsNil)
+	s.addMockKeyslot("/dev/sda1", recoveryKey)
+
+	path := filepath.Join(c.MkDir(), "recovery-key")
+	c.Assert(ioutil.WriteFile(path, []byte(recoveryKey.String()+"\n"), 0600), IsNil)
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		RecoveryKeyFile:  path}
+	result, err := ActivateVolumeWithRecoveryKeyResult("data", "/dev/sda1", &mockAuthRequestor{}, options)
+	c.Check(err, IsNil)
+	c.Check(result, DeepEquals, &RecoveryKeyActivationResult{Source: RecoveryKeySourceFile, TriesUsed: 1})
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+}
+
+type testActivateVolumeWithRecoveryKeyErrorHandlingData struct {
+	tries         int
+	authRequestor *mockAuthRequestor
+	activateTries int
+}
+
+func (s *cryptSuite) testActivateVolumeWithRecoveryKeyErrorHandling(c *C, data *testActivateVolumeWithRecoveryKeyErrorHandlingData) error {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	var authRequestor AuthRequestor
+	var numResponses int
+	if data.authRequestor != nil {
 		authRequestor = data.authRequestor
 		numResponses = len(data.authRequestor.recoveryKeyResponses)
 	}
@@ -769,6 +1669,27 @@ func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandling5(c *C) {
 	}), ErrorMatches, "cannot activate volume: systemd-cryptsetup failed with: exit status 1")
 }
 
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandlingIncorrectKeyType(c *C) {
+	err := s.testActivateVolumeWithRecoveryKeyErrorHandling(c, &testActivateVolumeWithRecoveryKeyErrorHandlingData{
+		tries:         1,
+		authRequestor: &mockAuthRequestor{recoveryKeyResponses: []interface{}{RecoveryKey{}}},
+		activateTries: 1,
+	})
+	var e *RecoveryKeyIncorrectError
+	c.Check(xerrors.As(err, &e), testutil.IsTrue)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandlingFormatErrorType(c *C) {
+	_, parseErr := ParseRecoveryKey("1234")
+	err := s.testActivateVolumeWithRecoveryKeyErrorHandling(c, &testActivateVolumeWithRecoveryKeyErrorHandlingData{
+		tries:         1,
+		authRequestor: &mockAuthRequestor{recoveryKeyResponses: []interface{}{xerrors.Errorf("cannot parse recovery key: %w", parseErr)}},
+	})
+	c.Check(err, ErrorMatches, "cannot obtain recovery key: cannot parse recovery key: incorrectly formatted: insufficient characters")
+	var e *RecoveryKeyFormatError
+	c.Check(xerrors.As(err, &e), testutil.IsTrue)
+}
+
 func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandling6(c *C) {
 	// Test that the last error is returned when there are consecutive failures for different reasons.
 	c.Check(s.testActivateVolumeWithRecoveryKeyErrorHandling(c, &testActivateVolumeWithRecoveryKeyErrorHandlingData{
@@ -778,6 +1699,30 @@ func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandling6(c *C) {
 	}), ErrorMatches, "cannot obtain recovery key: another error")
 }
 
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandlingAuthRequestFailed(c *C) {
+	// Test that no further requests are made if the auth requestor fails.
+	err := s.testActivateVolumeWithRecoveryKeyErrorHandling(c, &testActivateVolumeWithRecoveryKeyErrorHandlingData{
+		tries: 3,
+		authRequestor: &mockAuthRequestor{recoveryKeyResponses: []interface{}{
+			NewAuthRequestFailedError(errors.New("cannot execute systemd-ask-password: exit status 1"))}},
+	})
+	c.Check(err, ErrorMatches, "cannot obtain recovery key: cannot execute systemd-ask-password: exit status 1")
+	c.Check(err, Not(testutil.ErrorIs), ErrRecoveryKeyTriesExhausted)
+	var e *AuthRequestFailedError
+	c.Check(xerrors.As(err, &e), testutil.IsTrue)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandlingTimeout(c *C) {
+	// Test that a request that times out consumes a try.
+	err := s.testActivateVolumeWithRecoveryKeyErrorHandling(c, &testActivateVolumeWithRecoveryKeyErrorHandlingData{
+		tries:         2,
+		authRequestor: &mockAuthRequestor{recoveryKeyResponses: []interface{}{ErrAuthRequestTimeout, ErrAuthRequestTimeout}},
+	})
+	c.Check(err, ErrorMatches, "cannot obtain recovery key: timed out waiting for a credential")
+	c.Check(err, testutil.ErrorIs, ErrAuthRequestTimeout)
+	c.Check(err, testutil.ErrorIs, ErrRecoveryKeyTriesExhausted)
+}
+
 type testActivateVolumeWithKeyDataData struct {
 	authorizedModels []SnapModel
 	passphrase       string
@@ -787,13 +1732,14 @@ type testActivateVolumeWithKeyDataData struct {
 	keyringPrefix    string
 	authResponses    []interface{}
 	model            SnapModel
+	modelRole        string
 }
 
 func (s *cryptSuite) testActivateVolumeWithKeyData(c *C, data *testActivateVolumeWithKeyDataData) {
 	keyData, key, auxKey := s.newNamedKeyData(c, "")
 	s.addMockKeyslot(data.sourceDevicePath, key)
 
-	c.Check(keyData.SetAuthorizedSnapModels(auxKey, data.authorizedModels...), IsNil)
+	c.Check(keyData.SetAuthorizedSnapModelsForRole(auxKey, data.modelRole, data.authorizedModels...), IsNil)
 
 	authRequestor := &mockAuthRequestor{passphraseResponses: data.authResponses}
 
@@ -805,7 +1751,8 @@ func (s *cryptSuite) testActivateVolumeWithKeyData(c *C, data *testActivateVolum
 	options := &ActivateVolumeOptions{
 		PassphraseTries: data.passphraseTries,
 		KeyringPrefix:   data.keyringPrefix,
-		Model:           data.model}
+		Model:           data.model,
+		SnapModelRole:   data.modelRole}
 	err := ActivateVolumeWithKeyData(data.volumeName, data.sourceDevicePath, keyData, authRequestor, &kdf, options)
 	c.Assert(err, IsNil)
 
@@ -874,61 +1821,425 @@ func (s *cryptSuite) TestActivateVolumeWithKeyData3(c *C) {
 			"grade":        "secured",
 		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
 
-	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
-		authorizedModels: models,
-		volumeName:       "data",
-		sourceDevicePath: "/dev/sda1",
-		model:            models[0]})
+	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
+		authorizedModels: models,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		model:            models[0]})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyData4(c *C) {
+	// Test that skipping the snap model check works
+	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		model:            SkipSnapModelCheck})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyData5(c *C) {
+	// Test with passphrase
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+
+	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
+		passphrase:       "1234",
+		authorizedModels: models,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		passphraseTries:  1,
+		authResponses:    []interface{}{"1234"},
+		model:            models[0]})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyData6(c *C) {
+	// Test with passphrase using multiple tries
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+
+	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
+		passphrase:       "1234",
+		authorizedModels: models,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		passphraseTries:  3,
+		authResponses:    []interface{}{"incorrect", "1234"},
+		model:            models[0]})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataPassphraseNoInput(c *C) {
+	// Test that a passphrase request where nothing was entered doesn't
+	// consume a try
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+
+	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
+		passphrase:       "1234",
+		authorizedModels: models,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		passphraseTries:  1,
+		authResponses:    []interface{}{ErrAuthRequestNoInput, "1234"},
+		model:            models[0]})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataPassphraseNoInputLimit(c *C) {
+	// Test that passphrase and recovery key requests stop after too many
+	// consecutive requests where nothing was entered.
+	keyData, keys, _ := s.newMultipleNamedKeyData(c, "", "")
+	for _, key := range keys {
+		s.addMockKeyslot("/dev/sda1", key)
+	}
+
+	var kdf mockKDF
+	c.Check(keyData[0].SetPassphrase("1234", nil, &kdf), IsNil)
+
+	authRequestor := new(noInputAuthRequestor)
+	err := ActivateVolumeWithKeyData("data", "/dev/sda1", keyData[0], authRequestor, &kdf, &ActivateVolumeOptions{
+		PassphraseTries:  3,
+		RecoveryKeyTries: 3,
+		Model:            SkipSnapModelCheck})
+	c.Check(err, ErrorMatches, `(?s).*cannot obtain passphrase: giving up after 5 consecutive requests: no credential was supplied.*`)
+	c.Check(err, ErrorMatches, `(?s).*cannot obtain recovery key: giving up after 5 consecutive requests: no credential was supplied.*`)
+	c.Check(authRequestor.passphraseRequests, Equals, 5)
+	c.Check(authRequestor.recoveryKeyRequests, Equals, 5)
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataSnapModelRole(c *C) {
+	// Test with a model authorized for a named role
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+
+	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
+		authorizedModels: models,
+		volumeName:       "data",
+		sourceDevicePath: "/dev/sda1",
+		model:            models[0],
+		modelRole:        "recovery"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithPassphraseKeyData(c *C) {
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+	s.addMockKeyslot("/dev/sda1", key)
+
+	var kdf mockKDF
+	keyData, _, err := NewPassphraseKeyData("passphrase", key, nil, &kdf)
+	c.Assert(err, IsNil)
+
+	authRequestor := &mockAuthRequestor{passphraseResponses: []interface{}{"incorrect", "passphrase"}}
+	options := &ActivateVolumeOptions{
+		PassphraseTries: 2,
+		Model:           SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, authRequestor, &kdf, options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1)"})
+	c.Check(authRequestor.passphraseRequests, HasLen, 2)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataUnlockKeyWriter(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	w := new(bytes.Buffer)
+	options := &ActivateVolumeOptions{
+		UnlockKeyWriter: w,
+		Model:           SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1)"})
+	c.Check(w.Bytes(), DeepEquals, []byte(key))
+}
+
+type mockKeyMemoryLocker struct {
+	locked   [][]byte
+	unlocked [][]byte
+	err      error
+}
+
+func (l *mockKeyMemoryLocker) mlock(b []byte) error {
+	if l.err != nil {
+		return l.err
+	}
+	l.locked = append(l.locked, append([]byte(nil), b...))
+	return nil
+}
+
+func (l *mockKeyMemoryLocker) munlock(b []byte) error {
+	l.unlocked = append(l.unlocked, append([]byte(nil), b...))
+	return nil
+}
+
+func (s *cryptSuite) mockKeyMemoryLocker(err error) *mockKeyMemoryLocker {
+	l := &mockKeyMemoryLocker{err: err}
+	s.AddCleanup(MockUnixMlock(l.mlock))
+	s.AddCleanup(MockUnixMunlock(l.munlock))
+	return l
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataLockKeyMemory(c *C) {
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	l := s.mockKeyMemoryLocker(nil)
+
+	w := new(bytes.Buffer)
+	options := &ActivateVolumeOptions{
+		LockKeyMemory:   true,
+		UnlockKeyWriter: w,
+		Model:           SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1,)"})
+	c.Check(w.Bytes(), DeepEquals, []byte(key))
+
+	// The keys should have been locked, and only unlocked once they
+	// were wiped.
+	c.Check(l.locked, DeepEquals, [][]byte{key, auxKey})
+	c.Check(l.unlocked, DeepEquals, [][]byte{make([]byte, len(key)), make([]byte, len(auxKey))})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataLockKeyMemoryFails(c *C) {
+	// Test that failing to lock the keys in to memory isn't fatal.
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	l := s.mockKeyMemoryLocker(syscall.ENOMEM)
+
+	options := &ActivateVolumeOptions{
+		LockKeyMemory: true,
+		Model:         SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+	c.Check(l.unlocked, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataNoLockKeyMemory(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	l := s.mockKeyMemoryLocker(nil)
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+	c.Check(l.locked, HasLen, 0)
+	c.Check(l.unlocked, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyLockKeyMemory(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	l := s.mockKeyMemoryLocker(nil)
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries:   1,
+		RecoveryKeyReaders: []io.Reader{strings.NewReader(recoveryKey.String())},
+		LockKeyMemory:      true}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", &mockAuthRequestor{}, options), IsNil)
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+
+	// The buffers that the formatted and binary keys are read in to should
+	// have been locked before use, and only unlocked once they were wiped.
+	c.Check(l.locked, DeepEquals, [][]byte{make([]byte, 194), make([]byte, 64)})
+	c.Check(l.unlocked, DeepEquals, [][]byte{make([]byte, 64), make([]byte, 194)})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyFromAuthRequestorLockKeyMemory(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	l := s.mockKeyMemoryLocker(nil)
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		LockKeyMemory:    true}
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, options), IsNil)
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+
+	c.Check(l.locked, DeepEquals, [][]byte{make([]byte, 194), make([]byte, 64)})
+	c.Check(l.unlocked, DeepEquals, [][]byte{make([]byte, 64), make([]byte, 194)})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyNoLockKeyMemory(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	l := s.mockKeyMemoryLocker(nil)
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries:   1,
+		RecoveryKeyReaders: []io.Reader{strings.NewReader(recoveryKey.String())}}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", &mockAuthRequestor{}, options), IsNil)
+	c.Check(l.locked, HasLen, 0)
+	c.Check(l.unlocked, HasLen, 0)
+}
+
+type mockErrorWriter struct{}
+
+func (*mockErrorWriter) Write(data []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataUnlockKeyWriterError(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	options := &ActivateVolumeOptions{
+		UnlockKeyWriter: new(mockErrorWriter),
+		Model:           SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), ErrorMatches,
+		"cannot write unlock key: broken pipe")
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataDetachedHeader(c *C) {
+	headerPath := filepath.Join(c.MkDir(), "header")
+	c.Assert(ioutil.WriteFile(headerPath, nil, 0600), IsNil)
+
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot(headerPath, key)
+
+	options := &ActivateVolumeOptions{
+		HeaderPath: headerPath,
+		Model:      SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1," + headerPath + ")"})
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataSystemdCryptsetupOptions(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	options := &ActivateVolumeOptions{
+		SystemdCryptsetupOptions: []string{"discard", "no-read-workqueue"},
+		Model:                    SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1,,discard,no-read-workqueue)"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataReservedSystemdCryptsetupOption(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	for _, t := range []struct {
+		option   string
+		errMatch string
+	}{
+		{option: "tries=3", errMatch: `invalid activation options: cannot specify the "tries=" option for systemd-cryptsetup`},
+		{option: "key-file=/run/key", errMatch: `invalid activation options: cannot specify the "key-file=" option for systemd-cryptsetup`},
+		{option: "keyfile-offset=10", errMatch: `invalid activation options: cannot specify the "keyfile-offset=" option for systemd-cryptsetup`},
+		{option: "header=/run/header", errMatch: `invalid activation options: cannot specify the "header=" option for systemd-cryptsetup`},
+	} {
+		options := &ActivateVolumeOptions{
+			SystemdCryptsetupOptions: []string{t.option},
+			Model:                    SkipSnapModelCheck}
+		c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), ErrorMatches, t.errMatch)
+	}
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeySystemdCryptsetupPath(c *C) {
+	path := filepath.Join(c.MkDir(), "systemd-cryptsetup")
+	c.Assert(ioutil.WriteFile(path, nil, 0755), IsNil)
+
+	var activateOptions *luks2.ActivateOptions
+	restore := MockLUKS2Activate(func(_, _ string, _ []byte, options *luks2.ActivateOptions) error {
+		activateOptions = options
+		return nil
+	})
+	defer restore()
+
+	options := &ActivateVolumeOptions{SystemdCryptsetupPath: path}
+	c.Check(ActivateVolumeWithKey("data", "/dev/sda1", []byte{1, 2, 3, 4}, options), IsNil)
+	c.Check(activateOptions, DeepEquals, &luks2.ActivateOptions{SystemdCryptsetupPath: path})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyMissingSystemdCryptsetupPath(c *C) {
+	path := filepath.Join(c.MkDir(), "systemd-cryptsetup")
+
+	options := &ActivateVolumeOptions{SystemdCryptsetupPath: path}
+	c.Check(ActivateVolumeWithKey("data", "/dev/sda1", []byte{1, 2, 3, 4}, options), ErrorMatches,
+		`cannot access systemd-cryptsetup: stat .*/systemd-cryptsetup: no such file or directory`)
+	c.Check(s.luks2.operations, HasLen, 0)
 }
 
-func (s *cryptSuite) TestActivateVolumeWithKeyData4(c *C) {
-	// Test that skipping the snap model check works
-	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
-		volumeName:       "data",
-		sourceDevicePath: "/dev/sda1",
-		model:            SkipSnapModelCheck})
+func (s *cryptSuite) TestEnsureVolumeActivated(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	options := &ActivateVolumeOptions{
+		KeyringInsertionPolicy: KeyringInsertionDisabled,
+		Model:                  SkipSnapModelCheck}
+	activate := func() error {
+		return ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options)
+	}
+
+	c.Check(EnsureVolumeActivated("data", "/dev/sda1", activate), IsNil)
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+
+	// The second attempt should not try to activate the volume again.
+	c.Check(EnsureVolumeActivated("data", "/dev/sda1", activate), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"ActiveVolumeSourceDevice(data)",
+		"Activate(data,/dev/sda1)",
+		"ActiveVolumeSourceDevice(data)",
+	})
 }
 
-func (s *cryptSuite) TestActivateVolumeWithKeyData5(c *C) {
-	// Test with passphrase
-	models := []SnapModel{
-		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
-			"authority-id": "fake-brand",
-			"series":       "16",
-			"brand-id":     "fake-brand",
-			"model":        "fake-model",
-			"grade":        "secured",
-		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+func (s *cryptSuite) TestEnsureVolumeActivatedConflict(c *C) {
+	s.luks2.activated["data"] = "/dev/sdb1"
 
-	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
-		passphrase:       "1234",
-		authorizedModels: models,
-		volumeName:       "data",
-		sourceDevicePath: "/dev/sda1",
-		passphraseTries:  1,
-		authResponses:    []interface{}{"1234"},
-		model:            models[0]})
+	err := EnsureVolumeActivated("data", "/dev/sda1", func() error {
+		c.Error("unexpected activation")
+		return nil
+	})
+	c.Check(err, ErrorMatches, "volume data is already active with source device /dev/sdb1 rather than /dev/sda1")
+	c.Assert(err, FitsTypeOf, &VolumeActivationConflictError{})
+	c.Check(err.(*VolumeActivationConflictError).ActiveSourceDevicePath, Equals, "/dev/sdb1")
 }
 
-func (s *cryptSuite) TestActivateVolumeWithKeyData6(c *C) {
-	// Test with passphrase using multiple tries
-	models := []SnapModel{
-		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
-			"authority-id": "fake-brand",
-			"series":       "16",
-			"brand-id":     "fake-brand",
-			"model":        "fake-model",
-			"grade":        "secured",
-		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+func (s *cryptSuite) TestEnsureVolumeActivatedError(c *C) {
+	c.Check(EnsureVolumeActivated("data", "/dev/sda1", func() error {
+		return errors.New("some error")
+	}), ErrorMatches, "some error")
+}
 
-	s.testActivateVolumeWithKeyData(c, &testActivateVolumeWithKeyDataData{
-		passphrase:       "1234",
-		authorizedModels: models,
-		volumeName:       "data",
-		sourceDevicePath: "/dev/sda1",
-		passphraseTries:  3,
-		authResponses:    []interface{}{"incorrect", "1234"},
-		model:            models[0]})
+func (s *cryptSuite) TestActivateVolumeWithKeyDataMissingDetachedHeader(c *C) {
+	headerPath := filepath.Join(c.MkDir(), "header")
+
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	options := &ActivateVolumeOptions{
+		HeaderPath: headerPath,
+		Model:      SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), ErrorMatches,
+		"cannot access detached header: stat "+headerPath+": no such file or directory")
+	c.Check(s.luks2.operations, HasLen, 0)
 }
 
 type testActivateVolumeWithKeyDataErrorHandlingData struct {
@@ -944,7 +2255,8 @@ type testActivateVolumeWithKeyDataErrorHandlingData struct {
 
 	keyData *KeyData
 
-	model SnapModel
+	model     SnapModel
+	modelRole string
 
 	activateTries int
 }
@@ -966,7 +2278,8 @@ func (s *cryptSuite) testActivateVolumeWithKeyDataErrorHandling(c *C, data *test
 		PassphraseTries:  data.passphraseTries,
 		RecoveryKeyTries: data.recoveryKeyTries,
 		KeyringPrefix:    data.keyringPrefix,
-		Model:            data.model}
+		Model:            data.model,
+		SnapModelRole:    data.modelRole}
 	err := ActivateVolumeWithKeyData("data", "/dev/sda1", data.keyData, authRequestor, data.kdf, options)
 
 	if data.authRequestor != nil {
@@ -1078,6 +2391,236 @@ func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling5(c *C) {
 			"and activation with recovery key failed: no recovery key tries permitted")
 }
 
+func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandlingIs(c *C) {
+	// Test that the returned error can be matched against the underlying errors
+	keyData, key, _ := s.newNamedKeyData(c, "bar")
+	recoveryKey := s.newRecoveryKey()
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	err := s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
+		primaryKey:       key,
+		recoveryKey:      recoveryKey,
+		authRequestor:    &mockAuthRequestor{recoveryKeyResponses: []interface{}{RecoveryKey{}}},
+		recoveryKeyTries: 1,
+		keyData:          keyData,
+		model:            SkipSnapModelCheck,
+		activateTries:    1,
+	})
+	c.Check(xerrors.Is(err, ErrPlatformDeviceUnavailable), testutil.IsTrue)
+	c.Check(xerrors.Is(err, ErrRecoveryKeyTriesExhausted), testutil.IsTrue)
+	c.Check(xerrors.Is(err, ErrInvalidPassphrase), testutil.IsFalse)
+
+	var pe *PlatformDeviceUnavailableError
+	c.Check(xerrors.As(err, &pe), testutil.IsTrue)
+	var re *RecoveryKeyIncorrectError
+	c.Check(xerrors.As(err, &re), testutil.IsTrue)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataNoInteractive(c *C) {
+	// Test that the auth requestor isn't used when NoInteractive is set
+	keyData, key, _ := s.newNamedKeyData(c, "foo")
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", key)
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeOptions{
+		PassphraseTries:  1,
+		RecoveryKeyTries: 1,
+		Model:            SkipSnapModelCheck,
+		NoInteractive:    true}
+	err := ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, authRequestor, nil, options)
+	c.Check(err, ErrorMatches,
+		"cannot activate with platform protected keys:\n"+
+			"- foo: cannot recover key: the platform's secure device is unavailable: the "+
+			"platform device is unavailable\n"+
+			"and activation with recovery key failed: manual recovery is required but user interaction is disabled")
+	c.Check(xerrors.Is(err, ErrManualRecoveryRequired), testutil.IsTrue)
+
+	c.Check(authRequestor.passphraseRequests, HasLen, 0)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataNoInteractiveRecoveryKeyReaders(c *C) {
+	// Test that candidate recovery keys are tried when NoInteractive is set
+	keyData, key, _ := s.newNamedKeyData(c, "foo")
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", key)
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		RecoveryKeyReaders: []io.Reader{
+			strings.NewReader(s.newRecoveryKey().String()),
+			strings.NewReader(recoveryKey.String()),
+		},
+		Model:         SkipSnapModelCheck,
+		NoInteractive: true}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, authRequestor, nil, options), Equals, ErrRecoveryKeyUsed)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"Activate(data,/dev/sda1)",
+		"Activate(data,/dev/sda1)",
+	})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataNoInteractiveRecoveryKeyReadersIncorrect(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "foo")
+	s.addMockKeyslot("/dev/sda1", key)
+	s.addMockKeyslot("/dev/sda1", s.newRecoveryKey()[:])
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyReaders: []io.Reader{strings.NewReader(s.newRecoveryKey().String())},
+		Model:              SkipSnapModelCheck,
+		NoInteractive:      true}
+	err := ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options)
+	c.Check(xerrors.Is(err, ErrManualRecoveryRequired), testutil.IsTrue)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1)"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataRecoveryKeyReadersNoTries(c *C) {
+	// Test that candidate recovery keys are tried when RecoveryKeyTries is
+	// zero, and that no AuthRequestor is required.
+	keyData, key, _ := s.newNamedKeyData(c, "foo")
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", key)
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyReaders: []io.Reader{strings.NewReader(recoveryKey.String())},
+		Model:              SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), Equals, ErrRecoveryKeyUsed)
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataRecoveryKeyReadersNoTriesIncorrect(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "foo")
+	s.addMockKeyslot("/dev/sda1", key)
+	s.addMockKeyslot("/dev/sda1", s.newRecoveryKey()[:])
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyReaders: []io.Reader{strings.NewReader(s.newRecoveryKey().String())},
+		Model:              SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), ErrorMatches,
+		"cannot activate with platform protected keys:\n"+
+			"- foo: cannot recover key: the platform's secure device is unavailable: the "+
+			"platform device is unavailable\n"+
+			"and activation with recovery key failed: none of the candidate recovery keys could activate the volume and "+
+			"no recovery key tries permitted")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataRecoveryKeyReadersNoAuthRequestor(c *C) {
+	// Test that an AuthRequestor isn't required with candidate recovery keys
+	// unless they fail.
+	keyData, key, _ := s.newNamedKeyData(c, "foo")
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", key)
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries:   1,
+		RecoveryKeyReaders: []io.Reader{strings.NewReader(recoveryKey.String())},
+		Model:              SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), Equals, ErrRecoveryKeyUsed)
+
+	s.luks2.activated = make(map[string]string)
+	options.RecoveryKeyReaders = []io.Reader{strings.NewReader(s.newRecoveryKey().String())}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), ErrorMatches,
+		"(?s).*and activation with recovery key failed: cannot request recovery key: nil authRequestor")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyReadersNoTries(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	options := &ActivateVolumeOptions{
+		RecoveryKeyReaders: []io.Reader{strings.NewReader(recoveryKey.String())}}
+	result, err := ActivateVolumeWithRecoveryKeyResult("data", "/dev/sda1", nil, options)
+	c.Check(err, IsNil)
+	c.Check(result, DeepEquals, &RecoveryKeyActivationResult{Source: RecoveryKeySourceReader})
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyPrompt(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockPromptAuthRequestor{mockAuthRequestor: mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}}
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		PromptMessage:    "Enter the recovery key for {{.VolumeName}}:",
+		PromptIcon:       "dialog-password"}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, options), IsNil)
+	c.Check(authRequestor.recoveryKeyPrompts, DeepEquals, []*AuthRequestPrompt{
+		{Message: "Enter the recovery key for {{.VolumeName}}:", Icon: "dialog-password"}})
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"data": "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyNoPrompt(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockPromptAuthRequestor{mockAuthRequestor: mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}}
+	options := &ActivateVolumeOptions{RecoveryKeyTries: 1}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, options), IsNil)
+	c.Check(authRequestor.recoveryKeyPrompts, DeepEquals, []*AuthRequestPrompt{nil})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyPromptUnsupported(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		PromptMessage:    "Enter the recovery key:",
+		PromptIcon:       "dialog-password"}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, options), IsNil)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 1)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyInvalidPromptMessage(c *C) {
+	authRequestor := &mockPromptAuthRequestor{}
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		PromptMessage:    "{{.VolumeName"}
+	c.Check(ActivateVolumeWithRecoveryKey("data", "/dev/sda1", authRequestor, options), ErrorMatches,
+		"cannot parse prompt message template: .*")
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataPromptIcon(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	authRequestor := &mockPromptAuthRequestor{mockAuthRequestor: mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}}
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries: 1,
+		PromptIcon:       "dialog-password",
+		Model:            SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, authRequestor, nil, options), Equals, ErrRecoveryKeyUsed)
+	c.Check(authRequestor.recoveryKeyPrompts, DeepEquals, []*AuthRequestPrompt{{Icon: "dialog-password"}})
+}
+
 func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling6(c *C) {
 	// Test that activation fails if the supplied recovery key is incorrect
 	keyData, key, _ := s.newNamedKeyData(c, "bar")
@@ -1255,6 +2798,34 @@ func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling15(c *C) {
 		"and activation with recovery key failed: no recovery key tries permitted")
 }
 
+func (s *cryptSuite) TestActivateVolumeWithKeyDataErrorHandling16(c *C) {
+	// Test that activation fails if the supplied model is only authorized
+	// for a different role
+	keyData, key, auxKey := s.newNamedKeyData(c, "foo")
+	recoveryKey := s.newRecoveryKey()
+
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, model), IsNil)
+
+	c.Check(s.testActivateVolumeWithKeyDataErrorHandling(c, &testActivateVolumeWithKeyDataErrorHandlingData{
+		primaryKey:       key,
+		recoveryKey:      recoveryKey,
+		recoveryKeyTries: 0,
+		keyData:          keyData,
+		model:            model,
+		modelRole:        "recovery",
+		activateTries:    0,
+	}), ErrorMatches, "cannot activate with platform protected keys:\n"+
+		"- foo: snap model is not authorized\n"+
+		"and activation with recovery key failed: no recovery key tries permitted")
+}
+
 type testActivateVolumeWithMultipleKeyDataData struct {
 	keys    []DiskUnlockKey
 	keyData []*KeyData
@@ -1304,6 +2875,61 @@ func (s *cryptSuite) testActivateVolumeWithMultipleKeyData(c *C, data *testActiv
 	s.checkKeyDataKeysInKeyring(c, data.keyringPrefix, data.sourceDevicePath, data.key, data.auxKey)
 }
 
+func (s *cryptSuite) TestActivateVolumeWithKeyDataContext(c *C) {
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyDataContext(context.Background(), "data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1)"})
+
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", key, auxKey)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataContextCancelled(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{s.newRecoveryKey()}}
+	options := &ActivateVolumeOptions{RecoveryKeyTries: 1, Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyDataContext(ctx, "data", "/dev/sda1", keyData, authRequestor, nil, options), Equals, context.Canceled)
+	c.Check(s.luks2.operations, HasLen, 0)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataContextCancelledDuringPassphraseRequest(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	var kdf mockKDF
+	c.Check(keyData.SetPassphrase("1234", nil, &kdf), IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	authRequestor := &cancelingAuthRequestor{cancel: cancel}
+	options := &ActivateVolumeOptions{PassphraseTries: 3, RecoveryKeyTries: 3, Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyDataContext(ctx, "data", "/dev/sda1", keyData, authRequestor, &kdf, options), Equals, context.Canceled)
+	c.Check(authRequestor.requests, Equals, 1)
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyDataContextCancelledDuringRecoveryKeyRequest(c *C) {
+	keyData, _, _ := s.newNamedKeyData(c, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	authRequestor := &cancelingAuthRequestor{cancel: cancel}
+	options := &ActivateVolumeOptions{RecoveryKeyTries: 3, Model: SkipSnapModelCheck}
+	c.Check(ActivateVolumeWithKeyDataContext(ctx, "data", "/dev/sda1", keyData, authRequestor, nil, options), Equals, context.Canceled)
+	c.Check(authRequestor.requests, Equals, 1)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1)"})
+}
+
 func (s *cryptSuite) TestActivateVolumeWithMultipleKeyData1(c *C) {
 	keyData, keys, auxKeys := s.newMultipleNamedKeyData(c, "", "")
 
@@ -1602,6 +3228,44 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyData10(c *C) {
 		auxKey:           auxKeys[0]})
 }
 
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataResult(c *C) {
+	keyData, keys, auxKeys := s.newMultipleNamedKeyData(c, "foo", "bar")
+	s.addMockKeyslot("/dev/sda1", keys[1])
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	activatedKeyData, err := ActivateVolumeWithMultipleKeyDataResult("data", "/dev/sda1", keyData, nil, nil, options)
+	c.Check(err, IsNil)
+	c.Check(activatedKeyData, Equals, keyData[1])
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"Activate(data,/dev/sda1)",
+		"Activate(data,/dev/sda1)",
+	})
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", keys[1], auxKeys[1])
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataResultRecoveryKeyUsed(c *C) {
+	keyData, _, _ := s.newMultipleNamedKeyData(c, "foo", "bar")
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeOptions{RecoveryKeyTries: 1, Model: SkipSnapModelCheck}
+	activatedKeyData, err := ActivateVolumeWithMultipleKeyDataResult("data", "/dev/sda1", keyData, authRequestor, nil, options)
+	c.Check(err, Equals, ErrRecoveryKeyUsed)
+	c.Check(activatedKeyData, IsNil)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataResultError(c *C) {
+	keyData, _, _ := s.newMultipleNamedKeyData(c, "foo")
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	activatedKeyData, err := ActivateVolumeWithMultipleKeyDataResult("data", "/dev/sda1", keyData, nil, nil, options)
+	c.Check(err, ErrorMatches, "(?s)cannot activate with platform protected keys:.*")
+	c.Check(activatedKeyData, IsNil)
+}
+
 type testActivateVolumeWithMultipleKeyDataErrorHandlingData struct {
 	keys        []DiskUnlockKey
 	recoveryKey RecoveryKey
@@ -1849,6 +3513,32 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling10(c *C)
 	}), Equals, ErrRecoveryKeyUsed)
 }
 
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandlingPassphraseRequestFailed(c *C) {
+	// Test that no further passphrase requests are made if the auth
+	// requestor fails, and that the recovery key is requested instead.
+	keyData, keys, _ := s.newMultipleNamedKeyData(c, "", "")
+	recoveryKey := s.newRecoveryKey()
+
+	var kdf mockKDF
+	c.Check(keyData[0].SetPassphrase("1234", nil, &kdf), IsNil)
+	c.Check(keyData[1].SetPassphrase("1234", nil, &kdf), IsNil)
+
+	c.Check(s.testActivateVolumeWithMultipleKeyDataErrorHandling(c, &testActivateVolumeWithMultipleKeyDataErrorHandlingData{
+		keys:        keys,
+		recoveryKey: recoveryKey,
+		keyData:     keyData,
+		authRequestor: &mockAuthRequestor{
+			passphraseResponses: []interface{}{
+				NewAuthRequestFailedError(errors.New("cannot execute systemd-ask-password: signal: killed"))},
+			recoveryKeyResponses: []interface{}{recoveryKey}},
+		kdf:              &kdf,
+		passphraseTries:  3,
+		recoveryKeyTries: 1,
+		model:            SkipSnapModelCheck,
+		activateTries:    1,
+	}), Equals, ErrRecoveryKeyUsed)
+}
+
 func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling11(c *C) {
 	// Test that we get an error if no AuthRequestor is supplied when
 	// PassphraseTries is non-zero.
@@ -1935,6 +3625,62 @@ func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataErrorHandling15(c *C)
 		"and activation with recovery key failed: no recovery key tries permitted")
 }
 
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataConcurrent(c *C) {
+	// Test that activation succeeds when recovering keys concurrently, where
+	// only the last key is valid for the container.
+	keyData, keys, auxKeys := s.newMultipleNamedKeyData(c, "foo", "bar", "baz")
+	s.addMockKeyslot("/dev/sda1", keys[2])
+
+	options := &ActivateVolumeOptions{
+		Model:                      SkipSnapModelCheck,
+		MaxConcurrentKeyRecoveries: 2}
+	activatedKeyData, err := ActivateVolumeWithMultipleKeyDataResult("data", "/dev/sda1", keyData, nil, nil, options)
+	c.Assert(err, IsNil)
+	c.Check(activatedKeyData, Equals, keyData[2])
+
+	// The order in which keys are recovered isn't deterministic, so
+	// the number of activation attempts isn't either.
+	c.Check(len(s.luks2.operations) >= 1 && len(s.luks2.operations) <= 3, testutil.IsTrue)
+	for _, op := range s.luks2.operations {
+		c.Check(op, Equals, "Activate(data,/dev/sda1)")
+	}
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", keys[2], auxKeys[2])
+}
+
+func (s *cryptSuite) TestActivateVolumeWithMultipleKeyDataConcurrentErrorHandling(c *C) {
+	// Test that errors are reported in the order in which the keys are
+	// supplied and that recovery fallback works when recovering keys
+	// concurrently.
+	keyData, keys, _ := s.newMultipleNamedKeyData(c, "foo", "bar", "baz")
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", keys[0])
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	s.handler.state = mockPlatformDeviceStateUnavailable
+
+	authRequestor := &mockAuthRequestor{recoveryKeyResponses: []interface{}{recoveryKey}}
+	options := &ActivateVolumeOptions{
+		RecoveryKeyTries:           1,
+		Model:                      SkipSnapModelCheck,
+		MaxConcurrentKeyRecoveries: 3}
+	err := ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", keyData, authRequestor, nil, options)
+	c.Check(err, Equals, ErrRecoveryKeyUsed)
+	c.Check(authRequestor.recoveryKeyRequests, HasLen, 1)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Activate(data,/dev/sda1)"})
+
+	s.luks2.operations = nil
+	options.RecoveryKeyTries = 0
+	err = ActivateVolumeWithMultipleKeyData("data", "/dev/sda1", keyData, nil, nil, options)
+	c.Check(err, ErrorMatches, "cannot activate with platform protected keys:\n"+
+		"- foo: cannot recover key: the platform's secure device is unavailable: the platform device is unavailable\n"+
+		"- bar: cannot recover key: the platform's secure device is unavailable: the platform device is unavailable\n"+
+		"- baz: cannot recover key: the platform's secure device is unavailable: the platform device is unavailable\n"+
+		"and activation with recovery key failed: no recovery key tries permitted")
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
 type testActivateVolumeWithKeyData struct {
 	keyData         []byte
 	expectedKeyData []byte
@@ -1982,17 +3728,212 @@ func (s *cryptSuite) TestActivateVolumeWithKeyMismatchErr(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestActivateVolumeWithKeyEmpty(c *C) {
+	err := ActivateVolumeWithKey("luks-volume", "/dev/sda1", nil, nil)
+	c.Check(err, ErrorMatches, `invalid key length \(0 bytes\)`)
+	c.Check(err, DeepEquals, &InvalidKeyLengthError{Length: 0})
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyTooLong(c *C) {
+	err := ActivateVolumeWithKey("luks-volume", "/dev/sda1", make([]byte, (8192*1024)+1), nil)
+	c.Check(err, ErrorMatches, `invalid key length \(8388609 bytes\)`)
+	c.Check(err, DeepEquals, &InvalidKeyLengthError{Length: (8192 * 1024) + 1})
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyFile(c *C) {
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	s.addMockKeyslot("/dev/sda1", key)
+
+	path := filepath.Join(c.MkDir(), "keyfile")
+	c.Assert(ioutil.WriteFile(path, append(make([]byte, 512), key...), 0600), IsNil)
+
+	c.Check(ActivateVolumeWithKeyFile("luks-volume", "/dev/sda1", path, 512, 16, nil), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"ActivateWithKeyFile(luks-volume,/dev/sda1," + path + ",512,16)"})
+	c.Check(s.luks2.activated, DeepEquals, map[string]string{"luks-volume": "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyFileWithHeaderPath(c *C) {
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	s.addMockKeyslot("/boot/luks/sda1.hdr", key)
+
+	path := filepath.Join(c.MkDir(), "keyfile")
+	c.Assert(ioutil.WriteFile(path, key, 0600), IsNil)
+
+	options := &ActivateVolumeOptions{HeaderPath: "/boot/luks/sda1.hdr"}
+	c.Check(ActivateVolumeWithKeyFile("luks-volume", "/dev/sda1", path, 0, 16, options), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"ActivateWithKeyFile(luks-volume,/dev/sda1," + path + ",0,16,/boot/luks/sda1.hdr)"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyFileMismatchErr(c *C) {
+	s.addMockKeyslot("/dev/sda1", []byte{0, 0, 0, 0, 1})
+
+	path := filepath.Join(c.MkDir(), "keyfile")
+	c.Assert(ioutil.WriteFile(path, []byte{1, 2, 3, 4, 5, 6, 7, 8}, 0600), IsNil)
+
+	err := ActivateVolumeWithKeyFile("luks-volume", "/dev/sda1", path, 0, 8, nil)
+	c.Check(err, ErrorMatches, "systemd-cryptsetup failed with: exit status 1")
+	c.Check(s.luks2.operations, DeepEquals, []string{"ActivateWithKeyFile(luks-volume,/dev/sda1," + path + ",0,8)"})
+}
+
+func (s *cryptSuite) TestActivateVolumeWithKeyFileInvalidSize(c *C) {
+	for _, size := range []int64{0, -1, (8192 * 1024) + 1} {
+		err := ActivateVolumeWithKeyFile("luks-volume", "/dev/sda1", "/run/keyfile", 0, size, nil)
+		c.Check(err, ErrorMatches, fmt.Sprintf(`invalid key length \(%d bytes\)`, size))
+		c.Check(err, DeepEquals, &InvalidKeyLengthError{Length: int(size)})
+	}
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
 func (s *cryptSuite) TestDeactivateVolume(c *C) {
 	s.luks2.activated["luks-volume"] = "/dev/sda1"
 	err := DeactivateVolume("luks-volume")
 	c.Assert(err, IsNil)
-	c.Check(s.luks2.operations, DeepEquals, []string{"Deactivate(luks-volume)"})
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"ActiveVolumeSourceDevice(luks-volume)",
+		"Deactivate(luks-volume)",
+	})
 }
 
 func (s *cryptSuite) TestDeactivateVolumeErr(c *C) {
 	err := DeactivateVolume("bad-volume")
-	c.Assert(err, ErrorMatches, `systemd-cryptsetup failed with: exit status 1`)
-	c.Check(s.luks2.operations, DeepEquals, []string{"Deactivate(bad-volume)"})
+	c.Assert(err, Equals, ErrVolumeNotActive)
+	c.Check(s.luks2.operations, DeepEquals, []string{"ActiveVolumeSourceDevice(bad-volume)"})
+}
+
+func (s *cryptSuite) TestDeactivateVolumeRemovesKeys(c *C) {
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	c.Assert(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", key, auxKey)
+
+	c.Check(DeactivateVolume("data"), IsNil)
+	c.Check(s.luks2.activated, HasLen, 0)
+
+	_, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+	_, err = GetAuxiliaryKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *cryptSuite) TestDeactivateVolumeSourceDeviceError(c *C) {
+	s.AddCleanup(MockLUKS2ActiveVolumeSourceDevice(func(volumeName string) (string, error) {
+		return "", errors.New("some error")
+	}))
+
+	s.luks2.activated["data"] = "/dev/sda1"
+	c.Check(DeactivateVolume("data"), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Deactivate(data)"})
+}
+
+func (s *cryptSuite) TestDeactivateVolumeWithOptions(c *C) {
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	options := &ActivateVolumeOptions{KeyringPrefix: "foo", KeyringKeyName: "data", Model: SkipSnapModelCheck}
+	c.Assert(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+	s.checkKeyDataKeysInKeyring(c, "foo", "/dev/sda1", key, auxKey)
+
+	path := "/run/mnt/tools/systemd-cryptsetup"
+	s.AddCleanup(MockLUKS2Deactivate(func(volumeName string, options *luks2.DeactivateOptions) error {
+		c.Check(options, DeepEquals, &luks2.DeactivateOptions{SystemdCryptsetupPath: path})
+		return s.luks2.deactivate(volumeName, options)
+	}))
+
+	s.luks2.operations = nil
+	c.Check(DeactivateVolumeWithOptions("data", &DeactivateVolumeOptions{
+		SystemdCryptsetupPath: path,
+		SourceDevicePath:      "/dev/sda1",
+		KeyringPrefix:         "foo",
+		KeyringKeyNames:       []string{"data"}}), IsNil)
+	c.Check(s.luks2.activated, HasLen, 0)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Deactivate(data)"})
+
+	_, err := GetDiskUnlockKeyFromKernel("foo", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+	_, err = GetAuxiliaryKeyFromKernel("foo", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+	_, err = GetDiskUnlockKeyFromKernelByName("foo", "data", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *cryptSuite) TestDeactivateVolumeAndRemoveKeys(c *C) {
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	options := &ActivateVolumeOptions{Model: SkipSnapModelCheck}
+	c.Assert(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", key, auxKey)
+
+	c.Check(DeactivateVolumeAndRemoveKeys("data", "/dev/sda1", ""), IsNil)
+	c.Check(s.luks2.activated, HasLen, 0)
+
+	_, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+	_, err = GetAuxiliaryKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *cryptSuite) TestDeactivateVolumeAndRemoveKeysWithKeyringKeyName(c *C) {
+	keyData, key, auxKey := s.newNamedKeyData(c, "")
+	s.addMockKeyslot("/dev/sda1", key)
+
+	options := &ActivateVolumeOptions{KeyringKeyName: "data", Model: SkipSnapModelCheck}
+	c.Assert(ActivateVolumeWithKeyData("data", "/dev/sda1", keyData, nil, nil, options), IsNil)
+	s.checkKeyDataKeysInKeyring(c, "", "/dev/sda1", key, auxKey)
+
+	c.Check(DeactivateVolumeAndRemoveKeys("data", "/dev/sda1", "", "data"), IsNil)
+	c.Check(s.luks2.activated, HasLen, 0)
+
+	_, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+	_, err = GetAuxiliaryKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+	_, err = GetDiskUnlockKeyFromKernelByName("", "data", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *cryptSuite) TestDeactivateVolumeAndRemoveKeysNoKeys(c *C) {
+	s.luks2.activated["data"] = "/dev/sda1"
+	c.Check(DeactivateVolumeAndRemoveKeys("data", "/dev/sda1", "foo"), IsNil)
+	c.Check(s.luks2.operations, DeepEquals, []string{"Deactivate(data)"})
+}
+
+func (s *cryptSuite) TestDeactivateVolumeAndRemoveKeysNotActive(c *C) {
+	c.Check(DeactivateVolumeAndRemoveKeys("data", "/dev/sda1", ""), Equals, ErrVolumeNotActive)
+}
+
+func (s *cryptSuite) TestCheckKeyDataUnlockKey(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+	c.Check(CheckKeyDataUnlockKey(keyData, key, "", nil), IsNil)
+}
+
+func (s *cryptSuite) TestCheckKeyDataUnlockKeyWithPassphrase(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+
+	var kdf mockKDF
+	c.Check(keyData.SetPassphrase("1234", nil, &kdf), IsNil)
+
+	c.Check(CheckKeyDataUnlockKey(keyData, key, "1234", &kdf), IsNil)
+}
+
+func (s *cryptSuite) TestCheckKeyDataUnlockKeyMismatch(c *C) {
+	keyData, _, _ := s.newNamedKeyData(c, "")
+	c.Check(CheckKeyDataUnlockKey(keyData, s.newPrimaryKey(), "", nil), Equals, ErrKeyDataUnlockKeyMismatch)
+}
+
+func (s *cryptSuite) TestCheckKeyDataUnlockKeyInvalidPassphrase(c *C) {
+	keyData, key, _ := s.newNamedKeyData(c, "")
+
+	var kdf mockKDF
+	c.Check(keyData.SetPassphrase("1234", nil, &kdf), IsNil)
+
+	err := CheckKeyDataUnlockKey(keyData, key, "5678", &kdf)
+	c.Check(err, ErrorMatches, "cannot recover key: the supplied passphrase is incorrect")
+	c.Check(xerrors.Is(err, ErrInvalidPassphrase), testutil.IsTrue)
 }
 
 type testInitializeLUKS2ContainerData struct {
@@ -2040,6 +3981,129 @@ func (s *cryptSuite) TestInitializeLUKS2Container(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithProgress(c *C) {
+	key := s.newPrimaryKey()
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", key, &InitializeLUKS2ContainerOptions{
+		Progress: func(event string) {
+			s.luks2.operations = append(s.luks2.operations, "Progress("+event+")")
+		}}), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"Progress(formatting)",
+		fmt.Sprint("Format(/dev/sda1,data,", &luks2.FormatOptions{KDFOptions: luks2.KDFOptions{ForceIterations: 4, MemoryKiB: 32}}, ")"),
+		"Progress(importing token)",
+		"ImportToken(/dev/sda1,<nil>)",
+		"Progress(setting keyslot priority)",
+		"SetSlotPriority(/dev/sda1,0,prefer)"})
+}
+
+func (s *cryptSuite) mockBusyFormat(busyCount int) (sleeps *[]time.Duration, restore func()) {
+	var restores []func()
+	restores = append(restores, MockLUKS2Format(func(devicePath, label string, key []byte, options *luks2.FormatOptions) error {
+		if busyCount > 0 {
+			busyCount--
+			s.luks2.operations = append(s.luks2.operations, "Format(busy)")
+			return luks2.ErrDeviceBusy
+		}
+		return s.luks2.format(devicePath, label, key, options)
+	}))
+
+	sleeps = new([]time.Duration)
+	restores = append(restores, MockTimeSleep(func(d time.Duration) {
+		*sleeps = append(*sleeps, d)
+	}))
+
+	return sleeps, func() {
+		for _, fn := range restores {
+			fn()
+		}
+	}
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerRetryBusy(c *C) {
+	sleeps, restore := s.mockBusyFormat(2)
+	defer restore()
+
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), nil), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"Format(busy)",
+		"Format(busy)",
+		fmt.Sprint("Format(/dev/sda1,data,", &luks2.FormatOptions{KDFOptions: luks2.KDFOptions{ForceIterations: 4, MemoryKiB: 32}}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,0,prefer)"})
+	c.Check(*sleeps, DeepEquals, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerRetryBusyWithProgress(c *C) {
+	_, restore := s.mockBusyFormat(1)
+	defer restore()
+
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), &InitializeLUKS2ContainerOptions{
+		Progress: func(event string) {
+			s.luks2.operations = append(s.luks2.operations, "Progress("+event+")")
+		}}), IsNil)
+
+	c.Check(s.luks2.operations[0:4], DeepEquals, []string{
+		"Progress(formatting)",
+		"Format(busy)",
+		"Progress(device busy, retrying in 250ms)",
+		"Progress(formatting)"})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerRetryBusyExhausted(c *C) {
+	sleeps, restore := s.mockBusyFormat(10)
+	defer restore()
+
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), &InitializeLUKS2ContainerOptions{
+		BusyRetries:    2,
+		BusyRetryDelay: 10 * time.Millisecond}), ErrorMatches, "cannot format: device is busy")
+
+	c.Check(s.luks2.operations, DeepEquals, []string{"Format(busy)", "Format(busy)", "Format(busy)"})
+	c.Check(*sleeps, DeepEquals, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerRetryBusyDisabled(c *C) {
+	sleeps, restore := s.mockBusyFormat(1)
+	defer restore()
+
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), &InitializeLUKS2ContainerOptions{
+		BusyRetries: -1}), ErrorMatches, "cannot format: device is busy")
+
+	c.Check(s.luks2.operations, DeepEquals, []string{"Format(busy)"})
+	c.Check(*sleeps, HasLen, 0)
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerNoRetryOnOtherErrors(c *C) {
+	restore := MockLUKS2Format(func(string, string, []byte, *luks2.FormatOptions) error {
+		s.luks2.operations = append(s.luks2.operations, "Format(error)")
+		return errors.New("some error")
+	})
+	defer restore()
+
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), nil), ErrorMatches, "cannot format: some error")
+	c.Check(s.luks2.operations, DeepEquals, []string{"Format(error)"})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithDetachedHeader(c *C) {
+	key := s.newPrimaryKey()
+	headerPath := filepath.Join(c.MkDir(), "header")
+
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", key, &InitializeLUKS2ContainerOptions{HeaderPath: headerPath}), IsNil)
+
+	fmtOpts := &luks2.FormatOptions{
+		KDFOptions: luks2.KDFOptions{ForceIterations: 4, MemoryKiB: 32},
+		HeaderPath: headerPath}
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		fmt.Sprint("Format(/dev/sda1,data,", fmtOpts, ")"),
+		"ImportToken(" + headerPath + ",<nil>)",
+		"SetSlotPriority(" + headerPath + ",0,prefer)"})
+
+	dev, ok := s.luks2.devices[headerPath]
+	c.Assert(ok, testutil.IsTrue)
+	c.Check(dev.keyslots[0], DeepEquals, key)
+}
+
 func (s *cryptSuite) TestInitializeLUKS2ContainerDifferentArgs(c *C) {
 	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
 		devicePath: "/dev/vdc2",
@@ -2086,40 +4150,378 @@ func (s *cryptSuite) TestInitializeLUKS2ContainerWithCustomMetadataSize(c *C) {
 	})
 }
 
-func (s *cryptSuite) TestInitializeLUKS2ContainerWithCustomKDFTime(c *C) {
-	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
-		devicePath: "/dev/sda1",
-		label:      "data",
-		key:        s.newPrimaryKey(),
-		opts: &InitializeLUKS2ContainerOptions{
-			KDFOptions: &KDFOptions{TargetDuration: 100 * time.Millisecond},
-		},
-		fmtOpts: &luks2.FormatOptions{KDFOptions: luks2.KDFOptions{TargetDuration: 100 * time.Millisecond}},
-	})
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithCustomCipher(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/sda1",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			Cipher:      "xchacha20,aes-adiantum-plain64",
+			KeySizeBits: 256,
+		},
+		fmtOpts: &luks2.FormatOptions{
+			KDFOptions:  luks2.KDFOptions{ForceIterations: 4, MemoryKiB: 32},
+			Cipher:      "xchacha20,aes-adiantum-plain64",
+			KeySizeBits: 256,
+		},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithIntegrity(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/sda1",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			Cipher:      "aes-gcm-random",
+			KeySizeBits: 256,
+			Integrity:   "aead",
+		},
+		fmtOpts: &luks2.FormatOptions{
+			KDFOptions:  luks2.KDFOptions{ForceIterations: 4, MemoryKiB: 32},
+			Cipher:      "aes-gcm-random",
+			KeySizeBits: 256,
+			Integrity:   "aead",
+		},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithArgon2id(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/sda1",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			KDFOptions: &KDFOptions{MemoryKiB: 64 * 1024, Parallel: 2, TargetDuration: 100 * time.Millisecond},
+			KDFType:    LUKS2KDFTypeArgon2id,
+		},
+		fmtOpts: &luks2.FormatOptions{
+			KDFOptions: luks2.KDFOptions{
+				Type:           luks2.KDFTypeArgon2id,
+				TargetDuration: 100 * time.Millisecond,
+				MemoryKiB:      64 * 1024,
+				Parallel:       2},
+		},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithPBKDF2(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/sda1",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts:       &InitializeLUKS2ContainerOptions{KDFType: LUKS2KDFTypePBKDF2},
+		fmtOpts: &luks2.FormatOptions{
+			KDFOptions: luks2.KDFOptions{Type: luks2.KDFTypePBKDF2, ForceIterations: 1000},
+		},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithCustomKDFTime(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/sda1",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			KDFOptions: &KDFOptions{TargetDuration: 100 * time.Millisecond},
+		},
+		fmtOpts: &luks2.FormatOptions{KDFOptions: luks2.KDFOptions{TargetDuration: 100 * time.Millisecond}},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithCustomKDFMemory(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/sda1",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			KDFOptions: &KDFOptions{MemoryKiB: 128},
+		},
+		fmtOpts: &luks2.FormatOptions{KDFOptions: luks2.KDFOptions{MemoryKiB: 128}},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithCustomKDFIterations(c *C) {
+	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
+		devicePath: "/dev/sda1",
+		label:      "data",
+		key:        s.newPrimaryKey(),
+		opts: &InitializeLUKS2ContainerOptions{
+			KDFOptions: &KDFOptions{ForceIterations: 10},
+		},
+		fmtOpts: &luks2.FormatOptions{KDFOptions: luks2.KDFOptions{ForceIterations: 10}},
+	})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerCommand(c *C) {
+	args, err := InitializeLUKS2ContainerCommand("/dev/sda1", "data", nil)
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+		"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+		"--pbkdf-memory", "32", "/dev/sda1"})
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerCommandWithOptions(c *C) {
+	args, err := InitializeLUKS2ContainerCommand("/dev/vdb2", "test", &InitializeLUKS2ContainerOptions{
+		KDFType:     LUKS2KDFTypePBKDF2,
+		HeaderPath:  "/run/header",
+		Cipher:      "aes-xts-plain64",
+		KeySizeBits: 256})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+		"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "256",
+		"--label", "test", "--pbkdf", "pbkdf2", "--pbkdf-force-iterations", "1000",
+		"--header", "/run/header", "/dev/vdb2"})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerCommandWithExtraFormatArgs(c *C) {
+	args, err := InitializeLUKS2ContainerCommand("/dev/sda1", "data", &InitializeLUKS2ContainerOptions{
+		ExtraFormatArgs: []string{"--integrity-no-wipe", "--offset=2048"}})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+		"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+		"--pbkdf-memory", "32", "--integrity-no-wipe", "--offset=2048", "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithSectorSize(c *C) {
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), &InitializeLUKS2ContainerOptions{SectorSize: 4096}), IsNil)
+
+	fmtOpts := &luks2.FormatOptions{
+		KDFOptions: luks2.KDFOptions{ForceIterations: 4, MemoryKiB: 32},
+		SectorSize: 4096}
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		fmt.Sprint("Format(/dev/sda1,data,", fmtOpts, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,0,prefer)"})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerCommandWithSectorSize(c *C) {
+	args, err := InitializeLUKS2ContainerCommand("/dev/sda1", "data", &InitializeLUKS2ContainerOptions{SectorSize: 4096})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+		"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+		"--pbkdf-memory", "32", "--sector-size", "4096", "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerCommandWithCryptsetupPath(c *C) {
+	args, err := InitializeLUKS2ContainerCommand("/dev/sda1", "data", &InitializeLUKS2ContainerOptions{CryptsetupPath: "/run/mnt/tools/cryptsetup"})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"/run/mnt/tools/cryptsetup", "-q", "luksFormat", "--type", "luks2",
+		"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+		"--pbkdf-memory", "32", "/dev/sda1"})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithCryptsetupPath(c *C) {
+	path := "/run/mnt/tools/cryptsetup"
+
+	var paths []string
+	s.AddCleanup(MockLUKS2IsLUKS2(func(devicePath string, options *luks2.CommandOptions) (bool, error) {
+		paths = append(paths, "IsLUKS2:"+options.CryptsetupPath)
+		return s.luks2.isLUKS2(devicePath, options)
+	}))
+	s.AddCleanup(MockLUKS2Format(func(devicePath, label string, key []byte, options *luks2.FormatOptions) error {
+		paths = append(paths, "Format:"+options.CryptsetupPath)
+		return s.luks2.format(devicePath, label, key, options)
+	}))
+	s.AddCleanup(MockLUKS2ImportToken(func(devicePath string, token luks2.Token, options *luks2.ImportTokenOptions) error {
+		c.Check(options.Id, Equals, luks2.AnyId)
+		paths = append(paths, "ImportToken:"+options.CryptsetupPath)
+		return s.luks2.importToken(devicePath, token, options)
+	}))
+	s.AddCleanup(MockLUKS2SetSlotPriority(func(devicePath string, slot int, priority luks2.SlotPriority, options *luks2.CommandOptions) error {
+		paths = append(paths, "SetSlotPriority:"+options.CryptsetupPath)
+		return s.luks2.setSlotPriority(devicePath, slot, priority, options)
+	}))
+
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), &InitializeLUKS2ContainerOptions{
+		KDFOptions:     &KDFOptions{ForceIterations: 4, MemoryKiB: 32},
+		CryptsetupPath: path,
+		RefuseExisting: true}), IsNil)
+	c.Check(paths, DeepEquals, []string{
+		"IsLUKS2:" + path,
+		"Format:" + path,
+		"ImportToken:" + path,
+		"SetSlotPriority:" + path,
+	})
+
+	dev, ok := s.luks2.devices["/dev/sda1"]
+	c.Assert(ok, testutil.IsTrue)
+	c.Check(dev.tokens, HasLen, 1)
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerCommandInvalidSectorSize(c *C) {
+	_, err := InitializeLUKS2ContainerCommand("/dev/sda1", "data", &InitializeLUKS2ContainerOptions{SectorSize: 8192})
+	c.Check(err, ErrorMatches, "invalid sector size 8192")
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerCommandWithManagedExtraFormatArgs(c *C) {
+	_, err := InitializeLUKS2ContainerCommand("/dev/sda1", "data", &InitializeLUKS2ContainerOptions{
+		ExtraFormatArgs: []string{"--type=luks1"}})
+	c.Check(err, ErrorMatches, `cannot specify the "--type" option as an extra argument`)
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerWithExtraFormatArgs(c *C) {
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), &InitializeLUKS2ContainerOptions{
+		ExtraFormatArgs: []string{"--integrity-no-wipe"}}), IsNil)
+
+	fmtOpts := &luks2.FormatOptions{
+		KDFOptions: luks2.KDFOptions{ForceIterations: 4, MemoryKiB: 32},
+		ExtraArgs:  []string{"--integrity-no-wipe"}}
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		fmt.Sprint("Format(/dev/sda1,data,", fmtOpts, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,0,prefer)"})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerCommandInvalidOptions(c *C) {
+	_, err := InitializeLUKS2ContainerCommand("/dev/sda1", "data", &InitializeLUKS2ContainerOptions{KeySizeBits: 128})
+	c.Check(err, ErrorMatches, "cannot use a key size of 128 bits with cipher aes-xts-plain64: XTS requires 2 keys of 128, 192 or 256 bits")
+}
+
+func (s *cryptSuite) TestReformatLUKS2Container(c *C) {
+	key := s.newPrimaryKey()
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", key)
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	c.Check(ReformatLUKS2Container("/dev/sda1", "data", key, recoveryKey, &ReformatLUKS2ContainerOptions{
+		InitializeOptions: &InitializeLUKS2ContainerOptions{MetadataKiBSize: 2 * 1024}}), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"TestKey(/dev/sda1,-1)",
+		"TestKey(/dev/sda1,-1)",
+		fmt.Sprint("Format(/dev/sda1,data,", &luks2.FormatOptions{MetadataKiBSize: 2 * 1024, KDFOptions: luks2.KDFOptions{ForceIterations: 4, MemoryKiB: 32}}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,0,prefer)",
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 1}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,1,normal)",
+	})
+
+	dev, ok := s.luks2.devices["/dev/sda1"]
+	c.Assert(ok, testutil.IsTrue)
+	c.Check(dev.keyslots, DeepEquals, map[int][]byte{0: key, 1: recoveryKey[:]})
+
+	var expectedToken luks2.Token = &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 1,
+			TokenName:    "default-recovery"}}
+	c.Check(dev.tokens[1], DeepEquals, expectedToken)
+}
+
+func (s *cryptSuite) TestReformatLUKS2ContainerWithCryptsetupPath(c *C) {
+	key := s.newPrimaryKey()
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", key)
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	path := "/run/mnt/tools/cryptsetup"
+
+	var paths []string
+	s.AddCleanup(MockLUKS2TestKey(func(devicePath string, slot int, key []byte, options *luks2.CommandOptions) error {
+		paths = append(paths, "TestKey:"+options.CryptsetupPath)
+		return s.luks2.testKey(devicePath, slot, key, options)
+	}))
+	s.AddCleanup(MockLUKS2AddKey(func(devicePath string, existingKey, key []byte, options *luks2.AddKeyOptions) error {
+		paths = append(paths, "AddKey:"+options.CryptsetupPath)
+		return s.luks2.addKey(devicePath, existingKey, key, options)
+	}))
+
+	c.Check(ReformatLUKS2Container("/dev/sda1", "data", key, recoveryKey, &ReformatLUKS2ContainerOptions{
+		InitializeOptions: &InitializeLUKS2ContainerOptions{CryptsetupPath: path}}), IsNil)
+	c.Check(paths, DeepEquals, []string{
+		"TestKey:" + path,
+		"TestKey:" + path,
+		"AddKey:" + path,
+	})
+}
+
+func (s *cryptSuite) TestReformatLUKS2ContainerIncorrectKey(c *C) {
+	recoveryKey := s.newRecoveryKey()
+	s.addMockKeyslot("/dev/sda1", s.newPrimaryKey())
+	s.addMockKeyslot("/dev/sda1", recoveryKey[:])
+
+	c.Check(ReformatLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), recoveryKey, nil), ErrorMatches,
+		"the supplied key cannot unlock the existing container")
+	c.Check(s.luks2.operations, DeepEquals, []string{"TestKey(/dev/sda1,-1)"})
 }
 
-func (s *cryptSuite) TestInitializeLUKS2ContainerWithCustomKDFMemory(c *C) {
-	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
-		devicePath: "/dev/sda1",
-		label:      "data",
-		key:        s.newPrimaryKey(),
-		opts: &InitializeLUKS2ContainerOptions{
-			KDFOptions: &KDFOptions{MemoryKiB: 128},
-		},
-		fmtOpts: &luks2.FormatOptions{KDFOptions: luks2.KDFOptions{MemoryKiB: 128}},
+func (s *cryptSuite) TestReformatLUKS2ContainerIncorrectRecoveryKey(c *C) {
+	key := s.newPrimaryKey()
+	s.addMockKeyslot("/dev/sda1", key)
+
+	c.Check(ReformatLUKS2Container("/dev/sda1", "data", key, s.newRecoveryKey(), nil), ErrorMatches,
+		"the supplied recovery key cannot unlock the existing container")
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"TestKey(/dev/sda1,-1)",
+		"TestKey(/dev/sda1,-1)",
 	})
 }
 
-func (s *cryptSuite) TestInitializeLUKS2ContainerWithCustomKDFIterations(c *C) {
-	s.testInitializeLUKS2Container(c, &testInitializeLUKS2ContainerData{
-		devicePath: "/dev/sda1",
-		label:      "data",
-		key:        s.newPrimaryKey(),
-		opts: &InitializeLUKS2ContainerOptions{
-			KDFOptions: &KDFOptions{ForceIterations: 10},
-		},
-		fmtOpts: &luks2.FormatOptions{KDFOptions: luks2.KDFOptions{ForceIterations: 10}},
-	})
+func (s *cryptSuite) TestInitializeLUKS2ContainerExisting(c *C) {
+	s.addMockKeyslot("/dev/sda1", s.newPrimaryKey())
+
+	err := InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), &InitializeLUKS2ContainerOptions{RefuseExisting: true})
+	c.Check(err, ErrorMatches, "/dev/sda1 is already a LUKS2 container")
+	c.Check(err, FitsTypeOf, &LUKS2ContainerExistsError{})
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerExistingDetachedHeader(c *C) {
+	headerPath := filepath.Join(c.MkDir(), "header")
+	c.Assert(ioutil.WriteFile(headerPath, nil, 0600), IsNil)
+	s.addMockKeyslot(headerPath, s.newPrimaryKey())
+
+	err := InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), &InitializeLUKS2ContainerOptions{
+		HeaderPath:     headerPath,
+		RefuseExisting: true})
+	c.Check(err, ErrorMatches, headerPath+" is already a LUKS2 container")
+	c.Check(err, FitsTypeOf, &LUKS2ContainerExistsError{})
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerExistingOverwrite(c *C) {
+	s.addMockKeyslot("/dev/sda1", s.newPrimaryKey())
+
+	key := s.newPrimaryKey()
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", key, nil), IsNil)
+
+	dev, ok := s.luks2.devices["/dev/sda1"]
+	c.Assert(ok, testutil.IsTrue)
+	c.Check(dev.keyslots, DeepEquals, map[int][]byte{0: key})
+}
+
+func (s *cryptSuite) TestInitializeLUKS2ContainerIsLUKS2Error(c *C) {
+	s.AddCleanup(MockLUKS2IsLUKS2(func(string, *luks2.CommandOptions) (bool, error) {
+		return false, errors.New("some error")
+	}))
+
+	c.Check(InitializeLUKS2Container("/dev/sda1", "data", s.newPrimaryKey(), &InitializeLUKS2ContainerOptions{RefuseExisting: true}), ErrorMatches,
+		"cannot determine if /dev/sda1 is a LUKS2 container: some error")
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestIsLUKS2Container(c *C) {
+	s.addMockKeyslot("/dev/sda1", s.newPrimaryKey())
+
+	isLUKS2, err := IsLUKS2Container("/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(isLUKS2, testutil.IsTrue)
+
+	isLUKS2, err = IsLUKS2Container("/dev/sda2")
+	c.Check(err, IsNil)
+	c.Check(isLUKS2, testutil.IsFalse)
 }
 
 func (s *cryptSuite) TestInitializeLUKS2ContainerInvalidKeySize(c *C) {
@@ -2204,7 +4606,7 @@ func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyDifferentPath(c *C) {
 	existingKey := s.newPrimaryKey()
 
 	s.testAddLUKS2ContainerUnlockKey(c, &testAddLUKS2ContainerUnlockKeyData{
-		devicePath: "/dev/vdb1",
+		devicePath: "/dev/sda1",
 		dev: &mockLUKS2Container{
 			tokens: map[int]luks2.Token{
 				0: &luksview.KeyDataToken{
@@ -2407,6 +4809,253 @@ func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyNameInUse(c *C) {
 	c.Check(AddLUKS2ContainerUnlockKey("/dev/sda1", "default", existingKey, make([]byte, 32), nil), ErrorMatches, "the specified name is already in use")
 }
 
+func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyWithOptions(c *C) {
+	existingKey := s.newPrimaryKey()
+	dev := s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+	s.luks2.devices["/dev/sda1"] = dev
+
+	key := s.newPrimaryKey()
+	slot, err := AddLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "secondary", existingKey, key, &AddLUKS2ContainerUnlockKeyOptions{
+		Slot:     4,
+		Priority: LUKS2KeyslotPriorityNormal})
+	c.Check(err, IsNil)
+	c.Check(slot, Equals, 4)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{ForceIterations: 4, MemoryKiB: 32}, Slot: 4}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,4,normal)",
+	})
+
+	c.Check(dev.keyslots[4], DeepEquals, []byte(key))
+	c.Check(dev.priorities[4], Equals, luks2.SlotPriorityNormal)
+
+	var expectedToken luks2.Token = &luksview.KeyDataToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 4,
+			TokenName:    "secondary"}}
+	c.Check(dev.tokens[1], DeepEquals, expectedToken)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyWithOptionsCryptsetupPath(c *C) {
+	existingKey := s.newPrimaryKey()
+	dev := s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+	s.luks2.devices["/dev/sda1"] = dev
+
+	path := "/run/mnt/tools/cryptsetup"
+
+	var paths []string
+	s.AddCleanup(MockLUKS2AddKey(func(devicePath string, existingKey, key []byte, options *luks2.AddKeyOptions) error {
+		paths = append(paths, "AddKey:"+options.CryptsetupPath)
+		return s.luks2.addKey(devicePath, existingKey, key, options)
+	}))
+	s.AddCleanup(MockLUKS2ImportToken(func(devicePath string, token luks2.Token, options *luks2.ImportTokenOptions) error {
+		c.Check(options.Id, Equals, luks2.AnyId)
+		paths = append(paths, "ImportToken:"+options.CryptsetupPath)
+		return s.luks2.importToken(devicePath, token, options)
+	}))
+	s.AddCleanup(MockLUKS2SetSlotPriority(func(devicePath string, slot int, priority luks2.SlotPriority, options *luks2.CommandOptions) error {
+		paths = append(paths, "SetSlotPriority:"+options.CryptsetupPath)
+		return s.luks2.setSlotPriority(devicePath, slot, priority, options)
+	}))
+
+	key := s.newPrimaryKey()
+	slot, err := AddLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "secondary", existingKey, key, &AddLUKS2ContainerUnlockKeyOptions{
+		Slot:           LUKS2AnyKeyslot,
+		Priority:       LUKS2KeyslotPriorityHigh,
+		CryptsetupPath: path})
+	c.Check(err, IsNil)
+	c.Check(dev.keyslots[slot], DeepEquals, []byte(key))
+	c.Check(paths, DeepEquals, []string{
+		"AddKey:" + path,
+		"ImportToken:" + path,
+		"SetSlotPriority:" + path,
+	})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyWithOptionsCustomKDF(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	slot, err := AddLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "secondary", existingKey, s.newPrimaryKey(), &AddLUKS2ContainerUnlockKeyOptions{
+		KDFOptions: &KDFOptions{TargetDuration: 100 * time.Millisecond},
+		Slot:       LUKS2AnyKeyslot,
+		Priority:   LUKS2KeyslotPriorityHigh})
+	c.Check(err, IsNil)
+	c.Check(slot, Equals, 1)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{TargetDuration: 100 * time.Millisecond}, Slot: 1}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,1,prefer)",
+	})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyWithOptionsNil(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	slot, err := AddLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "secondary", existingKey, s.newPrimaryKey(), nil)
+	c.Check(err, IsNil)
+	c.Check(slot, Equals, 1)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{ForceIterations: 4, MemoryKiB: 32}, Slot: 1}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,1,prefer)",
+	})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyWithOptionsSlotInUse(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	_, err := AddLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "secondary", existingKey, s.newPrimaryKey(), &AddLUKS2ContainerUnlockKeyOptions{
+		Slot:     0,
+		Priority: LUKS2KeyslotPriorityHigh})
+	c.Check(err, ErrorMatches, "keyslot 0 is already in use")
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyWithOptionsShortKey(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	_, err := AddLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "secondary", existingKey, make([]byte, 16), nil)
+	c.Check(err, ErrorMatches,
+		"expected a key length of at least 256-bits \\(got 128\\)")
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerUnlockKeyWithOptionsInvalidPriority(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	_, err := AddLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "secondary", existingKey, s.newPrimaryKey(), &AddLUKS2ContainerUnlockKeyOptions{
+		Slot:     LUKS2AnyKeyslot,
+		Priority: LUKS2KeyslotPriorityIgnore})
+	c.Check(err, ErrorMatches, "invalid keyslot priority 0")
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) newMockContainerForChangeUnlockKey(existingKey DiskUnlockKey) *mockLUKS2Container {
+	return &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 1,
+					TokenName:    "default"}},
+			1: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default-recovery"}},
+		},
+		keyslots: map[int][]byte{
+			0: nil,
+			1: existingKey,
+		},
+		priorities: map[int]luks2.SlotPriority{1: luks2.SlotPriorityHigh},
+	}
+}
+
+func (s *cryptSuite) TestChangeLUKS2ContainerUnlockKey(c *C) {
+	existingKey := s.newPrimaryKey()
+	dev := s.newMockContainerForChangeUnlockKey(existingKey)
+	s.luks2.devices["/dev/sda1"] = dev
+
+	newKey := s.newPrimaryKey()
+	c.Check(ChangeLUKS2ContainerUnlockKey("/dev/sda1", "", existingKey, newKey, nil), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("ChangeKey(/dev/sda1,1,", &luks2.KDFOptions{MemoryKiB: 32, ForceIterations: 4}, ")"),
+		"SetSlotPriority(/dev/sda1,1,prefer)",
+	})
+	c.Check(dev.keyslots[1], DeepEquals, newKey)
+	c.Check(dev.tokens, HasLen, 2)
+}
+
+func (s *cryptSuite) TestChangeLUKS2ContainerUnlockKeyWithOptions(c *C) {
+	existingKey := s.newPrimaryKey()
+	dev := s.newMockContainerForChangeUnlockKey(existingKey)
+	dev.priorities[1] = luks2.SlotPriorityNormal
+	s.luks2.devices["/dev/sda1"] = dev
+
+	newKey := s.newPrimaryKey()
+	c.Check(ChangeLUKS2ContainerUnlockKey("/dev/sda1", "default", existingKey, newKey, &KDFOptions{ForceIterations: 10}), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("ChangeKey(/dev/sda1,1,", &luks2.KDFOptions{ForceIterations: 10}, ")"),
+		"SetSlotPriority(/dev/sda1,1,normal)",
+	})
+	c.Check(dev.keyslots[1], DeepEquals, newKey)
+}
+
+func (s *cryptSuite) TestChangeLUKS2ContainerUnlockKeyWithCryptsetupPath(c *C) {
+	existingKey := s.newPrimaryKey()
+	dev := s.newMockContainerForChangeUnlockKey(existingKey)
+	s.luks2.devices["/dev/sda1"] = dev
+
+	path := "/run/mnt/tools/cryptsetup"
+
+	var paths []string
+	s.AddCleanup(MockLUKS2ChangeKey(func(devicePath string, slot int, existingKey, key []byte, options *luks2.KDFOptions, cmdOptions *luks2.CommandOptions) error {
+		c.Check(options, DeepEquals, &luks2.KDFOptions{MemoryKiB: 32, ForceIterations: 4})
+		paths = append(paths, "ChangeKey:"+cmdOptions.CryptsetupPath)
+		return s.luks2.changeKey(devicePath, slot, existingKey, key, options, cmdOptions)
+	}))
+	s.AddCleanup(MockLUKS2SetSlotPriority(func(devicePath string, slot int, priority luks2.SlotPriority, options *luks2.CommandOptions) error {
+		paths = append(paths, "SetSlotPriority:"+options.CryptsetupPath)
+		return s.luks2.setSlotPriority(devicePath, slot, priority, options)
+	}))
+
+	newKey := s.newPrimaryKey()
+	c.Check(ChangeLUKS2ContainerUnlockKeyWithOptions("/dev/sda1", "", existingKey, newKey, &ChangeLUKS2ContainerUnlockKeyOptions{CryptsetupPath: path}), IsNil)
+	c.Check(dev.keyslots[1], DeepEquals, newKey)
+	c.Check(paths, DeepEquals, []string{
+		"ChangeKey:" + path,
+		"SetSlotPriority:" + path,
+	})
+}
+
+func (s *cryptSuite) TestChangeLUKS2ContainerUnlockKeyIncorrectKey(c *C) {
+	existingKey := s.newPrimaryKey()
+	dev := s.newMockContainerForChangeUnlockKey(existingKey)
+	s.luks2.devices["/dev/sda1"] = dev
+
+	err := ChangeLUKS2ContainerUnlockKey("/dev/sda1", "default", s.newPrimaryKey(), s.newPrimaryKey(), nil)
+	c.Check(err, ErrorMatches, "cannot change key: no keyslot can be unlocked with the supplied key")
+	c.Check(xerrors.Is(err, luks2.ErrIncorrectKey), testutil.IsTrue)
+	c.Check(dev.keyslots[1], DeepEquals, existingKey)
+}
+
+func (s *cryptSuite) TestChangeLUKS2ContainerUnlockKeyRecoveryKey(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForChangeUnlockKey(existingKey)
+
+	c.Check(ChangeLUKS2ContainerUnlockKey("/dev/sda1", "default-recovery", existingKey, s.newPrimaryKey(), nil), ErrorMatches,
+		"the specified key is not an unlock key")
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *cryptSuite) TestChangeLUKS2ContainerUnlockKeyMissing(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForChangeUnlockKey(existingKey)
+
+	c.Check(ChangeLUKS2ContainerUnlockKey("/dev/sda1", "foo", existingKey, s.newPrimaryKey(), nil), ErrorMatches,
+		"no key with the specified name exists")
+}
+
+func (s *cryptSuite) TestChangeLUKS2ContainerUnlockKeyShortKey(c *C) {
+	c.Check(ChangeLUKS2ContainerUnlockKey("/dev/sda1", "", s.newPrimaryKey(), make([]byte, 16), nil), ErrorMatches,
+		"expected a key length of at least 256-bits \\(got 128\\)")
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
 func (s *cryptSuite) TestListLUKS2ContainerKeyNames(c *C) {
 	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
 		tokens: map[int]luks2.Token{
@@ -2445,6 +5094,43 @@ func (s *cryptSuite) TestListLUKS2ContainerKeyNames(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestListLUKS2ContainerKeyslots(c *C) {
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		keyslots: map[int][]byte{
+			0: nil,
+			1: nil,
+			3: nil,
+		},
+		priorities: map[int]luks2.SlotPriority{
+			0: luks2.SlotPriorityHigh,
+			3: luks2.SlotPriorityIgnore,
+		},
+	}
+
+	keyslots, err := ListLUKS2ContainerKeyslots("/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(keyslots, DeepEquals, []LUKS2KeyslotInfo{
+		{Slot: 0, Priority: LUKS2KeyslotPriorityHigh},
+		{Slot: 1, Priority: LUKS2KeyslotPriorityNormal},
+		{Slot: 3, Priority: LUKS2KeyslotPriorityIgnore},
+	})
+
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *cryptSuite) TestListLUKS2ContainerKeyslotsEmpty(c *C) {
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{}
+
+	keyslots, err := ListLUKS2ContainerKeyslots("/dev/sda1")
+	c.Check(err, IsNil)
+	c.Check(keyslots, DeepEquals, []LUKS2KeyslotInfo{})
+}
+
+func (s *cryptSuite) TestListLUKS2ContainerKeyslotsNoContainer(c *C) {
+	_, err := ListLUKS2ContainerKeyslots("/dev/sda1")
+	c.Check(err, ErrorMatches, "cannot obtain LUKS header view: .*")
+}
+
 type testAddLUKS2ContainerRecoveryKeyData struct {
 	devicePath  string
 	dev         *mockLUKS2Container
@@ -2486,18 +5172,105 @@ func (s *cryptSuite) testAddLUKS2ContainerRecoveryKey(c *C, data *testAddLUKS2Co
 		"SetSlotPriority(" + data.devicePath + "," + strconv.Itoa(data.expectedOptions.Slot) + ",normal)",
 	})
 
-	key, ok := data.dev.keyslots[data.expectedOptions.Slot]
-	c.Check(ok, testutil.IsTrue)
-	c.Check(key, DeepEquals, []byte(data.key[:]))
+	key, ok := data.dev.keyslots[data.expectedOptions.Slot]
+	c.Check(ok, testutil.IsTrue)
+	c.Check(key, DeepEquals, []byte(data.key[:]))
+
+	var expectedToken luks2.Token = &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: data.expectedOptions.Slot,
+			TokenName:    keyslotName}}
+	c.Check(data.dev.tokens[data.expectedTokenId], DeepEquals, expectedToken)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKey(c *C) {
+	existingKey := s.newPrimaryKey()
+
+	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/sda1",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+			},
+			keyslots: map[int][]byte{0: existingKey},
+		},
+		existingKey:     existingKey,
+		key:             s.newRecoveryKey(),
+		keyslotName:     "recovery",
+		expectedOptions: &luks2.AddKeyOptions{Slot: 1},
+		expectedTokenId: 1,
+	})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyDifferentPath(c *C) {
+	existingKey := s.newPrimaryKey()
+
+	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/vdb2",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+			},
+			keyslots: map[int][]byte{0: existingKey},
+		},
+		existingKey:     existingKey,
+		key:             s.newRecoveryKey(),
+		keyslotName:     "recovery",
+		expectedOptions: &luks2.AddKeyOptions{Slot: 1},
+		expectedTokenId: 1,
+	})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyDifferentName(c *C) {
+	existingKey := s.newPrimaryKey()
+
+	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/sda1",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+			},
+			keyslots: map[int][]byte{0: existingKey},
+		},
+		existingKey:     existingKey,
+		key:             s.newRecoveryKey(),
+		keyslotName:     "foo",
+		expectedOptions: &luks2.AddKeyOptions{Slot: 1},
+		expectedTokenId: 1,
+	})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyNoName(c *C) {
+	existingKey := s.newPrimaryKey()
 
-	var expectedToken luks2.Token = &luksview.RecoveryToken{
-		TokenBase: luksview.TokenBase{
-			TokenKeyslot: data.expectedOptions.Slot,
-			TokenName:    keyslotName}}
-	c.Check(data.dev.tokens[data.expectedTokenId], DeepEquals, expectedToken)
+	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/sda1",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+			},
+			keyslots: map[int][]byte{0: existingKey},
+		},
+		existingKey:     existingKey,
+		key:             s.newRecoveryKey(),
+		expectedOptions: &luks2.AddKeyOptions{Slot: 1},
+		expectedTokenId: 1,
+	})
 }
 
-func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKey(c *C) {
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOrphanedTokens(c *C) {
 	existingKey := s.newPrimaryKey()
 
 	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
@@ -2508,6 +5281,7 @@ func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKey(c *C) {
 					TokenBase: luksview.TokenBase{
 						TokenKeyslot: 0,
 						TokenName:    "default"}},
+				1: luksview.MockOrphanedToken(luksview.RecoveryTokenType, "recovery"),
 			},
 			keyslots: map[int][]byte{0: existingKey},
 		},
@@ -2519,11 +5293,11 @@ func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKey(c *C) {
 	})
 }
 
-func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyDifferentPath(c *C) {
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithExternalKeyslots(c *C) {
 	existingKey := s.newPrimaryKey()
 
 	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
-		devicePath: "/dev/vdb2",
+		devicePath: "/dev/sda1",
 		dev: &mockLUKS2Container{
 			tokens: map[int]luks2.Token{
 				0: &luksview.KeyDataToken{
@@ -2531,17 +5305,25 @@ func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyDifferentPath(c *C) {
 						TokenKeyslot: 0,
 						TokenName:    "default"}},
 			},
-			keyslots: map[int][]byte{0: existingKey},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				1: nil,
+				2: nil,
+				3: nil,
+				4: nil,
+				5: nil,
+				9: nil,
+			},
 		},
 		existingKey:     existingKey,
 		key:             s.newRecoveryKey(),
 		keyslotName:     "recovery",
-		expectedOptions: &luks2.AddKeyOptions{Slot: 1},
+		expectedOptions: &luks2.AddKeyOptions{Slot: 6},
 		expectedTokenId: 1,
 	})
 }
 
-func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyDifferentName(c *C) {
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithCustomKDFTime(c *C) {
 	existingKey := s.newPrimaryKey()
 
 	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
@@ -2557,13 +5339,14 @@ func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyDifferentName(c *C) {
 		},
 		existingKey:     existingKey,
 		key:             s.newRecoveryKey(),
-		keyslotName:     "foo",
-		expectedOptions: &luks2.AddKeyOptions{Slot: 1},
+		keyslotName:     "recovery",
+		options:         &KDFOptions{TargetDuration: 5 * time.Second},
+		expectedOptions: &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{TargetDuration: 5 * time.Second}, Slot: 1},
 		expectedTokenId: 1,
 	})
 }
 
-func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyNoName(c *C) {
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithCustomKDFMemory(c *C) {
 	existingKey := s.newPrimaryKey()
 
 	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
@@ -2579,12 +5362,14 @@ func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyNoName(c *C) {
 		},
 		existingKey:     existingKey,
 		key:             s.newRecoveryKey(),
-		expectedOptions: &luks2.AddKeyOptions{Slot: 1},
+		keyslotName:     "recovery",
+		options:         &KDFOptions{MemoryKiB: 2 * 1024 * 1024},
+		expectedOptions: &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{MemoryKiB: 2 * 1024 * 1024}, Slot: 1},
 		expectedTokenId: 1,
 	})
 }
 
-func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOrphanedTokens(c *C) {
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithCustomKDFIterations(c *C) {
 	existingKey := s.newPrimaryKey()
 
 	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
@@ -2595,22 +5380,428 @@ func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOrphanedTokens(c *C) {
 					TokenBase: luksview.TokenBase{
 						TokenKeyslot: 0,
 						TokenName:    "default"}},
-				1: luksview.MockOrphanedToken(luksview.RecoveryTokenType, "recovery"),
 			},
 			keyslots: map[int][]byte{0: existingKey},
 		},
 		existingKey:     existingKey,
 		key:             s.newRecoveryKey(),
 		keyslotName:     "recovery",
-		expectedOptions: &luks2.AddKeyOptions{Slot: 1},
+		options:         &KDFOptions{ForceIterations: 10},
+		expectedOptions: &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{ForceIterations: 10}, Slot: 1},
+		expectedTokenId: 1,
+	})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyDifferentSlot(c *C) {
+	existingKey := s.newPrimaryKey()
+
+	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
+		devicePath: "/dev/sda1",
+		dev: &mockLUKS2Container{
+			tokens: map[int]luks2.Token{
+				0: &luksview.KeyDataToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 0,
+						TokenName:    "default"}},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				1: nil,
+			},
+		},
+		existingKey:     existingKey,
+		key:             s.newRecoveryKey(),
+		keyslotName:     "recovery",
+		expectedOptions: &luks2.AddKeyOptions{Slot: 2},
 		expectedTokenId: 1,
 	})
 }
 
-func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithExternalKeyslots(c *C) {
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyNameInUse(c *C) {
+	existingKey := s.newPrimaryKey()
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+			1: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 1,
+					TokenName:    "recovery"}},
+		},
+		keyslots: map[int][]byte{
+			0: existingKey,
+			1: nil,
+		},
+	}
+	c.Check(AddLUKS2ContainerRecoveryKey("/dev/sda1", "recovery", existingKey, RecoveryKey{}, nil), ErrorMatches, "the specified name is already in use")
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyReencryptionInProgress(c *C) {
+	existingKey := s.newPrimaryKey()
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+		},
+		keyslots:     map[int][]byte{0: existingKey},
+		reencrypting: true,
+	}
+
+	err := AddLUKS2ContainerRecoveryKey("/dev/sda1", "", existingKey, s.newRecoveryKey(), nil)
+	c.Check(err, FitsTypeOf, &LUKS2ReencryptionInProgressError{})
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *cryptSuite) newMockContainerForAddRecoveryKeyWithOptions(existingKey DiskUnlockKey) *mockLUKS2Container {
+	return &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+		},
+		keyslots: map[int][]byte{0: existingKey},
+	}
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOptions(c *C) {
+	existingKey := s.newPrimaryKey()
+	dev := s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+	s.luks2.devices["/dev/sda1"] = dev
+
+	recoveryKey := s.newRecoveryKey()
+	slot, err := AddLUKS2ContainerRecoveryKeyWithOptions("/dev/sda1", "", existingKey, recoveryKey, &AddLUKS2ContainerRecoveryKeyOptions{
+		Slot:     3,
+		Priority: LUKS2KeyslotPriorityHigh})
+	c.Check(err, IsNil)
+	c.Check(slot, Equals, 3)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 3}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,3,prefer)",
+	})
+
+	c.Check(dev.keyslots[3], DeepEquals, []byte(recoveryKey[:]))
+	c.Check(dev.priorities[3], Equals, luks2.SlotPriorityHigh)
+
+	var expectedToken luks2.Token = &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 3,
+			TokenName:    "default-recovery"}}
+	c.Check(dev.tokens[1], DeepEquals, expectedToken)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOptionsProgress(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	slot, err := AddLUKS2ContainerRecoveryKeyWithOptions("/dev/sda1", "", existingKey, s.newRecoveryKey(), &AddLUKS2ContainerRecoveryKeyOptions{
+		Slot:     LUKS2AnyKeyslot,
+		Priority: LUKS2KeyslotPriorityNormal,
+		Progress: func(event string) {
+			s.luks2.operations = append(s.luks2.operations, "Progress("+event+")")
+		}})
+	c.Check(err, IsNil)
+	c.Check(slot, Equals, 1)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"Progress(adding keyslot 1)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 1}, ")"),
+		"Progress(importing token)",
+		"ImportToken(/dev/sda1,<nil>)",
+		"Progress(setting keyslot priority)",
+		"SetSlotPriority(/dev/sda1,1,normal)",
+	})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOptionsNil(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	slot, err := AddLUKS2ContainerRecoveryKeyWithOptions("/dev/sda1", "", existingKey, s.newRecoveryKey(), nil)
+	c.Check(err, IsNil)
+	c.Check(slot, Equals, 1)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 1}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,1,normal)",
+	})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerExtendedRecoveryKey(c *C) {
+	existingKey := s.newPrimaryKey()
+	dev := s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+	s.luks2.devices["/dev/sda1"] = dev
+
+	recoveryKey, err := NewExtendedRecoveryKey(32)
+	c.Assert(err, IsNil)
+	slot, err := AddLUKS2ContainerExtendedRecoveryKey("/dev/sda1", "", existingKey, recoveryKey, nil)
+	c.Check(err, IsNil)
+	c.Check(slot, Equals, 1)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 1}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,1,normal)",
+	})
+	c.Check(dev.keyslots[1], DeepEquals, []byte(recoveryKey))
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerExtendedRecoveryKeyInvalidLength(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	_, err := AddLUKS2ContainerExtendedRecoveryKey("/dev/sda1", "", existingKey, make(ExtendedRecoveryKey, 17), nil)
+	c.Check(err, ErrorMatches, "invalid recovery key: odd length \\(17 bytes\\)")
+	_, err = AddLUKS2ContainerExtendedRecoveryKey("/dev/sda1", "", existingKey, make(ExtendedRecoveryKey, 8), nil)
+	c.Check(err, ErrorMatches, "invalid recovery key: too short \\(got 8 bytes, expected at least 16\\)")
+	_, err = AddLUKS2ContainerExtendedRecoveryKey("/dev/sda1", "", existingKey, make(ExtendedRecoveryKey, 66), nil)
+	c.Check(err, ErrorMatches, "invalid recovery key: too long \\(got 66 bytes, expected at most 64\\)")
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeys(c *C) {
+	existingKey := s.newPrimaryKey()
+	dev := s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+	s.luks2.devices["/dev/sda1"] = dev
+
+	recoveryKey1 := s.newRecoveryKey()
+	recoveryKey2 := s.newRecoveryKey()
+	slots, err := AddLUKS2ContainerRecoveryKeys("/dev/sda1", existingKey, []LUKS2ContainerRecoveryKeyslot{
+		{Name: "admin", Key: recoveryKey1},
+		{Name: "helpdesk", Key: recoveryKey2}}, nil)
+	c.Check(err, IsNil)
+	c.Check(slots, DeepEquals, []int{1, 2})
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 1}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,1,normal)",
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", &luks2.AddKeyOptions{Slot: 2}, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,2,normal)",
+	})
+
+	c.Check(dev.keyslots[1], DeepEquals, []byte(recoveryKey1[:]))
+	c.Check(dev.keyslots[2], DeepEquals, []byte(recoveryKey2[:]))
+
+	var expectedToken luks2.Token = &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 1,
+			TokenName:    "admin"}}
+	c.Check(dev.tokens[1], DeepEquals, expectedToken)
+	expectedToken = &luksview.RecoveryToken{
+		TokenBase: luksview.TokenBase{
+			TokenKeyslot: 2,
+			TokenName:    "helpdesk"}}
+	c.Check(dev.tokens[2], DeepEquals, expectedToken)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeysPartialFailure(c *C) {
+	existingKey := s.newPrimaryKey()
+	dev := s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+	s.luks2.devices["/dev/sda1"] = dev
+
+	n := 0
+	s.AddCleanup(MockLUKS2AddKey(func(devicePath string, existingKey, key []byte, options *luks2.AddKeyOptions) error {
+		n++
+		if n > 1 {
+			return errors.New("some error")
+		}
+		return s.luks2.addKey(devicePath, existingKey, key, options)
+	}))
+
+	recoveryKey := s.newRecoveryKey()
+	slots, err := AddLUKS2ContainerRecoveryKeys("/dev/sda1", existingKey, []LUKS2ContainerRecoveryKeyslot{
+		{Name: "admin", Key: recoveryKey},
+		{Name: "helpdesk", Key: s.newRecoveryKey()},
+		{Name: "other", Key: s.newRecoveryKey()}}, nil)
+	c.Check(err, ErrorMatches, `cannot add recovery key "helpdesk": cannot add key: some error`)
+	c.Assert(err, FitsTypeOf, &AddLUKS2ContainerRecoveryKeysError{})
+	c.Check(err.(*AddLUKS2ContainerRecoveryKeysError).Name, Equals, "helpdesk")
+	c.Check(err.(*AddLUKS2ContainerRecoveryKeysError).Added, DeepEquals, []string{"admin"})
+	c.Check(slots, DeepEquals, []int{1})
+
+	c.Check(dev.keyslots, DeepEquals, map[int][]byte{0: existingKey, 1: recoveryKey[:]})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeysDuplicateName(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	_, err := AddLUKS2ContainerRecoveryKeys("/dev/sda1", existingKey, []LUKS2ContainerRecoveryKeyslot{
+		{Key: s.newRecoveryKey()},
+		{Name: "default-recovery", Key: s.newRecoveryKey()}}, nil)
+	c.Check(err, ErrorMatches, `duplicate keyslot name "default-recovery"`)
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeysNameInUse(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	_, err := AddLUKS2ContainerRecoveryKeys("/dev/sda1", existingKey, []LUKS2ContainerRecoveryKeyslot{
+		{Name: "admin", Key: s.newRecoveryKey()},
+		{Name: "default", Key: s.newRecoveryKey()}}, nil)
+	c.Check(err, ErrorMatches, `the name "default" is already in use`)
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeysSpecificSlot(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	_, err := AddLUKS2ContainerRecoveryKeys("/dev/sda1", existingKey, []LUKS2ContainerRecoveryKeyslot{
+		{Name: "admin", Key: s.newRecoveryKey()},
+		{Name: "helpdesk", Key: s.newRecoveryKey()}}, &AddLUKS2ContainerRecoveryKeyOptions{
+		Slot:     3,
+		Priority: LUKS2KeyslotPriorityNormal})
+	c.Check(err, ErrorMatches, "a specific keyslot cannot be requested when adding more than one recovery key")
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOptionsSlotInUse(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	_, err := AddLUKS2ContainerRecoveryKeyWithOptions("/dev/sda1", "", existingKey, s.newRecoveryKey(), &AddLUKS2ContainerRecoveryKeyOptions{
+		Slot:     0,
+		Priority: LUKS2KeyslotPriorityNormal})
+	c.Check(err, ErrorMatches, "keyslot 0 is already in use")
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOptionsInvalidSlot(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	_, err := AddLUKS2ContainerRecoveryKeyWithOptions("/dev/sda1", "", existingKey, s.newRecoveryKey(), &AddLUKS2ContainerRecoveryKeyOptions{
+		Slot:     -2,
+		Priority: LUKS2KeyslotPriorityNormal})
+	c.Check(err, ErrorMatches, "invalid keyslot -2")
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOptionsInvalidPriority(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	_, err := AddLUKS2ContainerRecoveryKeyWithOptions("/dev/sda1", "", existingKey, s.newRecoveryKey(), &AddLUKS2ContainerRecoveryKeyOptions{
+		Slot:     LUKS2AnyKeyslot,
+		Priority: LUKS2KeyslotPriorityIgnore})
+	c.Check(err, ErrorMatches, "invalid keyslot priority 0")
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOptionsArgon2id(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	slot, err := AddLUKS2ContainerRecoveryKeyWithOptions("/dev/sda1", "", existingKey, s.newRecoveryKey(), &AddLUKS2ContainerRecoveryKeyOptions{
+		KDFOptions: &KDFOptions{MemoryKiB: 512 * 1024, Parallel: 2},
+		KDFType:    LUKS2KDFTypeArgon2id,
+		Slot:       LUKS2AnyKeyslot,
+		Priority:   LUKS2KeyslotPriorityNormal})
+	c.Check(err, IsNil)
+	c.Check(slot, Equals, 1)
+
+	expectedOptions := &luks2.AddKeyOptions{
+		KDFOptions: luks2.KDFOptions{Type: luks2.KDFTypeArgon2id, MemoryKiB: 512 * 1024, Parallel: 2},
+		Slot:       1}
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", expectedOptions, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,1,normal)",
+	})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOptionsPBKDF2(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	slot, err := AddLUKS2ContainerRecoveryKeyWithOptions("/dev/sda1", "", existingKey, s.newRecoveryKey(), &AddLUKS2ContainerRecoveryKeyOptions{
+		KDFOptions: &KDFOptions{ForceIterations: 1000},
+		KDFType:    LUKS2KDFTypePBKDF2,
+		Slot:       LUKS2AnyKeyslot,
+		Priority:   LUKS2KeyslotPriorityNormal})
+	c.Check(err, IsNil)
+	c.Check(slot, Equals, 1)
+
+	expectedOptions := &luks2.AddKeyOptions{
+		KDFOptions: luks2.KDFOptions{Type: luks2.KDFTypePBKDF2, ForceIterations: 1000},
+		Slot:       1}
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		fmt.Sprint("AddKey(/dev/sda1,", expectedOptions, ")"),
+		"ImportToken(/dev/sda1,<nil>)",
+		"SetSlotPriority(/dev/sda1,1,normal)",
+	})
+}
+
+func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithOptionsInvalidKDF(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForAddRecoveryKeyWithOptions(existingKey)
+
+	for _, t := range []struct {
+		kdfOptions *KDFOptions
+		kdfType    LUKS2KDFType
+		errMatch   string
+	}{
+		{kdfOptions: &KDFOptions{MemoryKiB: 32}, kdfType: LUKS2KDFTypePBKDF2, errMatch: `invalid KDF options: cannot set the memory cost or parallelism for pbkdf2`},
+		{kdfOptions: &KDFOptions{Parallel: 4}, kdfType: LUKS2KDFTypePBKDF2, errMatch: `invalid KDF options: cannot set the memory cost or parallelism for pbkdf2`},
+		{kdfType: "scrypt", errMatch: `invalid KDF options: unsupported KDF type "scrypt"`},
+	} {
+		_, err := AddLUKS2ContainerRecoveryKeyWithOptions("/dev/sda1", "", existingKey, s.newRecoveryKey(), &AddLUKS2ContainerRecoveryKeyOptions{
+			KDFOptions: t.kdfOptions,
+			KDFType:    t.kdfType,
+			Slot:       LUKS2AnyKeyslot,
+			Priority:   LUKS2KeyslotPriorityNormal})
+		c.Check(err, ErrorMatches, t.errMatch)
+	}
+	c.Check(s.luks2.operations, HasLen, 0)
+}
+
+type testDeleteLUKS2ContainerKeyData struct {
+	devicePath  string
+	dev         *mockLUKS2Container
+	keyslotName string
+	existingKey []byte
+	slot        int
+	tokenId     int
+}
+
+func (s *cryptSuite) testDeleteLUKS2ContainerKey(c *C, data *testDeleteLUKS2ContainerKeyData) {
+	s.luks2.devices[data.devicePath] = data.dev
+
+	c.Check(DeleteLUKS2ContainerKey(data.devicePath, data.keyslotName, data.existingKey), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(" + data.devicePath + ",0)",
+		"KillSlot(" + data.devicePath + "," + strconv.Itoa(data.slot) + ")",
+		"RemoveToken(" + data.devicePath + "," + strconv.Itoa(data.tokenId) + ")",
+	})
+}
+
+func (s *cryptSuite) TestDeleteLUKS2ContainerKey(c *C) {
 	existingKey := s.newPrimaryKey()
 
-	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
+	s.testDeleteLUKS2ContainerKey(c, &testDeleteLUKS2ContainerKeyData{
 		devicePath: "/dev/sda1",
 		dev: &mockLUKS2Container{
 			tokens: map[int]luks2.Token{
@@ -2618,52 +5809,55 @@ func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithExternalKeyslots(c *C)
 					TokenBase: luksview.TokenBase{
 						TokenKeyslot: 0,
 						TokenName:    "default"}},
+				1: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 1,
+						TokenName:    "default-recovery"}},
 			},
 			keyslots: map[int][]byte{
 				0: existingKey,
 				1: nil,
-				2: nil,
-				3: nil,
-				4: nil,
-				5: nil,
-				9: nil,
 			},
 		},
-		existingKey:     existingKey,
-		key:             s.newRecoveryKey(),
-		keyslotName:     "recovery",
-		expectedOptions: &luks2.AddKeyOptions{Slot: 6},
-		expectedTokenId: 1,
+		keyslotName: "default-recovery",
+		existingKey: existingKey,
+		slot:        1,
+		tokenId:     1,
 	})
 }
 
-func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithCustomKDFTime(c *C) {
+func (s *cryptSuite) TestDeleteLUKS2ContainerKeyDifferentPath(c *C) {
 	existingKey := s.newPrimaryKey()
 
-	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
-		devicePath: "/dev/sda1",
+	s.testDeleteLUKS2ContainerKey(c, &testDeleteLUKS2ContainerKeyData{
+		devicePath: "/dev/nvme0n1p1",
 		dev: &mockLUKS2Container{
 			tokens: map[int]luks2.Token{
 				0: &luksview.KeyDataToken{
 					TokenBase: luksview.TokenBase{
 						TokenKeyslot: 0,
 						TokenName:    "default"}},
+				1: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 1,
+						TokenName:    "default-recovery"}},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				1: nil,
 			},
-			keyslots: map[int][]byte{0: existingKey},
 		},
-		existingKey:     existingKey,
-		key:             s.newRecoveryKey(),
-		keyslotName:     "recovery",
-		options:         &KDFOptions{TargetDuration: 5 * time.Second},
-		expectedOptions: &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{TargetDuration: 5 * time.Second}, Slot: 1},
-		expectedTokenId: 1,
+		keyslotName: "default-recovery",
+		existingKey: existingKey,
+		slot:        1,
+		tokenId:     1,
 	})
 }
 
-func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithCustomKDFMemory(c *C) {
+func (s *cryptSuite) TestDeleteLUKS2ContainerKeyDifferentName(c *C) {
 	existingKey := s.newPrimaryKey()
 
-	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
+	s.testDeleteLUKS2ContainerKey(c, &testDeleteLUKS2ContainerKeyData{
 		devicePath: "/dev/sda1",
 		dev: &mockLUKS2Container{
 			tokens: map[int]luks2.Token{
@@ -2671,22 +5865,27 @@ func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithCustomKDFMemory(c *C) {
 					TokenBase: luksview.TokenBase{
 						TokenKeyslot: 0,
 						TokenName:    "default"}},
+				1: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 1,
+						TokenName:    "foo"}},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				1: nil,
 			},
-			keyslots: map[int][]byte{0: existingKey},
 		},
-		existingKey:     existingKey,
-		key:             s.newRecoveryKey(),
-		keyslotName:     "recovery",
-		options:         &KDFOptions{MemoryKiB: 2 * 1024 * 1024},
-		expectedOptions: &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{MemoryKiB: 2 * 1024 * 1024}, Slot: 1},
-		expectedTokenId: 1,
+		keyslotName: "foo",
+		existingKey: existingKey,
+		slot:        1,
+		tokenId:     1,
 	})
 }
 
-func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithCustomKDFIterations(c *C) {
+func (s *cryptSuite) TestDeleteLUKS2ContainerKeyDifferentKeyslot(c *C) {
 	existingKey := s.newPrimaryKey()
 
-	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
+	s.testDeleteLUKS2ContainerKey(c, &testDeleteLUKS2ContainerKeyData{
 		devicePath: "/dev/sda1",
 		dev: &mockLUKS2Container{
 			tokens: map[int]luks2.Token{
@@ -2694,22 +5893,27 @@ func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyWithCustomKDFIterations(c *
 					TokenBase: luksview.TokenBase{
 						TokenKeyslot: 0,
 						TokenName:    "default"}},
+				1: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 2,
+						TokenName:    "default-recovery"}},
+			},
+			keyslots: map[int][]byte{
+				0: existingKey,
+				2: nil,
 			},
-			keyslots: map[int][]byte{0: existingKey},
 		},
-		existingKey:     existingKey,
-		key:             s.newRecoveryKey(),
-		keyslotName:     "recovery",
-		options:         &KDFOptions{ForceIterations: 10},
-		expectedOptions: &luks2.AddKeyOptions{KDFOptions: luks2.KDFOptions{ForceIterations: 10}, Slot: 1},
-		expectedTokenId: 1,
+		keyslotName: "default-recovery",
+		existingKey: existingKey,
+		slot:        2,
+		tokenId:     1,
 	})
 }
 
-func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyDifferentSlot(c *C) {
+func (s *cryptSuite) TestDeleteLUKS2ContainerKeyDifferentTokenId(c *C) {
 	existingKey := s.newPrimaryKey()
 
-	s.testAddLUKS2ContainerRecoveryKey(c, &testAddLUKS2ContainerRecoveryKeyData{
+	s.testDeleteLUKS2ContainerKey(c, &testDeleteLUKS2ContainerKeyData{
 		devicePath: "/dev/sda1",
 		dev: &mockLUKS2Container{
 			tokens: map[int]luks2.Token{
@@ -2717,21 +5921,40 @@ func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyDifferentSlot(c *C) {
 					TokenBase: luksview.TokenBase{
 						TokenKeyslot: 0,
 						TokenName:    "default"}},
+				4: &luksview.RecoveryToken{
+					TokenBase: luksview.TokenBase{
+						TokenKeyslot: 1,
+						TokenName:    "default-recovery"}},
 			},
 			keyslots: map[int][]byte{
 				0: existingKey,
 				1: nil,
 			},
 		},
-		existingKey:     existingKey,
-		key:             s.newRecoveryKey(),
-		keyslotName:     "recovery",
-		expectedOptions: &luks2.AddKeyOptions{Slot: 2},
-		expectedTokenId: 1,
+		keyslotName: "default-recovery",
+		existingKey: existingKey,
+		slot:        1,
+		tokenId:     4,
 	})
 }
 
-func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyNameInUse(c *C) {
+func (s *cryptSuite) TestDeleteLUKS2ContainerKeyLastSlot(c *C) {
+	existingKey := s.newPrimaryKey()
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+		},
+		keyslots: map[int][]byte{0: existingKey},
+	}
+
+	c.Check(DeleteLUKS2ContainerKey("/dev/sda1", "default", existingKey), Equals, ErrLastLUKS2ContainerKeyslot)
+}
+
+func (s *cryptSuite) TestDeleteLUKS2ContainerKeyReencryptionInProgress(c *C) {
 	existingKey := s.newPrimaryKey()
 
 	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
@@ -2743,71 +5966,273 @@ func (s *cryptSuite) TestAddLUKS2ContainerRecoveryKeyNameInUse(c *C) {
 			1: &luksview.RecoveryToken{
 				TokenBase: luksview.TokenBase{
 					TokenKeyslot: 1,
-					TokenName:    "recovery"}},
+					TokenName:    "default-recovery"}},
+		},
+		keyslots: map[int][]byte{
+			0: existingKey,
+			1: nil,
+		},
+		reencrypting: true,
+	}
+
+	err := DeleteLUKS2ContainerKey("/dev/sda1", "default-recovery", existingKey)
+	c.Check(err, ErrorMatches, "cannot modify keyslots on /dev/sda1 because reencryption is in progress and must be completed first")
+	c.Check(err, FitsTypeOf, &LUKS2ReencryptionInProgressError{})
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *cryptSuite) TestTestLUKS2ContainerKey(c *C) {
+	key := s.newPrimaryKey()
+	s.addMockKeyslot("/dev/sda1", key)
+
+	ok, err := TestLUKS2ContainerKey("/dev/sda1", key)
+	c.Check(err, IsNil)
+	c.Check(ok, testutil.IsTrue)
+	c.Check(s.luks2.operations, DeepEquals, []string{"TestKey(/dev/sda1,-1)"})
+}
+
+func (s *cryptSuite) TestTestLUKS2ContainerKeyWithOptions(c *C) {
+	key := s.newPrimaryKey()
+	s.addMockKeyslot("/dev/sda1", key)
+
+	path := "/run/mnt/tools/cryptsetup"
+	s.AddCleanup(MockLUKS2TestKey(func(devicePath string, slot int, key []byte, options *luks2.CommandOptions) error {
+		c.Check(options, DeepEquals, &luks2.CommandOptions{CryptsetupPath: path})
+		return s.luks2.testKey(devicePath, slot, key, options)
+	}))
+
+	ok, err := TestLUKS2ContainerKeyWithOptions("/dev/sda1", key, &LUKS2CommandOptions{CryptsetupPath: path})
+	c.Check(err, IsNil)
+	c.Check(ok, testutil.IsTrue)
+	c.Check(s.luks2.operations, DeepEquals, []string{"TestKey(/dev/sda1,-1)"})
+}
+
+func (s *cryptSuite) TestTestLUKS2ContainerKeyIncorrect(c *C) {
+	s.addMockKeyslot("/dev/sda1", s.newPrimaryKey())
+
+	ok, err := TestLUKS2ContainerKey("/dev/sda1", s.newPrimaryKey())
+	c.Check(err, IsNil)
+	c.Check(ok, Not(testutil.IsTrue))
+}
+
+func (s *cryptSuite) TestTestLUKS2ContainerKeyError(c *C) {
+	ok, err := TestLUKS2ContainerKey("/dev/sda1", s.newPrimaryKey())
+	c.Check(err, ErrorMatches, "cannot test key: no container")
+	c.Check(ok, Not(testutil.IsTrue))
+}
+
+func (s *cryptSuite) newMockContainerForDeleteRecoveryKeyslot(existingKey DiskUnlockKey) *mockLUKS2Container {
+	return &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+			1: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 2,
+					TokenName:    "default-recovery"}},
+			2: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 3,
+					TokenName:    "recovery2"}},
+		},
+		keyslots: map[int][]byte{
+			0: existingKey,
+			2: nil,
+			3: nil,
+		},
+	}
+}
+
+func (s *cryptSuite) TestDeleteLUKS2ContainerRecoveryKeyslot(c *C) {
+	existingKey := s.newPrimaryKey()
+	dev := s.newMockContainerForDeleteRecoveryKeyslot(existingKey)
+	s.luks2.devices["/dev/sda1"] = dev
+
+	c.Check(DeleteLUKS2ContainerRecoveryKeyslot("/dev/sda1", 3, existingKey), IsNil)
+
+	c.Check(s.luks2.operations, DeepEquals, []string{
+		"newLUKSView(/dev/sda1,0)",
+		"KillSlot(/dev/sda1,3)",
+		"RemoveToken(/dev/sda1,2)",
+	})
+	c.Check(dev.keyslots, HasLen, 2)
+	c.Check(dev.tokens, HasLen, 2)
+}
+
+func (s *cryptSuite) TestDeleteLUKS2ContainerRecoveryKeyslotNotRecovery(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForDeleteRecoveryKeyslot(existingKey)
+
+	c.Check(DeleteLUKS2ContainerRecoveryKeyslot("/dev/sda1", 0, existingKey), ErrorMatches, "keyslot 0 is not a recovery keyslot")
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *cryptSuite) TestDeleteLUKS2ContainerRecoveryKeyslotMissing(c *C) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = s.newMockContainerForDeleteRecoveryKeyslot(existingKey)
+
+	c.Check(DeleteLUKS2ContainerRecoveryKeyslot("/dev/sda1", 1, existingKey), ErrorMatches, "no recovery key exists in keyslot 1")
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+func (s *cryptSuite) TestDeleteLUKS2ContainerRecoveryKeyslotLastSlot(c *C) {
+	existingKey := s.newPrimaryKey()
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default-recovery"}},
+		},
+		keyslots: map[int][]byte{0: existingKey},
+	}
+
+	c.Check(DeleteLUKS2ContainerRecoveryKeyslot("/dev/sda1", 0, existingKey), Equals, ErrLastLUKS2ContainerKeyslot)
+	c.Check(s.luks2.operations, DeepEquals, []string{"newLUKSView(/dev/sda1,0)"})
+}
+
+type testPruneLUKS2ContainerRecoveryKeyslotsData struct {
+	knownKeys []RecoveryKey
+	dryRun    bool
+
+	expectedNames      []string
+	expectedOperations []string
+	expectedKeyslots   []int
+}
+
+func (s *cryptSuite) testPruneLUKS2ContainerRecoveryKeyslots(c *C, data *testPruneLUKS2ContainerRecoveryKeyslotsData) {
+	existingKey := s.newPrimaryKey()
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+			1: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 1,
+					TokenName:    "default-recovery"}},
+			2: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 2,
+					TokenName:    "old-recovery"}},
+		},
+		keyslots: map[int][]byte{
+			0: existingKey,
+			1: bytes.Repeat([]byte{1}, 16),
+			2: bytes.Repeat([]byte{2}, 16),
+		},
+	}
+
+	names, err := PruneLUKS2ContainerRecoveryKeyslots("/dev/sda1", data.knownKeys, existingKey, data.dryRun)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, data.expectedNames)
+	c.Check(s.luks2.operations, DeepEquals, data.expectedOperations)
+
+	var keyslots []int
+	for slot := range s.luks2.devices["/dev/sda1"].keyslots {
+		keyslots = append(keyslots, slot)
+	}
+	sort.Ints(keyslots)
+	c.Check(keyslots, DeepEquals, data.expectedKeyslots)
+}
+
+func (s *cryptSuite) TestPruneLUKS2ContainerRecoveryKeyslots(c *C) {
+	var known RecoveryKey
+	copy(known[:], bytes.Repeat([]byte{1}, 16))
+
+	s.testPruneLUKS2ContainerRecoveryKeyslots(c, &testPruneLUKS2ContainerRecoveryKeyslotsData{
+		knownKeys:     []RecoveryKey{known},
+		expectedNames: []string{"old-recovery"},
+		expectedOperations: []string{
+			"newLUKSView(/dev/sda1,0)",
+			"TestKey(/dev/sda1,1)",
+			"TestKey(/dev/sda1,2)",
+			"newLUKSView(/dev/sda1,0)",
+			"KillSlot(/dev/sda1,2)",
+			"RemoveToken(/dev/sda1,2)",
+		},
+		expectedKeyslots: []int{0, 1}})
+}
+
+func (s *cryptSuite) TestPruneLUKS2ContainerRecoveryKeyslotsWithOptions(c *C) {
+	existingKey := s.newPrimaryKey()
+	var known RecoveryKey
+	copy(known[:], bytes.Repeat([]byte{1}, 16))
+
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+			1: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 1,
+					TokenName:    "default-recovery"}},
+			2: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 2,
+					TokenName:    "old-recovery"}},
 		},
 		keyslots: map[int][]byte{
 			0: existingKey,
-			1: nil,
+			1: known[:],
+			2: bytes.Repeat([]byte{2}, 16),
 		},
 	}
-	c.Check(AddLUKS2ContainerRecoveryKey("/dev/sda1", "recovery", existingKey, RecoveryKey{}, nil), ErrorMatches, "the specified name is already in use")
-}
-
-type testDeleteLUKS2ContainerKeyData struct {
-	devicePath  string
-	dev         *mockLUKS2Container
-	keyslotName string
-	existingKey []byte
-	slot        int
-	tokenId     int
-}
-
-func (s *cryptSuite) testDeleteLUKS2ContainerKey(c *C, data *testDeleteLUKS2ContainerKeyData) {
-	s.luks2.devices[data.devicePath] = data.dev
-
-	c.Check(DeleteLUKS2ContainerKey(data.devicePath, data.keyslotName, data.existingKey), IsNil)
 
-	c.Check(s.luks2.operations, DeepEquals, []string{
-		"newLUKSView(" + data.devicePath + ",0)",
-		"KillSlot(" + data.devicePath + "," + strconv.Itoa(data.slot) + ")",
-		"RemoveToken(" + data.devicePath + "," + strconv.Itoa(data.tokenId) + ")",
+	path := "/run/mnt/tools/cryptsetup"
+
+	var paths []string
+	s.AddCleanup(MockLUKS2TestKey(func(devicePath string, slot int, key []byte, options *luks2.CommandOptions) error {
+		paths = append(paths, "TestKey:"+options.CryptsetupPath)
+		return s.luks2.testKey(devicePath, slot, key, options)
+	}))
+	s.AddCleanup(MockLUKS2KillSlot(func(devicePath string, slot int, key []byte, options *luks2.CommandOptions) error {
+		paths = append(paths, "KillSlot:"+options.CryptsetupPath)
+		return s.luks2.killSlot(devicePath, slot, key, options)
+	}))
+	s.AddCleanup(MockLUKS2RemoveToken(func(devicePath string, id int, options *luks2.CommandOptions) error {
+		paths = append(paths, "RemoveToken:"+options.CryptsetupPath)
+		return s.luks2.removeToken(devicePath, id, options)
+	}))
+
+	names, err := PruneLUKS2ContainerRecoveryKeyslotsWithOptions("/dev/sda1", []RecoveryKey{known}, existingKey, false, &LUKS2CommandOptions{CryptsetupPath: path})
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"old-recovery"})
+	c.Check(paths, DeepEquals, []string{
+		"TestKey:" + path,
+		"TestKey:" + path,
+		"KillSlot:" + path,
+		"RemoveToken:" + path,
 	})
 }
 
-func (s *cryptSuite) TestDeleteLUKS2ContainerKey(c *C) {
-	existingKey := s.newPrimaryKey()
+func (s *cryptSuite) TestPruneLUKS2ContainerRecoveryKeyslotsDryRun(c *C) {
+	var known RecoveryKey
+	copy(known[:], bytes.Repeat([]byte{1}, 16))
 
-	s.testDeleteLUKS2ContainerKey(c, &testDeleteLUKS2ContainerKeyData{
-		devicePath: "/dev/sda1",
-		dev: &mockLUKS2Container{
-			tokens: map[int]luks2.Token{
-				0: &luksview.KeyDataToken{
-					TokenBase: luksview.TokenBase{
-						TokenKeyslot: 0,
-						TokenName:    "default"}},
-				1: &luksview.RecoveryToken{
-					TokenBase: luksview.TokenBase{
-						TokenKeyslot: 1,
-						TokenName:    "default-recovery"}},
-			},
-			keyslots: map[int][]byte{
-				0: existingKey,
-				1: nil,
-			},
+	s.testPruneLUKS2ContainerRecoveryKeyslots(c, &testPruneLUKS2ContainerRecoveryKeyslotsData{
+		knownKeys:     []RecoveryKey{known},
+		dryRun:        true,
+		expectedNames: []string{"old-recovery"},
+		expectedOperations: []string{
+			"newLUKSView(/dev/sda1,0)",
+			"TestKey(/dev/sda1,1)",
+			"TestKey(/dev/sda1,2)",
 		},
-		keyslotName: "default-recovery",
-		existingKey: existingKey,
-		slot:        1,
-		tokenId:     1,
-	})
+		expectedKeyslots: []int{0, 1, 2}})
 }
 
-func (s *cryptSuite) TestDeleteLUKS2ContainerKeyDifferentPath(c *C) {
-	existingKey := s.newPrimaryKey()
-
-	s.testDeleteLUKS2ContainerKey(c, &testDeleteLUKS2ContainerKeyData{
-		devicePath: "/dev/nvme0n1p1",
-		dev: &mockLUKS2Container{
+func (s *cryptSuite) TestPruneLUKS2ContainerRecoveryKeyslotsNoKnownKeys(c *C) {
+	// Test that every recovery keyslot isn't removed when no known keys are supplied.
+	for _, knownKeys := range [][]RecoveryKey{nil, {}} {
+		s.luks2.operations = nil
+		s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
 			tokens: map[int]luks2.Token{
 				0: &luksview.KeyDataToken{
 					TokenBase: luksview.TokenBase{
@@ -2818,116 +6243,96 @@ func (s *cryptSuite) TestDeleteLUKS2ContainerKeyDifferentPath(c *C) {
 						TokenKeyslot: 1,
 						TokenName:    "default-recovery"}},
 			},
-			keyslots: map[int][]byte{
-				0: existingKey,
-				1: nil,
-			},
-		},
-		keyslotName: "default-recovery",
-		existingKey: existingKey,
-		slot:        1,
-		tokenId:     1,
-	})
-}
-
-func (s *cryptSuite) TestDeleteLUKS2ContainerKeyDifferentName(c *C) {
-	existingKey := s.newPrimaryKey()
+			keyslots: map[int][]byte{0: make([]byte, 32), 1: make([]byte, 16)},
+		}
 
-	s.testDeleteLUKS2ContainerKey(c, &testDeleteLUKS2ContainerKeyData{
-		devicePath: "/dev/sda1",
-		dev: &mockLUKS2Container{
-			tokens: map[int]luks2.Token{
-				0: &luksview.KeyDataToken{
-					TokenBase: luksview.TokenBase{
-						TokenKeyslot: 0,
-						TokenName:    "default"}},
-				1: &luksview.RecoveryToken{
-					TokenBase: luksview.TokenBase{
-						TokenKeyslot: 1,
-						TokenName:    "foo"}},
-			},
-			keyslots: map[int][]byte{
-				0: existingKey,
-				1: nil,
-			},
-		},
-		keyslotName: "foo",
-		existingKey: existingKey,
-		slot:        1,
-		tokenId:     1,
-	})
+		names, err := PruneLUKS2ContainerRecoveryKeyslots("/dev/sda1", knownKeys, make([]byte, 32), false)
+		c.Check(err, ErrorMatches, "no known recovery keys supplied")
+		c.Check(names, IsNil)
+		c.Check(s.luks2.operations, HasLen, 0)
+		c.Check(s.luks2.devices["/dev/sda1"].keyslots, HasLen, 2)
+	}
 }
 
-func (s *cryptSuite) TestDeleteLUKS2ContainerKeyDifferentKeyslot(c *C) {
-	existingKey := s.newPrimaryKey()
+func (s *cryptSuite) TestPruneLUKS2ContainerRecoveryKeyslotsNothingToPrune(c *C) {
+	var known1, known2 RecoveryKey
+	copy(known1[:], bytes.Repeat([]byte{1}, 16))
+	copy(known2[:], bytes.Repeat([]byte{2}, 16))
 
-	s.testDeleteLUKS2ContainerKey(c, &testDeleteLUKS2ContainerKeyData{
-		devicePath: "/dev/sda1",
-		dev: &mockLUKS2Container{
-			tokens: map[int]luks2.Token{
-				0: &luksview.KeyDataToken{
-					TokenBase: luksview.TokenBase{
-						TokenKeyslot: 0,
-						TokenName:    "default"}},
-				1: &luksview.RecoveryToken{
-					TokenBase: luksview.TokenBase{
-						TokenKeyslot: 2,
-						TokenName:    "default-recovery"}},
-			},
-			keyslots: map[int][]byte{
-				0: existingKey,
-				2: nil,
-			},
+	s.testPruneLUKS2ContainerRecoveryKeyslots(c, &testPruneLUKS2ContainerRecoveryKeyslotsData{
+		knownKeys: []RecoveryKey{known1, known2},
+		expectedOperations: []string{
+			"newLUKSView(/dev/sda1,0)",
+			"TestKey(/dev/sda1,1)",
+			"TestKey(/dev/sda1,2)",
+			"TestKey(/dev/sda1,2)",
 		},
-		keyslotName: "default-recovery",
-		existingKey: existingKey,
-		slot:        2,
-		tokenId:     1,
-	})
+		expectedKeyslots: []int{0, 1, 2}})
 }
 
-func (s *cryptSuite) TestDeleteLUKS2ContainerKeyDifferentTokenId(c *C) {
+func (s *cryptSuite) TestPruneLUKS2ContainerRecoveryKeyslotsNoneKnown(c *C) {
+	// Test that nothing is removed if none of the known keys match a recovery
+	// keyslot, so that a verified recovery keyslot is always retained.
 	existingKey := s.newPrimaryKey()
-
-	s.testDeleteLUKS2ContainerKey(c, &testDeleteLUKS2ContainerKeyData{
-		devicePath: "/dev/sda1",
-		dev: &mockLUKS2Container{
-			tokens: map[int]luks2.Token{
-				0: &luksview.KeyDataToken{
-					TokenBase: luksview.TokenBase{
-						TokenKeyslot: 0,
-						TokenName:    "default"}},
-				4: &luksview.RecoveryToken{
-					TokenBase: luksview.TokenBase{
-						TokenKeyslot: 1,
-						TokenName:    "default-recovery"}},
-			},
-			keyslots: map[int][]byte{
-				0: existingKey,
-				1: nil,
-			},
+	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
+		tokens: map[int]luks2.Token{
+			0: &luksview.KeyDataToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 0,
+					TokenName:    "default"}},
+			1: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 1,
+					TokenName:    "default-recovery"}},
+			2: &luksview.RecoveryToken{
+				TokenBase: luksview.TokenBase{
+					TokenKeyslot: 2,
+					TokenName:    "old-recovery"}},
 		},
-		keyslotName: "default-recovery",
-		existingKey: existingKey,
-		slot:        1,
-		tokenId:     4,
-	})
+		keyslots: map[int][]byte{
+			0: existingKey,
+			1: bytes.Repeat([]byte{1}, 16),
+			2: bytes.Repeat([]byte{2}, 16),
+		},
+	}
+
+	var unknown RecoveryKey
+	copy(unknown[:], bytes.Repeat([]byte{3}, 16))
+
+	for _, dryRun := range []bool{false, true} {
+		s.luks2.operations = nil
+
+		names, err := PruneLUKS2ContainerRecoveryKeyslots("/dev/sda1", []RecoveryKey{unknown}, existingKey, dryRun)
+		c.Check(err, ErrorMatches, "none of the supplied known recovery keys can unlock a recovery keyslot")
+		c.Check(names, IsNil)
+		c.Check(s.luks2.operations, DeepEquals, []string{
+			"newLUKSView(/dev/sda1,0)",
+			"TestKey(/dev/sda1,1)",
+			"TestKey(/dev/sda1,2)",
+		})
+		c.Check(s.luks2.devices["/dev/sda1"].keyslots, HasLen, 3)
+	}
 }
 
-func (s *cryptSuite) TestDeleteLUKS2ContainerKeyLastSlot(c *C) {
-	existingKey := s.newPrimaryKey()
+func (s *cryptSuite) TestPruneLUKS2ContainerRecoveryKeyslotsLastSlot(c *C) {
+	// Test that the only recovery keyslot is retained if it is known.
+	var known RecoveryKey
+	copy(known[:], bytes.Repeat([]byte{1}, 16))
 
 	s.luks2.devices["/dev/sda1"] = &mockLUKS2Container{
 		tokens: map[int]luks2.Token{
-			0: &luksview.KeyDataToken{
+			0: &luksview.RecoveryToken{
 				TokenBase: luksview.TokenBase{
 					TokenKeyslot: 0,
-					TokenName:    "default"}},
+					TokenName:    "default-recovery"}},
 		},
-		keyslots: map[int][]byte{0: existingKey},
+		keyslots: map[int][]byte{0: known[:]},
 	}
 
-	c.Check(DeleteLUKS2ContainerKey("/dev/sda1", "default", existingKey), ErrorMatches, "cannot kill last remaining slot")
+	names, err := PruneLUKS2ContainerRecoveryKeyslots("/dev/sda1", []RecoveryKey{known}, known[:], false)
+	c.Check(err, IsNil)
+	c.Check(names, IsNil)
+	c.Check(s.luks2.devices["/dev/sda1"].keyslots, HasLen, 1)
 }
 
 type testRenameLUKS2ContainerKeyData struct {
@@ -3463,6 +6868,36 @@ func (s *cryptSuiteUnmocked) TestAddLUKS2ContainerRecoveryKeyWithCustomKDFIterat
 	})
 }
 
+func (s *cryptSuiteUnmocked) TestAddLUKS2ContainerRecoveryKeyWithArgon2id(c *C) {
+	key := s.newPrimaryKey()
+	path := luks2test.CreateEmptyDiskImage(c, 20)
+
+	c.Check(InitializeLUKS2Container(path, "data", key, nil), IsNil)
+
+	var recoveryKey RecoveryKey
+	rand.Read(recoveryKey[:])
+	slot, err := AddLUKS2ContainerRecoveryKeyWithOptions(path, "", key, recoveryKey, &AddLUKS2ContainerRecoveryKeyOptions{
+		KDFOptions: &KDFOptions{MemoryKiB: 32, ForceIterations: 4, Parallel: 1},
+		KDFType:    LUKS2KDFTypeArgon2id,
+		Slot:       LUKS2AnyKeyslot,
+		Priority:   LUKS2KeyslotPriorityNormal})
+	c.Assert(err, IsNil)
+	c.Check(slot, Equals, 1)
+
+	info, err := luks2.ReadHeader(path, luks2.LockModeBlocking)
+	c.Assert(err, IsNil)
+
+	keyslot, ok := info.Metadata.Keyslots[1]
+	c.Assert(ok, Equals, true)
+	c.Assert(keyslot.KDF, NotNil)
+	c.Check(keyslot.KDF.Type, Equals, luks2.KDFTypeArgon2id)
+	c.Check(keyslot.KDF.Time, Equals, 4)
+	c.Check(keyslot.KDF.Memory, Equals, 32)
+	c.Check(keyslot.KDF.CPUs, Equals, 1)
+
+	luks2test.CheckLUKS2Passphrase(c, path, recoveryKey[:])
+}
+
 func (s *cryptSuiteUnmockedExpensive) TestListLUKS2ContainerKeyName(c *C) {
 	key := s.newPrimaryKey()
 	path := luks2test.CreateEmptyDiskImage(c, 20)
@@ -3483,6 +6918,62 @@ func (s *cryptSuiteUnmockedExpensive) TestListLUKS2ContainerKeyName(c *C) {
 	c.Check(names, DeepEquals, []string{"default-recovery"})
 }
 
+func (s *cryptSuiteUnmockedExpensive) TestGetLUKS2ContainerInfo(c *C) {
+	key := s.newPrimaryKey()
+	path := luks2test.CreateEmptyDiskImage(c, 20)
+
+	c.Check(InitializeLUKS2Container(path, "data", key, nil), IsNil)
+
+	info, err := GetLUKS2ContainerInfo(path)
+	c.Assert(err, IsNil)
+	c.Check(info.Label, Equals, "data")
+	c.Check(info.Subsystem, Equals, "")
+	c.Check(info.Cipher, Equals, "aes-xts-plain64")
+	c.Check(info.SectorSize, Equals, 512)
+
+	hdr, err := luks2.ReadHeader(path, luks2.LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.UUID, Equals, hdr.UUID)
+	c.Check(info.UUID, Matches, "[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}")
+}
+
+func (s *cryptSuiteUnmockedExpensive) TestGetLUKS2ContainerInfoWithSectorSize(c *C) {
+	key := s.newPrimaryKey()
+	path := luks2test.CreateEmptyDiskImage(c, 20)
+
+	c.Check(InitializeLUKS2Container(path, "data", key, &InitializeLUKS2ContainerOptions{SectorSize: 4096}), IsNil)
+
+	info, err := GetLUKS2ContainerInfo(path)
+	c.Assert(err, IsNil)
+	c.Check(info.SectorSize, Equals, 4096)
+}
+
+func (s *cryptSuiteUnmocked) TestGetLUKS2ContainerInfoNotLUKS2(c *C) {
+	path := luks2test.CreateEmptyDiskImage(c, 20)
+
+	_, err := GetLUKS2ContainerInfo(path)
+	c.Check(err, ErrorMatches, ".* is not a LUKS2 container")
+	c.Check(err, DeepEquals, &NotLUKS2ContainerError{DevicePath: path})
+}
+
+func (s *cryptSuiteUnmockedExpensive) TestListLUKS2ContainerKeyslots(c *C) {
+	key := s.newPrimaryKey()
+	path := luks2test.CreateEmptyDiskImage(c, 20)
+
+	c.Check(InitializeLUKS2Container(path, "data", key, nil), IsNil)
+
+	var recoveryKey RecoveryKey
+	rand.Read(recoveryKey[:])
+	c.Check(AddLUKS2ContainerRecoveryKey(path, "", key, recoveryKey, nil), IsNil)
+
+	keyslots, err := ListLUKS2ContainerKeyslots(path)
+	c.Check(err, IsNil)
+	c.Check(keyslots, DeepEquals, []LUKS2KeyslotInfo{
+		{Slot: 0, Priority: LUKS2KeyslotPriorityHigh},
+		{Slot: 1, Priority: LUKS2KeyslotPriorityNormal},
+	})
+}
+
 type testDeleteLUKS2ContainerKeyUnmockedData struct {
 	key                   DiskUnlockKey
 	recoveryKey           RecoveryKey
@@ -3637,3 +7128,91 @@ func (s *cryptSuiteUnmocked) TestRenameLUKS2ContainerRecoveryKey(c *C) {
 				TokenName:    "bar",
 				TokenKeyslot: 1}}})
 }
+
+func (s *cryptSuiteUnmocked) TestBackupAndRestoreLUKS2Header(c *C) {
+	key := s.newPrimaryKey()
+	path := luks2test.CreateEmptyDiskImage(c, 20)
+
+	options := &InitializeLUKS2ContainerOptions{KDFOptions: &KDFOptions{MemoryKiB: 32, ForceIterations: 4}}
+	c.Assert(InitializeLUKS2Container(path, "data", key, options), IsNil)
+
+	backupFile := filepath.Join(c.MkDir(), "header")
+	c.Check(BackupLUKS2Header(path, backupFile), IsNil)
+
+	// Modify the header after taking the backup.
+	c.Assert(RenameLUKS2ContainerKey(path, "default", "foo"), IsNil)
+
+	c.Check(RestoreLUKS2Header(path, backupFile, nil), IsNil)
+
+	names, err := ListLUKS2ContainerUnlockKeyNames(path)
+	c.Check(err, IsNil)
+	c.Check(names, DeepEquals, []string{"default"})
+	luks2test.CheckLUKS2Passphrase(c, path, key)
+}
+
+func (s *cryptSuiteUnmocked) TestBackupLUKS2HeaderNotLUKS2(c *C) {
+	path := luks2test.CreateEmptyDiskImage(c, 20)
+
+	err := BackupLUKS2Header(path, filepath.Join(c.MkDir(), "header"))
+	c.Check(err, ErrorMatches, ".* is not a LUKS2 container")
+	c.Check(err, DeepEquals, &NotLUKS2ContainerError{DevicePath: path})
+}
+
+func (s *cryptSuiteUnmocked) testRestoreLUKS2HeaderDifferentUUID(c *C, options *RestoreLUKS2HeaderOptions) (path string, err error) {
+	kdfOptions := &KDFOptions{MemoryKiB: 32, ForceIterations: 4}
+
+	key1 := s.newPrimaryKey()
+	path1 := luks2test.CreateEmptyDiskImage(c, 20)
+	c.Assert(InitializeLUKS2Container(path1, "data", key1, &InitializeLUKS2ContainerOptions{KDFOptions: kdfOptions}), IsNil)
+
+	key2 := s.newPrimaryKey()
+	path2 := luks2test.CreateEmptyDiskImage(c, 20)
+	c.Assert(InitializeLUKS2Container(path2, "data", key2, &InitializeLUKS2ContainerOptions{KDFOptions: kdfOptions}), IsNil)
+
+	backupFile := filepath.Join(c.MkDir(), "header")
+	c.Assert(BackupLUKS2Header(path1, backupFile), IsNil)
+
+	return path2, RestoreLUKS2Header(path2, backupFile, options)
+}
+
+func (s *cryptSuiteUnmocked) TestRestoreLUKS2HeaderDifferentUUID(c *C) {
+	path, err := s.testRestoreLUKS2HeaderDifferentUUID(c, nil)
+	c.Check(err, ErrorMatches, `header backup UUID \([0-9a-f-]+\) does not match the UUID of the existing header \([0-9a-f-]+\)`)
+	c.Assert(err, FitsTypeOf, &LUKS2HeaderUUIDMismatchError{})
+
+	info, err2 := GetLUKS2ContainerInfo(path)
+	c.Assert(err2, IsNil)
+	c.Check(err.(*LUKS2HeaderUUIDMismatchError).UUID, Equals, info.UUID)
+	c.Check(err.(*LUKS2HeaderUUIDMismatchError).BackupUUID, Not(Equals), info.UUID)
+}
+
+func (s *cryptSuiteUnmocked) TestRestoreLUKS2HeaderDifferentUUIDForce(c *C) {
+	_, err := s.testRestoreLUKS2HeaderDifferentUUID(c, &RestoreLUKS2HeaderOptions{Force: true})
+	c.Check(err, IsNil)
+}
+
+func (s *cryptSuiteUnmocked) TestRestoreLUKS2HeaderNoExistingHeader(c *C) {
+	key := s.newPrimaryKey()
+	path1 := luks2test.CreateEmptyDiskImage(c, 20)
+	c.Assert(InitializeLUKS2Container(path1, "data", key, &InitializeLUKS2ContainerOptions{KDFOptions: &KDFOptions{MemoryKiB: 32, ForceIterations: 4}}), IsNil)
+
+	backupFile := filepath.Join(c.MkDir(), "header")
+	c.Assert(BackupLUKS2Header(path1, backupFile), IsNil)
+
+	path2 := luks2test.CreateEmptyDiskImage(c, 20)
+	c.Check(RestoreLUKS2Header(path2, backupFile, nil), ErrorMatches, "cannot read existing header: .*")
+	c.Check(RestoreLUKS2Header(path2, backupFile, &RestoreLUKS2HeaderOptions{Force: true}), IsNil)
+
+	info, err := GetLUKS2ContainerInfo(path2)
+	c.Assert(err, IsNil)
+	c.Check(info.Label, Equals, "data")
+}
+
+func (s *cryptSuiteUnmocked) TestRestoreLUKS2HeaderInvalidBackup(c *C) {
+	path := luks2test.CreateEmptyDiskImage(c, 20)
+
+	backupFile := filepath.Join(c.MkDir(), "header")
+	c.Assert(ioutil.WriteFile(backupFile, make([]byte, 4096), 0600), IsNil)
+
+	c.Check(RestoreLUKS2Header(path, backupFile, nil), ErrorMatches, "cannot read header backup: .*")
+}
@@ -0,0 +1,131 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+const (
+	grubStringPCR = 8 // PCR that GRUB measures commands and kernel commandlines to
+	grubBinaryPCR = 9 // PCR that GRUB measures the files that it loads to
+)
+
+// GrubBootPath describes a single path through GRUB to a kernel, such as a single menu entry.
+type GrubBootPath struct {
+	// Config is the contents of grub.cfg. GRUB measures the whole file exactly as it is read from disk, so this must not be
+	// normalized. In particular, a trailing newline must be retained if the file has one.
+	Config []byte
+
+	// Files is the sequence of files that GRUB loads after grub.cfg on this path, such as the kernel and initrd, in the order
+	// in which they are loaded. These are measured to PCR 9 after grub.cfg.
+	Files []Image
+
+	// Commands is the sequence of strings that GRUB measures to PCR 8 on this path, in the order in which they are measured.
+	// This includes every command that GRUB executes, including conditionals and the commands inside the selected menu entry,
+	// with the command name and arguments separated by single spaces, and the kernel commandline, which is measured
+	// immediately after the linux command. These are the strings from the event log without the "grub_cmd: " or
+	// "kernel_cmdline: " prefixes. Trailing newlines are ignored, because GRUB never includes them in a measurement.
+	Commands []string
+}
+
+// GrubProfileParams provides the parameters to AddGrubProfile.
+type GrubProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// BootPaths is the set of paths through GRUB to add to the PCR profile.
+	BootPaths []GrubBootPath
+}
+
+// computeGrubFileDigest computes the digest of the supplied file as measured by GRUB.
+func computeGrubFileDigest(alg tpm2.HashAlgorithmId, image Image) (tpm2.Digest, error) {
+	r, err := image.Open()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open file: %w", err)
+	}
+	defer r.Close()
+
+	h := alg.NewHash()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, r.Size())); err != nil {
+		return nil, xerrors.Errorf("cannot read file: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// AddGrubProfile adds the GRUB profile to the PCR protection profile, in order to generate a PCR policy that restricts access to
+// a key to a defined set of configurations and boot paths when booting with a version of GRUB that includes the TPM measured boot
+// module.
+//
+// GRUB measures the contents of every file that it loads, starting with grub.cfg, to PCR 9. It measures every command that it
+// executes and the kernel commandline to PCR 8.
+//
+// The set of paths through GRUB to add to the PCRProtectionProfile is specified via the BootPaths field of params. Each path
+// creates a separate branch in the profile, so a grub.cfg with a menu containing multiple kernels should be described with one
+// path for each menu entry that should be permitted.
+func AddGrubProfile(profile *secboot_tpm2.PCRProtectionProfile, params *GrubProfileParams) error {
+	if len(params.BootPaths) == 0 {
+		return errors.New("no boot paths specified")
+	}
+
+	var subProfiles []*secboot_tpm2.PCRProtectionProfile
+	for i, path := range params.BootPaths {
+		subProfile := secboot_tpm2.NewPCRProtectionProfile()
+
+		h := params.PCRAlgorithm.NewHash()
+		h.Write(path.Config)
+		subProfile.ExtendPCR(params.PCRAlgorithm, grubBinaryPCR, h.Sum(nil))
+
+		for _, file := range path.Files {
+			digest, err := computeGrubFileDigest(params.PCRAlgorithm, file)
+			if err != nil {
+				return xerrors.Errorf("cannot compute measurement for %v: %w", file, err)
+			}
+			subProfile.ExtendPCR(params.PCRAlgorithm, grubBinaryPCR, digest)
+		}
+
+		for _, cmd := range path.Commands {
+			cmd = strings.TrimRight(cmd, "\n")
+			if cmd == "" {
+				return fmt.Errorf("boot path %d contains an empty command", i)
+			}
+
+			h := params.PCRAlgorithm.NewHash()
+			io.WriteString(h, cmd)
+			subProfile.ExtendPCR(params.PCRAlgorithm, grubStringPCR, h.Sum(nil))
+		}
+
+		subProfiles = append(subProfiles, subProfile)
+	}
+
+	profile.AddProfileOR(subProfiles...)
+	return nil
+}
@@ -0,0 +1,173 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package efi_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	. "github.com/snapcore/secboot/efi"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
+)
+
+type grubPolicySuite struct{}
+
+var _ = Suite(&grubPolicySuite{})
+
+func (s *grubPolicySuite) writeFile(c *C, dir, name, data string) Image {
+	path := filepath.Join(dir, name)
+	c.Assert(ioutil.WriteFile(path, []byte(data), 0644), IsNil)
+	return FileImage(path)
+}
+
+func (s *grubPolicySuite) testAddGrubProfile(c *C, params *GrubProfileParams, expected []tpm2.PCRValues) {
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddGrubProfile(profile, params), IsNil)
+
+	values, err := profile.ComputePCRValues(nil)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, expected)
+
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", tpm2test.FormatPCRValuesFromPCRProtectionProfile(profile, nil))
+	}
+}
+
+func (s *grubPolicySuite) TestAddGrubProfile(c *C) {
+	dir := c.MkDir()
+	config := "set timeout=0\nmenuentry 'Ubuntu' {\n\tlinux /vmlinuz root=/dev/sda2 ro\n\tinitrd /initrd.img\n}\n"
+
+	s.testAddGrubProfile(c, &GrubProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		BootPaths: []GrubBootPath{
+			{
+				Config: []byte(config),
+				Files: []Image{
+					s.writeFile(c, dir, "vmlinuz", "kernel"),
+					s.writeFile(c, dir, "initrd.img", "initrd")},
+				Commands: []string{
+					"set timeout=0",
+					"setparams Ubuntu",
+					"linux /vmlinuz root=/dev/sda2 ro",
+					"BOOT_IMAGE=/vmlinuz root=/dev/sda2 ro",
+					"initrd /initrd.img"}},
+		}}, []tpm2.PCRValues{
+		{
+			tpm2.HashAlgorithmSHA256: {
+				8: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256,
+					"set timeout=0",
+					"setparams Ubuntu",
+					"linux /vmlinuz root=/dev/sda2 ro",
+					"BOOT_IMAGE=/vmlinuz root=/dev/sda2 ro",
+					"initrd /initrd.img"),
+				9: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, config, "kernel", "initrd"),
+			},
+		},
+	})
+}
+
+func (s *grubPolicySuite) TestAddGrubProfileMultipleKernels(c *C) {
+	dir := c.MkDir()
+	config := "menuentry 'Ubuntu' {\n\tlinux /vmlinuz-2\n}\nmenuentry 'Ubuntu (previous)' {\n\tlinux /vmlinuz-1\n}\n"
+
+	s.testAddGrubProfile(c, &GrubProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA1,
+		BootPaths: []GrubBootPath{
+			{
+				Config:   []byte(config),
+				Files:    []Image{s.writeFile(c, dir, "vmlinuz-2", "kernel2")},
+				Commands: []string{"setparams Ubuntu", "linux /vmlinuz-2", "BOOT_IMAGE=/vmlinuz-2"}},
+			{
+				Config:   []byte(config),
+				Files:    []Image{s.writeFile(c, dir, "vmlinuz-1", "kernel1")},
+				Commands: []string{"setparams Ubuntu (previous)", "linux /vmlinuz-1", "BOOT_IMAGE=/vmlinuz-1"}},
+		}}, []tpm2.PCRValues{
+		{
+			tpm2.HashAlgorithmSHA1: {
+				8: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA1, "setparams Ubuntu", "linux /vmlinuz-2", "BOOT_IMAGE=/vmlinuz-2"),
+				9: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA1, config, "kernel2"),
+			},
+		},
+		{
+			tpm2.HashAlgorithmSHA1: {
+				8: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA1, "setparams Ubuntu (previous)", "linux /vmlinuz-1", "BOOT_IMAGE=/vmlinuz-1"),
+				9: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA1, config, "kernel1"),
+			},
+		},
+	})
+}
+
+func (s *grubPolicySuite) TestAddGrubProfileNewlines(c *C) {
+	// The config is measured verbatim, but trailing newlines are
+	// stripped from commands.
+	config := "linux /vmlinuz"
+
+	s.testAddGrubProfile(c, &GrubProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		BootPaths: []GrubBootPath{
+			{
+				Config:   []byte(config),
+				Commands: []string{"linux /vmlinuz\n"}},
+			{
+				Config:   []byte(config + "\n"),
+				Commands: []string{"linux /vmlinuz"}},
+		}}, []tpm2.PCRValues{
+		{
+			tpm2.HashAlgorithmSHA256: {
+				8: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "linux /vmlinuz"),
+				9: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, config),
+			},
+		},
+		{
+			tpm2.HashAlgorithmSHA256: {
+				8: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, "linux /vmlinuz"),
+				9: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256, config+"\n"),
+			},
+		},
+	})
+}
+
+func (s *grubPolicySuite) TestAddGrubProfileNoBootPaths(c *C) {
+	err := AddGrubProfile(secboot_tpm2.NewPCRProtectionProfile(), &GrubProfileParams{PCRAlgorithm: tpm2.HashAlgorithmSHA256})
+	c.Check(err, ErrorMatches, "no boot paths specified")
+}
+
+func (s *grubPolicySuite) TestAddGrubProfileEmptyCommand(c *C) {
+	err := AddGrubProfile(secboot_tpm2.NewPCRProtectionProfile(), &GrubProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		BootPaths: []GrubBootPath{
+			{Config: []byte("linux /vmlinuz\n"), Commands: []string{"linux /vmlinuz", "\n"}}}})
+	c.Check(err, ErrorMatches, "boot path 0 contains an empty command")
+}
+
+func (s *grubPolicySuite) TestAddGrubProfileMissingFile(c *C) {
+	path := filepath.Join(c.MkDir(), "vmlinuz")
+	err := AddGrubProfile(secboot_tpm2.NewPCRProtectionProfile(), &GrubProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		BootPaths: []GrubBootPath{
+			{Config: []byte("linux /vmlinuz\n"), Files: []Image{FileImage(path)}}}})
+	c.Check(err, ErrorMatches, "cannot compute measurement for .*/vmlinuz: cannot open file: open .*/vmlinuz: no such file or directory")
+}
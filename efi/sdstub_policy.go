@@ -20,14 +20,33 @@
 package efi
 
 import (
+	"debug/pe"
 	"errors"
+	"io"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/tcglog-parser"
 
+	"golang.org/x/xerrors"
+
 	secboot_tpm2 "github.com/snapcore/secboot/tpm2"
 )
 
+// systemdStubUKISections are the sections of a unified kernel image that are
+// measured by the systemd EFI stub, in the order in which they are measured.
+// The .pcrsig section is omitted because it isn't measured.
+var systemdStubUKISections = []string{
+	".linux",
+	".osrel",
+	".cmdline",
+	".initrd",
+	".splash",
+	".dtb",
+	".uname",
+	".sbat",
+	".pcrpkey",
+}
+
 // SystemdStubProfileParams provides the parameters to AddSystemdStubProfile.
 type SystemdStubProfileParams struct {
 	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
@@ -66,3 +85,98 @@ func AddSystemdStubProfile(profile *secboot_tpm2.PCRProtectionProfile, params *S
 	profile.AddProfileOR(subProfiles...)
 	return nil
 }
+
+// SystemdStubUKIProfileParams provides the parameters to AddSystemdStubUKIProfile.
+type SystemdStubUKIProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// PCRIndex is the PCR that the systemd EFI stub measures the sections of a unified kernel image to. This is PCR 11 for
+	// current versions of systemd.
+	PCRIndex int
+
+	// Images is the set of unified kernel images to add to the PCR profile.
+	Images []Image
+}
+
+// computeSystemdStubUKIDigests computes the digests of the events that the systemd EFI stub measures for the supplied unified
+// kernel image. For each section that is present, the stub measures the NULL terminated section name followed by the contents of
+// the section, in the order defined by systemdStubUKISections. The measured contents of a section have the length of its virtual
+// size, which is zero-padded if it is larger than the size of the section's raw data in the file.
+func computeSystemdStubUKIDigests(alg tpm2.HashAlgorithmId, image Image) (tpm2.DigestList, error) {
+	r, err := image.Open()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open image: %w", err)
+	}
+	defer r.Close()
+
+	pefile, err := pe.NewFile(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode image: %w", err)
+	}
+
+	var digests tpm2.DigestList
+	for _, name := range systemdStubUKISections {
+		section := pefile.Section(name)
+		if section == nil {
+			continue
+		}
+
+		h := alg.NewHash()
+		h.Write(append([]byte(name), 0))
+		digests = append(digests, h.Sum(nil))
+
+		size := int64(section.VirtualSize)
+		h = alg.NewHash()
+		if _, err := io.Copy(h, io.NewSectionReader(section, 0, size)); err != nil {
+			return nil, xerrors.Errorf("cannot read %s section: %w", name, err)
+		}
+		if n := size - int64(section.Size); n > 0 {
+			h.Write(make([]byte, n))
+		}
+		digests = append(digests, h.Sum(nil))
+	}
+
+	if len(digests) == 0 {
+		return nil, errors.New("image does not contain any sections measured by the systemd EFI stub")
+	}
+
+	return digests, nil
+}
+
+// AddSystemdStubUKIProfile adds the systemd EFI linux loader stub profile for unified kernel images to the PCR protection profile,
+// in order to generate a PCR policy that restricts access to a key to a defined set of unified kernel images when booting with
+// the systemd EFI stub.
+//
+// The systemd EFI stub measures the name and contents of each of the sections of the unified kernel image that it uses, such as
+// .linux, .cmdline and .initrd. The PCR index that these are measured to can be specified via the PCRIndex field of params.
+//
+// The set of unified kernel images to add to the PCRProtectionProfile is specified via the Images field of params. Each image
+// creates a separate branch in the profile.
+func AddSystemdStubUKIProfile(profile *secboot_tpm2.PCRProtectionProfile, params *SystemdStubUKIProfileParams) error {
+	if params.PCRIndex < 0 {
+		return errors.New("invalid PCR index")
+	}
+	if len(params.Images) == 0 {
+		return errors.New("no images specified")
+	}
+
+	var subProfiles []*secboot_tpm2.PCRProtectionProfile
+	for _, image := range params.Images {
+		digests, err := computeSystemdStubUKIDigests(params.PCRAlgorithm, image)
+		if err != nil {
+			return xerrors.Errorf("cannot compute measurements for %v: %w", image, err)
+		}
+
+		subProfile := secboot_tpm2.NewPCRProtectionProfile()
+		for _, digest := range digests {
+			subProfile.ExtendPCR(params.PCRAlgorithm, params.PCRIndex, digest)
+		}
+		subProfiles = append(subProfiles, subProfile)
+	}
+
+	profile.AddProfileOR(subProfiles...)
+	return nil
+}
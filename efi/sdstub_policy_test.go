@@ -20,6 +20,12 @@
 package efi_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/util"
 
@@ -156,3 +162,206 @@ func (s *sdstubPolicySuite) TestAddSystemdStubProfileWithInitialProfile(c *C) {
 			},
 		}})
 }
+
+type mockUKISection struct {
+	name        string
+	data        []byte
+	virtualSize uint32 // defaults to the length of data
+}
+
+// writeMockUKI writes a minimal PE image containing the supplied sections
+// to the specified path.
+func writeMockUKI(c *C, path string, sections []mockUKISection) {
+	const (
+		peHeaderOffset      = 0x40
+		sectionHeaderOffset = peHeaderOffset + 4 + 20
+	)
+
+	w := new(bytes.Buffer)
+
+	// DOS header
+	dosHeader := make([]byte, peHeaderOffset)
+	copy(dosHeader, "MZ")
+	binary.LittleEndian.PutUint32(dosHeader[0x3c:], peHeaderOffset)
+	w.Write(dosHeader)
+
+	// PE signature and COFF file header
+	w.WriteString("PE\x00\x00")
+	binary.Write(w, binary.LittleEndian, struct {
+		Machine              uint16
+		NumberOfSections     uint16
+		TimeDateStamp        uint32
+		PointerToSymbolTable uint32
+		NumberOfSymbols      uint32
+		SizeOfOptionalHeader uint16
+		Characteristics      uint16
+	}{Machine: 0x8664, NumberOfSections: uint16(len(sections)), Characteristics: 0x22})
+
+	// Section headers
+	offset := uint32(sectionHeaderOffset + (40 * len(sections)))
+	for _, section := range sections {
+		virtualSize := section.virtualSize
+		if virtualSize == 0 {
+			virtualSize = uint32(len(section.data))
+		}
+		var name [8]byte
+		copy(name[:], section.name)
+		binary.Write(w, binary.LittleEndian, struct {
+			Name                 [8]byte
+			VirtualSize          uint32
+			VirtualAddress       uint32
+			SizeOfRawData        uint32
+			PointerToRawData     uint32
+			PointerToRelocations uint32
+			PointerToLineNumbers uint32
+			NumberOfRelocations  uint16
+			NumberOfLineNumbers  uint16
+			Characteristics      uint32
+		}{
+			Name:             name,
+			VirtualSize:      virtualSize,
+			VirtualAddress:   offset,
+			SizeOfRawData:    uint32(len(section.data)),
+			PointerToRawData: offset,
+			Characteristics:  0x40000040})
+		offset += uint32(len(section.data))
+	}
+
+	// Section data
+	for _, section := range sections {
+		w.Write(section.data)
+	}
+
+	c.Assert(ioutil.WriteFile(path, w.Bytes(), 0644), IsNil)
+}
+
+type testAddSystemdStubUKIProfileData struct {
+	alg      tpm2.HashAlgorithmId
+	pcr      int
+	sections [][]mockUKISection
+	values   []tpm2.PCRValues
+}
+
+func (s *sdstubPolicySuite) testAddSystemdStubUKIProfile(c *C, data *testAddSystemdStubUKIProfileData) {
+	dir := c.MkDir()
+
+	var images []Image
+	for i, sections := range data.sections {
+		path := filepath.Join(dir, fmt.Sprintf("uki%d.efi", i))
+		writeMockUKI(c, path, sections)
+		images = append(images, FileImage(path))
+	}
+
+	profile := secboot_tpm2.NewPCRProtectionProfile()
+	c.Check(AddSystemdStubUKIProfile(profile, &SystemdStubUKIProfileParams{
+		PCRAlgorithm: data.alg,
+		PCRIndex:     data.pcr,
+		Images:       images}), IsNil)
+
+	values, err := profile.ComputePCRValues(nil)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, data.values)
+
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", tpm2test.FormatPCRValuesFromPCRProtectionProfile(profile, nil))
+	}
+}
+
+func (s *sdstubPolicySuite) TestAddSystemdStubUKIProfile(c *C) {
+	s.testAddSystemdStubUKIProfile(c, &testAddSystemdStubUKIProfileData{
+		alg: tpm2.HashAlgorithmSHA256,
+		pcr: 11,
+		sections: [][]mockUKISection{
+			{
+				// Sections are measured in the order defined by
+				// systemd rather than the order in the image, and
+				// .pcrsig is not measured.
+				{name: ".cmdline", data: []byte("console=ttyS0 quiet")},
+				{name: ".pcrsig", data: []byte("{}")},
+				{name: ".linux", data: []byte("kernel")},
+				{name: ".initrd", data: []byte("initrd")},
+				{name: ".text", data: []byte("stub")},
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					11: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256,
+						".linux\x00", "kernel",
+						".cmdline\x00", "console=ttyS0 quiet",
+						".initrd\x00", "initrd"),
+				},
+			},
+		}})
+}
+
+func (s *sdstubPolicySuite) TestAddSystemdStubUKIProfileMultipleImages(c *C) {
+	s.testAddSystemdStubUKIProfile(c, &testAddSystemdStubUKIProfileData{
+		alg: tpm2.HashAlgorithmSHA1,
+		pcr: 11,
+		sections: [][]mockUKISection{
+			{
+				{name: ".linux", data: []byte("kernel1")},
+				{name: ".osrel", data: []byte("ID=ubuntu")},
+			},
+			{
+				{name: ".linux", data: []byte("kernel2")},
+				{name: ".osrel", data: []byte("ID=ubuntu")},
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA1: {
+					11: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA1,
+						".linux\x00", "kernel1", ".osrel\x00", "ID=ubuntu"),
+				},
+			},
+			{
+				tpm2.HashAlgorithmSHA1: {
+					11: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA1,
+						".linux\x00", "kernel2", ".osrel\x00", "ID=ubuntu"),
+				},
+			},
+		}})
+}
+
+func (s *sdstubPolicySuite) TestAddSystemdStubUKIProfileVirtualSize(c *C) {
+	s.testAddSystemdStubUKIProfile(c, &testAddSystemdStubUKIProfileData{
+		alg: tpm2.HashAlgorithmSHA256,
+		pcr: 11,
+		sections: [][]mockUKISection{
+			{
+				// The raw data is padded in the file.
+				{name: ".linux", data: []byte("kernel\x00\x00"), virtualSize: 6},
+				// The loaded section is larger than the raw data.
+				{name: ".uname", data: []byte("6.1"), virtualSize: 5},
+			},
+		},
+		values: []tpm2.PCRValues{
+			{
+				tpm2.HashAlgorithmSHA256: {
+					11: tpm2test.MakePCRValueFromEvents(tpm2.HashAlgorithmSHA256,
+						".linux\x00", "kernel", ".uname\x00", "6.1\x00\x00"),
+				},
+			},
+		}})
+}
+
+func (s *sdstubPolicySuite) TestAddSystemdStubUKIProfileNoMeasuredSections(c *C) {
+	path := filepath.Join(c.MkDir(), "uki.efi")
+	writeMockUKI(c, path, []mockUKISection{{name: ".text", data: []byte("stub")}})
+
+	err := AddSystemdStubUKIProfile(secboot_tpm2.NewPCRProtectionProfile(), &SystemdStubUKIProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		PCRIndex:     11,
+		Images:       []Image{FileImage(path)}})
+	c.Check(err, ErrorMatches, "cannot compute measurements for .*/uki.efi: image does not contain any sections measured by the systemd EFI stub")
+}
+
+func (s *sdstubPolicySuite) TestAddSystemdStubUKIProfileNoImages(c *C) {
+	err := AddSystemdStubUKIProfile(secboot_tpm2.NewPCRProtectionProfile(), &SystemdStubUKIProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		PCRIndex:     11})
+	c.Check(err, ErrorMatches, "no images specified")
+}
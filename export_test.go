@@ -20,6 +20,8 @@
 package secboot
 
 import (
+	"time"
+
 	"github.com/snapcore/secboot/internal/luks2"
 	"github.com/snapcore/secboot/internal/luksview"
 )
@@ -28,7 +30,11 @@ func (o *KDFOptions) DeriveCostParams(keyLen int, kdf KDF) (*KDFCostParams, erro
 	return o.deriveCostParams(keyLen, kdf)
 }
 
-func MockLUKS2Activate(fn func(string, string, []byte) error) (restore func()) {
+func NewAuthRequestFailedError(err error) *AuthRequestFailedError {
+	return &AuthRequestFailedError{err}
+}
+
+func MockLUKS2Activate(fn func(string, string, []byte, *luks2.ActivateOptions) error) (restore func()) {
 	origActivate := luks2Activate
 	luks2Activate = fn
 	return func() {
@@ -36,6 +42,22 @@ func MockLUKS2Activate(fn func(string, string, []byte) error) (restore func()) {
 	}
 }
 
+func MockLUKS2ActivateWithKeyFile(fn func(string, string, string, int64, int64, *luks2.ActivateOptions) error) (restore func()) {
+	origActivateWithKeyFile := luks2ActivateWithKeyFile
+	luks2ActivateWithKeyFile = fn
+	return func() {
+		luks2ActivateWithKeyFile = origActivateWithKeyFile
+	}
+}
+
+func MockLUKS2ActiveVolumeSourceDevice(fn func(string) (string, error)) (restore func()) {
+	origActiveVolumeSourceDevice := luks2ActiveVolumeSourceDevice
+	luks2ActiveVolumeSourceDevice = fn
+	return func() {
+		luks2ActiveVolumeSourceDevice = origActiveVolumeSourceDevice
+	}
+}
+
 func MockLUKS2AddKey(fn func(string, []byte, []byte, *luks2.AddKeyOptions) error) (restore func()) {
 	origAddKey := luks2AddKey
 	luks2AddKey = fn
@@ -44,7 +66,15 @@ func MockLUKS2AddKey(fn func(string, []byte, []byte, *luks2.AddKeyOptions) error
 	}
 }
 
-func MockLUKS2Deactivate(fn func(string) error) (restore func()) {
+func MockLUKS2ChangeKey(fn func(string, int, []byte, []byte, *luks2.KDFOptions, *luks2.CommandOptions) error) (restore func()) {
+	origChangeKey := luks2ChangeKey
+	luks2ChangeKey = fn
+	return func() {
+		luks2ChangeKey = origChangeKey
+	}
+}
+
+func MockLUKS2Deactivate(fn func(string, *luks2.DeactivateOptions) error) (restore func()) {
 	origDeactivate := luks2Deactivate
 	luks2Deactivate = fn
 	return func() {
@@ -68,7 +98,15 @@ func MockLUKS2ImportToken(fn func(string, luks2.Token, *luks2.ImportTokenOptions
 	}
 }
 
-func MockLUKS2KillSlot(fn func(string, int, []byte) error) (restore func()) {
+func MockLUKS2IsLUKS2(fn func(string, *luks2.CommandOptions) (bool, error)) (restore func()) {
+	origIsLUKS2 := luks2IsLUKS2
+	luks2IsLUKS2 = fn
+	return func() {
+		luks2IsLUKS2 = origIsLUKS2
+	}
+}
+
+func MockLUKS2KillSlot(fn func(string, int, []byte, *luks2.CommandOptions) error) (restore func()) {
 	origKillSlot := luks2KillSlot
 	luks2KillSlot = fn
 	return func() {
@@ -76,7 +114,7 @@ func MockLUKS2KillSlot(fn func(string, int, []byte) error) (restore func()) {
 	}
 }
 
-func MockLUKS2RemoveToken(fn func(string, int) error) (restore func()) {
+func MockLUKS2RemoveToken(fn func(string, int, *luks2.CommandOptions) error) (restore func()) {
 	origRemoveToken := luks2RemoveToken
 	luks2RemoveToken = fn
 	return func() {
@@ -84,7 +122,7 @@ func MockLUKS2RemoveToken(fn func(string, int) error) (restore func()) {
 	}
 }
 
-func MockLUKS2SetSlotPriority(fn func(string, int, luks2.SlotPriority) error) (restore func()) {
+func MockLUKS2SetSlotPriority(fn func(string, int, luks2.SlotPriority, *luks2.CommandOptions) error) (restore func()) {
 	origSetSlotPriority := luks2SetSlotPriority
 	luks2SetSlotPriority = fn
 	return func() {
@@ -92,6 +130,14 @@ func MockLUKS2SetSlotPriority(fn func(string, int, luks2.SlotPriority) error) (r
 	}
 }
 
+func MockLUKS2TestKey(fn func(string, int, []byte, *luks2.CommandOptions) error) (restore func()) {
+	origTestKey := luks2TestKey
+	luks2TestKey = fn
+	return func() {
+		luks2TestKey = origTestKey
+	}
+}
+
 func MockNewLUKSView(fn func(string, luks2.LockMode) (*luksview.View, error)) (restore func()) {
 	origNewLUKSView := newLUKSView
 	newLUKSView = fn
@@ -100,6 +146,22 @@ func MockNewLUKSView(fn func(string, luks2.LockMode) (*luksview.View, error)) (r
 	}
 }
 
+func MockUnixMlock(fn func([]byte) error) (restore func()) {
+	origMlock := unixMlock
+	unixMlock = fn
+	return func() {
+		unixMlock = origMlock
+	}
+}
+
+func MockUnixMunlock(fn func([]byte) error) (restore func()) {
+	origMunlock := unixMunlock
+	unixMunlock = fn
+	return func() {
+		unixMunlock = origMunlock
+	}
+}
+
 func MockRuntimeNumCPU(n int) (restore func()) {
 	orig := runtimeNumCPU
 	runtimeNumCPU = func() int {
@@ -109,3 +171,35 @@ func MockRuntimeNumCPU(n int) (restore func()) {
 		runtimeNumCPU = orig
 	}
 }
+
+func MockKeyringCheckUserKeyringAvailable(fn func() error) (restore func()) {
+	orig := keyringCheckUserKeyringAvailable
+	keyringCheckUserKeyringAvailable = fn
+	return func() {
+		keyringCheckUserKeyringAvailable = orig
+	}
+}
+
+func MockKeyringCheckKeyringAvailable(fn func(int) error) (restore func()) {
+	orig := keyringCheckKeyringAvailable
+	keyringCheckKeyringAvailable = fn
+	return func() {
+		keyringCheckKeyringAvailable = orig
+	}
+}
+
+func MockTimeSleep(fn func(time.Duration)) (restore func()) {
+	orig := timeSleep
+	timeSleep = fn
+	return func() {
+		timeSleep = orig
+	}
+}
+
+func MockTimeNow(fn func() time.Time) (restore func()) {
+	orig := timeNow
+	timeNow = fn
+	return func() {
+		timeNow = orig
+	}
+}
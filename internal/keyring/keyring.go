@@ -26,20 +26,57 @@ import (
 
 const (
 	userKeyType = "user"
-	userKeyring = -4
+	userKeyring = UserKeyring
+)
+
+// These are the special keyring IDs that can be used to refer to the
+// keyrings of the current process. See keyrings(7).
+const (
+	ProcessKeyring = unix.KEY_SPEC_PROCESS_KEYRING
+	SessionKeyring = unix.KEY_SPEC_SESSION_KEYRING
+	UserKeyring    = unix.KEY_SPEC_USER_KEYRING
 )
 
 func formatDesc(devicePath, purpose, prefix string) string {
 	return prefix + ":" + devicePath + ":" + purpose
 }
 
+// CheckUserKeyringAvailable determines whether the user keyring can be
+// accessed by the current process. This will fail in environments where
+// the kernel keyring syscalls are unavailable or blocked, such as in some
+// containers.
+func CheckUserKeyringAvailable() error {
+	if _, err := unix.KeyctlGetKeyringID(userKeyring, false); err != nil {
+		return xerrors.Errorf("cannot obtain user keyring ID: %w", err)
+	}
+	return nil
+}
+
+// CheckKeyringAvailable determines whether the keyring with the specified
+// special ID can be accessed by the current process, creating it if it
+// doesn't exist yet.
+func CheckKeyringAvailable(keyringID int) error {
+	if _, err := unix.KeyctlGetKeyringID(keyringID, true); err != nil {
+		return xerrors.Errorf("cannot obtain keyring ID: %w", err)
+	}
+	return nil
+}
+
 func AddKeyToUserKeyring(key []byte, devicePath, purpose, prefix string) error {
-	_, err := unix.AddKey(userKeyType, formatDesc(devicePath, purpose, prefix), key, userKeyring)
+	return AddKeyToKeyring(key, devicePath, purpose, prefix, userKeyring)
+}
+
+func AddKeyToKeyring(key []byte, devicePath, purpose, prefix string, keyringID int) error {
+	_, err := unix.AddKey(userKeyType, formatDesc(devicePath, purpose, prefix), key, keyringID)
 	return err
 }
 
 func GetKeyFromUserKeyring(devicePath, purpose, prefix string) ([]byte, error) {
-	id, err := unix.KeyctlSearch(userKeyring, userKeyType, formatDesc(devicePath, purpose, prefix), 0)
+	return GetKeyFromKeyring(devicePath, purpose, prefix, userKeyring)
+}
+
+func GetKeyFromKeyring(devicePath, purpose, prefix string, keyringID int) ([]byte, error) {
+	id, err := unix.KeyctlSearch(keyringID, userKeyType, formatDesc(devicePath, purpose, prefix), 0)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot find key: %w", err)
 	}
@@ -58,11 +95,15 @@ func GetKeyFromUserKeyring(devicePath, purpose, prefix string) ([]byte, error) {
 }
 
 func RemoveKeyFromUserKeyring(devicePath, purpose, prefix string) error {
-	id, err := unix.KeyctlSearch(userKeyring, userKeyType, formatDesc(devicePath, purpose, prefix), 0)
+	return RemoveKeyFromKeyring(devicePath, purpose, prefix, userKeyring)
+}
+
+func RemoveKeyFromKeyring(devicePath, purpose, prefix string, keyringID int) error {
+	id, err := unix.KeyctlSearch(keyringID, userKeyType, formatDesc(devicePath, purpose, prefix), 0)
 	if err != nil {
 		return xerrors.Errorf("cannot find key: %w", err)
 	}
 
-	_, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, userKeyring, 0, 0)
+	_, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, keyringID, 0, 0)
 	return err
 }
@@ -183,3 +183,28 @@ func (s *keyringSuite) TestRemoveKeyFromUserKeyringNoKey(c *C) {
 	c.Check(xerrors.As(err, &e), testutil.IsTrue)
 	c.Check(e, Equals, syscall.ENOKEY)
 }
+
+func (s *keyringSuite) TestCheckUserKeyringAvailable(c *C) {
+	c.Check(CheckUserKeyringAvailable(), IsNil)
+}
+
+func (s *keyringSuite) TestAddKeyToSessionKeyring(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	c.Check(AddKeyToKeyring(key, "/dev/sda1", "unlock", "secboot", SessionKeyring), IsNil)
+	defer func() {
+		c.Check(RemoveKeyFromKeyring("/dev/sda1", "unlock", "secboot", SessionKeyring), IsNil)
+	}()
+
+	key2, err := GetKeyFromKeyring("/dev/sda1", "unlock", "secboot", SessionKeyring)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	_, err = GetKeyFromUserKeyring("/dev/sda1", "unlock", "secboot")
+	c.Check(err, ErrorMatches, "cannot find key: required key not available")
+}
+
+func (s *keyringSuite) TestCheckKeyringAvailable(c *C) {
+	c.Check(CheckKeyringAvailable(SessionKeyring), IsNil)
+}
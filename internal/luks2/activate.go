@@ -21,40 +21,363 @@ package luks2
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/xerrors"
 )
 
 var (
+	devMapperDir          = "/dev/mapper"
+	sysBlockDir           = "/sys/block"
+	sysModuleDir          = "/sys/module"
 	systemdCryptsetupPath = "/lib/systemd/systemd-cryptsetup"
+
+	// reservedSystemdCryptsetupOptions are the systemd-cryptsetup options
+	// that are set by or conflict with the way that Activate drives
+	// systemd-cryptsetup, and which can't be supplied via
+	// ActivateOptions.Options.
+	reservedSystemdCryptsetupOptions = []string{
+		"tries",          // Activate only makes a single attempt with the supplied key
+		"header",         // set via ActivateOptions.HeaderPath
+		"key-file",       // the key is supplied via stdin or ActivateWithKeyFile
+		"keyfile-offset", // set by ActivateWithKeyFile
+		"keyfile-size",   // set by ActivateWithKeyFile
+	}
 )
 
+// ErrVolumeNotActive is returned from Deactivate if there is no active
+// volume with the supplied name.
+var ErrVolumeNotActive = errors.New("volume is not active")
+
+// ErrDMIntegrityUnavailable is returned from Activate if a volume that uses
+// dm-integrity could not be activated with a valid key and the dm-integrity
+// kernel module is not available.
+var ErrDMIntegrityUnavailable = errors.New("the kernel does not support dm-integrity")
+
+// SystemdCryptsetupError is returned from Activate and Deactivate if
+// systemd-cryptsetup fails. It contains the argument vector that was
+// used to invoke systemd-cryptsetup, so that the failure can be logged
+// and reproduced manually. Keys are always passed to systemd-cryptsetup
+// via stdin or a key file, so the argument vector never contains any key
+// material.
+type SystemdCryptsetupError struct {
+	Args []string // The arguments used to invoke systemd-cryptsetup, including argv[0]
+	err  error
+}
+
+func (e *SystemdCryptsetupError) Error() string {
+	return fmt.Sprintf("systemd-cryptsetup failed with: %v", e.err)
+}
+
+func (e *SystemdCryptsetupError) Unwrap() error {
+	return e.err
+}
+
+func newSystemdCryptsetupError(cmd *exec.Cmd, output []byte, err error) error {
+	args := make([]string, len(cmd.Args))
+	copy(args, cmd.Args)
+	return &SystemdCryptsetupError{Args: args, err: osutil.OutputErr(output, err)}
+}
+
+// ActivateOptions provides the options for activating a LUKS2 volume.
+type ActivateOptions struct {
+	// HeaderPath is the path of a detached LUKS2 header. If this is
+	// empty, the header is read from the source device.
+	HeaderPath string
+
+	// Options are additional options to pass to systemd-cryptsetup,
+	// in the format used by crypttab(5). Options that conflict with
+	// the way that Activate drives systemd-cryptsetup, such as "tries=",
+	// "header=" and "keyfile-offset=", are not permitted.
+	Options []string
+
+	// SystemdCryptsetupPath is the path of the systemd-cryptsetup
+	// binary to use. If this is empty, the default location
+	// (/lib/systemd/systemd-cryptsetup) is used.
+	SystemdCryptsetupPath string
+
+	// CryptsetupPath is the path of the cryptsetup binary used to
+	// test the key if activation fails. If this is empty, cryptsetup
+	// is found via PATH.
+	CryptsetupPath string
+
+	// LockKeyMemory indicates that the caller has locked the supplied
+	// key in to memory. If this is set, the key is written directly to
+	// a pipe connected to systemd-cryptsetup rather than being copied
+	// through an intermediate buffer that may be swapped out.
+	LockKeyMemory bool
+}
+
+// Validate checks that these options can be used for activation.
+func (options *ActivateOptions) Validate() error {
+	if strings.Contains(options.HeaderPath, ",") {
+		return errors.New("header path cannot contain a comma")
+	}
+
+	for _, o := range options.Options {
+		if o == "" {
+			return errors.New("systemd-cryptsetup options cannot be empty")
+		}
+		if strings.Contains(o, ",") {
+			return fmt.Errorf("systemd-cryptsetup option \"%s\" cannot contain a comma", o)
+		}
+
+		name := strings.SplitN(o, "=", 2)[0]
+		for _, reserved := range reservedSystemdCryptsetupOptions {
+			if name == reserved {
+				return fmt.Errorf("cannot specify the \"%s=\" option for systemd-cryptsetup", reserved)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (options *ActivateOptions) systemdCryptsetupPath() string {
+	if options.SystemdCryptsetupPath != "" {
+		return options.SystemdCryptsetupPath
+	}
+	return systemdCryptsetupPath
+}
+
+func (options *ActivateOptions) systemdCryptsetupOptions() (string, error) {
+	if err := options.Validate(); err != nil {
+		return "", err
+	}
+
+	opts := "luks,tries=1"
+	if options.HeaderPath != "" {
+		opts += ",header=" + options.HeaderPath
+	}
+	for _, o := range options.Options {
+		opts += "," + o
+	}
+	return opts, nil
+}
+
 // Activate unlocks the LUKS device at sourceDevicePath using systemd-cryptsetup and creates a device
 // mapping with the supplied volumeName. The device is unlocked using the supplied key.
-func Activate(volumeName, sourceDevicePath string, key []byte) error {
-	cmd := exec.Command(systemdCryptsetupPath, "attach", volumeName, sourceDevicePath, "/dev/stdin", "luks,tries=1")
+//
+// If options is not supplied, the LUKS2 header is read from the source device.
+func Activate(volumeName, sourceDevicePath string, key []byte, options *ActivateOptions) error {
+	if options == nil {
+		options = &ActivateOptions{}
+	}
+
+	opts, err := options.systemdCryptsetupOptions()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(options.systemdCryptsetupPath(), "attach", volumeName, sourceDevicePath, "/dev/stdin", opts)
+	if options.LockKeyMemory {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return xerrors.Errorf("cannot create pipe: %w", err)
+		}
+		defer r.Close()
+
+		go func() {
+			w.Write(key)
+			w.Close()
+		}()
+		cmd.Stdin = r
+	} else {
+		cmd.Stdin = bytes.NewReader(key)
+	}
+
+	return runSystemdCryptsetupAttach(cmd, sourceDevicePath, options, func() []byte {
+		return key
+	})
+}
+
+// ActivateWithKeyFile unlocks the LUKS device at sourceDevicePath using systemd-cryptsetup and
+// creates a device mapping with the supplied volumeName. The device is unlocked using the key
+// contained in the file at keyFilePath, which is size bytes long and starts at the specified
+// offset. The key is read directly from the file by systemd-cryptsetup.
+//
+// An error is returned without invoking systemd-cryptsetup if the key file is not a regular
+// file, or if the specified range is empty or extends beyond the end of the file.
+//
+// If options is not supplied, the LUKS2 header is read from the source device.
+func ActivateWithKeyFile(volumeName, sourceDevicePath, keyFilePath string, offset, size int64, options *ActivateOptions) error {
+	if options == nil {
+		options = &ActivateOptions{}
+	}
+
+	opts, err := options.systemdCryptsetupOptions()
+	if err != nil {
+		return err
+	}
+
+	if offset < 0 {
+		return fmt.Errorf("invalid key file offset %d", offset)
+	}
+	if size <= 0 {
+		return fmt.Errorf("invalid key file size %d", size)
+	}
+
+	fi, err := os.Stat(keyFilePath)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain key file information: %w", err)
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New("key file is not a regular file")
+	}
+	if offset > fi.Size() || size > fi.Size()-offset {
+		return fmt.Errorf("key file offset (%d) and size (%d) exceed the length of the file (%d bytes)", offset, size, fi.Size())
+	}
+
+	opts += fmt.Sprintf(",keyfile-offset=%d,keyfile-size=%d", offset, size)
+	cmd := exec.Command(options.systemdCryptsetupPath(), "attach", volumeName, sourceDevicePath, keyFilePath, opts)
+
+	return runSystemdCryptsetupAttach(cmd, sourceDevicePath, options, func() []byte {
+		f, err := os.Open(keyFilePath)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+
+		key := make([]byte, size)
+		if _, err := f.ReadAt(key, offset); err != nil {
+			return nil
+		}
+		return key
+	})
+}
+
+// runSystemdCryptsetupAttach runs the supplied systemd-cryptsetup attach command. If
+// it fails, the key is obtained from the supplied callback in order to determine
+// whether the failure was caused by the kernel not supporting dm-integrity.
+func runSystemdCryptsetupAttach(cmd *exec.Cmd, sourceDevicePath string, options *ActivateOptions, key func() []byte) error {
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "SYSTEMD_LOG_TARGET=console")
-	cmd.Stdin = bytes.NewReader(key)
 
 	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("systemd-cryptsetup failed with: %v", osutil.OutputErr(output, err))
+		sdErr := newSystemdCryptsetupError(cmd, output, err)
+		headerPath := sourceDevicePath
+		if options.HeaderPath != "" {
+			headerPath = options.HeaderPath
+		}
+		if dmIntegrityUnavailable(headerPath, key(), &CommandOptions{CryptsetupPath: options.CryptsetupPath}) {
+			return xerrors.Errorf("cannot activate volume with dm-integrity (%v): %w", sdErr, ErrDMIntegrityUnavailable)
+		}
+		return sdErr
 	}
 
 	return nil
 }
 
-// Deactivate detaches the LUKS volume with the supplied name.
-func Deactivate(volumeName string) error {
-	cmd := exec.Command(systemdCryptsetupPath, "detach", volumeName)
+// dmIntegrityUnavailable determines whether a failure to activate the volume
+// with the header at the specified path was caused by the kernel not
+// supporting dm-integrity. This is the case if the volume uses dm-integrity,
+// the supplied key is valid and the dm_integrity kernel module isn't loaded
+// (device-mapper would have loaded it on demand if it were available).
+func dmIntegrityUnavailable(headerPath string, key []byte, cmdOptions *CommandOptions) bool {
+	hdr, err := ReadHeader(headerPath, LockModeNonBlocking)
+	if err != nil {
+		return false
+	}
+
+	usesIntegrity := false
+	for _, segment := range hdr.Metadata.Segments {
+		if segment.Integrity != nil {
+			usesIntegrity = true
+			break
+		}
+	}
+	if !usesIntegrity {
+		return false
+	}
+
+	if _, err := os.Stat(filepath.Join(sysModuleDir, "dm_integrity")); err == nil {
+		return false
+	}
+
+	return TestKey(headerPath, AnySlot, key, cmdOptions) == nil
+}
+
+// ActiveVolumeSourceDevice returns the path of the source device of the active
+// volume with the supplied name, in the form /dev/<kernel name> (eg, /dev/sda1
+// or /dev/dm-3). If the volume uses dm-integrity, this returns the device
+// underneath the integrity mapping. If there is no active volume with the
+// supplied name, ErrVolumeNotActive is returned.
+func ActiveVolumeSourceDevice(volumeName string) (string, error) {
+	dev, err := filepath.EvalSymlinks(filepath.Join(devMapperDir, volumeName))
+	switch {
+	case os.IsNotExist(err):
+		return "", ErrVolumeNotActive
+	case err != nil:
+		return "", xerrors.Errorf("cannot determine if volume is active: %w", err)
+	}
+
+	name := filepath.Base(dev)
+	for {
+		slaves, err := ioutil.ReadDir(filepath.Join(sysBlockDir, name, "slaves"))
+		if err != nil {
+			return "", xerrors.Errorf("cannot obtain source devices for %s: %w", name, err)
+		}
+		if len(slaves) != 1 {
+			return "", fmt.Errorf("unexpected number of source devices for %s (%d)", name, len(slaves))
+		}
+		name = slaves[0].Name()
+
+		// The source device may itself be a device-mapper device, but
+		// only continue if it's the dm-integrity mapping created for
+		// this volume.
+		if !strings.HasPrefix(name, "dm-") {
+			break
+		}
+		dmName, err := ioutil.ReadFile(filepath.Join(sysBlockDir, name, "dm", "name"))
+		if err != nil || strings.TrimSpace(string(dmName)) != volumeName+"_dif" {
+			break
+		}
+	}
+
+	return filepath.Join("/dev", name), nil
+}
+
+// DeactivateOptions provides the options for deactivating a volume.
+type DeactivateOptions struct {
+	// SystemdCryptsetupPath is the path of the systemd-cryptsetup
+	// binary to use. If this is empty, the default location
+	// (/lib/systemd/systemd-cryptsetup) is used.
+	SystemdCryptsetupPath string
+}
+
+func (options *DeactivateOptions) systemdCryptsetupPath() string {
+	if options == nil || options.SystemdCryptsetupPath == "" {
+		return systemdCryptsetupPath
+	}
+	return options.SystemdCryptsetupPath
+}
+
+// Deactivate detaches the LUKS volume with the supplied name. If there is no
+// active volume with the supplied name, ErrVolumeNotActive is returned.
+func Deactivate(volumeName string, options *DeactivateOptions) error {
+	// systemd-cryptsetup detach succeeds for volumes that aren't active, so
+	// check this first.
+	if _, err := os.Stat(filepath.Join(devMapperDir, volumeName)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrVolumeNotActive
+		}
+		return xerrors.Errorf("cannot determine if volume is active: %w", err)
+	}
+
+	cmd := exec.Command(options.systemdCryptsetupPath(), "detach", volumeName)
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "SYSTEMD_LOG_TARGET=console")
 
 	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("systemd-cryptsetup failed with: %v", osutil.OutputErr(output, err))
+		return newSystemdCryptsetupError(cmd, output, err)
 	}
 
 	return nil
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"path/filepath"
 
 	. "github.com/snapcore/secboot/internal/luks2"
@@ -35,7 +36,10 @@ import (
 type activateSuite struct {
 	snapd_testutil.BaseTest
 
-	runDir string
+	runDir       string
+	devDir       string
+	devMapperDir string
+	sysBlockDir  string
 
 	mockKeyslotsDir   string
 	mockKeyslotsCount int
@@ -49,6 +53,13 @@ func (s *activateSuite) SetUpTest(c *C) {
 	s.runDir = c.MkDir()
 	s.AddCleanup(pathstest.MockRunDir(s.runDir))
 
+	s.devDir = c.MkDir()
+	s.devMapperDir = c.MkDir()
+	s.AddCleanup(MockDevMapperDir(s.devMapperDir))
+
+	s.sysBlockDir = c.MkDir()
+	s.AddCleanup(MockSysBlockDir(s.sysBlockDir))
+
 	s.mockKeyslotsDir = c.MkDir()
 	s.mockKeyslotsCount = 0
 
@@ -59,7 +70,13 @@ if [ "$1" = "detach" ]; then
     fi
     exit 0
 fi
-key=$(xxd -p < "$4")
+offset=$(echo "$5" | sed -n 's/.*keyfile-offset=\([0-9]*\).*/\1/p')
+size=$(echo "$5" | sed -n 's/.*keyfile-size=\([0-9]*\).*/\1/p')
+if [ -n "$size" ]; then
+    key=$(tail -c +$((offset+1)) "$4" | head -c "$size" | xxd -p)
+else
+    key=$(xxd -p < "$4")
+fi
 for f in "%[1]s"/*; do
     if [ "$key" == "$(xxd -p < "$f")" ]; then
 	exit 0
@@ -74,6 +91,10 @@ exit 5
 	s.AddCleanup(MockSystemdCryptsetupPath(s.mockSdCryptsetup.Exe()))
 }
 
+func (s *activateSuite) addMockVolume(c *C, volumeName string) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.devMapperDir, volumeName), nil, 0644), IsNil)
+}
+
 func (s *activateSuite) addMockKeyslot(c *C, key []byte) {
 	c.Assert(ioutil.WriteFile(filepath.Join(s.mockKeyslotsDir, fmt.Sprintf("%d", s.mockKeyslotsCount)), key, 0644), IsNil)
 	s.mockKeyslotsCount++
@@ -91,7 +112,7 @@ func (s *activateSuite) testActivate(c *C, data *testActivateData) {
 	rand.Read(key)
 	s.addMockKeyslot(c, key)
 
-	c.Check(Activate(data.volumeName, data.sourceDevicePath, key), IsNil)
+	c.Check(Activate(data.volumeName, data.sourceDevicePath, key, nil), IsNil)
 
 	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
 	c.Assert(s.mockSdCryptsetup.Calls()[0], HasLen, 6)
@@ -116,12 +137,97 @@ func (s *activateSuite) TestActivate3(c *C) {
 		sourceDevicePath: "/dev/vda2"})
 }
 
+func (s *activateSuite) TestActivateWithDetachedHeader(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	c.Check(Activate("data", "/dev/sda1", key, &ActivateOptions{HeaderPath: "/boot/luks/sda1.hdr"}), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", "/dev/stdin", "luks,tries=1,header=/boot/luks/sda1.hdr"})
+}
+
+func (s *activateSuite) TestActivateWithInvalidHeaderPath(c *C) {
+	c.Check(Activate("data", "/dev/sda1", nil, &ActivateOptions{HeaderPath: "/boot/luks/sda1,hdr"}), ErrorMatches, "header path cannot contain a comma")
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *activateSuite) TestActivateWithOptions(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	c.Check(Activate("data", "/dev/sda1", key, &ActivateOptions{Options: []string{"discard", "no-read-workqueue"}}), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", "/dev/stdin", "luks,tries=1,discard,no-read-workqueue"})
+}
+
+func (s *activateSuite) TestActivateWithReservedOptions(c *C) {
+	for _, t := range []struct {
+		option   string
+		errMatch string
+	}{
+		{option: "tries=3", errMatch: `cannot specify the "tries=" option for systemd-cryptsetup`},
+		{option: "header=/boot/luks/sda1.hdr", errMatch: `cannot specify the "header=" option for systemd-cryptsetup`},
+		{option: "key-file=/run/key", errMatch: `cannot specify the "key-file=" option for systemd-cryptsetup`},
+		{option: "keyfile-offset=10", errMatch: `cannot specify the "keyfile-offset=" option for systemd-cryptsetup`},
+		{option: "keyfile-size", errMatch: `cannot specify the "keyfile-size=" option for systemd-cryptsetup`},
+		{option: "discard,tries=3", errMatch: `systemd-cryptsetup option "discard,tries=3" cannot contain a comma`},
+		{option: "", errMatch: `systemd-cryptsetup options cannot be empty`},
+	} {
+		c.Check(Activate("data", "/dev/sda1", nil, &ActivateOptions{Options: []string{"discard", t.option}}), ErrorMatches, t.errMatch)
+	}
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *activateSuite) TestActivateWithSystemdCryptsetupPath(c *C) {
+	customSdCryptsetup := snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "systemd-cryptsetup"), "")
+	defer customSdCryptsetup.Restore()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	c.Check(Activate("data", "/dev/sda1", key, &ActivateOptions{SystemdCryptsetupPath: customSdCryptsetup.Exe()}), IsNil)
+
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+	c.Check(customSdCryptsetup.Calls(), DeepEquals, [][]string{
+		{"systemd-cryptsetup", "attach", "data", "/dev/sda1", "/dev/stdin", "luks,tries=1"},
+	})
+}
+
+func (s *activateSuite) TestActivateWithLockKeyMemory(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	c.Check(Activate("data", "/dev/sda1", key, &ActivateOptions{LockKeyMemory: true}), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", "/dev/stdin", "luks,tries=1"})
+}
+
+func (s *activateSuite) TestActivateWithLockKeyMemoryWrongKey(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	c.Check(Activate("data", "/dev/sda1", make([]byte, 32), &ActivateOptions{LockKeyMemory: true}), ErrorMatches, `systemd-cryptsetup failed with: exit status 5`)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", "/dev/stdin", "luks,tries=1"})
+}
+
 func (s *activateSuite) TestActivateWrongKey(c *C) {
 	key := make([]byte, 32)
 	rand.Read(key)
 	s.addMockKeyslot(c, key)
 
-	c.Check(Activate("data", "/dev/sda1", nil), ErrorMatches, `systemd-cryptsetup failed with: exit status 5`)
+	err := Activate("data", "/dev/sda1", nil, nil)
+	c.Check(err, ErrorMatches, `systemd-cryptsetup failed with: exit status 5`)
+	c.Assert(err, FitsTypeOf, &SystemdCryptsetupError{})
+	c.Check(err.(*SystemdCryptsetupError).Args, DeepEquals, []string{s.mockSdCryptsetup.Exe(), "attach", "data", "/dev/sda1", "/dev/stdin", "luks,tries=1"})
 
 	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
 	c.Assert(s.mockSdCryptsetup.Calls()[0], HasLen, 6)
@@ -129,18 +235,165 @@ func (s *activateSuite) TestActivateWrongKey(c *C) {
 	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", "/dev/stdin", "luks,tries=1"})
 }
 
+func (s *activateSuite) writeKeyFile(c *C, offset int, key []byte) string {
+	data := make([]byte, offset+len(key)+16)
+	rand.Read(data)
+	copy(data[offset:], key)
+
+	path := filepath.Join(c.MkDir(), "keyfile")
+	c.Assert(ioutil.WriteFile(path, data, 0600), IsNil)
+	return path
+}
+
+func (s *activateSuite) TestActivateWithKeyFile(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	path := s.writeKeyFile(c, 0, key)
+
+	c.Check(ActivateWithKeyFile("data", "/dev/sda1", path, 0, 32, nil), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", path, "luks,tries=1,keyfile-offset=0,keyfile-size=32"})
+}
+
+func (s *activateSuite) TestActivateWithKeyFileOffset(c *C) {
+	key := make([]byte, 64)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	path := s.writeKeyFile(c, 4096, key)
+
+	c.Check(ActivateWithKeyFile("data", "/dev/sda1", path, 4096, 64, &ActivateOptions{HeaderPath: "/boot/luks/sda1.hdr"}), IsNil)
+
+	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1", path, "luks,tries=1,header=/boot/luks/sda1.hdr,keyfile-offset=4096,keyfile-size=64"})
+}
+
+func (s *activateSuite) TestActivateWithKeyFileWrongKey(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	s.addMockKeyslot(c, key)
+
+	path := s.writeKeyFile(c, 0, key)
+
+	err := ActivateWithKeyFile("data", "/dev/sda1", path, 1, 32, nil)
+	c.Check(err, ErrorMatches, `systemd-cryptsetup failed with: exit status 5`)
+	c.Assert(err, FitsTypeOf, &SystemdCryptsetupError{})
+	c.Check(err.(*SystemdCryptsetupError).Args, DeepEquals, []string{s.mockSdCryptsetup.Exe(), "attach", "data", "/dev/sda1", path, "luks,tries=1,keyfile-offset=1,keyfile-size=32"})
+}
+
+func (s *activateSuite) TestActivateWithKeyFileInvalidRange(c *C) {
+	path := s.writeKeyFile(c, 0, make([]byte, 16))
+
+	for _, t := range []struct {
+		offset   int64
+		size     int64
+		errMatch string
+	}{
+		{offset: -1, size: 16, errMatch: `invalid key file offset -1`},
+		{offset: 0, size: 0, errMatch: `invalid key file size 0`},
+		{offset: 0, size: 33, errMatch: `key file offset \(0\) and size \(33\) exceed the length of the file \(32 bytes\)`},
+		{offset: 16, size: 17, errMatch: `key file offset \(16\) and size \(17\) exceed the length of the file \(32 bytes\)`},
+		{offset: 33, size: 1, errMatch: `key file offset \(33\) and size \(1\) exceed the length of the file \(32 bytes\)`},
+	} {
+		c.Check(ActivateWithKeyFile("data", "/dev/sda1", path, t.offset, t.size, nil), ErrorMatches, t.errMatch)
+	}
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *activateSuite) TestActivateWithKeyFileMissing(c *C) {
+	path := filepath.Join(c.MkDir(), "keyfile")
+	c.Check(ActivateWithKeyFile("data", "/dev/sda1", path, 0, 32, nil), ErrorMatches, `cannot obtain key file information: stat .*/keyfile: no such file or directory`)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *activateSuite) TestActivateWithKeyFileNotRegular(c *C) {
+	c.Check(ActivateWithKeyFile("data", "/dev/sda1", c.MkDir(), 0, 32, nil), ErrorMatches, `key file is not a regular file`)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *activateSuite) addMockDMDevice(c *C, dev, dmName string, slaves ...string) {
+	dir := filepath.Join(s.sysBlockDir, dev)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "slaves"), 0755), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "dm"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "dm", "name"), []byte(dmName+"\n"), 0644), IsNil)
+	for _, slave := range slaves {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, "slaves", slave), nil, 0644), IsNil)
+	}
+
+	devPath := filepath.Join(s.devDir, dev)
+	c.Assert(ioutil.WriteFile(devPath, nil, 0644), IsNil)
+	c.Assert(os.Symlink(devPath, filepath.Join(s.devMapperDir, dmName)), IsNil)
+}
+
+func (s *activateSuite) TestActiveVolumeSourceDevice(c *C) {
+	s.addMockDMDevice(c, "dm-0", "data", "sda1")
+
+	dev, err := ActiveVolumeSourceDevice("data")
+	c.Check(err, IsNil)
+	c.Check(dev, Equals, "/dev/sda1")
+}
+
+func (s *activateSuite) TestActiveVolumeSourceDeviceDMSource(c *C) {
+	s.addMockDMDevice(c, "dm-0", "vg-lv", "sda2")
+	s.addMockDMDevice(c, "dm-1", "data", "dm-0")
+
+	dev, err := ActiveVolumeSourceDevice("data")
+	c.Check(err, IsNil)
+	c.Check(dev, Equals, "/dev/dm-0")
+}
+
+func (s *activateSuite) TestActiveVolumeSourceDeviceWithIntegrity(c *C) {
+	s.addMockDMDevice(c, "dm-0", "data_dif", "nvme0n1p3")
+	s.addMockDMDevice(c, "dm-1", "data", "dm-0")
+
+	dev, err := ActiveVolumeSourceDevice("data")
+	c.Check(err, IsNil)
+	c.Check(dev, Equals, "/dev/nvme0n1p3")
+}
+
+func (s *activateSuite) TestActiveVolumeSourceDeviceNotActive(c *C) {
+	_, err := ActiveVolumeSourceDevice("data")
+	c.Check(err, Equals, ErrVolumeNotActive)
+}
+
 func (s *activateSuite) TestDeactivate(c *C) {
-	c.Assert(Deactivate("data"), IsNil)
+	s.addMockVolume(c, "data")
+	c.Assert(Deactivate("data", nil), IsNil)
 	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
 	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{
 		"systemd-cryptsetup", "detach", "data",
 	})
 }
 
+func (s *activateSuite) TestDeactivateWithSystemdCryptsetupPath(c *C) {
+	customSdCryptsetup := snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "systemd-cryptsetup"), "")
+	defer customSdCryptsetup.Restore()
+
+	s.addMockVolume(c, "data")
+	c.Check(Deactivate("data", &DeactivateOptions{SystemdCryptsetupPath: customSdCryptsetup.Exe()}), IsNil)
+
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+	c.Check(customSdCryptsetup.Calls(), DeepEquals, [][]string{
+		{"systemd-cryptsetup", "detach", "data"},
+	})
+}
+
 func (s *activateSuite) TestDeactivateErr(c *C) {
-	c.Assert(Deactivate("bad-volume"), ErrorMatches, `systemd-cryptsetup failed with: exit status 7`)
+	s.addMockVolume(c, "bad-volume")
+	err := Deactivate("bad-volume", nil)
+	c.Assert(err, ErrorMatches, `systemd-cryptsetup failed with: exit status 7`)
+	c.Assert(err, FitsTypeOf, &SystemdCryptsetupError{})
+	c.Check(err.(*SystemdCryptsetupError).Args, DeepEquals, []string{s.mockSdCryptsetup.Exe(), "detach", "bad-volume"})
 	c.Assert(s.mockSdCryptsetup.Calls(), HasLen, 1)
 	c.Check(s.mockSdCryptsetup.Calls()[0], DeepEquals, []string{
 		"systemd-cryptsetup", "detach", "bad-volume",
 	})
 }
+
+func (s *activateSuite) TestDeactivateNotActive(c *C) {
+	c.Check(Deactivate("data", nil), Equals, ErrVolumeNotActive)
+	c.Check(s.mockSdCryptsetup.Calls(), HasLen, 0)
+}
@@ -28,6 +28,7 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -52,10 +53,23 @@ var (
 	// required features.
 	ErrMissingCryptsetupFeature = errors.New("cannot perform the requested operation because a required feature is missing from cryptsetup")
 
+	// ErrIncorrectKey is returned from TestKey if the supplied key is not
+	// valid for any of the tested keyslots.
+	ErrIncorrectKey = errors.New("no keyslot can be unlocked with the supplied key")
+
+	// ErrDeviceBusy is matched by errors returned from functions that run
+	// cryptsetup when using xerrors.Is, if cryptsetup failed because the
+	// device was busy. This may be a transient condition, eg, if udev is
+	// still processing a newly created partition.
+	ErrDeviceBusy = errors.New("device is busy")
+
 	features     Features
 	featuresOnce sync.Once
+)
 
-	keySize = 64
+const (
+	defaultCipher      = "aes-xts-plain64"
+	defaultKeySizeBits = 512
 )
 
 // Features indicates the set of features supported by this package,
@@ -79,11 +93,68 @@ const (
 	FeatureTokenReplace
 )
 
-// cryptsetupCmd is a helper for running the cryptsetup command. If stdin is supplied, data read
-// from it is supplied to cryptsetup via its stdin. If callback is supplied, it will be invoked
-// after cryptsetup has started.
-func cryptsetupCmd(stdin io.Reader, callback func(cmd *exec.Cmd) error, args ...string) error {
-	cmd := exec.Command("cryptsetup", args...)
+// cryptsetupExitCodeInvalid is the exit code used by cryptsetup to
+// indicate invalid parameters. This is also returned by isLuks for a
+// device that isn't a LUKS container of the requested type.
+const cryptsetupExitCodeInvalid = 1
+
+// cryptsetupExitCodeNoPermission is the exit code used by cryptsetup
+// to indicate that no keyslot could be unlocked with the supplied key.
+const cryptsetupExitCodeNoPermission = 2
+
+// cryptsetupExitCodeBusy is the exit code used by cryptsetup to
+// indicate that the device already exists or is busy.
+const cryptsetupExitCodeBusy = 5
+
+// cryptsetupError is returned from cryptsetupCmd when cryptsetup exits
+// with an error.
+type cryptsetupError struct {
+	exitCode int
+	err      error
+}
+
+func (e *cryptsetupError) Error() string {
+	return fmt.Sprintf("cryptsetup failed with: %v", e.err)
+}
+
+func (e *cryptsetupError) Is(target error) bool {
+	return target == ErrDeviceBusy && e.exitCode == cryptsetupExitCodeBusy
+}
+
+// CommandOptions provides the options that are common to all of the functions
+// in this package that run cryptsetup.
+type CommandOptions struct {
+	// CryptsetupPath is the path of the cryptsetup binary to use. If
+	// this is empty, cryptsetup is found via PATH.
+	CryptsetupPath string
+}
+
+func (options *CommandOptions) cryptsetupPath() string {
+	if options == nil || options.CryptsetupPath == "" {
+		return "cryptsetup"
+	}
+	return options.CryptsetupPath
+}
+
+func (options *CommandOptions) features() Features {
+	if options == nil || options.CryptsetupPath == "" {
+		return DetectCryptsetupFeatures()
+	}
+	return detectCryptsetupFeatures(options.CryptsetupPath)
+}
+
+// cryptsetupCmd is a helper for running the cryptsetup command, using the binary
+// specified by options. If stdin is supplied, data read from it is supplied to
+// cryptsetup via its stdin. If callback is supplied, it will be invoked after
+// cryptsetup has started.
+func cryptsetupCmd(options *CommandOptions, stdin io.Reader, callback func(cmd *exec.Cmd) error, args ...string) error {
+	return cryptsetupCmdWithPath(options.cryptsetupPath(), stdin, callback, args...)
+}
+
+// cryptsetupCmdWithPath is the same as cryptsetupCmd, but runs the
+// cryptsetup binary at the specified path.
+func cryptsetupCmdWithPath(path string, stdin io.Reader, callback func(cmd *exec.Cmd) error, args ...string) error {
+	cmd := exec.Command(path, args...)
 	cmd.Stdin = stdin
 
 	var b bytes.Buffer
@@ -105,7 +176,11 @@ func cryptsetupCmd(stdin io.Reader, callback func(cmd *exec.Cmd) error, args ...
 	case cbErr != nil:
 		return cbErr
 	case err != nil:
-		return fmt.Errorf("cryptsetup failed with: %v", osutil.OutputErr(b.Bytes(), err))
+		exitCode := -1
+		if e, ok := err.(*exec.ExitError); ok {
+			exitCode = e.ExitCode()
+		}
+		return &cryptsetupError{exitCode: exitCode, err: osutil.OutputErr(b.Bytes(), err)}
 	}
 
 	return nil
@@ -115,32 +190,41 @@ func cryptsetupCmd(stdin io.Reader, callback func(cmd *exec.Cmd) error, args ...
 // on this system.
 func DetectCryptsetupFeatures() Features {
 	featuresOnce.Do(func() {
-		features = 0
-
-		cmd := exec.Command("cryptsetup", "--version")
-		out, err := cmd.CombinedOutput()
-		if err == nil {
-			var major, minor, patch int
-			n, _ := fmt.Sscanf(string(out), "cryptsetup %d.%d.%d", &major, &minor, &patch)
-			if n == 3 {
-				if major >= 3 || (major == 2 && minor >= 1) {
-					features |= FeatureHeaderSizeSetting
-				}
-				if major >= 3 || (major == 2 && minor >= 1) || (major == 2 && minor == 0 && patch >= 3) {
-					features |= FeatureTokenImport
-				}
+		features = detectCryptsetupFeatures("cryptsetup")
+	})
+	return features
+}
+
+// detectCryptsetupFeatures returns the features supported by the cryptsetup
+// binary at the specified path.
+func detectCryptsetupFeatures(path string) (features Features) {
+	cmd := exec.Command(path, "--version")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		var major, minor, patch int
+		n, _ := fmt.Sscanf(string(out), "cryptsetup %d.%d.%d", &major, &minor, &patch)
+		if n == 3 {
+			if major >= 3 || (major == 2 && minor >= 1) {
+				features |= FeatureHeaderSizeSetting
+			}
+			if major >= 3 || (major == 2 && minor >= 1) || (major == 2 && minor == 0 && patch >= 3) {
+				features |= FeatureTokenImport
 			}
 		}
-		if err := cryptsetupCmd(nil, nil, "--test-args", "token", "import", "--token-id", "0",
-			"--token-replace", "/dev/null"); err == nil {
-			features |= FeatureTokenReplace
-		}
-	})
+	}
+	if err := cryptsetupCmdWithPath(path, nil, nil, "--test-args", "token", "import", "--token-id", "0",
+		"--token-replace", "/dev/null"); err == nil {
+		features |= FeatureTokenReplace
+	}
 	return features
 }
 
-// KDFOptions specifies parameters for the Argon2 KDF.
+// KDFOptions specifies parameters for the KDF.
 type KDFOptions struct {
+	// Type specifies the KDF algorithm. If this is empty, argon2i is
+	// used. The MemoryKiB and Parallel options cannot be used with pbkdf2.
+	Type KDFType
+
 	// TargetDuration specifies the target time for benchmarking of the
 	// time and memory cost parameters. If it is zero then the cryptsetup
 	// default is used. If ForceIterations is not zero then this is ignored.
@@ -164,9 +248,30 @@ type KDFOptions struct {
 	Parallel int
 }
 
+// Validate checks that these options are valid. It doesn't check that the
+// selected KDF is supported by the system's cryptsetup binary.
+func (options *KDFOptions) Validate() error {
+	switch options.Type {
+	case "", KDFTypeArgon2i, KDFTypeArgon2id:
+		// ok
+	case KDFTypePBKDF2:
+		if options.MemoryKiB != 0 || options.Parallel != 0 {
+			return errors.New("cannot set the memory cost or parallelism for pbkdf2")
+		}
+	default:
+		return fmt.Errorf("unsupported KDF type \"%s\"", options.Type)
+	}
+
+	return nil
+}
+
 func (options *KDFOptions) appendArguments(args []string) []string {
-	// use argon2i as the KDF
-	args = append(args, "--pbkdf", "argon2i")
+	// use argon2i as the KDF by default
+	kdfType := options.Type
+	if kdfType == "" {
+		kdfType = KDFTypeArgon2i
+	}
+	args = append(args, "--pbkdf", string(kdfType))
 
 	switch {
 	case options.ForceIterations != 0:
@@ -206,14 +311,223 @@ type FormatOptions struct {
 	// KDFOptions describes the KDF options for the initial
 	// key slot.
 	KDFOptions KDFOptions
+
+	// HeaderPath is the path of a device or file in which to store
+	// a detached LUKS2 header. If this is empty, the header is stored
+	// on the device being formatted.
+	HeaderPath string
+
+	// Cipher is the cipher specification used to encrypt data, in
+	// the format accepted by cryptsetup's --cipher option. Set to
+	// empty to use AES with XTS block cipher mode (aes-xts-plain64).
+	Cipher string
+
+	// KeySizeBits is the size of the volume key in bits. Set to zero
+	// to use the default for the cipher, which is 512 bits for XTS
+	// modes (2 256-bit keys) and 256 bits for Adiantum. It must be
+	// set for other ciphers.
+	KeySizeBits int
+
+	// Integrity is the dm-integrity algorithm used to provide
+	// authenticated encryption, in the format accepted by cryptsetup's
+	// --integrity option. Set to empty to disable integrity protection.
+	// Supported values are "hmac-sha256" and "hmac-sha512" for
+	// non-AEAD ciphers, "aead" for AEAD ciphers such as
+	// aes-gcm-random, and "poly1305" for chacha20-random. The
+	// KeySizeBits field does not include the size of any HMAC key.
+	Integrity string
+
+	// ExtraArgs are additional arguments appended to the luksFormat
+	// command line, to permit the use of cryptsetup options that are
+	// not otherwise supported by this package. Each argument must be
+	// a long option with any value supplied in the same argument
+	// (eg, "--integrity-no-wipe" or "--offset=2048"). Options that
+	// are managed by this package cannot be specified.
+	ExtraArgs []string
+
+	// SectorSize is the encryption sector size in bytes. Set to zero
+	// to use the cryptsetup default. Must be 512, 1024, 2048 or 4096.
+	SectorSize int
+
+	// CryptsetupPath is the path of the cryptsetup binary to use. If
+	// this is empty, cryptsetup is found via PATH.
+	CryptsetupPath string
+}
+
+// formatManagedOptions are the luksFormat options that are managed by this
+// package, and which cannot be specified in FormatOptions.ExtraArgs.
+var formatManagedOptions = []string{
+	"--batch-mode",
+	"--type",
+	"--key-file",
+	"--keyfile-offset",
+	"--keyfile-size",
+	"--cipher",
+	"--key-size",
+	"--label",
+	"--pbkdf",
+	"--pbkdf-force-iterations",
+	"--iter-time",
+	"--pbkdf-memory",
+	"--pbkdf-parallel",
+	"--luks2-metadata-size",
+	"--luks2-keyslots-size",
+	"--header",
+	"--integrity",
+	"--sector-size",
+}
+
+// isAEADCipher indicates whether the supplied cipher specification is
+// for an authenticated encryption mode.
+func isAEADCipher(cipher string) bool {
+	return strings.Contains(cipher, "-gcm-") || strings.Contains(cipher, "-ccm-") ||
+		strings.HasPrefix(cipher, "aegis") || cipher == "chacha20-random"
+}
+
+// integrityKeySizeBits returns the size of the key used by the integrity
+// algorithm, which forms part of the volume key.
+func (options *FormatOptions) integrityKeySizeBits() int {
+	switch options.Integrity {
+	case "hmac-sha256":
+		return 256
+	case "hmac-sha512":
+		return 512
+	default:
+		return 0
+	}
+}
+
+func (options *FormatOptions) validateIntegrity() error {
+	cipher := options.cipher()
+
+	switch options.Integrity {
+	case "":
+		if isAEADCipher(cipher) {
+			return fmt.Errorf("cipher %s requires an integrity algorithm", cipher)
+		}
+	case "hmac-sha256", "hmac-sha512":
+		if isAEADCipher(cipher) {
+			return fmt.Errorf("cannot use integrity algorithm %s with AEAD cipher %s", options.Integrity, cipher)
+		}
+	case "aead":
+		if !isAEADCipher(cipher) || cipher == "chacha20-random" {
+			return fmt.Errorf("cannot use integrity algorithm aead with cipher %s", cipher)
+		}
+	case "poly1305":
+		if cipher != "chacha20-random" {
+			return fmt.Errorf("cannot use integrity algorithm poly1305 with cipher %s", cipher)
+		}
+	default:
+		return fmt.Errorf("unsupported integrity algorithm \"%s\"", options.Integrity)
+	}
+
+	return nil
+}
+
+func (options *FormatOptions) cipher() string {
+	if options.Cipher == "" {
+		return defaultCipher
+	}
+	return options.Cipher
+}
+
+func (options *FormatOptions) keySizeBits() int {
+	switch {
+	case options.KeySizeBits != 0:
+		return options.KeySizeBits
+	case options.Cipher == "":
+		return defaultKeySizeBits
+	case strings.Contains(options.Cipher, "-xts-"):
+		return 512
+	case strings.Contains(options.Cipher, "-adiantum-"):
+		return 256
+	default:
+		return 0
+	}
+}
+
+func (options *FormatOptions) validateCipher() error {
+	cipher := options.cipher()
+	keySizeBits := options.keySizeBits()
+
+	switch {
+	case keySizeBits == 0:
+		return fmt.Errorf("a key size must be specified for cipher %s", cipher)
+	case keySizeBits < 0 || keySizeBits%8 != 0:
+		return fmt.Errorf("invalid key size %d bits", keySizeBits)
+	case strings.Contains(cipher, "-xts-"):
+		// XTS uses 2 keys of the same size, so the key size must be
+		// twice a valid block cipher key size.
+		if keySizeBits != 256 && keySizeBits != 384 && keySizeBits != 512 {
+			return fmt.Errorf("cannot use a key size of %d bits with cipher %s: XTS requires 2 keys of 128, 192 or 256 bits", keySizeBits, cipher)
+		}
+	case strings.Contains(cipher, "-adiantum-"):
+		if keySizeBits != 256 {
+			return fmt.Errorf("cannot use a key size of %d bits with cipher %s: Adiantum requires a 256 bit key", keySizeBits, cipher)
+		}
+	}
+
+	return nil
+}
+
+func (options *FormatOptions) validateExtraArgs() error {
+	for _, arg := range options.ExtraArgs {
+		if !strings.HasPrefix(arg, "--") || len(arg) == 2 {
+			return fmt.Errorf("invalid extra argument \"%s\": must be a long option", arg)
+		}
+		name := strings.SplitN(arg, "=", 2)[0]
+		for _, managed := range formatManagedOptions {
+			if name == managed {
+				return fmt.Errorf("cannot specify the \"%s\" option as an extra argument", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (options *FormatOptions) cryptsetupPath() string {
+	if options.CryptsetupPath != "" {
+		return options.CryptsetupPath
+	}
+	return "cryptsetup"
+}
+
+func (options *FormatOptions) features() Features {
+	if options.CryptsetupPath != "" {
+		return detectCryptsetupFeatures(options.CryptsetupPath)
+	}
+	return DetectCryptsetupFeatures()
 }
 
 func (options *FormatOptions) validate() error {
 	if (options.MetadataKiBSize != 0 || options.KeyslotsAreaKiBSize != 0) &&
-		DetectCryptsetupFeatures()&FeatureHeaderSizeSetting == 0 {
+		options.features()&FeatureHeaderSizeSetting == 0 {
 		return ErrMissingCryptsetupFeature
 	}
 
+	if err := options.validateCipher(); err != nil {
+		return err
+	}
+
+	if err := options.validateIntegrity(); err != nil {
+		return err
+	}
+
+	if err := options.validateExtraArgs(); err != nil {
+		return err
+	}
+
+	switch options.SectorSize {
+	case 0, 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("invalid sector size %d", options.SectorSize)
+	}
+
+	if err := options.KDFOptions.Validate(); err != nil {
+		return err
+	}
+
 	if options.MetadataKiBSize != 0 {
 		// Verify that the size is a power of 2 between 16KiB and 4MiB.
 		found := false
@@ -231,7 +545,7 @@ func (options *FormatOptions) validate() error {
 	if options.KeyslotsAreaKiBSize != 0 {
 		// Verify that the size is sufficient for a single keyslot, not more than 128MiB
 		// and a multiple of 4KiB.
-		if options.KeyslotsAreaKiBSize < (keySize*4000)/1024 ||
+		if options.KeyslotsAreaKiBSize < ((options.keySizeBits()/8)*4000)/1024 ||
 			options.KeyslotsAreaKiBSize > 128*1024 || options.KeyslotsAreaKiBSize%4 != 0 {
 			return fmt.Errorf("cannot set keyslots area size to %v KiB", options.KeyslotsAreaKiBSize)
 		}
@@ -251,6 +565,21 @@ func (options *FormatOptions) appendArguments(args []string) []string {
 		// override the default keyslots area size if specified
 		args = append(args, "--luks2-keyslots-size", fmt.Sprintf("%dk", options.KeyslotsAreaKiBSize))
 	}
+	if options.HeaderPath != "" {
+		// store the header separately from the data
+		args = append(args, "--header", options.HeaderPath)
+	}
+	if options.Integrity != "" {
+		// enable authenticated encryption with dm-integrity
+		args = append(args, "--integrity", options.Integrity)
+	}
+	if options.SectorSize != 0 {
+		// override the default encryption sector size if specified
+		args = append(args, "--sector-size", strconv.Itoa(options.SectorSize))
+	}
+
+	// append any extra arguments supplied by the caller
+	args = append(args, options.ExtraArgs...)
 
 	return args
 }
@@ -259,19 +588,49 @@ func (options *FormatOptions) appendArguments(args []string) []string {
 // supplied key. The label for the new container will be set to the supplied label. This can only be
 // called on a device that is not mapped.
 //
-// The container will be configured to encrypt data with AES-256 and XTS block cipher mode. The
-// KDF for the primary keyslot will be configured to use argon2i with the supplied benchmark time.
+// The container will be configured to encrypt data with AES-256 and XTS block cipher mode, unless
+// a different cipher is specified in the supplied options. The KDF for the primary keyslot will be
+// configured to use argon2i with the supplied benchmark time, unless a different KDF type is specified.
 //
 // WARNING: This function is destructive. Calling this on an existing LUKS2 container will make the
 // data contained inside of it irretrievable.
 func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
+	if opts == nil {
+		opts = &FormatOptions{}
+	}
+
+	args, err := formatArgs(devicePath, label, opts)
+	if err != nil {
+		return err
+	}
+
+	return cryptsetupCmdWithPath(opts.cryptsetupPath(), bytes.NewReader(key), nil, args...)
+}
+
+// FormatCommand returns the command line that Format would execute with the
+// supplied arguments, including the name of the cryptsetup binary. The key
+// is not part of the command line - Format supplies it via stdin.
+func FormatCommand(devicePath, label string, opts *FormatOptions) ([]string, error) {
+	if opts == nil {
+		opts = &FormatOptions{}
+	}
+
+	args, err := formatArgs(devicePath, label, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{opts.cryptsetupPath()}, args...), nil
+}
+
+func formatArgs(devicePath, label string, opts *FormatOptions) ([]string, error) {
 	if opts == nil {
 		var defaultOpts FormatOptions
 		opts = &defaultOpts
 	}
 
 	if err := opts.validate(); err != nil {
-		return err
+		return nil, err
 	}
 
 	args := []string{
@@ -283,8 +642,10 @@ func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
 		"--type", "luks2",
 		// read the key from stdin
 		"--key-file", "-",
-		// use AES-256 with XTS block cipher mode (XTS requires 2 keys)
-		"--cipher", "aes-xts-plain64", "--key-size", strconv.Itoa(keySize * 8),
+		// use the requested cipher, which defaults to AES-256 with XTS block
+		// cipher mode (XTS requires 2 keys). The volume key also contains
+		// the key for the integrity algorithm if there is one.
+		"--cipher", opts.cipher(), "--key-size", strconv.Itoa(opts.keySizeBits() + opts.integrityKeySizeBits()),
 		// set LUKS2 label
 		"--label", label}
 
@@ -295,7 +656,41 @@ func Format(devicePath, label string, key []byte, opts *FormatOptions) error {
 		// device to format
 		devicePath)
 
-	return cryptsetupCmd(bytes.NewReader(key), nil, args...)
+	return args, nil
+}
+
+// writeExistingKeyToFifo returns a callback for cryptsetupCmd that passes
+// the supplied existing key to cryptsetup via the FIFO at the specified path.
+func writeExistingKeyToFifo(fifoPath string, existingKey []byte) func(cmd *exec.Cmd) error {
+	return func(cmd *exec.Cmd) error {
+		f, err := os.OpenFile(fifoPath, os.O_WRONLY, 0)
+		if err != nil {
+			// If we fail to open the write end, the read end will be blocked in open(), so
+			// kill the process.
+			cmd.Process.Kill()
+			return xerrors.Errorf("cannot open FIFO for passing existing key to cryptsetup: %w", err)
+		}
+
+		if _, err := f.Write(existingKey); err != nil {
+			// The read end is open and blocked inside read(). Closing our write end will result in the
+			// read end returning 0 bytes (EOF) and continuing cleanly.
+			if err := f.Close(); err != nil {
+				// If we can't close the write end, the read end will remain blocked inside read(),
+				// so kill the process.
+				cmd.Process.Kill()
+			}
+			return xerrors.Errorf("cannot pass existing key to cryptsetup: %w", err)
+		}
+
+		if err := f.Close(); err != nil {
+			// If we can't close the write end, the read end will remain blocked inside read(),
+			// so kill the process.
+			cmd.Process.Kill()
+			return xerrors.Errorf("cannot close write end of FIFO: %w", err)
+		}
+
+		return nil
+	}
 }
 
 // AddKeyOptions provides the options for adding a key to a LUKS2 volume
@@ -306,6 +701,9 @@ type AddKeyOptions struct {
 	// Slot is the keyslot to use. Note that the default value is slot 0. In
 	// order to automatically choose a slot, use AnySlot.
 	Slot int
+
+	// CommandOptions specifies the cryptsetup binary to use.
+	CommandOptions
 }
 
 // AddKey adds the supplied key in to a new keyslot for specified LUKS2 container. In order to do this,
@@ -319,6 +717,10 @@ func AddKey(devicePath string, existingKey, key []byte, options *AddKeyOptions)
 		options = &AddKeyOptions{Slot: AnySlot}
 	}
 
+	if err := options.KDFOptions.Validate(); err != nil {
+		return err
+	}
+
 	fifoPath, cleanupFifo, err := mkFifo()
 	if err != nil {
 		return xerrors.Errorf("cannot create FIFO for passing existing key to cryptsetup: %w", err)
@@ -349,37 +751,58 @@ func AddKey(devicePath string, existingKey, key []byte, options *AddKeyOptions)
 		// in order to be able to do this.
 		"-")
 
-	writeExistingKeyToFifo := func(cmd *exec.Cmd) error {
-		f, err := os.OpenFile(fifoPath, os.O_WRONLY, 0)
-		if err != nil {
-			// If we fail to open the write end, the read end will be blocked in open(), so
-			// kill the process.
-			cmd.Process.Kill()
-			return xerrors.Errorf("cannot open FIFO for passing existing key to cryptsetup: %w", err)
-		}
-
-		if _, err := f.Write(existingKey); err != nil {
-			// The read end is open and blocked inside read(). Closing our write end will result in the
-			// read end returning 0 bytes (EOF) and continuing cleanly.
-			if err := f.Close(); err != nil {
-				// If we can't close the write end, the read end will remain blocked inside read(),
-				// so kill the process.
-				cmd.Process.Kill()
-			}
-			return xerrors.Errorf("cannot pass existing key to cryptsetup: %w", err)
-		}
+	return cryptsetupCmd(&options.CommandOptions, bytes.NewReader(key), writeExistingKeyToFifo(fifoPath, existingKey), args...)
+}
 
-		if err := f.Close(); err != nil {
-			// If we can't close the write end, the read end will remain blocked inside read(),
-			// so kill the process.
-			cmd.Process.Kill()
-			return xerrors.Errorf("cannot close write end of FIFO: %w", err)
-		}
+// ChangeKey changes the key protecting the keyslot with the supplied slot
+// number on the specified LUKS2 container from existingKey to key. The new
+// key is stored in the same keyslot, so any tokens associated with the
+// keyslot remain valid. The KDF for the keyslot is reconfigured using the
+// supplied options. If options is nil, the default KDF options are used.
+//
+// If existingKey is not valid for the keyslot, ErrIncorrectKey is returned.
+func ChangeKey(devicePath string, slot int, existingKey, key []byte, options *KDFOptions, cmdOptions *CommandOptions) error {
+	if slot < 0 {
+		return errors.New("invalid slot")
+	}
+	if options == nil {
+		options = new(KDFOptions)
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
 
-		return nil
+	fifoPath, cleanupFifo, err := mkFifo()
+	if err != nil {
+		return xerrors.Errorf("cannot create FIFO for passing existing key to cryptsetup: %w", err)
 	}
+	defer cleanupFifo()
+
+	args := []string{
+		// change an existing key
+		"luksChangeKey",
+		// LUKS2 only
+		"--type", "luks2",
+		// read existing key from named pipe
+		"--key-file", fifoPath,
+		// the keyslot to change
+		"--key-slot", strconv.Itoa(slot)}
+
+	// apply KDF options
+	args = options.appendArguments(args)
 
-	return cryptsetupCmd(bytes.NewReader(key), writeExistingKeyToFifo, args...)
+	args = append(args,
+		// container to change the key on
+		devicePath,
+		// read new key from stdin.
+		"-")
+
+	err = cryptsetupCmd(cmdOptions, bytes.NewReader(key), writeExistingKeyToFifo(fifoPath, existingKey), args...)
+	var e *cryptsetupError
+	if xerrors.As(err, &e) && e.exitCode == cryptsetupExitCodeNoPermission {
+		return ErrIncorrectKey
+	}
+	return err
 }
 
 // ImportTokenOptions provides the options for importing a JSON token into a LUKS2 header.
@@ -390,22 +813,26 @@ type ImportTokenOptions struct {
 
 	// Replace will overwrite an existing token at the specified slot.
 	Replace bool
+
+	// CommandOptions specifies the cryptsetup binary to use.
+	CommandOptions
 }
 
 // ImportToken imports the supplied token in to the JSON metadata area of the specified LUKS2 container.
 // This requires FeatureTokenImport. If the Replace field of options is set, then FeatureTokenReplace
 // is required.
 func ImportToken(devicePath string, token Token, options *ImportTokenOptions) error {
-	if DetectCryptsetupFeatures()&FeatureTokenImport == 0 {
-		return ErrMissingCryptsetupFeature
-	}
-
 	if options == nil {
 		options = &ImportTokenOptions{Id: AnyId}
 	}
 
+	features := options.CommandOptions.features()
+	if features&FeatureTokenImport == 0 {
+		return ErrMissingCryptsetupFeature
+	}
+
 	if options.Replace {
-		if DetectCryptsetupFeatures()&FeatureTokenReplace == 0 {
+		if features&FeatureTokenReplace == 0 {
 			return ErrMissingCryptsetupFeature
 		}
 		if options.Id == AnyId {
@@ -428,13 +855,13 @@ func ImportToken(devicePath string, token Token, options *ImportTokenOptions) er
 	}
 	args = append(args, devicePath)
 
-	return cryptsetupCmd(bytes.NewReader(tokenJSON), nil, args...)
+	return cryptsetupCmd(&options.CommandOptions, bytes.NewReader(tokenJSON), nil, args...)
 }
 
 // RemoveToken removes the token with the supplied ID from the JSON metadata area of the specified
 // LUKS2 container.
-func RemoveToken(devicePath string, id int) error {
-	return cryptsetupCmd(nil, nil, "token", "remove", "--token-id", strconv.Itoa(id), devicePath)
+func RemoveToken(devicePath string, id int, options *CommandOptions) error {
+	return cryptsetupCmd(options, nil, nil, "token", "remove", "--token-id", strconv.Itoa(id), devicePath)
 }
 
 // KillSlot erases the keyslot with the supplied slot number from the specified LUKS2 container.
@@ -442,12 +869,78 @@ func RemoveToken(devicePath string, id int) error {
 //
 // WARNING: This function will remove the last keyslot if the key associated with it
 // is supplied, which will make the encrypted data permanently inaccessible.
-func KillSlot(devicePath string, slot int, key []byte) error {
-	return cryptsetupCmd(bytes.NewReader(key), nil, "luksKillSlot", "--type", "luks2", "--key-file", "-", devicePath, strconv.Itoa(slot))
+func KillSlot(devicePath string, slot int, key []byte, options *CommandOptions) error {
+	return cryptsetupCmd(options, bytes.NewReader(key), nil, "luksKillSlot", "--type", "luks2", "--key-file", "-", devicePath, strconv.Itoa(slot))
 }
 
 // SetSlotPriority sets the priority of the keyslot with the supplied slot number on
 // the specified LUKS2 container.
-func SetSlotPriority(devicePath string, slot int, priority SlotPriority) error {
-	return cryptsetupCmd(nil, nil, "config", "--priority", priority.String(), "--key-slot", strconv.Itoa(slot), devicePath)
+func SetSlotPriority(devicePath string, slot int, priority SlotPriority, options *CommandOptions) error {
+	return cryptsetupCmd(options, nil, nil, "config", "--priority", priority.String(), "--key-slot", strconv.Itoa(slot), devicePath)
+}
+
+// BackupHeader writes a copy of the LUKS2 header of the specified container,
+// including the keyslots area, to backupFile. The backup file must not already
+// exist.
+func BackupHeader(devicePath, backupFile string, options *CommandOptions) error {
+	return cryptsetupCmd(options, nil, nil, "luksHeaderBackup", "--header-backup-file", backupFile, devicePath)
+}
+
+// RestoreHeader replaces the LUKS2 header of the specified container, including
+// the keyslots area, with the one contained in backupFile, which was previously
+// created with BackupHeader.
+//
+// WARNING: This function does not check that the backup belongs to the specified
+// container. Restoring a header from a different container will make the encrypted
+// data inaccessible.
+func RestoreHeader(devicePath, backupFile string, options *CommandOptions) error {
+	return cryptsetupCmd(options, nil, nil, "luksHeaderRestore", "--batch-mode", "--type", "luks2", "--header-backup-file", backupFile, devicePath)
+}
+
+// IsLUKS2 determines whether the specified device or file contains a LUKS2
+// header. This returns false for devices that are unformatted or that contain
+// something other than a LUKS2 container. An error is returned if the device
+// cannot be accessed.
+func IsLUKS2(devicePath string, options *CommandOptions) (bool, error) {
+	if _, err := os.Stat(devicePath); err != nil {
+		return false, xerrors.Errorf("cannot access device: %w", err)
+	}
+
+	err := cryptsetupCmd(options, nil, nil, "isLuks", "--type", "luks2", devicePath)
+	var e *cryptsetupError
+	switch {
+	case xerrors.As(err, &e) && e.exitCode == cryptsetupExitCodeInvalid:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
+}
+
+// TestKey tests whether the supplied key can be used to unlock the keyslot
+// with the supplied slot number on the specified LUKS2 container, without
+// activating it. If slot is AnySlot, then every keyslot is tested.
+//
+// If the key is not valid for the tested keyslots, ErrIncorrectKey is
+// returned. Any other error indicates that the test could not be performed.
+func TestKey(devicePath string, slot int, key []byte, options *CommandOptions) error {
+	args := []string{
+		// test the key without activating
+		"open", "--test-passphrase",
+		// LUKS2 only
+		"--type", "luks2",
+		// read key from stdin
+		"--key-file", "-"}
+	if slot != AnySlot {
+		args = append(args, "--key-slot", strconv.Itoa(slot))
+	}
+	args = append(args, devicePath)
+
+	err := cryptsetupCmd(options, bytes.NewReader(key), nil, args...)
+	var e *cryptsetupError
+	if xerrors.As(err, &e) && e.exitCode == cryptsetupExitCodeNoPermission {
+		return ErrIncorrectKey
+	}
+	return err
 }
@@ -33,6 +33,8 @@ import (
 
 	snapd_testutil "github.com/snapcore/snapd/testutil"
 
+	"golang.org/x/xerrors"
+
 	. "gopkg.in/check.v1"
 
 	. "github.com/snapcore/secboot/internal/luks2"
@@ -44,7 +46,8 @@ import (
 type cryptsetupSuiteBase struct {
 	snapd_testutil.BaseTest
 
-	cryptsetup *snapd_testutil.MockCmd
+	cryptsetup     *snapd_testutil.MockCmd
+	cryptsetupPath string
 }
 
 func (s *cryptsetupSuiteBase) SetUpTest(c *C) {
@@ -56,6 +59,7 @@ func (s *cryptsetupSuiteBase) SetUpTest(c *C) {
 
 	cryptsetup, err := exec.LookPath("cryptsetup")
 	c.Assert(err, IsNil)
+	s.cryptsetupPath = cryptsetup
 
 	s.cryptsetup = snapd_testutil.MockCommand(c, "cryptsetup", fmt.Sprintf(cryptsetupWrapperTpl, cryptsetup))
 	s.AddCleanup(s.cryptsetup.Restore)
@@ -190,6 +194,84 @@ func (s *cryptsetupSuite) TestFormatOptionsValidateBadKeyslotsAreaSize(c *C) {
 	}
 }
 
+func (s *cryptsetupSuite) TestFormatOptionsValidateBadCipher(c *C) {
+	for _, t := range []struct {
+		opts FormatOptions
+		err  string
+	}{
+		{FormatOptions{KeySizeBits: 128}, "cannot use a key size of 128 bits with cipher aes-xts-plain64: XTS requires 2 keys of 128, 192 or 256 bits"},
+		{FormatOptions{Cipher: "serpent-xts-plain64", KeySizeBits: 1024}, "cannot use a key size of 1024 bits with cipher serpent-xts-plain64: XTS requires 2 keys of 128, 192 or 256 bits"},
+		{FormatOptions{Cipher: "xchacha20,aes-adiantum-plain64", KeySizeBits: 512}, "cannot use a key size of 512 bits with cipher xchacha20,aes-adiantum-plain64: Adiantum requires a 256 bit key"},
+		{FormatOptions{Cipher: "aes-cbc-essiv:sha256"}, "a key size must be specified for cipher aes-cbc-essiv:sha256"},
+		{FormatOptions{Cipher: "aes-cbc-essiv:sha256", KeySizeBits: 130}, "invalid key size 130 bits"},
+		{FormatOptions{KeySizeBits: -256}, "invalid key size -256 bits"},
+	} {
+		c.Check(Format("/dev/null", "", make([]byte, 32), &t.opts), ErrorMatches, t.err)
+	}
+	c.Check(s.cryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *cryptsetupSuite) TestFormatOptionsValidateBadKDF(c *C) {
+	for _, t := range []struct {
+		opts FormatOptions
+		err  string
+	}{
+		{FormatOptions{KDFOptions: KDFOptions{Type: KDFTypePBKDF2, MemoryKiB: 32}}, "cannot set the memory cost or parallelism for pbkdf2"},
+		{FormatOptions{KDFOptions: KDFOptions{Type: KDFTypePBKDF2, Parallel: 2}}, "cannot set the memory cost or parallelism for pbkdf2"},
+		{FormatOptions{KDFOptions: KDFOptions{Type: "scrypt"}}, "unsupported KDF type \"scrypt\""},
+	} {
+		c.Check(Format("/dev/null", "", make([]byte, 32), &t.opts), ErrorMatches, t.err)
+	}
+	c.Check(s.cryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *cryptsetupSuite) TestFormatWithArgon2id(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	options := &FormatOptions{
+		KDFOptions: KDFOptions{Type: KDFTypeArgon2id, MemoryKiB: 32 * 1024, ForceIterations: 4, Parallel: 1}}
+	c.Check(Format(devicePath, "data", key, options), IsNil)
+
+	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+			"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "512",
+			"--label", "data", "--pbkdf", "argon2id", "--pbkdf-force-iterations", "4",
+			"--pbkdf-memory", "32768", "--pbkdf-parallel", "1", devicePath}})
+
+	info, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Assert(info.Metadata.Keyslots, HasLen, 1)
+	c.Assert(info.Metadata.Keyslots[0].KDF, NotNil)
+	c.Check(info.Metadata.Keyslots[0].KDF.Type, Equals, KDFTypeArgon2id)
+}
+
+func (s *cryptsetupSuite) TestFormatWithCipherAndKeySize(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	options := &FormatOptions{
+		KDFOptions:  KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+		Cipher:      "aes-xts-plain64",
+		KeySizeBits: 256}
+	c.Check(Format(devicePath, "data", key, options), IsNil)
+
+	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+			"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "256",
+			"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+			"--pbkdf-memory", "32768", devicePath}})
+
+	info, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Assert(info.Metadata.Keyslots, HasLen, 1)
+	c.Check(info.Metadata.Keyslots[0].KeySize, Equals, 32)
+}
+
 type testFormatData struct {
 	label   string
 	key     []byte
@@ -319,6 +401,228 @@ func (s *cryptsetupSuite) TestFormatWithForceIterations(c *C) {
 		extraArgs: []string{"--pbkdf-force-iterations", "4", "--pbkdf-memory", "32768"}})
 }
 
+func (s *cryptsetupSuite) TestFormatWithDetachedHeader(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+	headerPath := filepath.Join(c.MkDir(), "header")
+
+	options := &FormatOptions{
+		KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+		HeaderPath: headerPath}
+	c.Check(Format(devicePath, "data", key, options), IsNil)
+
+	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+			"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "512",
+			"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+			"--pbkdf-memory", "32768", "--header", headerPath, devicePath}})
+
+	info, err := ReadHeader(headerPath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Label, Equals, "data")
+	c.Check(info.Metadata.Keyslots, HasLen, 1)
+
+	_, err = ReadHeader(devicePath, LockModeBlocking)
+	c.Check(err, NotNil)
+}
+
+func (s *cryptsetupSuite) TestFormatCommand(c *C) {
+	args, err := FormatCommand("/dev/sda1", "data", &FormatOptions{
+		MetadataKiBSize:     2 * 1024,
+		KeyslotsAreaKiBSize: 3 * 1024,
+		KDFOptions:          KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+		HeaderPath:          "/run/header"})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+		"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+		"--pbkdf-memory", "32768", "--luks2-metadata-size", "2048k",
+		"--luks2-keyslots-size", "3072k", "--header", "/run/header", "/dev/sda1"})
+}
+
+func (s *cryptsetupSuite) TestFormatWithCryptsetupPath(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	customCryptsetup := snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "cryptsetup"), fmt.Sprintf(`exec %s "$@" </dev/stdin`, s.cryptsetupPath))
+	defer customCryptsetup.Restore()
+
+	options := &FormatOptions{
+		KDFOptions:     KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+		CryptsetupPath: customCryptsetup.Exe()}
+	c.Check(Format(devicePath, "data", key, options), IsNil)
+
+	c.Check(s.cryptsetup.Calls(), HasLen, 0)
+	c.Check(customCryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+			"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "512",
+			"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+			"--pbkdf-memory", "32768", devicePath}})
+
+	info, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Label, Equals, "data")
+}
+
+func (s *cryptsetupSuite) TestCommandsWithCryptsetupPath(c *C) {
+	if DetectCryptsetupFeatures()&FeatureTokenImport == 0 {
+		c.Skip("cryptsetup doesn't support token import")
+	}
+	s.cryptsetup.ForgetCalls()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	customCryptsetup := snapd_testutil.MockCommand(c, filepath.Join(c.MkDir(), "cryptsetup"), fmt.Sprintf(`exec %s "$@" </dev/stdin`, s.cryptsetupPath))
+	defer customCryptsetup.Restore()
+
+	cmdOptions := CommandOptions{CryptsetupPath: customCryptsetup.Exe()}
+	kdfOptions := KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}
+
+	c.Check(Format(devicePath, "", key, &FormatOptions{KDFOptions: kdfOptions, CryptsetupPath: customCryptsetup.Exe()}), IsNil)
+	c.Check(AddKey(devicePath, key, key, &AddKeyOptions{KDFOptions: kdfOptions, Slot: 1, CommandOptions: cmdOptions}), IsNil)
+
+	isLUKS2, err := IsLUKS2(devicePath, &cmdOptions)
+	c.Check(err, IsNil)
+	c.Check(isLUKS2, Equals, true)
+
+	customCryptsetup.ForgetCalls()
+
+	c.Check(ImportToken(devicePath, &GenericToken{TokenType: "secboot-test", TokenKeyslots: []int{0}},
+		&ImportTokenOptions{Id: AnyId, CommandOptions: cmdOptions}), IsNil)
+	c.Check(SetSlotPriority(devicePath, 0, SlotPriorityHigh, &cmdOptions), IsNil)
+	c.Check(TestKey(devicePath, 1, key, &cmdOptions), IsNil)
+	c.Check(KillSlot(devicePath, 1, key, &cmdOptions), IsNil)
+
+	// The features of the custom binary are detected before importing
+	// the token, so only check the calls that follow.
+	calls := customCryptsetup.Calls()
+	c.Assert(len(calls) >= 4, Equals, true)
+	c.Check(calls[len(calls)-4:], DeepEquals, [][]string{
+		{"cryptsetup", "token", "import", devicePath},
+		{"cryptsetup", "config", "--priority", "prefer", "--key-slot", "0", devicePath},
+		{"cryptsetup", "open", "--test-passphrase", "--type", "luks2", "--key-file", "-", "--key-slot", "1", devicePath},
+		{"cryptsetup", "luksKillSlot", "--type", "luks2", "--key-file", "-", devicePath, "1"},
+	})
+	c.Check(s.cryptsetup.Calls(), HasLen, 0)
+}
+
+func (s *cryptsetupSuite) TestFormatCommandWithCryptsetupPath(c *C) {
+	args, err := FormatCommand("/dev/sda1", "data", &FormatOptions{
+		KDFOptions:     KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+		CryptsetupPath: "/run/mnt/tools/cryptsetup"})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"/run/mnt/tools/cryptsetup", "-q", "luksFormat", "--type", "luks2",
+		"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+		"--pbkdf-memory", "32768", "/dev/sda1"})
+}
+
+func (s *cryptsetupSuite) TestFormatCommandInvalidOptions(c *C) {
+	_, err := FormatCommand("/dev/sda1", "data", &FormatOptions{MetadataKiBSize: 2})
+	c.Check(err, ErrorMatches, "cannot set metadata size to 2 KiB")
+}
+
+func (s *cryptsetupSuite) TestFormatCommandWithIntegrity(c *C) {
+	args, err := FormatCommand("/dev/sda1", "data", &FormatOptions{
+		KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+		Integrity:  "hmac-sha256"})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+		"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "768",
+		"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+		"--pbkdf-memory", "32768", "--integrity", "hmac-sha256", "/dev/sda1"})
+}
+
+func (s *cryptsetupSuite) TestFormatCommandWithAEADIntegrity(c *C) {
+	args, err := FormatCommand("/dev/sda1", "data", &FormatOptions{
+		KDFOptions:  KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+		Cipher:      "aes-gcm-random",
+		KeySizeBits: 256,
+		Integrity:   "aead"})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+		"--key-file", "-", "--cipher", "aes-gcm-random", "--key-size", "256",
+		"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+		"--pbkdf-memory", "32768", "--integrity", "aead", "/dev/sda1"})
+}
+
+func (s *cryptsetupSuite) TestFormatOptionsValidateBadIntegrity(c *C) {
+	for _, t := range []struct {
+		opts     FormatOptions
+		errMatch string
+	}{
+		{opts: FormatOptions{Integrity: "crc32c"}, errMatch: `unsupported integrity algorithm "crc32c"`},
+		{opts: FormatOptions{Integrity: "aead"}, errMatch: `cannot use integrity algorithm aead with cipher aes-xts-plain64`},
+		{opts: FormatOptions{Integrity: "poly1305"}, errMatch: `cannot use integrity algorithm poly1305 with cipher aes-xts-plain64`},
+		{opts: FormatOptions{Cipher: "aes-gcm-random", KeySizeBits: 256, Integrity: "hmac-sha256"}, errMatch: `cannot use integrity algorithm hmac-sha256 with AEAD cipher aes-gcm-random`},
+		{opts: FormatOptions{Cipher: "aes-gcm-random", KeySizeBits: 256}, errMatch: `cipher aes-gcm-random requires an integrity algorithm`},
+		{opts: FormatOptions{Cipher: "chacha20-random", KeySizeBits: 256, Integrity: "aead"}, errMatch: `cannot use integrity algorithm aead with cipher chacha20-random`},
+	} {
+		c.Check(t.opts.Validate(), ErrorMatches, t.errMatch)
+	}
+}
+
+func (s *cryptsetupSuite) TestFormatCommandWithExtraArgs(c *C) {
+	args, err := FormatCommand("/dev/sda1", "data", &FormatOptions{
+		KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+		ExtraArgs:  []string{"--offset=4096", "--integrity-no-wipe"}})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+		"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+		"--pbkdf-memory", "32768", "--offset=4096", "--integrity-no-wipe", "/dev/sda1"})
+}
+
+func (s *cryptsetupSuite) TestFormatCommandWithSectorSize(c *C) {
+	args, err := FormatCommand("/dev/sda1", "data", &FormatOptions{
+		KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4},
+		SectorSize: 4096})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"cryptsetup", "-q", "luksFormat", "--type", "luks2",
+		"--key-file", "-", "--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--label", "data", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4",
+		"--pbkdf-memory", "32768", "--sector-size", "4096", "/dev/sda1"})
+}
+
+func (s *cryptsetupSuite) TestFormatOptionsValidateBadSectorSize(c *C) {
+	for _, sz := range []int{-512, 256, 768, 8192} {
+		opts := FormatOptions{SectorSize: sz}
+		c.Check(opts.Validate(), ErrorMatches, fmt.Sprintf("invalid sector size %d", sz))
+	}
+}
+
+func (s *cryptsetupSuite) TestFormatOptionsValidateBadExtraArgs(c *C) {
+	for _, t := range []struct {
+		args     []string
+		errMatch string
+	}{
+		{args: []string{"--type=luks1"}, errMatch: `cannot specify the "--type" option as an extra argument`},
+		{args: []string{"--cipher=aes-cbc-essiv:sha256"}, errMatch: `cannot specify the "--cipher" option as an extra argument`},
+		{args: []string{"--key-file=/etc/key"}, errMatch: `cannot specify the "--key-file" option as an extra argument`},
+		{args: []string{"--offset=4096", "--header"}, errMatch: `cannot specify the "--header" option as an extra argument`},
+		{args: []string{"--sector-size=4096"}, errMatch: `cannot specify the "--sector-size" option as an extra argument`},
+		{args: []string{"-c", "aes-cbc-essiv:sha256"}, errMatch: `invalid extra argument "-c": must be a long option`},
+		{args: []string{"/dev/sdb1"}, errMatch: `invalid extra argument "/dev/sdb1": must be a long option`},
+		{args: []string{"--"}, errMatch: `invalid extra argument "--": must be a long option`},
+	} {
+		opts := FormatOptions{ExtraArgs: t.args}
+		c.Check(opts.Validate(), ErrorMatches, t.errMatch)
+	}
+}
+
 func (s *cryptsetupSuite) TestFormatWithDifferentLabel(c *C) {
 	key := make([]byte, 32)
 	rand.Read(key)
@@ -346,6 +650,18 @@ func (s *cryptsetupSuite) TestFormatWithCustomMetadataSize(c *C) {
 		extraArgs: []string{"--pbkdf-force-iterations", "4", "--pbkdf-memory", "32768", "--luks2-metadata-size", "2048k"}})
 }
 
+func (s *cryptsetupSuite) TestFormatWithSectorSize(c *C) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	c.Check(Format(devicePath, "", make([]byte, 32), &FormatOptions{
+		KDFOptions: KDFOptions{MemoryKiB: 32, ForceIterations: 4},
+		SectorSize: 4096}), IsNil)
+
+	info, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.Metadata.Segments[0].SectorSize, Equals, 4096)
+}
+
 func (s *cryptsetupSuite) TestFormatWithCustomKeyslotsAreaSize(c *C) {
 	if DetectCryptsetupFeatures()&FeatureHeaderSizeSetting == 0 {
 		c.Skip("cryptsetup doesn't support --luks2-keyslots-size")
@@ -391,6 +707,24 @@ func (s *cryptsetupSuite) TestFormatWithInvalidKeyslotsAreaSize(c *C) {
 	c.Check(Format(devicePath, "", make([]byte, 32), &FormatOptions{KeyslotsAreaKiBSize: 41}), ErrorMatches, "cannot set keyslots area size to 41 KiB")
 }
 
+func (s *cryptsetupSuite) TestFormatDeviceBusy(c *C) {
+	cryptsetup := snapd_testutil.MockCommand(c, "cryptsetup", `echo "Cannot format device /dev/sda1 in use." >&2; exit 5`)
+	defer cryptsetup.Restore()
+
+	err := Format("/dev/sda1", "", make([]byte, 32), &FormatOptions{KDFOptions: KDFOptions{ForceIterations: 4, MemoryKiB: 32}})
+	c.Check(err, ErrorMatches, "cryptsetup failed with: Cannot format device /dev/sda1 in use.")
+	c.Check(xerrors.Is(err, ErrDeviceBusy), Equals, true)
+}
+
+func (s *cryptsetupSuite) TestFormatOtherErrorIsNotDeviceBusy(c *C) {
+	cryptsetup := snapd_testutil.MockCommand(c, "cryptsetup", `echo "Device /dev/sda1 does not exist or access denied." >&2; exit 4`)
+	defer cryptsetup.Restore()
+
+	err := Format("/dev/sda1", "", make([]byte, 32), &FormatOptions{KDFOptions: KDFOptions{ForceIterations: 4, MemoryKiB: 32}})
+	c.Check(err, ErrorMatches, "cryptsetup failed with: Device /dev/sda1 does not exist or access denied.")
+	c.Check(xerrors.Is(err, ErrDeviceBusy), Equals, false)
+}
+
 type testAddKeyData struct {
 	key     []byte
 	options *AddKeyOptions
@@ -821,7 +1155,7 @@ func (s *cryptsetupSuite) testRemoveToken(c *C, tokenId int) {
 
 	s.cryptsetup.ForgetCalls()
 
-	c.Check(RemoveToken(devicePath, tokenId), IsNil)
+	c.Check(RemoveToken(devicePath, tokenId, nil), IsNil)
 
 	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{
 		{"cryptsetup", "token", "remove", "--token-id", strconv.Itoa(tokenId), devicePath},
@@ -853,7 +1187,7 @@ func (s *cryptsetupSuite) TestRemoveNonExistantToken(c *C) {
 	c.Assert(Format(devicePath, "", make([]byte, 32), &options), IsNil)
 	c.Assert(ImportToken(devicePath, &GenericToken{TokenType: "secboot-foo", TokenKeyslots: []int{0}}, nil), IsNil)
 
-	c.Check(RemoveToken(devicePath, 10), ErrorMatches, "cryptsetup failed with: Token 10 is not in use.")
+	c.Check(RemoveToken(devicePath, 10, nil), ErrorMatches, "cryptsetup failed with: Token 10 is not in use.")
 
 	info, err := ReadHeader(devicePath, LockModeBlocking)
 	c.Assert(err, IsNil)
@@ -885,7 +1219,7 @@ func (s *cryptsetupSuite) testKillSlot(c *C, data *testKillSlotData) {
 
 	s.cryptsetup.ForgetCalls()
 
-	c.Check(KillSlot(devicePath, data.slotId, data.key), IsNil)
+	c.Check(KillSlot(devicePath, data.slotId, data.key, nil), IsNil)
 
 	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{
 		{"cryptsetup", "luksKillSlot", "--type", "luks2", "--key-file", "-", devicePath, strconv.Itoa(data.slotId)},
@@ -940,7 +1274,7 @@ func (s *cryptsetupSuite) TestKillSlotWithWrongPassphrase(c *C) {
 	c.Assert(Format(devicePath, "", key1, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
 	c.Assert(AddKey(devicePath, key1, key2, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
 
-	c.Check(KillSlot(devicePath, 1, key2), ErrorMatches, "cryptsetup failed with: No key available with this passphrase.")
+	c.Check(KillSlot(devicePath, 1, key2, nil), ErrorMatches, "cryptsetup failed with: No key available with this passphrase.")
 
 	luks2test.CheckLUKS2Passphrase(c, devicePath, key1)
 	luks2test.CheckLUKS2Passphrase(c, devicePath, key2)
@@ -954,7 +1288,7 @@ func (s *cryptsetupSuite) TestKillNonExistantSlot(c *C) {
 	options := FormatOptions{KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}}
 	c.Assert(Format(devicePath, "", key, &options), IsNil)
 
-	c.Check(KillSlot(devicePath, 8, key), ErrorMatches, "cryptsetup failed with: Keyslot 8 is not active.")
+	c.Check(KillSlot(devicePath, 8, key, nil), ErrorMatches, "cryptsetup failed with: Keyslot 8 is not active.")
 
 	luks2test.CheckLUKS2Passphrase(c, devicePath, key)
 }
@@ -979,7 +1313,7 @@ func (s *cryptsetupSuite) testSetSlotPriority(c *C, data *testSetSlotPriorityDat
 
 	s.cryptsetup.ForgetCalls()
 
-	c.Check(SetSlotPriority(devicePath, data.slotId, data.priority), IsNil)
+	c.Check(SetSlotPriority(devicePath, data.slotId, data.priority, nil), IsNil)
 
 	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{
 		{"cryptsetup", "config", "--priority", data.priority.String(), "--key-slot", strconv.Itoa(data.slotId), devicePath},
@@ -1009,3 +1343,212 @@ func (s *cryptsetupSuite) TestSetSlotPriority3(c *C) {
 		slotId:   1,
 		priority: SlotPriorityIgnore})
 }
+
+func (s *cryptsetupSuite) TestChangeKey(c *C) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	key1 := make([]byte, 32)
+	rand.Read(key1)
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+	key3 := make([]byte, 32)
+	rand.Read(key3)
+
+	kdfOptions := KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}
+	c.Assert(Format(devicePath, "", key1, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+	c.Assert(AddKey(devicePath, key1, key2, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+
+	s.cryptsetup.ForgetCalls()
+
+	c.Check(ChangeKey(devicePath, 1, key2, key3, &kdfOptions, nil), IsNil)
+
+	c.Assert(s.cryptsetup.Calls(), HasLen, 1)
+	call := s.cryptsetup.Calls()[0]
+	c.Assert(call, HasLen, 16)
+	c.Check(call[0:5], DeepEquals, []string{"cryptsetup", "luksChangeKey", "--type", "luks2", "--key-file"})
+	c.Check(call[5], Matches, filepath.Join(paths.RunDir, filepath.Base(os.Args[0]))+"\\.[0-9]+/fifo")
+	c.Check(call[6:], DeepEquals, []string{"--key-slot", "1", "--pbkdf", "argon2i", "--pbkdf-force-iterations", "4", "--pbkdf-memory", "32768", devicePath, "-"})
+
+	c.Check(TestKey(devicePath, 1, key3, nil), IsNil)
+	c.Check(TestKey(devicePath, 1, key2, nil), Equals, ErrIncorrectKey)
+	c.Check(TestKey(devicePath, 0, key1, nil), IsNil)
+}
+
+func (s *cryptsetupSuite) TestChangeKeyIncorrectKey(c *C) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	kdfOptions := KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}
+	c.Assert(Format(devicePath, "", key, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+
+	c.Check(ChangeKey(devicePath, 0, make([]byte, 32), make([]byte, 32), &kdfOptions, nil), Equals, ErrIncorrectKey)
+	c.Check(TestKey(devicePath, 0, key, nil), IsNil)
+}
+
+func (s *cryptsetupSuite) TestChangeKeyInvalidSlot(c *C) {
+	c.Check(ChangeKey("/dev/sda1", AnySlot, nil, nil, nil, nil), ErrorMatches, "invalid slot")
+}
+
+type testTestKeyData struct {
+	slot int
+}
+
+func (s *cryptsetupSuite) testTestKey(c *C, data *testTestKeyData) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	key1 := make([]byte, 32)
+	rand.Read(key1)
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+
+	kdfOptions := KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}
+	c.Assert(Format(devicePath, "", key1, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+	c.Assert(AddKey(devicePath, key1, key2, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+
+	s.cryptsetup.ForgetCalls()
+
+	c.Check(TestKey(devicePath, data.slot, key2, nil), IsNil)
+
+	expectedArgs := []string{"cryptsetup", "open", "--test-passphrase", "--type", "luks2", "--key-file", "-"}
+	if data.slot != AnySlot {
+		expectedArgs = append(expectedArgs, "--key-slot", strconv.Itoa(data.slot))
+	}
+	expectedArgs = append(expectedArgs, devicePath)
+	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{expectedArgs})
+}
+
+func (s *cryptsetupSuite) TestTestKeyAnySlot(c *C) {
+	s.testTestKey(c, &testTestKeyData{slot: AnySlot})
+}
+
+func (s *cryptsetupSuite) TestTestKeySpecificSlot(c *C) {
+	s.testTestKey(c, &testTestKeyData{slot: 1})
+}
+
+func (s *cryptsetupSuite) TestTestKeyIncorrectKey(c *C) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	options := FormatOptions{KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}}
+	c.Assert(Format(devicePath, "", key, &options), IsNil)
+
+	c.Check(TestKey(devicePath, AnySlot, make([]byte, 32), nil), Equals, ErrIncorrectKey)
+}
+
+func (s *cryptsetupSuite) TestTestKeyWrongSlot(c *C) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	key1 := make([]byte, 32)
+	rand.Read(key1)
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+
+	kdfOptions := KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}
+	c.Assert(Format(devicePath, "", key1, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+	c.Assert(AddKey(devicePath, key1, key2, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+
+	c.Check(TestKey(devicePath, 0, key2, nil), Equals, ErrIncorrectKey)
+}
+
+func (s *cryptsetupSuite) TestTestKeyNoDevice(c *C) {
+	err := TestKey(filepath.Join(c.MkDir(), "foo"), AnySlot, make([]byte, 32), nil)
+	c.Check(err, ErrorMatches, "cryptsetup failed with: .*")
+	c.Check(err, Not(Equals), ErrIncorrectKey)
+}
+
+func (s *cryptsetupSuite) TestBackupAndRestoreHeader(c *C) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	key1 := make([]byte, 32)
+	rand.Read(key1)
+	key2 := make([]byte, 32)
+	rand.Read(key2)
+
+	kdfOptions := KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}
+	c.Assert(Format(devicePath, "", key1, &FormatOptions{KDFOptions: kdfOptions}), IsNil)
+
+	backupFile := filepath.Join(c.MkDir(), "header")
+
+	s.cryptsetup.ForgetCalls()
+	c.Check(BackupHeader(devicePath, backupFile, nil), IsNil)
+	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "luksHeaderBackup", "--header-backup-file", backupFile, devicePath},
+	})
+
+	expected, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	backup, err := ReadHeader(backupFile, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(backup.UUID, Equals, expected.UUID)
+
+	// Modify the keyslots after taking the backup.
+	c.Assert(AddKey(devicePath, key1, key2, &AddKeyOptions{KDFOptions: kdfOptions, Slot: AnySlot}), IsNil)
+	c.Assert(KillSlot(devicePath, 0, key2, nil), IsNil)
+
+	s.cryptsetup.ForgetCalls()
+	c.Check(RestoreHeader(devicePath, backupFile, nil), IsNil)
+	c.Check(s.cryptsetup.Calls(), DeepEquals, [][]string{
+		{"cryptsetup", "luksHeaderRestore", "--batch-mode", "--type", "luks2", "--header-backup-file", backupFile, devicePath},
+	})
+
+	info, err := ReadHeader(devicePath, LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(info.UUID, Equals, expected.UUID)
+	c.Check(info.Metadata.Keyslots, HasLen, 1)
+	_, ok := info.Metadata.Keyslots[0]
+	c.Check(ok, Equals, true)
+
+	luks2test.CheckLUKS2Passphrase(c, devicePath, key1)
+}
+
+func (s *cryptsetupSuite) TestBackupHeaderFileExists(c *C) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	options := FormatOptions{KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}}
+	c.Assert(Format(devicePath, "", make([]byte, 32), &options), IsNil)
+
+	backupFile := filepath.Join(c.MkDir(), "header")
+	c.Assert(ioutil.WriteFile(backupFile, nil, 0600), IsNil)
+
+	c.Check(BackupHeader(devicePath, backupFile, nil), ErrorMatches, "cryptsetup failed with: .*")
+}
+
+func (s *cryptsetupSuite) TestIsLUKS2(c *C) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	options := FormatOptions{KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}}
+	c.Assert(Format(devicePath, "", make([]byte, 32), &options), IsNil)
+
+	isLUKS2, err := IsLUKS2(devicePath, nil)
+	c.Check(err, IsNil)
+	c.Check(isLUKS2, Equals, true)
+}
+
+func (s *cryptsetupSuite) TestIsLUKS2Unformatted(c *C) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	isLUKS2, err := IsLUKS2(devicePath, nil)
+	c.Check(err, IsNil)
+	c.Check(isLUKS2, Equals, false)
+}
+
+func (s *cryptsetupSuite) TestIsLUKS2Missing(c *C) {
+	_, err := IsLUKS2(filepath.Join(c.MkDir(), "disk.img"), nil)
+	c.Check(err, ErrorMatches, "cannot access device: .*")
+}
+
+func (s *cryptsetupSuite) TestRestoreHeaderInvalidBackup(c *C) {
+	devicePath := luks2test.CreateEmptyDiskImage(c, 20)
+
+	options := FormatOptions{KDFOptions: KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 4}}
+	c.Assert(Format(devicePath, "", make([]byte, 32), &options), IsNil)
+
+	backupFile := filepath.Join(c.MkDir(), "header")
+	c.Assert(ioutil.WriteFile(backupFile, make([]byte, 4096), 0600), IsNil)
+
+	c.Check(RestoreHeader(devicePath, backupFile, nil), ErrorMatches, "cryptsetup failed with: .*")
+}
@@ -70,6 +70,22 @@ func MockDataDeviceInfo(stMock *unix.Stat_t) (restore func()) {
 	}
 }
 
+func MockDevMapperDir(path string) (restore func()) {
+	origDevMapperDir := devMapperDir
+	devMapperDir = path
+	return func() {
+		devMapperDir = origDevMapperDir
+	}
+}
+
+func MockSysBlockDir(path string) (restore func()) {
+	origSysBlockDir := sysBlockDir
+	sysBlockDir = path
+	return func() {
+		sysBlockDir = origSysBlockDir
+	}
+}
+
 func MockSystemdCryptsetupPath(path string) (restore func()) {
 	origSystemdCryptsetupPath := systemdCryptsetupPath
 	systemdCryptsetupPath = path
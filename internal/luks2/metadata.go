@@ -295,9 +295,14 @@ func (h Hash) GetHash() crypto.Hash {
 type KeyslotType string
 
 const (
-	KeyslotTypeLUKS2 KeyslotType = "luks2"
+	KeyslotTypeLUKS2     KeyslotType = "luks2"
+	KeyslotTypeReencrypt KeyslotType = "reencrypt"
 )
 
+// requirementOnlineReencryptPrefix is the prefix of the mandatory requirement
+// added to the config object of a LUKS2 volume whilst it is being reencrypted.
+const requirementOnlineReencryptPrefix = "online-reencrypt"
+
 type TokenType string
 
 const (
@@ -327,6 +332,12 @@ func (l label) String() string {
 
 type csumAlg [32]byte
 
+// nulTerminatedString returns the string contained in the supplied
+// NUL-padded byte slice.
+func nulTerminatedString(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
 func (a csumAlg) GetHash() crypto.Hash {
 	return Hash(strings.TrimRight(string(a[:]), "\x00")).GetHash()
 }
@@ -365,7 +376,7 @@ type Config struct {
 	JSONSize     uint64   // Size of the JSON area, in bytes
 	KeyslotsSize uint64   // Size of the keyslots area, in bytes
 	Flags        []string // Optional flags
-	Requirements []string // Optional required features
+	Requirements []string // Optional mandatory required features
 }
 
 func (c *Config) UnmarshalJSON(data []byte) error {
@@ -373,7 +384,9 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 		JSONSize     JsonNumber `json:"json_size"`
 		KeyslotsSize JsonNumber `json:"keyslots_size"`
 		Flags        []string
-		Requirements []string
+		Requirements struct {
+			Mandatory []string
+		}
 	}
 	if err := json.Unmarshal(data, &d); err != nil {
 		return err
@@ -381,7 +394,7 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 
 	*c = Config{
 		Flags:        d.Flags,
-		Requirements: d.Requirements}
+		Requirements: d.Requirements.Mandatory}
 	jsonSize, err := d.JSONSize.Uint64()
 	if err != nil {
 		return xerrors.Errorf("invalid json_size value: %w", err)
@@ -723,6 +736,22 @@ type Metadata struct {
 	Config   Config           // Config object
 }
 
+// ReencryptionInProgress indicates whether the LUKS2 volume is in the process
+// of being reencrypted.
+func (m *Metadata) ReencryptionInProgress() bool {
+	for _, r := range m.Config.Requirements {
+		if strings.HasPrefix(r, requirementOnlineReencryptPrefix) {
+			return true
+		}
+	}
+	for _, k := range m.Keyslots {
+		if k.Type == KeyslotTypeReencrypt {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Metadata) UnmarshalJSON(data []byte) error {
 	var d struct {
 		Keyslots map[JsonNumber]*Keyslot
@@ -792,9 +821,34 @@ func (m *Metadata) UnmarshalJSON(data []byte) error {
 type HeaderInfo struct {
 	HeaderSize uint64   // The total size of the binary header and JSON metadata in bytes
 	Label      string   // The label
+	UUID       string   // The UUID
+	Subsystem  string   // The subsystem label
 	Metadata   Metadata // JSON metadata
 }
 
+var (
+	errInvalidMagic   = errors.New("invalid magic")
+	errInvalidVersion = errors.New("invalid version")
+)
+
+// NoHeaderError is returned from ReadHeader if the specified path doesn't
+// contain a LUKS2 header.
+type NoHeaderError struct {
+	err error
+}
+
+func (e *NoHeaderError) Error() string {
+	return e.err.Error()
+}
+
+func (e *NoHeaderError) Unwrap() error {
+	return e.err
+}
+
+func isNoHeaderErr(err error) bool {
+	return err == errInvalidMagic || err == errInvalidVersion
+}
+
 func decodeAndCheckHeader(r io.ReadSeeker, offset int64, primary bool) (*binaryHdr, *bytes.Buffer, error) {
 	if _, err := r.Seek(offset, io.SeekStart); err != nil {
 		return nil, nil, err
@@ -808,10 +862,10 @@ func decodeAndCheckHeader(r io.ReadSeeker, offset int64, primary bool) (*binaryH
 	case primary && bytes.Equal(hdr.Magic[:], []byte("LUKS\xba\xbe")):
 	case !primary && bytes.Equal(hdr.Magic[:], []byte("SKUL\xba\xbe")):
 	default:
-		return nil, nil, errors.New("invalid magic")
+		return nil, nil, errInvalidMagic
 	}
 	if hdr.Version != 2 {
-		return nil, nil, errors.New("invalid version")
+		return nil, nil, errInvalidVersion
 	}
 	if hdr.HdrSize > uint64(math.MaxInt64) {
 		return nil, nil, errors.New("header size too large")
@@ -956,12 +1010,18 @@ func ReadHeader(path string, lockMode LockMode) (*HeaderInfo, error) {
 		fmt.Fprintf(stderr, "luks2.ReadHeader: primary header for %s is invalid: %v\n", path, primaryErr)
 	default:
 		// No valid headers :(
-		return nil, xerrors.Errorf("no valid header found, error from decoding primary header: %w", primaryErr)
+		err := xerrors.Errorf("no valid header found, error from decoding primary header: %w", primaryErr)
+		if isNoHeaderErr(primaryErr) && isNoHeaderErr(secondaryErr) {
+			return nil, &NoHeaderError{err: err}
+		}
+		return nil, err
 	}
 
 	return &HeaderInfo{
 		HeaderSize: hdr.HdrSize,
 		Label:      hdr.Label.String(),
+		UUID:       nulTerminatedString(hdr.Uuid[:]),
+		Subsystem:  nulTerminatedString(hdr.Subsystem[:]),
 		Metadata:   *metadata}, nil
 }
 
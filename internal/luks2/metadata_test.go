@@ -283,6 +283,45 @@ func (s *metadataSuite) TestMarshalGenericToken2(c *C) {
 	})
 }
 
+func (s *metadataSuite) TestUnmarshalMetadataReencryptionInProgress(c *C) {
+	data := []byte(`{
+	"keyslots": {},
+	"tokens": {},
+	"segments": {},
+	"digests": {},
+	"config": {
+		"json_size": "12288",
+		"keyslots_size": "16744448",
+		"requirements": {
+			"mandatory": ["online-reencrypt-v2"]
+		}
+	}
+}`)
+
+	var metadata Metadata
+	c.Assert(json.Unmarshal(data, &metadata), IsNil)
+	c.Check(metadata.Config.Requirements, DeepEquals, []string{"online-reencrypt-v2"})
+	c.Check(metadata.ReencryptionInProgress(), Equals, true)
+}
+
+func (s *metadataSuite) TestUnmarshalMetadataNoReencryption(c *C) {
+	data := []byte(`{
+	"keyslots": {},
+	"tokens": {},
+	"segments": {},
+	"digests": {},
+	"config": {
+		"json_size": "12288",
+		"keyslots_size": "16744448"
+	}
+}`)
+
+	var metadata Metadata
+	c.Assert(json.Unmarshal(data, &metadata), IsNil)
+	c.Check(metadata.Config.Requirements, HasLen, 0)
+	c.Check(metadata.ReencryptionInProgress(), Equals, false)
+}
+
 type testReadHeaderData struct {
 	path             string
 	hdrSize          uint64
@@ -440,12 +479,26 @@ func (s *metadataSuite) TestReadHeaderInvalidMagic(c *C) {
 	// Test where both headers have invalid magic values to check we get the right error.
 	_, err := ReadHeader(s.decompress(c, "testdata/luks2-hdr-invalid-magic-both.img"), LockModeBlocking)
 	c.Check(err, ErrorMatches, "no valid header found, error from decoding primary header: invalid magic")
+	c.Check(err, FitsTypeOf, &NoHeaderError{})
 }
 
 func (s *metadataSuite) TestReadHeaderInvalidVersion(c *C) {
 	// Test where both headers have an invalid version to check we get the right error.
 	_, err := ReadHeader(s.decompress(c, "testdata/luks2-hdr-invalid-version-both.img"), LockModeBlocking)
 	c.Check(err, ErrorMatches, "no valid header found, error from decoding primary header: invalid version")
+	c.Check(err, FitsTypeOf, &NoHeaderError{})
+}
+
+func (s *metadataSuite) TestReadHeaderUUIDAndSubsystem(c *C) {
+	hdr, err := ReadHeader(s.decompress(c, "testdata/luks2-valid-hdr.img"), LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(hdr.UUID, Equals, "6503ce5c-c2fb-49e9-a560-71928d8ded0e")
+	c.Check(hdr.Subsystem, Equals, "")
+
+	hdr, err = ReadHeader(s.decompress(c, "testdata/luks2-valid-hdr2.img"), LockModeBlocking)
+	c.Assert(err, IsNil)
+	c.Check(hdr.UUID, Equals, "971ccc5f-5843-445b-9cac-65234c203543")
+	c.Check(hdr.Subsystem, Equals, "")
 }
 
 func (s *metadataSuite) TestReadHeaderWithExternalToken(c *C) {
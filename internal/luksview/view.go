@@ -115,6 +115,12 @@ func (v *View) Reread() error {
 	return nil
 }
 
+// ReencryptionInProgress indicates whether the container associated with
+// this view is in the process of being reencrypted.
+func (v *View) ReencryptionInProgress() bool {
+	return v.hdr.Metadata.ReencryptionInProgress()
+}
+
 // TokenNames returns a sorted list of all of the keyslot names from this view.
 // This doesn't return names associated with tokens that have been orphaned
 // because their associated keyslot has been deleted.
@@ -200,3 +206,13 @@ func (v *View) UsedKeyslots() (slots []int) {
 	sort.Ints(slots)
 	return slots
 }
+
+// KeyslotPriority returns the priority of the keyslot with the specified id.
+// If the keyslot isn't active, false will be returned.
+func (v *View) KeyslotPriority(slot int) (priority luks2.SlotPriority, exists bool) {
+	keyslot, exists := v.hdr.Metadata.Keyslots[slot]
+	if !exists {
+		return 0, false
+	}
+	return keyslot.Priority, true
+}
@@ -52,7 +52,7 @@ func (s mockHeaderSource) ReadHeader() (*luks2.HeaderInfo, error) {
 var testHeader = mockHeaderSource(luks2.HeaderInfo{
 	Metadata: luks2.Metadata{
 		Keyslots: map[int]*luks2.Keyslot{
-			0: new(luks2.Keyslot),
+			0: &luks2.Keyslot{Priority: luks2.SlotPriorityHigh},
 			1: new(luks2.Keyslot),
 			2: new(luks2.Keyslot),
 			3: new(luks2.Keyslot),
@@ -166,6 +166,22 @@ func (s *viewSuite) TestViewUsedKeyslots(c *C) {
 	c.Check(view.UsedKeyslots(), DeepEquals, []int{0, 1, 2, 3, 4, 5})
 }
 
+func (s *viewSuite) TestViewKeyslotPriority(c *C) {
+	view, err := NewViewFromCustomHeaderSource(testHeader)
+	c.Assert(err, IsNil)
+
+	priority, exists := view.KeyslotPriority(0)
+	c.Check(priority, Equals, luks2.SlotPriorityHigh)
+	c.Check(exists, testutil.IsTrue)
+
+	priority, exists = view.KeyslotPriority(1)
+	c.Check(priority, Equals, luks2.SlotPriorityIgnore)
+	c.Check(exists, testutil.IsTrue)
+
+	_, exists = view.KeyslotPriority(6)
+	c.Check(exists, Not(testutil.IsTrue))
+}
+
 func (s *viewSuite) TestNewView(c *C) {
 	if luks2.DetectCryptsetupFeatures()&luks2.FeatureTokenImport == 0 {
 		c.Skip("cryptsetup doesn't support token import")
@@ -249,7 +265,7 @@ func (s *viewSuite) TestViewReread(c *C) {
 			TokenName:    "foo",
 			TokenKeyslot: 2}}
 	c.Check(luks2.ImportToken(path, token2, nil), IsNil)
-	c.Check(luks2.KillSlot(path, 2, make([]byte, 32)), IsNil)
+	c.Check(luks2.KillSlot(path, 2, make([]byte, 32), nil), IsNil)
 
 	c.Check(view.Reread(), IsNil)
 
@@ -31,6 +31,7 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"time"
 
 	drbg "github.com/canonical/go-sp800.90a-drbg"
 
@@ -39,6 +40,8 @@ import (
 )
 
 const (
+	keyDataVersion = 2 // the current version of the serialized key data
+
 	kdfType                 = "argon2i"
 	passphraseDerivedKeyLen = 32
 	passphraseEncryption    = "aes-cfb"
@@ -46,6 +49,8 @@ const (
 
 var (
 	snapModelHMACKDFLabel = []byte("SNAP-MODEL-HMAC")
+
+	timeNow = time.Now
 )
 
 // ErrNoPlatformHandlerRegistered is returned from KeyData methods if no
@@ -71,6 +76,17 @@ func (e *InvalidKeyDataError) Unwrap() error {
 	return e.err
 }
 
+// IncompatibleKeyDataVersionError is returned from ReadKeyData and
+// KeyData.UnmarshalJSON if the key data has a version that is newer than
+// is supported by this package.
+type IncompatibleKeyDataVersionError struct {
+	Version int
+}
+
+func (e *IncompatibleKeyDataVersionError) Error() string {
+	return fmt.Sprintf("unsupported key data version %d", e.Version)
+}
+
 // PlatformUninitializedError is returned from KeyData methods if the
 // platform's secure device has not been initialized properly.
 type PlatformUninitializedError struct {
@@ -85,6 +101,10 @@ func (e *PlatformUninitializedError) Unwrap() error {
 	return e.err
 }
 
+// ErrPlatformDeviceUnavailable can be used with xerrors.Is to test whether
+// an error is or wraps a *PlatformDeviceUnavailableError.
+var ErrPlatformDeviceUnavailable = errors.New("the platform's secure device is unavailable")
+
 // PlatformDeviceUnavailableError is returned from KeyData methods if the
 // platform's secure device is currently unavailable.
 type PlatformDeviceUnavailableError struct {
@@ -99,13 +119,35 @@ func (e *PlatformDeviceUnavailableError) Unwrap() error {
 	return e.err
 }
 
+func (e *PlatformDeviceUnavailableError) Is(target error) bool {
+	return target == ErrPlatformDeviceUnavailable
+}
+
 // DiskUnlockKey is the key used to unlock a LUKS volume.
 type DiskUnlockKey []byte
 
+// Wipe overwrites the contents of this key with zeroes. This should be called
+// once the key is no longer required so that it doesn't linger in memory.
+func (k DiskUnlockKey) Wipe() {
+	wipeBytes(k)
+}
+
 // AuxiliaryKey is an additional key used to modify properties of a KeyData
 // object without having to create a new object.
 type AuxiliaryKey []byte
 
+// Wipe overwrites the contents of this key with zeroes. This should be called
+// once the key is no longer required so that it doesn't linger in memory.
+func (k AuxiliaryKey) Wipe() {
+	wipeBytes(k)
+}
+
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 // KeyPayload is the payload that should be encrypted by a platform's secure device.
 type KeyPayload []byte
 
@@ -173,6 +215,16 @@ type KeyCreationData struct {
 	// device models, and also the digest algorithm used to produce the
 	// key digest.
 	SnapModelAuthHash crypto.Hash
+
+	// Description is an optional free-form description of the key data,
+	// which is stored in the key data to aid debugging.
+	Description string
+
+	// UnlockKeySize is the length of the disk unlock key protected inside
+	// EncryptedPayload. This is optional, and is recorded in the key data
+	// so that it can be obtained without using the platform's secure
+	// device.
+	UnlockKeySize int
 }
 
 // KeyID is the unique ID for a KeyData object. It is used to facilitate the
@@ -255,6 +307,10 @@ func (l snapModelHMACList) contains(h snapModelHMAC) bool {
 	return false
 }
 
+// DefaultSnapModelRole is the role used for the authorized Snap models by
+// KeyData.SetAuthorizedSnapModels and KeyData.IsSnapModelAuthorized.
+const DefaultSnapModelRole = ""
+
 // keyDigest contains a salted digest to verify the correctness of a key.
 type keyDigest struct {
 	Alg    hashAlg `json:"alg"`
@@ -273,6 +329,17 @@ type authorizedSnapModelsRaw struct {
 	KDF       *hkdfData         `json:"kdf,omitempty"`
 	KeyDigest json.RawMessage   `json:"key_digest"`
 	Hmacs     snapModelHMACList `json:"hmacs"`
+
+	Models []AuthorizedSnapModel `json:"models,omitempty"`
+
+	Roles map[string]*authorizedSnapModelSet `json:"roles,omitempty"`
+}
+
+// authorizedSnapModelSet contains the HMACs and identities of the Snap models
+// that are authorized for a named role other than DefaultSnapModelRole.
+type authorizedSnapModelSet struct {
+	Hmacs  snapModelHMACList     `json:"hmacs"`
+	Models []AuthorizedSnapModel `json:"models,omitempty"`
 }
 
 // authorizedSnapModels defines the Snap models that have been
@@ -283,6 +350,15 @@ type authorizedSnapModels struct {
 	keyDigest keyDigest         // information used to validate the correctness of the HMAC key
 	hmacs     snapModelHMACList // the list of HMACs of authorized models
 
+	// models contains the identities of the authorized models, in the
+	// same order as hmacs. This is informational only and is not used
+	// for authorization. It is nil for older key data.
+	models []AuthorizedSnapModel
+
+	// roles contains the models authorized for each named role other than
+	// DefaultSnapModelRole, which uses hmacs and models.
+	roles map[string]*authorizedSnapModelSet
+
 	// legacyKeyDigest is true when keyDigest should be marshalled
 	// as a plain key rather than a keyDigest object.
 	legacyKeyDigest bool
@@ -306,7 +382,9 @@ func (m authorizedSnapModels) MarshalJSON() ([]byte, error) {
 		Alg:       m.alg,
 		KDF:       m.kdf,
 		KeyDigest: digest,
-		Hmacs:     m.hmacs})
+		Hmacs:     m.hmacs,
+		Models:    m.models,
+		Roles:     m.roles})
 }
 
 // UnmarshalJSON implements custom unmarshalling to handle older key data
@@ -318,9 +396,11 @@ func (m *authorizedSnapModels) UnmarshalJSON(b []byte) error {
 	}
 
 	*m = authorizedSnapModels{
-		alg:   raw.Alg,
-		kdf:   raw.KDF,
-		hmacs: raw.Hmacs}
+		alg:    raw.Alg,
+		kdf:    raw.KDF,
+		hmacs:  raw.Hmacs,
+		models: raw.Models,
+		roles:  raw.Roles}
 
 	token, err := json.NewDecoder(bytes.NewReader(raw.KeyDigest)).Token()
 	switch {
@@ -383,8 +463,26 @@ type passphraseData struct {
 }
 
 type keyData struct {
+	// Version is the version of the serialized format. Key data created by
+	// older versions of this package don't have this field, and these are
+	// treated as version 1. Version 2 requires that the authorized snap
+	// models key digest is serialized as an object.
+	Version int `json:"version,omitempty"`
+
 	PlatformName string `json:"platform_name"` // used to identify a PlatformKeyDataHandler
 
+	// CreationTime is the time that this key data was created. This is
+	// not set for key data created by older versions of this package.
+	CreationTime *time.Time `json:"creation_time,omitempty"`
+
+	// Description is an optional free-form description of this key data.
+	Description string `json:"description,omitempty"`
+
+	// UnlockKeySize is the length of the protected disk unlock key. This
+	// is not set for key data created by older versions of this package
+	// or by platforms that don't supply it.
+	UnlockKeySize int `json:"unlock_key_size,omitempty"`
+
 	// PlatformHandle is an opaque blob of data used by the associated
 	// PlatformKeyDataHandler to recover the cleartext keys from one of
 	// the encrypted payloads.
@@ -579,6 +677,139 @@ func (d *KeyData) ReadableName() string {
 	return d.readableName
 }
 
+// Version returns the version of the serialized format of this key data.
+func (d *KeyData) Version() int {
+	return d.data.version()
+}
+
+// PlatformName returns the name of the platform that produced this key data,
+// which is used to identify the associated PlatformKeyDataHandler.
+func (d *KeyData) PlatformName() string {
+	return d.data.PlatformName
+}
+
+// CreationTime returns the time that this key data was created. This returns
+// the zero time for key data created by older versions of this package, which
+// didn't record it.
+func (d *KeyData) CreationTime() time.Time {
+	if d.data.CreationTime == nil {
+		return time.Time{}
+	}
+	return *d.data.CreationTime
+}
+
+// Description returns the free-form description of this key data that was
+// supplied when it was created, if any.
+func (d *KeyData) Description() string {
+	return d.data.Description
+}
+
+// UnlockKeySize returns the length of the disk unlock key that will be
+// recovered from this key data, without using the platform's secure device.
+// This returns 0 if the length isn't known, which is the case for key data
+// created by older versions of this package or by platforms that don't
+// supply it.
+func (d *KeyData) UnlockKeySize() int {
+	return d.data.UnlockKeySize
+}
+
+// validateSnapModelHMACs checks that the supplied list of authorized model HMACs
+// and the corresponding model identities are consistent with the supplied
+// digest algorithm.
+func validateSnapModelHMACs(alg hashAlg, hmacs snapModelHMACList, models []AuthorizedSnapModel) error {
+	for i, h := range hmacs {
+		if len(h) != alg.Size() {
+			return fmt.Errorf("HMAC %d has an invalid length", i)
+		}
+	}
+	if len(models) > 0 && len(models) != len(hmacs) {
+		return errors.New("inconsistent number of model identities")
+	}
+	return nil
+}
+
+// validate checks the structural invariants of this key data.
+func (d *KeyData) validate() error {
+	if d.data.PlatformName == "" {
+		return errors.New("no platform name")
+	}
+	if len(d.data.PlatformHandle) == 0 || bytes.Equal(d.data.PlatformHandle, []byte("null")) {
+		return errors.New("no platform handle")
+	}
+	if d.data.UnlockKeySize < 0 {
+		return errors.New("invalid unlock key size")
+	}
+
+	switch {
+	case len(d.data.EncryptedPayload) > 0 && d.data.PassphraseProtectedPayload != nil:
+		return errors.New("both encrypted_payload and passphrase_protected_payload are set")
+	case len(d.data.EncryptedPayload) > 0:
+		// ok
+	case d.data.PassphraseProtectedPayload != nil:
+		data := d.data.PassphraseProtectedPayload
+		if data.KDF.Type != kdfType {
+			return fmt.Errorf("unexpected KDF type \"%s\"", data.KDF.Type)
+		}
+		if len(data.KDF.Salt) == 0 {
+			return errors.New("no KDF salt")
+		}
+		if data.Encryption != passphraseEncryption {
+			return fmt.Errorf("unexpected encryption algorithm \"%s\"", data.Encryption)
+		}
+		if data.KeySize != passphraseDerivedKeyLen {
+			return fmt.Errorf("unexpected key size %d", data.KeySize)
+		}
+		if len(data.EncryptedPayload) == 0 {
+			return errors.New("no passphrase protected payload")
+		}
+	default:
+		return errors.New("no encrypted payload")
+	}
+
+	m := d.data.AuthorizedSnapModels
+	if !m.alg.Available() {
+		return errors.New("invalid snap model digest algorithm")
+	}
+	if m.kdf != nil && !m.kdf.Alg.Available() {
+		return errors.New("invalid snap model auth key KDF digest algorithm")
+	}
+	if !m.keyDigest.Alg.Available() {
+		return errors.New("invalid snap model auth key digest algorithm")
+	}
+	if len(m.keyDigest.Digest) != m.keyDigest.Alg.Size() {
+		return errors.New("snap model auth key digest has an invalid length")
+	}
+	if err := validateSnapModelHMACs(m.alg, m.hmacs, m.models); err != nil {
+		return xerrors.Errorf("invalid authorized snap models: %w", err)
+	}
+	for role, set := range m.roles {
+		if set == nil {
+			return fmt.Errorf("invalid authorized snap models for role \"%s\"", role)
+		}
+		if err := validateSnapModelHMACs(m.alg, set.Hmacs, set.Models); err != nil {
+			return xerrors.Errorf("invalid authorized snap models for role \"%s\": %w", role, err)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the structural integrity of this key data without requiring
+// access to the platform's secure device or any of the keys. It checks that the
+// platform handle and encrypted payload are present, that the passphrase
+// parameters are supported, and that the data used to authorize snap models is
+// self-consistent. This makes it possible to reject corrupted key data before it
+// is needed.
+//
+// An error returned from this function will be a *InvalidKeyDataError. Note that
+// a successful result doesn't guarantee that the keys can be recovered.
+func (d *KeyData) Validate() error {
+	if err := d.validate(); err != nil {
+		return &InvalidKeyDataError{err}
+	}
+	return nil
+}
+
 // UniqueID returns the unique ID for this key data.
 func (d *KeyData) UniqueID() (KeyID, error) {
 	h := crypto.SHA256.New()
@@ -658,9 +889,9 @@ func (d *KeyData) RecoverKeys() (DiskUnlockKey, AuxiliaryKey, error) {
 		return nil, nil, processPlatformHandlerError(err)
 	}
 
-	key, auxKey, err := c.Unmarshal()
+	key, auxKey, err := d.unmarshalKeys(c)
 	if err != nil {
-		return nil, nil, &InvalidKeyDataError{xerrors.Errorf("cannot unmarshal cleartext key payload: %w", err)}
+		return nil, nil, &InvalidKeyDataError{err}
 	}
 
 	return key, auxKey, nil
@@ -689,19 +920,80 @@ func (d *KeyData) RecoverKeysWithPassphrase(passphrase string, kdf KDF) (DiskUnl
 		return nil, nil, processPlatformHandlerError(err)
 	}
 
+	key, auxKey, err := d.unmarshalKeys(c)
+	if err != nil {
+		return nil, nil, &InvalidKeyDataError{err}
+	}
+
+	return key, auxKey, nil
+}
+
+// unmarshalKeys obtains the keys from the supplied cleartext payload, and
+// checks that the disk unlock key has the length recorded in this key data.
+func (d *KeyData) unmarshalKeys(c KeyPayload) (DiskUnlockKey, AuxiliaryKey, error) {
 	key, auxKey, err := c.Unmarshal()
 	if err != nil {
-		return nil, nil, &InvalidKeyDataError{xerrors.Errorf("cannot unmarshal cleartext key payload: %w", err)}
+		return nil, nil, xerrors.Errorf("cannot unmarshal cleartext key payload: %w", err)
+	}
+	if d.data.UnlockKeySize > 0 && len(key) != d.data.UnlockKeySize {
+		return nil, nil, fmt.Errorf("unexpected unlock key size (got %d bytes, expected %d bytes)", len(key), d.data.UnlockKeySize)
 	}
 
 	return key, auxKey, nil
 }
 
+// authorizedSnapModelsForRole returns the HMACs and identities of the Snap models
+// that are authorized for the specified role.
+func (d *KeyData) authorizedSnapModelsForRole(role string) (snapModelHMACList, []AuthorizedSnapModel) {
+	m := d.data.AuthorizedSnapModels
+	if role == DefaultSnapModelRole {
+		return m.hmacs, m.models
+	}
+	set, ok := m.roles[role]
+	if !ok {
+		return nil, nil
+	}
+	return set.Hmacs, set.Models
+}
+
+// setAuthorizedSnapModelsForRole updates the HMACs and identities of the Snap
+// models that are authorized for the specified role.
+func (d *KeyData) setAuthorizedSnapModelsForRole(role string, hmacs snapModelHMACList, models []AuthorizedSnapModel) {
+	m := &d.data.AuthorizedSnapModels
+	switch {
+	case role == DefaultSnapModelRole:
+		m.hmacs = hmacs
+		m.models = models
+	case len(hmacs) == 0:
+		delete(m.roles, role)
+		if len(m.roles) == 0 {
+			m.roles = nil
+		}
+	default:
+		if m.roles == nil {
+			m.roles = make(map[string]*authorizedSnapModelSet)
+		}
+		m.roles[role] = &authorizedSnapModelSet{Hmacs: hmacs, Models: models}
+	}
+}
+
 // IsSnapModelAuthorized indicates whether the supplied Snap device model is trusted to
-// access the data on the encrypted volume protected by this key data.
+// access the data on the encrypted volume protected by this key data. This checks the
+// models authorized for DefaultSnapModelRole.
 //
 // The supplied auxKey is obtained using one of the RecoverKeys* functions.
 func (d *KeyData) IsSnapModelAuthorized(auxKey AuxiliaryKey, model SnapModel) (bool, error) {
+	return d.IsSnapModelAuthorizedForRole(auxKey, DefaultSnapModelRole, model)
+}
+
+// IsSnapModelAuthorizedForRole indicates whether the supplied Snap device model is
+// trusted to access the data on the encrypted volume protected by this key data for
+// the specified role. Models are authorized for a role using
+// SetAuthorizedSnapModelsForRole. No models are authorized for a role that has not
+// been set.
+//
+// The supplied auxKey is obtained using one of the RecoverKeys* functions.
+func (d *KeyData) IsSnapModelAuthorizedForRole(auxKey AuxiliaryKey, role string, model SnapModel) (bool, error) {
 	hmacKey, err := d.snapModelAuthKey(auxKey)
 	if err != nil {
 		return false, xerrors.Errorf("cannot obtain auth key: %w", err)
@@ -717,12 +1009,37 @@ func (d *KeyData) IsSnapModelAuthorized(auxKey AuxiliaryKey, model SnapModel) (b
 		return false, xerrors.Errorf("cannot compute HMAC of model: %w", err)
 	}
 
-	return d.data.AuthorizedSnapModels.hmacs.contains(h), nil
+	hmacs, _ := d.authorizedSnapModelsForRole(role)
+	return hmacs.contains(h), nil
+}
+
+// validatedSnapModelAuthKey derives the key used for the HMACs of authorized
+// Snap models from the supplied auxiliary key, and checks it against the digest
+// stored in this key data.
+func (d *KeyData) validatedSnapModelAuthKey(auxKey AuxiliaryKey) ([]byte, error) {
+	hmacKey, err := d.snapModelAuthKey(auxKey)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain auth key: %w", err)
+	}
+
+	alg := d.data.AuthorizedSnapModels.keyDigest.Alg
+	if !alg.Available() {
+		return nil, errors.New("invalid digest algorithm")
+	}
+
+	h := alg.New()
+	h.Write(hmacKey)
+	h.Write(d.data.AuthorizedSnapModels.keyDigest.Salt)
+	if !bytes.Equal(h.Sum(nil), d.data.AuthorizedSnapModels.keyDigest.Digest) {
+		return nil, errors.New("incorrect key supplied")
+	}
+
+	return hmacKey, nil
 }
 
 // SetAuthorizedSnapModels marks the supplied Snap device models as trusted to access
 // the data on the encrypted volume protected by this key data. This function replaces all
-// previously trusted models.
+// previously trusted models for DefaultSnapModelRole.
 //
 // This makes changes to the key data, which will need to persisted afterwards using
 // WriteAtomic.
@@ -730,43 +1047,115 @@ func (d *KeyData) IsSnapModelAuthorized(auxKey AuxiliaryKey, model SnapModel) (b
 // The supplied auxKey is obtained using one of the RecoverKeys* functions. If the
 // supplied auxKey is incorrect, then an error will be returned.
 func (d *KeyData) SetAuthorizedSnapModels(auxKey AuxiliaryKey, models ...SnapModel) error {
-	hmacKey, err := d.snapModelAuthKey(auxKey)
+	return d.SetAuthorizedSnapModelsForRole(auxKey, DefaultSnapModelRole, models...)
+}
+
+// SetAuthorizedSnapModelsForRole marks the supplied Snap device models as trusted to
+// access the data on the encrypted volume protected by this key data for the specified
+// role. This makes it possible to maintain independent sets of trusted models, eg, for
+// run and recovery models. This function replaces all previously trusted models for the
+// specified role, and doesn't affect the models trusted for other roles. Supplying no
+// models removes the role.
+//
+// This makes changes to the key data, which will need to persisted afterwards using
+// WriteAtomic.
+//
+// The supplied auxKey is obtained using one of the RecoverKeys* functions. If the
+// supplied auxKey is incorrect, then an error will be returned.
+func (d *KeyData) SetAuthorizedSnapModelsForRole(auxKey AuxiliaryKey, role string, models ...SnapModel) error {
+	hmacKey, err := d.validatedSnapModelAuthKey(auxKey)
 	if err != nil {
-		return xerrors.Errorf("cannot obtain auth key: %w", err)
+		return err
 	}
 
-	alg := d.data.AuthorizedSnapModels.keyDigest.Alg
+	alg := d.data.AuthorizedSnapModels.alg
 	if !alg.Available() {
 		return errors.New("invalid digest algorithm")
 	}
 
-	h := alg.New()
-	h.Write(hmacKey)
-	h.Write(d.data.AuthorizedSnapModels.keyDigest.Salt)
-	if !bytes.Equal(h.Sum(nil), d.data.AuthorizedSnapModels.keyDigest.Digest) {
-		return errors.New("incorrect key supplied")
+	var modelHMACs snapModelHMACList
+	var modelIDs []AuthorizedSnapModel
+
+	for _, model := range models {
+		h, err := computeSnapModelHMAC(alg.Hash, hmacKey, model)
+		if err != nil {
+			return xerrors.Errorf("cannot compute HMAC of model: %w", err)
+		}
+
+		modelHMACs = append(modelHMACs, h)
+		modelIDs = append(modelIDs, makeAuthorizedSnapModel(model))
 	}
 
-	alg = d.data.AuthorizedSnapModels.alg
+	d.setAuthorizedSnapModelsForRole(role, modelHMACs, modelIDs)
+	return nil
+}
+
+// RemoveAuthorizedSnapModels removes the supplied Snap device models from the set of
+// models that are trusted to access the data on the encrypted volume protected by this
+// key data. Supplied models that aren't currently trusted are ignored.
+//
+// This makes changes to the key data, which will need to persisted afterwards using
+// WriteAtomic.
+//
+// The supplied auxKey is obtained using one of the RecoverKeys* functions. If the
+// supplied auxKey is incorrect, then an error will be returned.
+func (d *KeyData) RemoveAuthorizedSnapModels(auxKey AuxiliaryKey, models ...SnapModel) error {
+	hmacKey, err := d.validatedSnapModelAuthKey(auxKey)
+	if err != nil {
+		return err
+	}
+
+	alg := d.data.AuthorizedSnapModels.alg
 	if !alg.Available() {
 		return errors.New("invalid digest algorithm")
 	}
 
-	var modelHMACs snapModelHMACList
-
+	var removeHMACs snapModelHMACList
 	for _, model := range models {
 		h, err := computeSnapModelHMAC(alg.Hash, hmacKey, model)
 		if err != nil {
 			return xerrors.Errorf("cannot compute HMAC of model: %w", err)
 		}
+		removeHMACs = append(removeHMACs, h)
+	}
+
+	current := d.data.AuthorizedSnapModels
+	haveIDs := len(current.models) == len(current.hmacs)
 
+	var modelHMACs snapModelHMACList
+	var modelIDs []AuthorizedSnapModel
+	for i, h := range current.hmacs {
+		if removeHMACs.contains(h) {
+			continue
+		}
 		modelHMACs = append(modelHMACs, h)
+		if haveIDs {
+			modelIDs = append(modelIDs, current.models[i])
+		}
 	}
 
 	d.data.AuthorizedSnapModels.hmacs = modelHMACs
+	d.data.AuthorizedSnapModels.models = modelIDs
 	return nil
 }
 
+// ListAuthorizedSnapModels returns the identities of the Snap device models that are
+// trusted to access the data on the encrypted volume protected by this key data. This
+// doesn't require the auxiliary key.
+//
+// The returned identities are informational only - IsSnapModelAuthorized should be
+// used to determine whether a model is trusted. Key data where the authorized models
+// were last set by an older version of this package doesn't record the identities of
+// its authorized models, in which case an error will be returned.
+func (d *KeyData) ListAuthorizedSnapModels() ([]AuthorizedSnapModel, error) {
+	m := d.data.AuthorizedSnapModels
+	if len(m.models) != len(m.hmacs) {
+		return nil, errors.New("key data does not record the identities of its authorized models")
+	}
+
+	return append([]AuthorizedSnapModel(nil), m.models...), nil
+}
+
 // SetPassphrase sets a passphrase on this key data, which can be used to recover
 // the keys via the KeyData.RecoverKeysWithPassphrase API. This can only be called when
 // KeyData.AuthMode returns AuthModeNone. Once a passphrase has been set, the
@@ -865,6 +1254,95 @@ func (d *KeyData) WriteAtomic(w KeyDataWriter) error {
 	return nil
 }
 
+// MarshalJSON implements json.Marshaler. It returns exactly the same bytes that
+// are written by WriteAtomic, which makes it possible to embed key data in
+// other JSON documents.
+func (d *KeyData) MarshalJSON() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	if err := enc.Encode(d.data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It accepts the serialized key data
+// produced by MarshalJSON or WriteAtomic. An error is returned if the key data
+// has a version that is newer than is supported by this package.
+//
+// Key data decoded this way isn't associated with a KeyDataReader, so it has
+// no readable name and ReadableName will return an empty string.
+func (d *KeyData) UnmarshalJSON(b []byte) error {
+	var data keyData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	if err := data.checkVersion(); err != nil {
+		return err
+	}
+
+	d.readableName = ""
+	d.data = data
+	return nil
+}
+
+// checkVersion returns an error if this key data has a version that is not
+// supported by this package.
+func (d *keyData) checkVersion() error {
+	if d.Version > keyDataVersion {
+		return &IncompatibleKeyDataVersionError{Version: d.Version}
+	}
+	return nil
+}
+
+// version returns the version of this key data.
+func (d *keyData) version() int {
+	if d.Version == 0 {
+		return 1
+	}
+	return d.Version
+}
+
+// migrate upgrades this key data to the current version. It returns false
+// if the key data is already the current version.
+func (d *keyData) migrate() bool {
+	if d.version() >= keyDataVersion {
+		return false
+	}
+
+	// Version 1 -> 2: the key digest is serialized as an object. A legacy
+	// key digest is unsalted, so it can be represented as an object with
+	// an empty salt.
+	d.AuthorizedSnapModels.legacyKeyDigest = false
+	d.Version = keyDataVersion
+	return true
+}
+
+// MigrateKeyData reads the key data from the supplied KeyDataReader and, if it
+// was created with an older version of the serialized format, upgrades it to the
+// current version and writes it to the supplied KeyDataWriter. The migration
+// doesn't require any of the keys and is lossless. Supplying a reader and writer
+// for the same file (eg, FileKeyDataReader and FileKeyDataWriter) migrates the
+// file in place.
+//
+// This returns true if the key data was migrated, or false if it is already the
+// current version, in which case nothing is written.
+func MigrateKeyData(r KeyDataReader, w KeyDataWriter) (migrated bool, err error) {
+	d, err := ReadKeyData(r)
+	if err != nil {
+		return false, err
+	}
+
+	if !d.data.migrate() {
+		return false, nil
+	}
+
+	if err := d.WriteAtomic(w); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // ReadKeyData reads the key data from the supplied KeyDataReader, returning a
 // new KeyData object.
 func ReadKeyData(r KeyDataReader) (*KeyData, error) {
@@ -873,6 +1351,9 @@ func ReadKeyData(r KeyDataReader) (*KeyData, error) {
 	if err := dec.Decode(&d.data); err != nil {
 		return nil, xerrors.Errorf("cannot decode key data: %w", err)
 	}
+	if err := d.data.checkVersion(); err != nil {
+		return nil, err
+	}
 
 	return d, nil
 }
@@ -892,9 +1373,15 @@ func NewKeyData(creationData *KeyCreationData) (*KeyData, error) {
 		return nil, xerrors.Errorf("cannot read salt: %w", err)
 	}
 
+	creationTime := timeNow().UTC().Truncate(time.Second)
+
 	kd := &KeyData{
 		data: keyData{
+			Version:          keyDataVersion,
 			PlatformName:     creationData.PlatformName,
+			CreationTime:     &creationTime,
+			Description:      creationData.Description,
+			UnlockKeySize:    creationData.UnlockKeySize,
 			PlatformHandle:   json.RawMessage(encodedHandle),
 			EncryptedPayload: creationData.EncryptedPayload,
 			AuthorizedSnapModels: authorizedSnapModels{
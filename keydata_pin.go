@@ -0,0 +1,245 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	pinPlatformName        = "pin"
+	passphrasePlatformName = "passphrase"
+	pinAuxKeyLen           = 32
+)
+
+// pinPlatformKeyDataHandle is the platform handle for key data protected
+// only by a PIN. It contains a HMAC of the current PIN derived key, which
+// is used to detect an incorrect PIN.
+type pinPlatformKeyDataHandle struct {
+	Salt        []byte `json:"salt"`
+	AuthKeyHMAC []byte `json:"auth_key_hmac"`
+}
+
+func (h *pinPlatformKeyDataHandle) computeAuthKeyHMAC(key []byte) []byte {
+	m := hmac.New(func() hash.Hash { return crypto.SHA256.New() }, h.Salt)
+	m.Write(key)
+	return m.Sum(nil)
+}
+
+// pinPlatformKeyDataHandler is the PlatformKeyDataHandler for key data that
+// is protected only by a PIN or passphrase. There is no secure device associated
+// with this platform - the passphrase support in KeyData provides the encryption
+// of the keys, and this handler only validates the PIN or passphrase derived key.
+type pinPlatformKeyDataHandler struct {
+	authName string // "PIN" or "passphrase", used in errors
+}
+
+func (h *pinPlatformKeyDataHandler) unmarshalHandle(data []byte) (*pinPlatformKeyDataHandle, error) {
+	var handle pinPlatformKeyDataHandle
+	if err := json.Unmarshal(data, &handle); err != nil {
+		return nil, &PlatformHandlerError{
+			Type: PlatformHandlerErrorInvalidData,
+			Err:  xerrors.Errorf("cannot decode platform handle: %w", err)}
+	}
+	if len(handle.Salt) == 0 {
+		return nil, &PlatformHandlerError{
+			Type: PlatformHandlerErrorInvalidData,
+			Err:  errors.New("no salt")}
+	}
+	return &handle, nil
+}
+
+func (h *pinPlatformKeyDataHandler) checkKey(handle *pinPlatformKeyDataHandle, key []byte) error {
+	if len(handle.AuthKeyHMAC) == 0 && key == nil {
+		// No PIN has been set yet.
+		return nil
+	}
+	if !hmac.Equal(handle.AuthKeyHMAC, handle.computeAuthKeyHMAC(key)) {
+		return &PlatformHandlerError{
+			Type: PlatformHandlerErrorInvalidAuthKey,
+			Err:  errors.New("the supplied key is incorrect")}
+	}
+	return nil
+}
+
+func (h *pinPlatformKeyDataHandler) RecoverKeys(data *PlatformKeyData) (KeyPayload, error) {
+	return nil, &PlatformHandlerError{
+		Type: PlatformHandlerErrorInvalidData,
+		Err:  fmt.Errorf("key data must be protected by a %s", h.authName)}
+}
+
+func (h *pinPlatformKeyDataHandler) RecoverKeysWithAuthKey(data *PlatformKeyData, key []byte) (KeyPayload, error) {
+	handle, err := h.unmarshalHandle(data.EncodedHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(handle.AuthKeyHMAC) == 0 {
+		return nil, &PlatformHandlerError{
+			Type: PlatformHandlerErrorInvalidData,
+			Err:  fmt.Errorf("key data must be protected by a %s", h.authName)}
+	}
+	if err := h.checkKey(handle, key); err != nil {
+		return nil, err
+	}
+
+	return KeyPayload(data.EncryptedPayload), nil
+}
+
+func (h *pinPlatformKeyDataHandler) ChangeAuthKey(data, old, new []byte) ([]byte, error) {
+	if new == nil {
+		return nil, fmt.Errorf("cannot remove the %[1]s from key data that is only protected by a %[1]s", h.authName)
+	}
+
+	handle, err := h.unmarshalHandle(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.checkKey(handle, old); err != nil {
+		return nil, err
+	}
+
+	handle.AuthKeyHMAC = handle.computeAuthKeyHMAC(new)
+	return json.Marshal(handle)
+}
+
+// PINKeyDataParams contains the parameters used to create a new KeyData
+// object that is protected only by a PIN.
+type PINKeyDataParams struct {
+	// KDFOptions configures the Argon2 KDF settings used to stretch
+	// the PIN. These are stored in the key data.
+	KDFOptions *KDFOptions
+
+	// SnapModelAuthHash is the digest algorithm used for HMACs of Snap
+	// device models. If not set, SHA-256 is used.
+	SnapModelAuthHash crypto.Hash
+}
+
+// NewPINKeyData creates a new KeyData object that protects the supplied disk
+// unlock key with a key derived from the supplied PIN using the Argon2 KDF,
+// without the involvement of any platform secure device. This is intended for
+// devices that don't have a TPM or other secure device available.
+//
+// Key data created by this function is much weaker than key data protected by
+// a secure device. Anyone with access to the key data can attempt to guess the
+// PIN offline without any rate limiting other than that provided by the cost of
+// the KDF, so the KDF parameters should be chosen to be as expensive as can be
+// tolerated. It should not be used where a secure device is available.
+//
+// The returned KeyData has AuthModePassphrase set, so it can be used with
+// ActivateVolumeWithKeyData, which will request the PIN via the supplied
+// AuthRequestor up to ActivateVolumeOptions.PassphraseTries times. The PIN
+// can be changed later on with KeyData.ChangePassphrase, but cannot be
+// removed.
+//
+// The kdf argument provides the Argon2 KDF implementation that will be used -
+// this should ultimately execute the implementation returned by the Argon2iKDF
+// function, but the caller can choose to execute this in a short-lived utility
+// process.
+//
+// On success, the new KeyData is returned along with the auxiliary key,
+// which is required for managing the authorized snap models.
+func NewPINKeyData(pin string, key DiskUnlockKey, params *PINKeyDataParams, kdf KDF) (*KeyData, AuxiliaryKey, error) {
+	if pin == "" {
+		return nil, nil, errors.New("no PIN supplied")
+	}
+	if params == nil {
+		params = new(PINKeyDataParams)
+	}
+
+	return newPassphraseOnlyKeyData(pinPlatformName, "PIN", pin, key, params, kdf)
+}
+
+// PassphraseKeyDataParams contains the parameters used to create a new KeyData
+// object that is protected only by a passphrase.
+type PassphraseKeyDataParams = PINKeyDataParams
+
+// NewPassphraseKeyData creates a new KeyData object that protects the supplied
+// disk unlock key with a key derived from the supplied passphrase using the Argon2
+// KDF, without the involvement of any platform secure device. This is intended for
+// devices that don't have a TPM or other secure device available.
+//
+// This behaves the same as NewPINKeyData, and the same caveats apply. The returned
+// KeyData has AuthModePassphrase set, so it can be used with
+// ActivateVolumeWithKeyData, which will request the passphrase via the supplied
+// AuthRequestor up to ActivateVolumeOptions.PassphraseTries times. The passphrase
+// can be changed later on with KeyData.ChangePassphrase, which doesn't change the
+// protected disk unlock key, but the passphrase cannot be removed.
+//
+// On success, the new KeyData is returned along with the auxiliary key,
+// which is required for managing the authorized snap models.
+func NewPassphraseKeyData(passphrase string, key DiskUnlockKey, params *PassphraseKeyDataParams, kdf KDF) (*KeyData, AuxiliaryKey, error) {
+	if passphrase == "" {
+		return nil, nil, errors.New("no passphrase supplied")
+	}
+	if params == nil {
+		params = new(PassphraseKeyDataParams)
+	}
+
+	return newPassphraseOnlyKeyData(passphrasePlatformName, "passphrase", passphrase, key, params, kdf)
+}
+
+func newPassphraseOnlyKeyData(platformName, authName, passphrase string, key DiskUnlockKey, params *PINKeyDataParams, kdf KDF) (*KeyData, AuxiliaryKey, error) {
+	snapModelAuthHash := params.SnapModelAuthHash
+	if snapModelAuthHash == crypto.Hash(0) {
+		snapModelAuthHash = crypto.SHA256
+	}
+
+	auxKey := make(AuxiliaryKey, pinAuxKeyLen)
+	if _, err := rand.Read(auxKey); err != nil {
+		return nil, nil, xerrors.Errorf("cannot obtain auxiliary key: %w", err)
+	}
+
+	handle := pinPlatformKeyDataHandle{Salt: make([]byte, 32)}
+	if _, err := rand.Read(handle.Salt); err != nil {
+		return nil, nil, xerrors.Errorf("cannot read salt: %w", err)
+	}
+
+	keyData, err := NewKeyData(&KeyCreationData{
+		Handle:            &handle,
+		EncryptedPayload:  MarshalKeys(key, auxKey),
+		PlatformName:      platformName,
+		AuxiliaryKey:      auxKey,
+		SnapModelAuthHash: snapModelAuthHash,
+		UnlockKeySize:     len(key)})
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot create key data: %w", err)
+	}
+
+	if err := keyData.SetPassphrase(passphrase, params.KDFOptions, kdf); err != nil {
+		return nil, nil, xerrors.Errorf("cannot set %s: %w", authName, err)
+	}
+
+	return keyData, auxKey, nil
+}
+
+func init() {
+	RegisterPlatformKeyDataHandler(pinPlatformName, &pinPlatformKeyDataHandler{authName: "PIN"})
+	RegisterPlatformKeyDataHandler(passphrasePlatformName, &pinPlatformKeyDataHandler{authName: "passphrase"})
+}
@@ -0,0 +1,183 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"encoding/json"
+	"math/rand"
+
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type keyDataPINSuite struct{}
+
+var _ = Suite(&keyDataPINSuite{})
+
+func (s *keyDataPINSuite) newKey(c *C) DiskUnlockKey {
+	key := make(DiskUnlockKey, 32)
+	_, err := rand.Read(key)
+	c.Assert(err, IsNil)
+	return key
+}
+
+func (s *keyDataPINSuite) TestNewPINKeyData(c *C) {
+	key := s.newKey(c)
+
+	var kdf mockKDF
+	keyData, auxKey, err := NewPINKeyData("1234", key, nil, &kdf)
+	c.Assert(err, IsNil)
+	c.Check(keyData.AuthMode(), Equals, AuthModePassphrase)
+	c.Check(auxKey, HasLen, 32)
+	c.Check(keyData.UnlockKeySize(), Equals, len(key))
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataPINSuite) TestNewPINKeyDataStoresKDFParams(c *C) {
+	var kdf mockKDF
+	keyData, _, err := NewPINKeyData("1234", s.newKey(c), &PINKeyDataParams{
+		KDFOptions: &KDFOptions{MemoryKiB: 32 * 1024, ForceIterations: 8}}, &kdf)
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	c.Check(j["platform_name"], Equals, "pin")
+
+	p, ok := j["passphrase_protected_payload"].(map[string]interface{})
+	c.Assert(ok, Equals, true)
+	k, ok := p["kdf"].(map[string]interface{})
+	c.Assert(ok, Equals, true)
+	c.Check(k["time"], Equals, float64(8))
+	c.Check(k["memory"], Equals, float64(32*1024))
+}
+
+func (s *keyDataPINSuite) TestNewPINKeyDataNoPIN(c *C) {
+	var kdf mockKDF
+	_, _, err := NewPINKeyData("", s.newKey(c), nil, &kdf)
+	c.Check(err, ErrorMatches, "no PIN supplied")
+}
+
+func (s *keyDataPINSuite) TestRecoverKeysWithWrongPIN(c *C) {
+	var kdf mockKDF
+	keyData, _, err := NewPINKeyData("1234", s.newKey(c), nil, &kdf)
+	c.Assert(err, IsNil)
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("4321", &kdf)
+	c.Check(err, Equals, ErrInvalidPassphrase)
+}
+
+func (s *keyDataPINSuite) TestChangePIN(c *C) {
+	key := s.newKey(c)
+
+	var kdf mockKDF
+	keyData, auxKey, err := NewPINKeyData("1234", key, nil, &kdf)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.ChangePassphrase("1234", "5678", nil, &kdf), IsNil)
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("1234", &kdf)
+	c.Check(err, Equals, ErrInvalidPassphrase)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("5678", &kdf)
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataPINSuite) TestChangePINWithWrongPIN(c *C) {
+	var kdf mockKDF
+	keyData, _, err := NewPINKeyData("1234", s.newKey(c), nil, &kdf)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.ChangePassphrase("4321", "5678", nil, &kdf), Equals, ErrInvalidPassphrase)
+}
+
+func (s *keyDataPINSuite) TestClearPIN(c *C) {
+	var kdf mockKDF
+	keyData, _, err := NewPINKeyData("1234", s.newKey(c), nil, &kdf)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.ClearPassphraseWithPassphrase("1234", &kdf), ErrorMatches,
+		"cannot perform action because of an unexpected error: cannot remove the PIN from key data that is only protected by a PIN")
+	c.Check(keyData.AuthMode(), Equals, AuthModePassphrase)
+}
+
+func (s *keyDataPINSuite) TestNewPassphraseKeyData(c *C) {
+	key := s.newKey(c)
+
+	var kdf mockKDF
+	keyData, auxKey, err := NewPassphraseKeyData("correct horse battery staple", key, nil, &kdf)
+	c.Assert(err, IsNil)
+	c.Check(keyData.AuthMode(), Equals, AuthModePassphrase)
+	c.Check(keyData.PlatformName(), Equals, "passphrase")
+	c.Check(auxKey, HasLen, 32)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("correct horse battery staple", &kdf)
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataPINSuite) TestNewPassphraseKeyDataNoPassphrase(c *C) {
+	var kdf mockKDF
+	_, _, err := NewPassphraseKeyData("", s.newKey(c), nil, &kdf)
+	c.Check(err, ErrorMatches, "no passphrase supplied")
+}
+
+func (s *keyDataPINSuite) TestChangePassphraseKeyData(c *C) {
+	key := s.newKey(c)
+
+	var kdf mockKDF
+	keyData, auxKey, err := NewPassphraseKeyData("passphrase", key, nil, &kdf)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.ChangePassphrase("passphrase", "new passphrase", nil, &kdf), IsNil)
+
+	_, _, err = keyData.RecoverKeysWithPassphrase("passphrase", &kdf)
+	c.Check(err, Equals, ErrInvalidPassphrase)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+
+	recoveredKey, recoveredAuxKey, err := keyData.RecoverKeysWithPassphrase("new passphrase", &kdf)
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+}
+
+func (s *keyDataPINSuite) TestClearPassphraseKeyData(c *C) {
+	var kdf mockKDF
+	keyData, _, err := NewPassphraseKeyData("passphrase", s.newKey(c), nil, &kdf)
+	c.Assert(err, IsNil)
+
+	c.Check(keyData.ClearPassphraseWithPassphrase("passphrase", &kdf), ErrorMatches,
+		"cannot perform action because of an unexpected error: cannot remove the passphrase from key data that is only protected by a passphrase")
+	c.Check(keyData.AuthMode(), Equals, AuthModePassphrase)
+}
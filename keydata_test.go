@@ -25,6 +25,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rsa"
 	_ "crypto/sha256"
 	_ "crypto/sha512"
 	"encoding/base64"
@@ -39,6 +40,8 @@ import (
 	. "github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/testutil"
 
+	"github.com/snapcore/snapd/asserts"
+
 	"golang.org/x/xerrors"
 
 	. "gopkg.in/check.v1"
@@ -524,6 +527,22 @@ func (s *keyDataSuite) TestKeyPayloadUnmarshalInvalid2(c *C) {
 	c.Check(auxKey, IsNil)
 }
 
+func (s *keyDataSuite) TestDiskUnlockKeyWipe(c *C) {
+	key, _ := s.newKeyDataKeys(c, 32, 0)
+	c.Check(key, Not(DeepEquals), make(DiskUnlockKey, 32))
+
+	key.Wipe()
+	c.Check(key, DeepEquals, make(DiskUnlockKey, 32))
+}
+
+func (s *keyDataSuite) TestAuxiliaryKeyWipe(c *C) {
+	_, auxKey := s.newKeyDataKeys(c, 32, 32)
+	c.Check(auxKey, Not(DeepEquals), make(AuxiliaryKey, 32))
+
+	auxKey.Wipe()
+	c.Check(auxKey, DeepEquals, make(AuxiliaryKey, 32))
+}
+
 type keyDataHasher struct {
 	hash.Hash
 }
@@ -553,6 +572,428 @@ func (s *keyDataSuite) TestNewKeyData(c *C) {
 	c.Check(err, IsNil)
 }
 
+func (s *keyDataSuite) TestNewKeyDataMetadata(c *C) {
+	now := time.Date(2021, time.October, 4, 10, 30, 15, 500, time.UTC)
+	restore := MockTimeNow(func() time.Time { return now })
+	defer restore()
+
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+	protected.Description = "run+recover key for ubuntu-data"
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.PlatformName(), Equals, mockPlatformName)
+	c.Check(keyData.CreationTime(), Equals, now.Truncate(time.Second))
+	c.Check(keyData.Description(), Equals, "run+recover key for ubuntu-data")
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	c.Check(j["creation_time"], Equals, "2021-10-04T10:30:15Z")
+	c.Check(j["description"], Equals, "run+recover key for ubuntu-data")
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+	c.Check(keyData.PlatformName(), Equals, mockPlatformName)
+	c.Check(keyData.CreationTime().Equal(now.Truncate(time.Second)), testutil.IsTrue)
+	c.Check(keyData.Description(), Equals, "run+recover key for ubuntu-data")
+}
+
+func (s *keyDataSuite) TestKeyDataMetadataLegacy(c *C) {
+	j := []byte(
+		`{` +
+			`"platform_name":"mock",` +
+			`"platform_handle":"iTnGw6iFTfDgGS+KMtDHx2yF0bpNaTWyzeLtsbaC9YaspcssRrHzcRsNrubyEVT9",` +
+			`"encrypted_payload":"fYM/SYjIRZj7JOJA710c9hSsxp5NpEchEVXgozd1KgxqZ/TOzIvWF9WYSrRcXiy1vsyjhkF0Svh3ihfApzvje7tTQRI=",` +
+			`"authorized_snap_models":{` +
+			`"alg":"sha256",` +
+			`"key_digest":"ECpFZzxG8XWUKGylGggA2HR+8pERsmA891SmDvs3NiE=",` +
+			`"hmacs":null}}
+`)
+
+	keyData, err := ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(j)})
+	c.Assert(err, IsNil)
+	c.Check(keyData.PlatformName(), Equals, "mock")
+	c.Check(keyData.CreationTime().IsZero(), testutil.IsTrue)
+	c.Check(keyData.Description(), Equals, "")
+}
+
+func (s *keyDataSuite) TestUnlockKeySize(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 64, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+	protected.UnlockKeySize = len(key)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.UnlockKeySize(), Equals, 64)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	c.Check(j["unlock_key_size"], Equals, float64(64))
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+	c.Check(keyData.UnlockKeySize(), Equals, 64)
+
+	recoveredKey, _, err := keyData.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+}
+
+func (s *keyDataSuite) TestUnlockKeySizeUnknown(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.UnlockKeySize(), Equals, 0)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	_, ok := j["unlock_key_size"]
+	c.Check(ok, testutil.IsFalse)
+}
+
+func (s *keyDataSuite) TestRecoverKeysUnexpectedUnlockKeySize(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+	protected.UnlockKeySize = 64
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	_, _, err = keyData.RecoverKeys()
+	c.Check(err, ErrorMatches, `invalid key data: unexpected unlock key size \(got 32 bytes, expected 64 bytes\)`)
+	c.Check(err, FitsTypeOf, &InvalidKeyDataError{})
+}
+
+func (s *keyDataSuite) TestValidate(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.Validate(), IsNil)
+
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, models...), IsNil)
+	c.Check(keyData.SetAuthorizedSnapModelsForRole(auxKey, "recovery", models...), IsNil)
+	c.Check(keyData.Validate(), IsNil)
+
+	var kdf mockKDF
+	c.Check(keyData.SetPassphrase("passphrase", nil, &kdf), IsNil)
+	c.Check(keyData.Validate(), IsNil)
+}
+
+func (s *keyDataSuite) TestValidateLegacy(c *C) {
+	j := []byte(
+		`{` +
+			`"platform_name":"mock",` +
+			`"platform_handle":"iTnGw6iFTfDgGS+KMtDHx2yF0bpNaTWyzeLtsbaC9YaspcssRrHzcRsNrubyEVT9",` +
+			`"encrypted_payload":"fYM/SYjIRZj7JOJA710c9hSsxp5NpEchEVXgozd1KgxqZ/TOzIvWF9WYSrRcXiy1vsyjhkF0Svh3ihfApzvje7tTQRI=",` +
+			`"authorized_snap_models":{` +
+			`"alg":"sha256",` +
+			`"key_digest":"ECpFZzxG8XWUKGylGggA2HR+8pERsmA891SmDvs3NiE=",` +
+			`"hmacs":["pcYGJdlrxgn6M5Q4gq23cykD1D6X68XBZV+Ikzoyxo0="]}}
+`)
+
+	keyData, err := ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(j)})
+	c.Assert(err, IsNil)
+	c.Check(keyData.Validate(), IsNil)
+}
+
+func (s *keyDataSuite) testValidateInvalid(c *C, mutate func(j map[string]interface{})) error {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, model), IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	var j map[string]interface{}
+	c.Assert(json.NewDecoder(w.Reader()).Decode(&j), IsNil)
+	mutate(j)
+
+	b, err := json.Marshal(j)
+	c.Assert(err, IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(b)})
+	c.Assert(err, IsNil)
+
+	err = keyData.Validate()
+	if err != nil {
+		c.Check(err, FitsTypeOf, &InvalidKeyDataError{})
+	}
+	return err
+}
+
+func (s *keyDataSuite) TestValidateNoPlatformName(c *C) {
+	c.Check(s.testValidateInvalid(c, func(j map[string]interface{}) {
+		delete(j, "platform_name")
+	}), ErrorMatches, "invalid key data: no platform name")
+}
+
+func (s *keyDataSuite) TestValidateNoPlatformHandle(c *C) {
+	c.Check(s.testValidateInvalid(c, func(j map[string]interface{}) {
+		delete(j, "platform_handle")
+	}), ErrorMatches, "invalid key data: no platform handle")
+}
+
+func (s *keyDataSuite) TestValidateNoEncryptedPayload(c *C) {
+	c.Check(s.testValidateInvalid(c, func(j map[string]interface{}) {
+		delete(j, "encrypted_payload")
+	}), ErrorMatches, "invalid key data: no encrypted payload")
+}
+
+func (s *keyDataSuite) TestValidateInvalidKeyDigest(c *C) {
+	c.Check(s.testValidateInvalid(c, func(j map[string]interface{}) {
+		m := j["authorized_snap_models"].(map[string]interface{})
+		d := m["key_digest"].(map[string]interface{})
+		d["digest"] = "AAAA"
+	}), ErrorMatches, "invalid key data: snap model auth key digest has an invalid length")
+}
+
+func (s *keyDataSuite) TestValidateInvalidHMAC(c *C) {
+	c.Check(s.testValidateInvalid(c, func(j map[string]interface{}) {
+		m := j["authorized_snap_models"].(map[string]interface{})
+		m["hmacs"] = []interface{}{"AAAA"}
+	}), ErrorMatches, "invalid key data: invalid authorized snap models: HMAC 0 has an invalid length")
+}
+
+func (s *keyDataSuite) TestValidateInconsistentModels(c *C) {
+	c.Check(s.testValidateInvalid(c, func(j map[string]interface{}) {
+		m := j["authorized_snap_models"].(map[string]interface{})
+		models := m["models"].([]interface{})
+		m["models"] = append(models, models[0])
+	}), ErrorMatches, "invalid key data: invalid authorized snap models: inconsistent number of model identities")
+}
+
+func (s *keyDataSuite) TestValidateInvalidAlg(c *C) {
+	c.Check(s.testValidateInvalid(c, func(j map[string]interface{}) {
+		m := j["authorized_snap_models"].(map[string]interface{})
+		m["alg"] = "null"
+	}), ErrorMatches, "invalid key data: invalid snap model digest algorithm")
+}
+
+func (s *keyDataSuite) TestMarshalJSON(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, model), IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+	expected, err := ioutil.ReadAll(w.Reader())
+	c.Assert(err, IsNil)
+
+	b, err := keyData.MarshalJSON()
+	c.Check(err, IsNil)
+	c.Check(b, DeepEquals, expected)
+
+	// When embedded in another document, the encoding package drops
+	// the trailing newline.
+	b, err = json.Marshal(keyData)
+	c.Check(err, IsNil)
+	c.Check(append(b, '\n'), DeepEquals, expected)
+}
+
+func (s *keyDataSuite) TestUnmarshalJSON(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, model), IsNil)
+
+	type config struct {
+		Name string   `json:"name"`
+		Key  *KeyData `json:"key"`
+	}
+
+	b, err := json.Marshal(&config{Name: "data", Key: keyData})
+	c.Assert(err, IsNil)
+
+	var cfg config
+	c.Assert(json.Unmarshal(b, &cfg), IsNil)
+	c.Check(cfg.Name, Equals, "data")
+	c.Assert(cfg.Key, NotNil)
+	c.Check(cfg.Key.ReadableName(), Equals, "")
+
+	expectedID, err := keyData.UniqueID()
+	c.Check(err, IsNil)
+	id, err := cfg.Key.UniqueID()
+	c.Check(err, IsNil)
+	c.Check(id, DeepEquals, expectedID)
+
+	recoveredKey, recoveredAuxKey, err := cfg.Key.RecoverKeys()
+	c.Check(err, IsNil)
+	c.Check(recoveredKey, DeepEquals, key)
+	c.Check(recoveredAuxKey, DeepEquals, auxKey)
+
+	authorized, err := cfg.Key.IsSnapModelAuthorized(recoveredAuxKey, model)
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsTrue)
+}
+
+func (s *keyDataSuite) TestUnmarshalJSONClearsReadableName(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+	b, err := ioutil.ReadAll(w.Reader())
+	c.Assert(err, IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{readableName: "foo", Reader: bytes.NewReader(b)})
+	c.Assert(err, IsNil)
+	c.Check(keyData.ReadableName(), Equals, "foo")
+
+	c.Check(json.Unmarshal(b, keyData), IsNil)
+	c.Check(keyData.ReadableName(), Equals, "")
+
+	b2, err := keyData.MarshalJSON()
+	c.Check(err, IsNil)
+	c.Check(b2, DeepEquals, b)
+}
+
+func (s *keyDataSuite) TestUnmarshalJSONUnsupportedVersion(c *C) {
+	j := []byte(
+		`{` +
+			`"version":100,` +
+			`"platform_name":"mock",` +
+			`"platform_handle":"iTnGw6iFTfDgGS+KMtDHx2yF0bpNaTWyzeLtsbaC9YaspcssRrHzcRsNrubyEVT9",` +
+			`"encrypted_payload":"fYM/SYjIRZj7JOJA710c9hSsxp5NpEchEVXgozd1KgxqZ/TOzIvWF9WYSrRcXiy1vsyjhkF0Svh3ihfApzvje7tTQRI=",` +
+			`"authorized_snap_models":{` +
+			`"alg":"sha256",` +
+			`"key_digest":"ECpFZzxG8XWUKGylGggA2HR+8pERsmA891SmDvs3NiE=",` +
+			`"hmacs":null}}
+`)
+
+	var keyData KeyData
+	err := json.Unmarshal(j, &keyData)
+	c.Check(err, ErrorMatches, "unsupported key data version 100")
+	c.Check(err, DeepEquals, &IncompatibleKeyDataVersionError{Version: 100})
+
+	_, err = ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(j)})
+	c.Check(err, ErrorMatches, "unsupported key data version 100")
+	c.Check(err, DeepEquals, &IncompatibleKeyDataVersionError{Version: 100})
+}
+
+func (s *keyDataSuite) TestMigrateKeyData(c *C) {
+	auxKey := testutil.DecodeHexString(c, "8107f1c65c58934f0d59245d1d94d312ea803e69c8599a7bac8c67fe253232f2")
+	j := []byte(
+		`{` +
+			`"platform_name":"mock",` +
+			`"platform_handle":"iTnGw6iFTfDgGS+KMtDHx2yF0bpNaTWyzeLtsbaC9YaspcssRrHzcRsNrubyEVT9",` +
+			`"encrypted_payload":"fYM/SYjIRZj7JOJA710c9hSsxp5NpEchEVXgozd1KgxqZ/TOzIvWF9WYSrRcXiy1vsyjhkF0Svh3ihfApzvje7tTQRI=",` +
+			`"authorized_snap_models":{` +
+			`"alg":"sha256",` +
+			`"key_digest":"ECpFZzxG8XWUKGylGggA2HR+8pERsmA891SmDvs3NiE=",` +
+			`"hmacs":["pcYGJdlrxgn6M5Q4gq23cykD1D6X68XBZV+Ikzoyxo0="]}}
+`)
+
+	w := makeMockKeyDataWriter()
+	migrated, err := MigrateKeyData(&mockKeyDataReader{"foo", bytes.NewReader(j)}, w)
+	c.Check(err, IsNil)
+	c.Check(migrated, testutil.IsTrue)
+
+	var d map[string]interface{}
+	c.Assert(json.NewDecoder(bytes.NewReader(w.final.Bytes())).Decode(&d), IsNil)
+	c.Check(d["version"], Equals, float64(2))
+	m, ok := d["authorized_snap_models"].(map[string]interface{})
+	c.Assert(ok, testutil.IsTrue)
+	c.Check(m["key_digest"], DeepEquals, map[string]interface{}{
+		"alg":    "sha256",
+		"salt":   nil,
+		"digest": "ECpFZzxG8XWUKGylGggA2HR+8pERsmA891SmDvs3NiE="})
+
+	keyData, err := ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+	c.Check(keyData.Version(), Equals, 2)
+
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+
+	ok, err = keyData.IsSnapModelAuthorized(auxKey, model)
+	c.Check(err, IsNil)
+	c.Check(ok, testutil.IsTrue)
+
+	// The key digest is still usable to validate the auxiliary key.
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, model), IsNil)
+	c.Check(keyData.SetAuthorizedSnapModels(make(AuxiliaryKey, 32), model), ErrorMatches, "incorrect key supplied")
+}
+
+func (s *keyDataSuite) TestMigrateKeyDataCurrentVersion(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+	c.Check(keyData.Version(), Equals, 2)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	w2 := makeMockKeyDataWriter()
+	migrated, err := MigrateKeyData(&mockKeyDataReader{"foo", w.Reader()}, w2)
+	c.Check(err, IsNil)
+	c.Check(migrated, testutil.IsFalse)
+	c.Check(w2.final, IsNil)
+}
+
 func (s *keyDataSuite) TestUnmarshalPlatformHandle(c *C) {
 	key, auxKey := s.newKeyDataKeys(c, 32, 32)
 	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
@@ -1057,6 +1498,413 @@ func (s *keyDataSuite) TestSetAuthorizedSnapModelsWithWrongKey(c *C) {
 	c.Check(keyData.SetAuthorizedSnapModels(make(AuxiliaryKey, 32), models...), ErrorMatches, "incorrect key supplied")
 }
 
+func (s *keyDataSuite) TestRemoveAuthorizedSnapModels(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij"),
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "other-model",
+			"grade":        "dangerous",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, models...), IsNil)
+	c.Check(keyData.RemoveAuthorizedSnapModels(auxKey, models[0]), IsNil)
+
+	authorized, err := keyData.IsSnapModelAuthorized(auxKey, models[0])
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsFalse)
+	authorized, err = keyData.IsSnapModelAuthorized(auxKey, models[1])
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsTrue)
+
+	list, err := keyData.ListAuthorizedSnapModels()
+	c.Check(err, IsNil)
+	c.Check(list, DeepEquals, []AuthorizedSnapModel{
+		{BrandID: "fake-brand", Model: "other-model", Series: "16", Grade: "dangerous"}})
+
+	// Removing a model that isn't authorized is a no-op.
+	c.Check(keyData.RemoveAuthorizedSnapModels(auxKey, models[0]), IsNil)
+	list, err = keyData.ListAuthorizedSnapModels()
+	c.Check(err, IsNil)
+	c.Check(list, HasLen, 1)
+}
+
+func (s *keyDataSuite) TestRemoveAuthorizedSnapModelsWithWrongKey(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, models...), IsNil)
+	c.Check(keyData.RemoveAuthorizedSnapModels(make(AuxiliaryKey, 32), models...), ErrorMatches, "incorrect key supplied")
+
+	authorized, err := keyData.IsSnapModelAuthorized(auxKey, models[0])
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsTrue)
+}
+
+func (s *keyDataSuite) TestListAuthorizedSnapModelsAfterWrite(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	list, err := keyData.ListAuthorizedSnapModels()
+	c.Check(err, IsNil)
+	c.Check(list, HasLen, 0)
+
+	models := []SnapModel{
+		testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+			"authority-id": "fake-brand",
+			"series":       "16",
+			"brand-id":     "fake-brand",
+			"model":        "fake-model",
+			"grade":        "secured",
+		}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")}
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, models...), IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+
+	list, err = keyData.ListAuthorizedSnapModels()
+	c.Check(err, IsNil)
+	c.Check(list, DeepEquals, []AuthorizedSnapModel{
+		{BrandID: "fake-brand", Model: "fake-model", Series: "16", Grade: "secured"}})
+}
+
+func (s *keyDataSuite) TestSetAuthorizedSnapModelsForRole(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	runModel := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+	recoveryModel := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-recovery-model",
+		"grade":        "signed",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, runModel), IsNil)
+	c.Check(keyData.SetAuthorizedSnapModelsForRole(auxKey, "recovery", recoveryModel), IsNil)
+
+	w := makeMockKeyDataWriter()
+	c.Check(keyData.WriteAtomic(w), IsNil)
+
+	keyData, err = ReadKeyData(&mockKeyDataReader{"foo", w.Reader()})
+	c.Assert(err, IsNil)
+
+	for _, t := range []struct {
+		role       string
+		model      SnapModel
+		authorized bool
+	}{
+		{role: DefaultSnapModelRole, model: runModel, authorized: true},
+		{role: DefaultSnapModelRole, model: recoveryModel, authorized: false},
+		{role: "recovery", model: runModel, authorized: false},
+		{role: "recovery", model: recoveryModel, authorized: true},
+		{role: "other", model: runModel, authorized: false},
+	} {
+		authorized, err := keyData.IsSnapModelAuthorizedForRole(auxKey, t.role, t.model)
+		c.Check(err, IsNil)
+		c.Check(authorized, Equals, t.authorized, Commentf("role: %q, model: %s", t.role, t.model.Model()))
+	}
+
+	authorized, err := keyData.IsSnapModelAuthorized(auxKey, runModel)
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsTrue)
+
+	// Clearing a role doesn't affect the other roles.
+	c.Check(keyData.SetAuthorizedSnapModelsForRole(auxKey, "recovery"), IsNil)
+	authorized, err = keyData.IsSnapModelAuthorizedForRole(auxKey, "recovery", recoveryModel)
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsFalse)
+	authorized, err = keyData.IsSnapModelAuthorized(auxKey, runModel)
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsTrue)
+}
+
+func (s *keyDataSuite) TestSetAuthorizedSnapModelsForRoleWithWrongKey(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+
+	c.Check(keyData.SetAuthorizedSnapModelsForRole(make(AuxiliaryKey, 32), "recovery", model), ErrorMatches, "incorrect key supplied")
+
+	authorized, err := keyData.IsSnapModelAuthorizedForRole(auxKey, "recovery", model)
+	c.Check(err, IsNil)
+	c.Check(authorized, testutil.IsFalse)
+}
+
+// mockSnapAssertionStack signs a brand's account, account-key and model
+// assertions with a chain of keys rooted at a trusted account-key.
+type mockSnapAssertionStack struct {
+	db         *asserts.Database
+	brandKeyID string
+	trusted    []asserts.Assertion
+	brand      []asserts.Assertion
+}
+
+func newMockSnapAssertionStack(c *C, brandID string) *mockSnapAssertionStack {
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{KeypairManager: asserts.NewMemoryKeypairManager()})
+	c.Assert(err, IsNil)
+
+	newKey := func() asserts.PrivateKey {
+		k, err := rsa.GenerateKey(testutil.RandReader, 2048)
+		c.Assert(err, IsNil)
+		key := asserts.RSAPrivateKey(k)
+		c.Assert(db.ImportKey(key), IsNil)
+		return key
+	}
+
+	since := time.Now().Add(-time.Hour).Format(time.RFC3339)
+
+	signAccount := func(accountID, signKeyID string, key asserts.PrivateKey) []asserts.Assertion {
+		account, err := db.Sign(asserts.AccountType, map[string]interface{}{
+			"authority-id": "fake-root",
+			"account-id":   accountID,
+			"display-name": accountID,
+			"validation":   "verified",
+			"timestamp":    since}, nil, signKeyID)
+		c.Assert(err, IsNil)
+
+		pubKey, err := asserts.EncodePublicKey(key.PublicKey())
+		c.Assert(err, IsNil)
+		accountKey, err := db.Sign(asserts.AccountKeyType, map[string]interface{}{
+			"authority-id":        "fake-root",
+			"account-id":          accountID,
+			"name":                "default",
+			"public-key-sha3-384": key.PublicKey().ID(),
+			"since":               since}, pubKey, signKeyID)
+		c.Assert(err, IsNil)
+
+		return []asserts.Assertion{account, accountKey}
+	}
+
+	rootKey := newKey()
+	brandKey := newKey()
+
+	return &mockSnapAssertionStack{
+		db:         db,
+		brandKeyID: brandKey.PublicKey().ID(),
+		trusted:    signAccount("fake-root", rootKey.PublicKey().ID(), rootKey),
+		brand:      signAccount(brandID, rootKey.PublicKey().ID(), brandKey)}
+}
+
+func (s *mockSnapAssertionStack) signModel(c *C, headers map[string]interface{}) asserts.Assertion {
+	template := map[string]interface{}{
+		"authority-id": s.brand[0].HeaderString("account-id"),
+		"brand-id":     s.brand[0].HeaderString("account-id"),
+		"series":       "16",
+		"architecture": "amd64",
+		"base":         "core20",
+		"grade":        "secured",
+		"timestamp":    time.Now().Format(time.RFC3339),
+		"snaps": []interface{}{
+			map[string]interface{}{
+				"name": "fake-linux",
+				"id":   "fakelinuxidididididididididididi",
+				"type": "kernel",
+			},
+			map[string]interface{}{
+				"name": "fake-gadget",
+				"id":   "fakegadgetididididididididididid",
+				"type": "gadget",
+			},
+		},
+	}
+	for k, v := range headers {
+		template[k] = v
+	}
+
+	model, err := s.db.Sign(asserts.ModelType, template, nil, s.brandKeyID)
+	c.Assert(err, IsNil)
+	return model
+}
+
+func (s *mockSnapAssertionStack) encode(c *C, assertions ...asserts.Assertion) []byte {
+	buf := new(bytes.Buffer)
+	enc := asserts.NewEncoder(buf)
+	for _, a := range assertions {
+		c.Assert(enc.Encode(a), IsNil)
+	}
+	return buf.Bytes()
+}
+
+func (s *keyDataSuite) TestCheckSnapModelAssertionsForRole(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	stack := newMockSnapAssertionStack(c, "fake-brand")
+	model := stack.signModel(c, map[string]interface{}{"model": "fake-model"})
+	c.Check(keyData.SetAuthorizedSnapModelsForRole(auxKey, "recovery", model.(SnapModel)), IsNil)
+
+	verified, err := keyData.CheckSnapModelAssertionsForRole(auxKey, "recovery",
+		stack.encode(c, append(stack.brand, model)...), stack.trusted)
+	c.Check(err, IsNil)
+	c.Assert(verified, NotNil)
+	c.Check(verified.BrandID(), Equals, "fake-brand")
+	c.Check(verified.Model(), Equals, "fake-model")
+}
+
+func (s *keyDataSuite) TestCheckSnapModelAssertionsForRoleNotAuthorized(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	stack := newMockSnapAssertionStack(c, "fake-brand")
+	model := stack.signModel(c, map[string]interface{}{"model": "fake-model"})
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, model.(SnapModel)), IsNil)
+
+	// The model is only authorized for the default role.
+	_, err = keyData.CheckSnapModelAssertionsForRole(auxKey, "recovery",
+		stack.encode(c, append(stack.brand, model)...), stack.trusted)
+	c.Check(err, Equals, ErrSnapModelNotAuthorized)
+
+	other := stack.signModel(c, map[string]interface{}{"model": "other-model"})
+	_, err = keyData.CheckSnapModelAssertionsForRole(auxKey, DefaultSnapModelRole,
+		stack.encode(c, append(stack.brand, other)...), stack.trusted)
+	c.Check(err, Equals, ErrSnapModelNotAuthorized)
+}
+
+func (s *keyDataSuite) TestCheckSnapModelAssertionsForRoleUntrusted(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	stack := newMockSnapAssertionStack(c, "fake-brand")
+	model := stack.signModel(c, map[string]interface{}{"model": "fake-model"})
+	c.Check(keyData.SetAuthorizedSnapModels(auxKey, model.(SnapModel)), IsNil)
+
+	// Verify against a different root of trust.
+	otherStack := newMockSnapAssertionStack(c, "fake-brand")
+	_, err = keyData.CheckSnapModelAssertionsForRole(auxKey, DefaultSnapModelRole,
+		stack.encode(c, append(stack.brand, model)...), otherStack.trusted)
+	c.Check(err, ErrorMatches, "invalid snap model assertion: cannot verify account assertion: .*")
+	c.Check(err, FitsTypeOf, &InvalidSnapModelAssertionError{})
+}
+
+func (s *keyDataSuite) TestCheckSnapModelAssertionsForRoleNoModel(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	stack := newMockSnapAssertionStack(c, "fake-brand")
+	_, err = keyData.CheckSnapModelAssertionsForRole(auxKey, DefaultSnapModelRole,
+		stack.encode(c, stack.brand...), stack.trusted)
+	c.Check(err, ErrorMatches, "invalid snap model assertion: no model assertion supplied")
+	c.Check(err, FitsTypeOf, &InvalidSnapModelAssertionError{})
+}
+
+func (s *keyDataSuite) TestCheckSnapModelAssertionsForRoleInvalidEncoding(c *C) {
+	key, auxKey := s.newKeyDataKeys(c, 32, 32)
+	protected := s.mockProtectKeys(c, key, auxKey, crypto.SHA256)
+
+	keyData, err := NewKeyData(protected)
+	c.Assert(err, IsNil)
+
+	stack := newMockSnapAssertionStack(c, "fake-brand")
+	_, err = keyData.CheckSnapModelAssertionsForRole(auxKey, DefaultSnapModelRole,
+		[]byte("type: model\n\ngarbage"), stack.trusted)
+	c.Check(err, ErrorMatches, "invalid snap model assertion: cannot decode assertion: .*")
+	c.Check(err, FitsTypeOf, &InvalidSnapModelAssertionError{})
+}
+
+func (s *keyDataSuite) TestListAuthorizedSnapModelsLegacy(c *C) {
+	// Key data written by older versions doesn't record the identities
+	// of the authorized models.
+	auxKey := testutil.DecodeHexString(c, "8107f1c65c58934f0d59245d1d94d312ea803e69c8599a7bac8c67fe253232f2")
+	j := []byte(
+		`{` +
+			`"platform_name":"mock",` +
+			`"platform_handle":"iTnGw6iFTfDgGS+KMtDHx2yF0bpNaTWyzeLtsbaC9YaspcssRrHzcRsNrubyEVT9",` +
+			`"encrypted_payload":"fYM/SYjIRZj7JOJA710c9hSsxp5NpEchEVXgozd1KgxqZ/TOzIvWF9WYSrRcXiy1vsyjhkF0Svh3ihfApzvje7tTQRI=",` +
+			`"authorized_snap_models":{` +
+			`"alg":"sha256",` +
+			`"key_digest":"ECpFZzxG8XWUKGylGggA2HR+8pERsmA891SmDvs3NiE=",` +
+			`"hmacs":["pcYGJdlrxgn6M5Q4gq23cykD1D6X68XBZV+Ikzoyxo0="]}}
+`)
+
+	keyData, err := ReadKeyData(&mockKeyDataReader{Reader: bytes.NewReader(j)})
+	c.Assert(err, IsNil)
+
+	_, err = keyData.ListAuthorizedSnapModels()
+	c.Check(err, ErrorMatches, "key data does not record the identities of its authorized models")
+
+	model := testutil.MakeMockCore20ModelAssertion(c, map[string]interface{}{
+		"authority-id": "fake-brand",
+		"series":       "16",
+		"brand-id":     "fake-brand",
+		"model":        "fake-model",
+		"grade":        "secured",
+	}, "Jv8_JiHiIzJVcO9M55pPdqSDWUvuhfDIBJUS-3VW7F_idjix7Ffn5qMxB21ZQuij")
+	c.Check(keyData.RemoveAuthorizedSnapModels(auxKey, model), IsNil)
+
+	ok, err := keyData.IsSnapModelAuthorized(auxKey, model)
+	c.Check(err, IsNil)
+	c.Check(ok, testutil.IsFalse)
+
+	list, err := keyData.ListAuthorizedSnapModels()
+	c.Check(err, IsNil)
+	c.Check(list, HasLen, 0)
+}
+
 type testWriteAtomicData struct {
 	keyData      *KeyData
 	creationData *KeyCreationData
@@ -35,7 +35,170 @@ const (
 	keyringPurposeDiskUnlock = "unlock"
 )
 
-var ErrKernelKeyNotFound = errors.New("cannot find key in kernel keyring")
+var (
+	ErrKernelKeyNotFound = errors.New("cannot find key in kernel keyring")
+
+	keyringCheckUserKeyringAvailable = keyring.CheckUserKeyringAvailable
+	keyringCheckKeyringAvailable     = keyring.CheckKeyringAvailable
+)
+
+// KeyringTarget selects the kernel keyring that the ActivateVolumeWith*
+// family of functions add keys to after successful activation.
+type KeyringTarget int
+
+const (
+	// KeyringTargetUser indicates that keys should be added to the user
+	// keyring. This is the default. Keys in the user keyring can only be
+	// read by processes that possess them, which requires the user
+	// keyring to be linked from the session keyring.
+	KeyringTargetUser KeyringTarget = iota
+
+	// KeyringTargetSession indicates that keys should be added to the
+	// session keyring. This is useful for services that run in their
+	// own session keyring, from which the user keyring isn't reachable.
+	KeyringTargetSession
+
+	// KeyringTargetProcess indicates that keys should be added to the
+	// process keyring. Keys added here are only accessible to the
+	// current process, and are discarded when it exits.
+	KeyringTargetProcess
+)
+
+func (t KeyringTarget) String() string {
+	switch t {
+	case KeyringTargetUser:
+		return "user keyring"
+	case KeyringTargetSession:
+		return "session keyring"
+	case KeyringTargetProcess:
+		return "process keyring"
+	default:
+		return fmt.Sprintf("invalid keyring target (%d)", int(t))
+	}
+}
+
+func (t KeyringTarget) keyringID() int {
+	switch t {
+	case KeyringTargetSession:
+		return keyring.SessionKeyring
+	case KeyringTargetProcess:
+		return keyring.ProcessKeyring
+	default:
+		return keyring.UserKeyring
+	}
+}
+
+// keyringSearchOrder is the order in which keyrings are searched when
+// retrieving or removing keys.
+var keyringSearchOrder = []KeyringTarget{KeyringTargetUser, KeyringTargetSession, KeyringTargetProcess}
+
+// KeyringInsertionPolicy describes how the ActivateVolumeWith* family of
+// functions behave with respect to adding keys to the kernel's user keyring
+// after successful activation. If a different keyring is selected with
+// ActivateVolumeOptions.KeyringTarget, the policy applies to that keyring
+// instead.
+//
+// The availability of the user keyring is checked before any activation is
+// attempted. Only a keyring that is unavailable at this point can cause
+// activation to fail, and only with KeyringInsertionRequired. Failures to
+// add individual keys once a volume has been activated are always tolerated
+// and are only reported to stderr, as the volume is already unlocked at this
+// point.
+type KeyringInsertionPolicy int
+
+const (
+	// KeyringInsertionBestEffort indicates that keys should be added to
+	// the user keyring if it is available. If the user keyring is not
+	// available, a warning is printed to stderr and activation proceeds
+	// without adding any keys. This is the default.
+	KeyringInsertionBestEffort KeyringInsertionPolicy = iota
+
+	// KeyringInsertionRequired indicates that keys must be added to the
+	// user keyring. If the user keyring is not available, activation is
+	// not attempted and an error is returned.
+	KeyringInsertionRequired
+
+	// KeyringInsertionDisabled indicates that no keys should be added
+	// to the user keyring.
+	KeyringInsertionDisabled
+)
+
+// shouldInsertKeysIntoKeyring determines whether keys should be added to the
+// target keyring after activation, based on the supplied policy and whether the
+// target keyring is available.
+func shouldInsertKeysIntoKeyring(policy KeyringInsertionPolicy, target KeyringTarget) (bool, error) {
+	switch target {
+	case KeyringTargetUser, KeyringTargetSession, KeyringTargetProcess:
+	default:
+		return false, errors.New("invalid KeyringTarget")
+	}
+
+	switch policy {
+	case KeyringInsertionBestEffort, KeyringInsertionRequired:
+		// Handled below
+	case KeyringInsertionDisabled:
+		return false, nil
+	default:
+		return false, errors.New("invalid KeyringInsertionPolicy")
+	}
+
+	var err error
+	if target == KeyringTargetUser {
+		err = keyringCheckUserKeyringAvailable()
+	} else {
+		err = keyringCheckKeyringAvailable(target.keyringID())
+	}
+	if err != nil {
+		if policy == KeyringInsertionRequired {
+			return false, xerrors.Errorf("%v is unavailable: %w", target, err)
+		}
+		fmt.Fprintf(os.Stderr, "secboot: The %v is unavailable, keys will not be added to it: %v\n", target, err)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// addKeyToKernel adds the supplied key to the target keyring. As this happens
+// after successful activation, failures are only reported to stderr.
+func addKeyToKernel(key []byte, devicePath, purpose, prefix string, target KeyringTarget) {
+	if err := keyring.AddKeyToKeyring(key, devicePath, purpose, prefix, target.keyringID()); err != nil {
+		fmt.Fprintf(os.Stderr, "secboot: Cannot add key to %v: %v\n", target, err)
+	}
+}
+
+// getKeyFromKernel retrieves the key for the specified device path and purpose,
+// searching each of the keyrings that activation can add keys to.
+func getKeyFromKernel(prefix, devicePath, purpose string, remove bool) ([]byte, error) {
+	for _, target := range keyringSearchOrder {
+		key, err := keyring.GetKeyFromKeyring(devicePath, purpose, keyringPrefixOrDefault(prefix), target.keyringID())
+		var e syscall.Errno
+		switch {
+		case err == nil:
+		case xerrors.As(err, &e) && e == syscall.ENOKEY:
+			continue
+		default:
+			return nil, err
+		}
+
+		if remove {
+			if err := keyring.RemoveKeyFromKeyring(devicePath, purpose, keyringPrefixOrDefault(prefix), target.keyringID()); err != nil {
+				fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
+			}
+		}
+
+		return key, nil
+	}
+
+	return nil, ErrKernelKeyNotFound
+}
+
+// keyringNamedKeyID returns the identifier used in place of a device path
+// for keys added to the kernel keyring under a caller-chosen name. This
+// can't collide with the absolute path of a device.
+func keyringNamedKeyID(name string) string {
+	return "@" + name
+}
 
 func keyringPrefixOrDefault(prefix string) string {
 	if prefix == "" {
@@ -53,23 +216,22 @@ func keyringPrefixOrDefault(prefix string) string {
 //
 // If no key is found, a ErrKernelKeyNotFound error will be returned.
 func GetDiskUnlockKeyFromKernel(prefix, devicePath string, remove bool) (DiskUnlockKey, error) {
-	key, err := keyring.GetKeyFromUserKeyring(devicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(prefix))
-	if err != nil {
-		var e syscall.Errno
-		if xerrors.As(err, &e) && e == syscall.ENOKEY {
-			return nil, ErrKernelKeyNotFound
-		}
-		return nil, err
-
-	}
-
-	if remove {
-		if err := keyring.RemoveKeyFromUserKeyring(devicePath, keyringPurposeDiskUnlock, keyringPrefixOrDefault(prefix)); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
-		}
-	}
+	return getKeyFromKernel(prefix, devicePath, keyringPurposeDiskUnlock, remove)
+}
 
-	return key, nil
+// GetDiskUnlockKeyFromKernelByName retrieves the key that was used to
+// unlock an encrypted container, which was added to the kernel keyring
+// under the specified name via ActivateVolumeOptions.KeyringKeyName. The
+// value of prefix must match the prefix that was supplied via
+// ActivateVolumeOptions during unlocking.
+//
+// If remove is true, the key will be removed from the kernel keyring prior
+// to returning. This does not remove the entry associated with the device
+// path.
+//
+// If no key is found, a ErrKernelKeyNotFound error will be returned.
+func GetDiskUnlockKeyFromKernelByName(prefix, name string, remove bool) (DiskUnlockKey, error) {
+	return getKeyFromKernel(prefix, keyringNamedKeyID(name), keyringPurposeDiskUnlock, remove)
 }
 
 // GetAuxiliaryKeyFromKernel retrieves the auxiliary key associated with the
@@ -82,21 +244,54 @@ func GetDiskUnlockKeyFromKernel(prefix, devicePath string, remove bool) (DiskUnl
 //
 // If no key is found, a ErrKernelKeyNotFound error will be returned.
 func GetAuxiliaryKeyFromKernel(prefix, devicePath string, remove bool) (AuxiliaryKey, error) {
-	key, err := keyring.GetKeyFromUserKeyring(devicePath, keyringPurposeAuxiliary, keyringPrefixOrDefault(prefix))
-	if err != nil {
+	return getKeyFromKernel(prefix, devicePath, keyringPurposeAuxiliary, remove)
+}
+
+// removeKeyFromKernel removes the key for the specified identifier and purpose
+// from each of the keyrings that activation can add keys to. Keys that don't
+// exist are ignored.
+func removeKeyFromKernel(prefix, id, purpose string) error {
+	for _, target := range keyringSearchOrder {
+		err := keyring.RemoveKeyFromKeyring(id, purpose, keyringPrefixOrDefault(prefix), target.keyringID())
 		var e syscall.Errno
-		if xerrors.As(err, &e) && e == syscall.ENOKEY {
-			return nil, ErrKernelKeyNotFound
+		switch {
+		case err == nil:
+		case xerrors.As(err, &e) && e == syscall.ENOKEY:
+			// Nothing to remove.
+		default:
+			return xerrors.Errorf("cannot remove key with purpose %q from %v: %w", purpose, target, err)
 		}
-		return nil, err
+	}
+
+	return nil
+}
 
+// RemoveKeysFromKernel removes the disk unlock key and auxiliary key that were
+// added to the user keyring when the encrypted container at the specified path
+// was unlocked. The value of prefix must match the prefix that was supplied via
+// ActivateVolumeOptions during unlocking. Keys are removed from each of the
+// keyrings that can be selected with ActivateVolumeOptions.KeyringTarget.
+//
+// If the container was unlocked with ActivateVolumeOptions.KeyringKeyName set,
+// the name should be supplied via the names argument so that the additional
+// entry added under that name is also removed.
+//
+// This is intended to be called once the keys have been retrieved with
+// GetDiskUnlockKeyFromKernel and GetAuxiliaryKeyFromKernel, so that they don't
+// remain in the keyring for longer than necessary. Keys that don't exist are
+// ignored.
+func RemoveKeysFromKernel(prefix, devicePath string, names ...string) error {
+	for _, purpose := range []string{keyringPurposeDiskUnlock, keyringPurposeAuxiliary} {
+		if err := removeKeyFromKernel(prefix, devicePath, purpose); err != nil {
+			return err
+		}
 	}
 
-	if remove {
-		if err := keyring.RemoveKeyFromUserKeyring(devicePath, keyringPurposeAuxiliary, keyringPrefixOrDefault(prefix)); err != nil {
-			fmt.Fprintf(os.Stderr, "secboot: cannot remove key from keyring: %v\n", err)
+	for _, name := range names {
+		if err := removeKeyFromKernel(prefix, keyringNamedKeyID(name), keyringPurposeDiskUnlock); err != nil {
+			return xerrors.Errorf("cannot remove key with name %q: %w", name, err)
 		}
 	}
 
-	return key, nil
+	return nil
 }
@@ -111,6 +111,20 @@ func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelAndRemove(c *C) {
 	c.Check(err, ErrorMatches, "cannot find key: required key not available")
 }
 
+func (s *keyringSuite) TestGetDiskUnlockKeyFromKernelByName(c *C) {
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "@data", "unlock", "ubuntu-fde"), IsNil)
+
+	key2, err := GetDiskUnlockKeyFromKernelByName("", "data", false)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+
+	_, err = GetDiskUnlockKeyFromKernel("", "data", false)
+	c.Check(err, ErrorMatches, "cannot find key in kernel keyring")
+}
+
 type testGetAuxiliaryKeyFromKernelData struct {
 	key        AuxiliaryKey
 	prefix     string
@@ -169,3 +183,67 @@ func (s *keyringSuite) TestGetAuxiliaryKeyFromKernelAndRemove(c *C) {
 	_, err = keyring.GetKeyFromUserKeyring("/dev/sda1", "aux", "ubuntu-fde")
 	c.Check(err, ErrorMatches, "cannot find key: required key not available")
 }
+
+func (s *keyringSuite) TestRemoveKeysFromKernel(c *C) {
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+	auxKey := make(AuxiliaryKey, 32)
+	rand.Read(auxKey)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda1", "unlock", "foo"), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(auxKey, "/dev/sda1", "aux", "foo"), IsNil)
+
+	c.Check(RemoveKeysFromKernel("foo", "/dev/sda1"), IsNil)
+
+	_, err := GetDiskUnlockKeyFromKernel("foo", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+	_, err = GetAuxiliaryKeyFromKernel("foo", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+}
+
+func (s *keyringSuite) TestRemoveKeysFromKernelWithNames(c *C) {
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+	auxKey := make(AuxiliaryKey, 32)
+	rand.Read(auxKey)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda1", "unlock", "ubuntu-fde"), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(auxKey, "/dev/sda1", "aux", "ubuntu-fde"), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(key, "@data", "unlock", "ubuntu-fde"), IsNil)
+	c.Check(keyring.AddKeyToUserKeyring(key, "@save", "unlock", "ubuntu-fde"), IsNil)
+
+	c.Check(RemoveKeysFromKernel("", "/dev/sda1", "data"), IsNil)
+
+	_, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+	_, err = GetAuxiliaryKeyFromKernel("", "/dev/sda1", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+	_, err = GetDiskUnlockKeyFromKernelByName("", "data", false)
+	c.Check(err, Equals, ErrKernelKeyNotFound)
+
+	// Keys with other names should be left alone.
+	key2, err := GetDiskUnlockKeyFromKernelByName("", "save", true)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+}
+
+func (s *keyringSuite) TestRemoveKeysFromKernelWithNamesNoKeys(c *C) {
+	c.Check(RemoveKeysFromKernel("", "/dev/sda1", "data"), IsNil)
+}
+
+func (s *keyringSuite) TestRemoveKeysFromKernelDifferentPath(c *C) {
+	key := make(DiskUnlockKey, 32)
+	rand.Read(key)
+
+	c.Check(keyring.AddKeyToUserKeyring(key, "/dev/sda1", "unlock", "ubuntu-fde"), IsNil)
+
+	c.Check(RemoveKeysFromKernel("", "/dev/sda2"), IsNil)
+
+	key2, err := GetDiskUnlockKeyFromKernel("", "/dev/sda1", true)
+	c.Check(err, IsNil)
+	c.Check(key2, DeepEquals, key)
+}
+
+func (s *keyringSuite) TestRemoveKeysFromKernelNoKeys(c *C) {
+	c.Check(RemoveKeysFromKernel("", "/dev/sda1"), IsNil)
+}
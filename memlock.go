@@ -0,0 +1,68 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/snapcore/secboot/internal/luks2"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	unixMlock   = unix.Mlock
+	unixMunlock = unix.Munlock
+)
+
+// shouldLockKeyMemory indicates whether key material used for activation
+// with the supplied options should be locked in to memory.
+func shouldLockKeyMemory(options *luks2.ActivateOptions) bool {
+	return options != nil && options.LockKeyMemory
+}
+
+// lockKeyMemory locks the pages containing the supplied key in to memory so
+// that they are not written to swap, and returns a function to unlock them
+// again. Locks are not reference counted, so the returned function should only
+// be called once the key and any other key material in the same pages have
+// been wiped.
+//
+// Failing to lock the key isn't fatal. If the key cannot be locked, eg, because
+// RLIMIT_MEMLOCK is too low, a warning is printed and a function that does
+// nothing is returned.
+func lockKeyMemory(key []byte) (unlock func()) {
+	if len(key) == 0 {
+		return func() {}
+	}
+
+	if err := unixMlock(key); err != nil {
+		var hint string
+		if err == unix.ENOMEM || err == unix.EPERM {
+			hint = " (RLIMIT_MEMLOCK may be too low)"
+		}
+		fmt.Fprintf(os.Stderr, "secboot: Cannot lock key in to memory: %v%s\n", err, hint)
+		return func() {}
+	}
+
+	return func() {
+		unixMunlock(key)
+	}
+}
@@ -20,13 +20,17 @@
 package secboot
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/hmac"
 	_ "crypto/sha256"
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash"
+	"io"
 
 	"github.com/snapcore/snapd/asserts"
 
@@ -50,6 +54,25 @@ type SnapModel interface {
 	SignKeyID() string
 }
 
+// AuthorizedSnapModel identifies a Snap device model that has been authorized
+// to access the data protected by a KeyData.
+type AuthorizedSnapModel struct {
+	BrandID string             `json:"brand-id"`
+	Model   string             `json:"model"`
+	Series  string             `json:"series"`
+	Grade   asserts.ModelGrade `json:"grade"`
+	Classic bool               `json:"classic,omitempty"`
+}
+
+func makeAuthorizedSnapModel(model SnapModel) AuthorizedSnapModel {
+	return AuthorizedSnapModel{
+		BrandID: model.BrandID(),
+		Model:   model.Model(),
+		Series:  model.Series(),
+		Grade:   model.Grade(),
+		Classic: model.Classic()}
+}
+
 func computeSnapModelHMAC(alg crypto.Hash, key []byte, model SnapModel) (snapModelHMAC, error) {
 	// XXX: Probably would be nice to know the hash algorithm used for the signing key,
 	// rather than just assuming SHA3-384 here. Note that the actual algorithm ID here
@@ -87,3 +110,102 @@ func computeSnapModelHMAC(alg crypto.Hash, key []byte, model SnapModel) (snapMod
 
 	return h.Sum(nil), nil
 }
+
+// ErrSnapModelNotAuthorized is returned from
+// KeyData.CheckSnapModelAssertionsForRole if the supplied model assertion is
+// valid but the model it describes is not authorized to access the data
+// protected by the key data.
+var ErrSnapModelNotAuthorized = errors.New("snap model is not authorized")
+
+// InvalidSnapModelAssertionError is returned from
+// KeyData.CheckSnapModelAssertionsForRole if the supplied assertions cannot be
+// decoded, if any of them cannot be verified against the supplied trusted
+// assertions, or if they don't contain a model assertion.
+type InvalidSnapModelAssertionError struct {
+	err error
+}
+
+func (e *InvalidSnapModelAssertionError) Error() string {
+	return fmt.Sprintf("invalid snap model assertion: %v", e.err)
+}
+
+func (e *InvalidSnapModelAssertionError) Unwrap() error {
+	return e.err
+}
+
+// verifySnapModelAssertions decodes the supplied encoded assertions and adds
+// them to a temporary assertion database containing only the supplied trusted
+// assertions, so that the signature and signing authority of each one is
+// checked. It returns the model assertion from the supplied assertions.
+func verifySnapModelAssertions(data []byte, trusted []asserts.Assertion) (*asserts.Model, error) {
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore: asserts.NewMemoryBackstore(),
+		Trusted:   trusted})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open assertion database: %w", err)
+	}
+
+	var model *asserts.Model
+
+	dec := asserts.NewDecoder(bytes.NewReader(data))
+	for {
+		a, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &InvalidSnapModelAssertionError{xerrors.Errorf("cannot decode assertion: %w", err)}
+		}
+
+		if err := db.Add(a); err != nil {
+			return nil, &InvalidSnapModelAssertionError{xerrors.Errorf("cannot verify %s assertion: %w", a.Type().Name, err)}
+		}
+
+		if m, ok := a.(*asserts.Model); ok {
+			if model != nil {
+				return nil, &InvalidSnapModelAssertionError{errors.New("more than one model assertion supplied")}
+			}
+			model = m
+		}
+	}
+
+	if model == nil {
+		return nil, &InvalidSnapModelAssertionError{errors.New("no model assertion supplied")}
+	}
+
+	return model, nil
+}
+
+// CheckSnapModelAssertionsForRole verifies the supplied chain of encoded
+// assertions and checks whether the model assertion contained in it is
+// authorized for the specified role.
+//
+// The assertions are supplied in the format produced by asserts.Encode, and
+// would normally consist of the brand's account and account-key assertions
+// followed by the model assertion. Each assertion must be signed by a key
+// that is either present in the trusted assertions or that is introduced by
+// an earlier assertion in the chain. If any assertion cannot be decoded or
+// verified, or the chain doesn't contain exactly one model assertion, an
+// *InvalidSnapModelAssertionError error will be returned.
+//
+// If the model assertion is valid but the model is not authorized for the
+// specified role, ErrSnapModelNotAuthorized will be returned.
+//
+// On success, the verified model assertion is returned. The supplied auxKey
+// is obtained using one of the RecoverKeys* functions.
+func (d *KeyData) CheckSnapModelAssertionsForRole(auxKey AuxiliaryKey, role string, assertions []byte, trusted []asserts.Assertion) (*asserts.Model, error) {
+	model, err := verifySnapModelAssertions(assertions, trusted)
+	if err != nil {
+		return nil, err
+	}
+
+	authorized, err := d.IsSnapModelAuthorizedForRole(auxKey, role, model)
+	switch {
+	case err != nil:
+		return nil, xerrors.Errorf("cannot check if snap model is authorized: %w", err)
+	case !authorized:
+		return nil, ErrSnapModelNotAuthorized
+	}
+
+	return model, nil
+}
@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/canonical/go-tpm2"
@@ -218,6 +219,13 @@ func (k *SealedKeyObject) PCRPolicyCounterHandle() tpm2.Handle {
 	return k.data.Policy().PCRPolicyCounterHandle()
 }
 
+// PCRPolicySequence indicates the sequence number of the current PCR policy for this sealed key object. This is incremented
+// on each call to UpdatePCRProtectionPolicy, and PCR policies with a sequence number lower than the value of the PCR policy
+// counter cannot be satisfied. This is meaningless if PCRPolicyCounterHandle returns tpm2.HandleNull.
+func (k *SealedKeyObject) PCRPolicySequence() uint64 {
+	return k.data.Policy().PCRPolicySequence()
+}
+
 // WriteAtomic will serialize this SealedKeyObject to the supplied writer.
 func (k *SealedKeyObject) WriteAtomic(w secboot.KeyDataWriter) error {
 	if _, err := mu.MarshalToWriter(w, k.data.Version()); err != nil {
@@ -270,6 +278,12 @@ func NewFileSealedKeyObjectReader(path string) (io.Reader, error) {
 	}
 	defer f.Close()
 
+	return newKeyFileReader(f)
+}
+
+// newKeyFileReader decodes the key file specific metadata from the supplied
+// reader, and returns a reader that can be passed to ReadSealedKeyObject.
+func newKeyFileReader(f io.Reader) (*bytes.Buffer, error) {
 	// v0 files contain the following structure:
 	//  magic   uint32 // 0x55534b24
 	//  version uint32 // 0
@@ -401,6 +415,58 @@ func NewFileSealedKeyObjectWriter(path string) *FileSealedKeyObjectWriter {
 	return &FileSealedKeyObjectWriter{new(bytes.Buffer), path}
 }
 
+// eofTrackingReader records whether the underlying reader has reached the
+// end of its data.
+type eofTrackingReader struct {
+	io.Reader
+	eof bool
+}
+
+func (r *eofTrackingReader) Read(data []byte) (int, error) {
+	n, err := r.Reader.Read(data)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// ReadSealedKeyObjectFromReader reads a SealedKeyObject from the supplied io.Reader, which
+// provides data in the same format as the files created by SealKeyToTPM. This is useful for
+// sealed key objects that are delivered via a pipe or are embedded in another file, and
+// avoids having to write them to a temporary file first. The returned object behaves
+// identically to one returned from ReadSealedKeyObjectFromFile.
+//
+// If reading from the supplied reader fails, the returned error will wrap the error from
+// the reader. If the data ends before a complete sealed key object has been decoded, the
+// returned error will wrap io.ErrUnexpectedEOF. If the data cannot otherwise be deserialized
+// successfully, an InvalidKeyDataError error will be returned.
+func ReadSealedKeyObjectFromReader(r io.Reader) (*SealedKeyObject, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read sealed key object: %w", err)
+	}
+
+	src := &eofTrackingReader{Reader: bytes.NewReader(data)}
+	buf, err := newKeyFileReader(src)
+	if err != nil {
+		if src.eof {
+			return nil, xerrors.Errorf("sealed key object is truncated (%v): %w", err, io.ErrUnexpectedEOF)
+		}
+		return nil, err
+	}
+
+	keyData := &eofTrackingReader{Reader: buf}
+	k, err := ReadSealedKeyObject(keyData)
+	if err != nil {
+		if keyData.eof {
+			return nil, xerrors.Errorf("sealed key object is truncated (%v): %w", err, io.ErrUnexpectedEOF)
+		}
+		return nil, err
+	}
+
+	return k, nil
+}
+
 // ReadSealedKeyObjectFromFile reads a SealedKeyObject from the file created by SealKeyToTPM at the specified path.
 // If the file cannot be opened, an *os.PathError error is returned. If the file cannot be deserialized successfully,
 // an InvalidKeyDataError error will be returned.
@@ -411,3 +477,60 @@ func ReadSealedKeyObjectFromFile(path string) (*SealedKeyObject, error) {
 	}
 	return ReadSealedKeyObject(r)
 }
+
+// DumpSealedKeyPolicy reads the sealed key object from the file created by SealKeyToTPM at the specified path, and returns a
+// human-readable description of its authorization policy. This is intended to help with diagnosing unsealing failures, such
+// as when the TPM's current PCR values aren't consistent with the PCR policy.
+//
+// The description contains the PCR selection and the number of permitted combinations of PCR values (branches) of the
+// current PCR policy, the handle of the NV counter used for PCR policy revocation (which is also the PIN NV index for
+// version 0 key files) and the sequence number of the current PCR policy. A PCR policy is revoked once the PCR policy
+// counter is incremented beyond its sequence number.
+//
+// If the file cannot be opened, an *os.PathError error is returned. If the file cannot be deserialized successfully, an
+// InvalidKeyDataError error will be returned.
+func DumpSealedKeyPolicy(keyFile string) (string, error) {
+	k, err := ReadSealedKeyObjectFromFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	var pcrData *pcrPolicyData_v0
+	switch p := k.data.Policy().(type) {
+	case *keyDataPolicy_v0:
+		pcrData = p.PCRData
+	case *keyDataPolicy_v1:
+		pcrData = p.PCRData
+	default:
+		return "", fmt.Errorf("unrecognized policy type %T", p)
+	}
+
+	tree, err := pcrData.OrData.resolve()
+	if err != nil {
+		return "", InvalidKeyDataError{fmt.Sprintf("cannot resolve PCR policy branches: %v", err)}
+	}
+	branches := 0
+	for _, n := range tree.leafNodes {
+		branches += len(n.digests)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "version: %d\n", k.Version())
+	fmt.Fprintf(&b, "PCR selection:")
+	if len(pcrData.Selection) == 0 {
+		fmt.Fprintf(&b, " none")
+	}
+	for _, s := range pcrData.Selection {
+		fmt.Fprintf(&b, " %v:%v", s.Hash, s.Select)
+	}
+	fmt.Fprintf(&b, "\n")
+	fmt.Fprintf(&b, "PCR policy branches: %d\n", branches)
+	if k.Version() == 0 {
+		fmt.Fprintf(&b, "PIN NV index and PCR policy counter handle: %v\n", k.PCRPolicyCounterHandle())
+	} else {
+		fmt.Fprintf(&b, "PCR policy counter handle: %v\n", k.PCRPolicyCounterHandle())
+	}
+	fmt.Fprintf(&b, "PCR policy sequence: %d\n", pcrData.PolicySequence)
+
+	return b.String(), nil
+}
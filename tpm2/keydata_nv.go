@@ -0,0 +1,170 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+
+	"github.com/snapcore/secboot"
+)
+
+// NVSealedKeyObjectWriter is used to write a sealed key object to a NV index
+// using SealedKeyObject.WriteAtomic. This requires knowledge of the authorization
+// value for the storage hierarchy.
+//
+// If the NV index already exists and has the same size as the new data, it is
+// overwritten. If it has a different size, it is undefined and then redefined,
+// so an interruption during Commit can result in the sealed key object being
+// lost.
+type NVSealedKeyObjectWriter struct {
+	*bytes.Buffer
+	tpm    *Connection
+	handle tpm2.Handle
+}
+
+func (w *NVSealedKeyObjectWriter) Commit() error {
+	data := w.Bytes()
+	if len(data) > math.MaxUint16 {
+		return errors.New("sealed key object is too large")
+	}
+
+	session := w.tpm.HmacSession()
+
+	index, err := w.tpm.CreateResourceContextFromTPM(w.handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, w.handle):
+		// No existing index
+	case err != nil:
+		return xerrors.Errorf("cannot create context for existing NV index: %w", err)
+	default:
+		pub, _, err := w.tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return xerrors.Errorf("cannot read public area of existing NV index: %w", err)
+		}
+		if int(pub.Size) == len(data) {
+			if err := w.tpm.NVWrite(w.tpm.OwnerHandleContext(), index, data, 0, session); err != nil {
+				return xerrors.Errorf("cannot write NV index: %w", err)
+			}
+			return nil
+		}
+		if err := w.tpm.NVUndefineSpace(w.tpm.OwnerHandleContext(), index, session); err != nil {
+			return xerrors.Errorf("cannot undefine existing NV index: %w", err)
+		}
+	}
+
+	nvPub := tpm2.NVPublic{
+		Index:   w.handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    uint16(len(data))}
+	index, err = w.tpm.NVDefineSpace(w.tpm.OwnerHandleContext(), nil, &nvPub, session)
+	if err != nil {
+		return xerrors.Errorf("cannot define NV index: %w", err)
+	}
+
+	if err := w.tpm.NVWrite(w.tpm.OwnerHandleContext(), index, data, 0, session); err != nil {
+		w.tpm.NVUndefineSpace(w.tpm.OwnerHandleContext(), index, session)
+		return xerrors.Errorf("cannot write NV index: %w", err)
+	}
+
+	return nil
+}
+
+// NewNVSealedKeyObjectWriter creates a new writer for updating a sealed key object
+// stored in the NV index at the specified handle using SealedKeyObject.WriteAtomic.
+func NewNVSealedKeyObjectWriter(tpm *Connection, handle tpm2.Handle) *NVSealedKeyObjectWriter {
+	return &NVSealedKeyObjectWriter{new(bytes.Buffer), tpm, handle}
+}
+
+// ReadSealedKeyObjectFromNV reads a SealedKeyObject from the NV index at the specified
+// handle, previously created by SealKeyToTPMNV. If the NV index doesn't exist, a
+// tpm2.ResourceUnavailableError error is returned. If the data cannot be deserialized
+// successfully, an InvalidKeyDataError error will be returned.
+func ReadSealedKeyObjectFromNV(tpm *Connection, handle tpm2.Handle) (*SealedKeyObject, error) {
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, err := tpm.NVReadPublic(index, tpm.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of NV index: %w", err)
+	}
+
+	data, err := tpm.NVRead(index, index, pub.Size, 0, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read NV index: %w", err)
+	}
+
+	return ReadSealedKeyObject(bytes.NewReader(data))
+}
+
+// SealKeyToTPMNV seals the supplied disk encryption key to the storage hierarchy of the TPM. This behaves
+// in the same way as SealKeyToTPM, except that the sealed key object and associated metadata is stored in
+// a NV index at the specified handle rather than in a file. This is useful for systems that don't have
+// persistent storage available before the encrypted volume is unlocked. The sealed key object can be read
+// back with ReadSealedKeyObjectFromNV, and updated with SealedKeyObject.WriteAtomic using the writer
+// returned from NewNVSealedKeyObjectWriter.
+//
+// The handle must be a valid NV index handle (MSO == 0x01) that is different to the PCRPolicyCounterHandle
+// field of the params argument, and the choice of handle should take in to consideration the reserved
+// indices from the "Registry of reserved TPM 2.0 handles and localities" specification. If the handle is
+// already in use, a TPMResourceExistsError error will be returned.
+//
+// The created NV index can be read without any authorization, and can only be written with knowledge of
+// the authorization value for the storage hierarchy. If any part of this function fails, the NV index will
+// be undefined.
+func SealKeyToTPMNV(tpm *Connection, key secboot.DiskUnlockKey, handle tpm2.Handle, params *KeyCreationParams) (authKey secboot.AuxiliaryKey, err error) {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return nil, fmt.Errorf("invalid NV index handle %v", handle)
+	}
+	if params != nil && params.PCRPolicyCounterHandle == handle {
+		return nil, errors.New("NV index handle must be different to the PCR policy counter handle")
+	}
+
+	switch _, err := tpm.CreateResourceContextFromTPM(handle); {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		// ok
+	case err != nil:
+		return nil, xerrors.Errorf("cannot determine if NV index exists: %w", err)
+	default:
+		return nil, TPMResourceExistsError{handle}
+	}
+
+	return sealKeyToTPMMultiple(tpm, []*sealKeyToTPMRequest{{
+		key: key,
+		newWriter: func() secboot.KeyDataWriter {
+			return NewNVSealedKeyObjectWriter(tpm, handle)
+		},
+		remove: func() {
+			index, err := tpm.CreateResourceContextFromTPM(handle)
+			if err != nil {
+				return
+			}
+			tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, tpm.HmacSession())
+		}}}, params)
+}
@@ -0,0 +1,161 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tpm2_test
+
+import (
+	"math/rand"
+
+	"github.com/canonical/go-tpm2"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/secboot"
+	"github.com/snapcore/secboot/internal/testutil"
+	"github.com/snapcore/secboot/internal/tpm2test"
+	. "github.com/snapcore/secboot/tpm2"
+)
+
+type keyDataNVSuite struct {
+	tpm2test.TPMTest
+}
+
+func (s *keyDataNVSuite) SetUpSuite(c *C) {
+	s.TPMFeatures = tpm2test.TPMFeatureOwnerHierarchy |
+		tpm2test.TPMFeatureEndorsementHierarchy |
+		tpm2test.TPMFeatureLockoutHierarchy | // Allow the test fixture to reset the DA counter
+		tpm2test.TPMFeaturePCR |
+		tpm2test.TPMFeatureNV
+}
+
+func (s *keyDataNVSuite) SetUpTest(c *C) {
+	s.TPMTest.SetUpTest(c)
+
+	c.Assert(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil),
+		testutil.InSlice(Equals), []error{ErrTPMProvisioningRequiresLockout, nil})
+}
+
+var _ = Suite(&keyDataNVSuite{})
+
+func (s *keyDataNVSuite) TestSealKeyToTPMNV(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	handle := s.NextAvailableHandle(c, 0x01880000)
+	params := &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)}
+
+	authKey, err := SealKeyToTPMNV(s.TPM(), key, handle, params)
+	c.Assert(err, IsNil)
+
+	index, err := s.TPM().CreateResourceContextFromTPM(handle)
+	c.Assert(err, IsNil)
+	pub, _, err := s.TPM().NVReadPublic(index)
+	c.Check(err, IsNil)
+	c.Check(pub.Attrs, Equals, tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVOwnerWrite|tpm2.AttrNVAuthRead|tpm2.AttrNVNoDA|tpm2.AttrNVWritten))
+
+	k, err := ReadSealedKeyObjectFromNV(s.TPM(), handle)
+	c.Assert(err, IsNil)
+	c.Check(k.Version(), Equals, uint32(1))
+	c.Check(k.PCRPolicyCounterHandle(), Equals, params.PCRPolicyCounterHandle)
+
+	keyUnsealed, authKeyUnsealed, err := k.UnsealFromTPM(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+	c.Check(authKeyUnsealed, DeepEquals, authKey)
+}
+
+func (s *keyDataNVSuite) TestUpdateSealedKeyObjectInNV(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	handle := s.NextAvailableHandle(c, 0x01880000)
+	authKey, err := SealKeyToTPMNV(s.TPM(), key, handle, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromNV(s.TPM(), handle)
+	c.Assert(err, IsNil)
+
+	// Update the PCR policy so that it has a different size.
+	c.Check(k.UpdatePCRProtectionPolicy(s.TPM(), authKey,
+		tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 12, 23})), IsNil)
+	c.Check(k.WriteAtomic(NewNVSealedKeyObjectWriter(s.TPM(), handle)), IsNil)
+
+	k, err = ReadSealedKeyObjectFromNV(s.TPM(), handle)
+	c.Assert(err, IsNil)
+
+	keyUnsealed, _, err := k.UnsealFromTPM(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+	_, _, err = k.UnsealFromTPM(s.TPM())
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
+		"cannot execute PolicyOR assertions: current session digest not found in policy data")
+}
+
+func (s *keyDataNVSuite) TestSealKeyToTPMNVIndexExists(c *C) {
+	public := tpm2.NVPublic{
+		Index:   s.NextAvailableHandle(c, 0x01880000),
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &public)
+
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	_, err := SealKeyToTPMNV(s.TPM(), key, public.Index, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, testutil.ConvertibleTo, TPMResourceExistsError{})
+	c.Check(err.(TPMResourceExistsError).Handle, Equals, public.Index)
+}
+
+func (s *keyDataNVSuite) TestSealKeyToTPMNVInvalidHandle(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	_, err := SealKeyToTPMNV(s.TPM(), key, 0x81000001, &KeyCreationParams{PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Check(err, ErrorMatches, "invalid NV index handle 0x81000001")
+}
+
+func (s *keyDataNVSuite) TestSealKeyToTPMNVErrorUndefinesIndex(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	handle := s.NextAvailableHandle(c, 0x01880000)
+	_, err := SealKeyToTPMNV(s.TPM(), key, handle, &KeyCreationParams{
+		PCRProfile:             NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 50, make([]byte, tpm2.HashAlgorithmSHA256.Size())),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Check(err, ErrorMatches, "cannot create initial PCR policy: .*")
+
+	_, err = s.TPM().CreateResourceContextFromTPM(handle)
+	c.Check(tpm2.IsResourceUnavailableError(err, handle), testutil.IsTrue)
+}
+
+func (s *keyDataNVSuite) TestReadSealedKeyObjectFromNVMissing(c *C) {
+	handle := s.NextAvailableHandle(c, 0x01880000)
+	_, err := ReadSealedKeyObjectFromNV(s.TPM(), handle)
+	c.Check(tpm2.IsResourceUnavailableError(err, handle), testutil.IsTrue)
+}
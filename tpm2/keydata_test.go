@@ -21,17 +21,22 @@ package tpm2_test
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"path/filepath"
 
 	"github.com/canonical/go-tpm2"
 
 	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
 
 	. "gopkg.in/check.v1"
 
+	"github.com/snapcore/secboot"
 	"github.com/snapcore/secboot/internal/tpm2test"
 	. "github.com/snapcore/secboot/tpm2"
 )
@@ -126,3 +131,94 @@ func (s *keydataSuite) TestReadAndWrite(c *C) {
 	c.Assert(err, IsNil)
 	c.Check(k.Validate(s.TPM().TPMContext, authPrivateKey, s.TPM().HmacSession()), IsNil)
 }
+
+func (s *keydataSuite) sealKeyToFileData(c *C, key []byte) (data []byte, authPrivateKey secboot.AuxiliaryKey) {
+	keyFile := filepath.Join(c.MkDir(), "keydata")
+
+	authPrivateKey, err := SealKeyToTPM(s.TPM(), key, keyFile, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	data, err = ioutil.ReadFile(keyFile)
+	c.Assert(err, IsNil)
+	return data, authPrivateKey
+}
+
+func (s *keydataSuite) TestReadSealedKeyObjectFromReader(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	data, authPrivateKey := s.sealKeyToFileData(c, key)
+
+	k, err := ReadSealedKeyObjectFromReader(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Check(k.Validate(s.TPM().TPMContext, authPrivateKey, s.TPM().HmacSession()), IsNil)
+
+	keyUnsealed, authKeyUnsealed, err := k.UnsealFromTPM(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, secboot.DiskUnlockKey(key))
+	c.Check(authKeyUnsealed, DeepEquals, authPrivateKey)
+}
+
+func (s *keydataSuite) TestReadSealedKeyObjectFromReaderTruncated(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	data, _ := s.sealKeyToFileData(c, key)
+
+	for _, n := range []int{4, 16, len(data) - 1} {
+		_, err := ReadSealedKeyObjectFromReader(bytes.NewReader(data[:n]))
+		c.Check(err, ErrorMatches, "sealed key object is truncated \\(invalid key data: .*\\): unexpected EOF", Commentf("n: %d", n))
+		c.Check(xerrors.Is(err, io.ErrUnexpectedEOF), Equals, true, Commentf("n: %d", n))
+	}
+}
+
+func (s *keydataSuite) TestReadSealedKeyObjectFromReaderInvalid(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	data, _ := s.sealKeyToFileData(c, key)
+	data[0] ^= 0xff
+
+	_, err := ReadSealedKeyObjectFromReader(bytes.NewReader(data))
+	c.Check(err, ErrorMatches, "invalid key data: unexpected magic .*")
+	c.Check(err, FitsTypeOf, InvalidKeyDataError{})
+}
+
+func (s *keydataSuite) TestReadSealedKeyObjectFromReaderReadError(c *C) {
+	r, w := io.Pipe()
+	w.CloseWithError(errors.New("some error"))
+
+	_, err := ReadSealedKeyObjectFromReader(r)
+	c.Check(err, ErrorMatches, "cannot read sealed key object: some error")
+}
+
+func (s *keydataSuite) TestDumpSealedKeyPolicy(c *C) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	keyFile := filepath.Join(c.MkDir(), "keydata")
+
+	event := sha256.Sum256([]byte("foo"))
+	profile := tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}).
+		AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23),
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 23, event[:]))
+
+	_, err := SealKeyToTPM(s.TPM(), key, keyFile, &KeyCreationParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	dump, err := DumpSealedKeyPolicy(keyFile)
+	c.Check(err, IsNil)
+	c.Check(dump, Equals, fmt.Sprintf(`version: 1
+PCR selection: %v:[7 23]
+PCR policy branches: 2
+PCR policy counter handle: %v
+PCR policy sequence: 0
+`, tpm2.HashAlgorithmSHA256, tpm2.HandleNull))
+}
+
+func (s *keydataSuite) TestDumpSealedKeyPolicyMissingFile(c *C) {
+	_, err := DumpSealedKeyPolicy(filepath.Join(c.MkDir(), "keydata"))
+	c.Check(err, ErrorMatches, "open .*/keydata: no such file or directory")
+}
@@ -565,6 +565,26 @@ func (b *PCRProtectionProfileBranch) EndBranch() *PCRProtectionProfileBranchPoin
 // computed PCR policy and a branch point with m sub-branches is encountered,
 // the profile branch will be associated with n x m branches in the computed
 // PCR policy upon completion of the sub-branches.
+//
+// A profile with multiple branches can be used to create a key that can be
+// unsealed in more than one PCR state - for example, both before and after a
+// kernel or bootloader update. Each branch of the computed PCR policy produces
+// a composite PCR digest. When the policy is created, the policy digest for
+// each of these is computed, and these digests are grouped into a tree of
+// TPM2_PolicyOR assertions. Each node in the tree contains up to 8 digests,
+// which is the limit for a single TPM2_PolicyOR assertion. When unsealing, the
+// PCR assertion is executed with the current PCR values, and the resulting
+// session digest is located in a leaf node of the tree. A TPM2_PolicyOR
+// assertion is then executed for that node and for each of its ancestors in
+// turn, up to the root node. Unsealing therefore succeeds if the current PCR
+// values match any one of the branches.
+//
+// The tree has a maximum depth of 4, so a computed policy can have a maximum
+// of 4096 branches. Note that the branches multiply as described above, so
+// profiles with many nested branch points can exceed this limit quickly. The
+// size of the policy data stored with a key grows linearly with the number of
+// branches, and each additional level in the tree adds one TPM2_PolicyOR
+// command when unsealing.
 type PCRProtectionProfile struct {
 	root *PCRProtectionProfileBranch
 	err  error
@@ -577,6 +597,75 @@ func NewPCRProtectionProfile() *PCRProtectionProfile {
 	return profile
 }
 
+// maxPCRReadDigests is the maximum number of digests that can be returned
+// from a single TPM2_PCR_Read command.
+const maxPCRReadDigests = 8
+
+// ReadCurrentPCRValues reads the current values of the specified PCRs for the
+// specified algorithm from the TPM, returning a map of PCR index to digest. The
+// values are in the same form as those supplied to
+// PCRProtectionProfile.AddPCRValue, so this can be used to compare the values
+// computed from a PCR profile with the current state of a device.
+//
+// The PCR values are read using a single TPM2_PCR_Read command so that they
+// are consistent with each other. This means that no more than 8 PCRs can be
+// specified. If the TPM doesn't return a value for every requested PCR, an
+// error is returned.
+func ReadCurrentPCRValues(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId, pcrs ...int) (map[int]tpm2.Digest, error) {
+	if !alg.IsValid() {
+		return nil, errors.New("invalid digest algorithm")
+	}
+	switch {
+	case len(pcrs) == 0:
+		return nil, errors.New("no PCRs specified")
+	case len(pcrs) > maxPCRReadDigests:
+		return nil, fmt.Errorf("too many PCRs specified (cannot read more than %d PCRs with a single command)", maxPCRReadDigests)
+	}
+	for _, pcr := range pcrs {
+		if pcr < 0 || pcr > maxPCR {
+			return nil, fmt.Errorf("invalid PCR index %d", pcr)
+		}
+	}
+
+	_, values, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: alg, Select: pcrs}})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read current PCR values: %w", err)
+	}
+
+	out := make(map[int]tpm2.Digest)
+	for _, pcr := range pcrs {
+		value, ok := values[alg][pcr]
+		if !ok {
+			return nil, fmt.Errorf("TPM did not return a value for PCR %d", pcr)
+		}
+		out[pcr] = value
+	}
+
+	return out, nil
+}
+
+// NewPCRProtectionProfileFromCurrentValues creates a PCR profile with a single
+// branch containing the current values of the specified PCRs for the specified
+// algorithm, which are read from the TPM immediately. This is useful for
+// protecting a key with the current state of a device, where that state is
+// trusted.
+//
+// The PCR values are read using ReadCurrentPCRValues, so no more than 8 PCRs
+// can be specified.
+func NewPCRProtectionProfileFromCurrentValues(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId, pcrs ...int) (*PCRProtectionProfile, error) {
+	values, err := ReadCurrentPCRValues(tpm, alg, pcrs...)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := NewPCRProtectionProfile()
+	for _, pcr := range pcrs {
+		profile.RootBranch().AddPCRValue(alg, pcr, values[pcr])
+	}
+
+	return profile, nil
+}
+
 func (p *PCRProtectionProfile) fail(msg string) {
 	if p.err != nil {
 		return
@@ -958,3 +958,63 @@ func (s *pcrProfileTPMSuite) TestAddValueFromTPM(c *C) {
 	expectedDigest, _ := util.ComputePCRDigest(tpm2.HashAlgorithmSHA256, tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{23}}}, values)
 	c.Check(digests[0], DeepEquals, expectedDigest)
 }
+
+func (s *pcrProfileTPMSuite) TestNewPCRProtectionProfileFromCurrentValues(c *C) {
+	_, err := s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	_, values, err := s.TPM().PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 23}}})
+	c.Assert(err, IsNil)
+
+	p, err := NewPCRProtectionProfileFromCurrentValues(s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, 7, 23)
+	c.Assert(err, IsNil)
+
+	// The values are fixed at construction, so subsequent PCR
+	// changes don't affect the profile.
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("bar"), nil)
+	c.Check(err, IsNil)
+
+	computed, err := p.ComputePCRValues(nil)
+	c.Check(err, IsNil)
+	c.Check(computed, DeepEquals, []tpm2.PCRValues{values})
+}
+
+func (s *pcrProfileTPMSuite) TestReadCurrentPCRValues(c *C) {
+	_, err := s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	_, expected, err := s.TPM().PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 23}}})
+	c.Assert(err, IsNil)
+
+	values, err := ReadCurrentPCRValues(s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, 7, 23)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, map[int]tpm2.Digest{
+		7:  expected[tpm2.HashAlgorithmSHA256][7],
+		23: expected[tpm2.HashAlgorithmSHA256][23]})
+}
+
+func (s *pcrProfileTPMSuite) TestReadCurrentPCRValuesInvalidPCR(c *C) {
+	_, err := ReadCurrentPCRValues(s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, 7, 2048)
+	c.Check(err, ErrorMatches, "invalid PCR index 2048")
+}
+
+func (s *pcrProfileTPMSuite) TestReadCurrentPCRValuesMissingPCR(c *C) {
+	// The TPM only implements 24 PCRs, so it won't return a value for PCR 24.
+	_, err := ReadCurrentPCRValues(s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, 7, 24)
+	c.Check(err, ErrorMatches, "TPM did not return a value for PCR 24")
+}
+
+func (s *pcrProfileTPMSuite) TestNewPCRProtectionProfileFromCurrentValuesNoPCRs(c *C) {
+	_, err := NewPCRProtectionProfileFromCurrentValues(s.TPM().TPMContext, tpm2.HashAlgorithmSHA256)
+	c.Check(err, ErrorMatches, "no PCRs specified")
+}
+
+func (s *pcrProfileTPMSuite) TestNewPCRProtectionProfileFromCurrentValuesTooManyPCRs(c *C) {
+	_, err := NewPCRProtectionProfileFromCurrentValues(s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, 0, 1, 2, 3, 4, 5, 6, 7, 8)
+	c.Check(err, ErrorMatches, `too many PCRs specified \(cannot read more than 8 PCRs with a single command\)`)
+}
+
+func (s *pcrProfileTPMSuite) TestNewPCRProtectionProfileFromCurrentValuesInvalidAlg(c *C) {
+	_, err := NewPCRProtectionProfileFromCurrentValues(s.TPM().TPMContext, tpm2.HashAlgorithmNull, 7)
+	c.Check(err, ErrorMatches, "invalid digest algorithm")
+}
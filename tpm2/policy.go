@@ -99,6 +99,8 @@ type keyDataPolicy interface {
 
 	PCRPolicySequence() uint64 // Current sequence of PCR policy for revocation
 
+	PCRSelection() tpm2.PCRSelectionList // PCRs used by the current PCR policy
+
 	// UpdatePCRPolicy updates the PCR policy associated with this keyDataPolicy.
 	UpdatePCRPolicy(alg tpm2.HashAlgorithmId, params *pcrPolicyParams) error
 
@@ -117,6 +117,10 @@ func (p *keyDataPolicy_v1) PCRPolicySequence() uint64 {
 	return p.PCRData.PolicySequence
 }
 
+func (p *keyDataPolicy_v1) PCRSelection() tpm2.PCRSelectionList {
+	return p.PCRData.Selection
+}
+
 // UpdatePCRPolicy updates the PCR policy associated with this keyDataPolicy. The PCR policy asserts
 // that the following are true:
 //   - The selected PCRs contain expected values - ie, one of the sets of permitted values specified by
@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
@@ -413,6 +414,205 @@ func (t *Connection) EnsureProvisioned(mode ProvisionMode, newLockoutAuth []byte
 	return t.ensureProvisionedInternal(mode, newLockoutAuth, nil, true)
 }
 
+// ProvisionStatusAttributes correspond to the state of the TPM with regards to provisioning for full disk encryption.
+type ProvisionStatusAttributes int
+
+const (
+	// AttrValidSRK indicates that the TPM contains a valid primary storage key with the expected properties at the
+	// expected location. Note that this does not mean that the same storage key will be created if the TPM is
+	// reprovisioned. If the TPM has been provisioned with a custom template using EnsureProvisionedWithCustomSRK,
+	// the key is checked against that template.
+	AttrValidSRK ProvisionStatusAttributes = 1 << iota
+
+	// AttrValidEK indicates that the TPM contains a valid endorsement key at the expected location. On a Connection
+	// created with SecureConnectToDefaultTPM, it also indicates that the TPM is the device for which the endorsement
+	// certificate was issued.
+	AttrValidEK
+
+	AttrDAParamsOK         // The dictionary attack lockout parameters are configured correctly.
+	AttrOwnerClearDisabled // The ability to clear the TPM with owner authorization is disabled.
+
+	// AttrLockoutAuthSet indicates that the lockout hierarchy has an authorization value defined. This
+	// doesn't necessarily mean that the authorization value is the same one that was originally provided
+	// to EnsureProvisioned - it could have been changed outside of our control.
+	AttrLockoutAuthSet
+
+	// AttrLockNVIndex indicates that the legacy global NV index used for locking access to v0 sealed key
+	// objects is defined. Keys created by this package no longer require this index.
+	AttrLockNVIndex
+)
+
+// ProvisionStatus returns the provisioning status for the TPM, which can be used by an installer to determine
+// whether EnsureProvisioned needs to be called, and which mode is appropriate. A TPM that has been fully
+// provisioned with ProvisionModeFull or ProvisionModeClear will have the AttrValidSRK, AttrValidEK,
+// AttrDAParamsOK, AttrOwnerClearDisabled and AttrLockoutAuthSet attributes set. If only AttrValidSRK or
+// AttrValidEK are missing, then calling EnsureProvisioned with ProvisionModeWithoutLockout is sufficient.
+//
+// This function does not require knowledge of any hierarchy authorization values.
+func (t *Connection) ProvisionStatus() (ProvisionStatusAttributes, error) {
+	var out ProvisionStatusAttributes
+
+	session := t.HmacSession()
+	var auditSession tpm2.SessionContext
+	if session != nil {
+		auditSession = session.IncludeAttrs(tpm2.AttrAudit)
+	}
+
+	ek, err := t.CreateResourceContextFromTPM(tcg.EKHandle, auditSession)
+	switch {
+	case err != nil && !tpm2.IsResourceUnavailableError(err, tcg.EKHandle):
+		// Unexpected error
+		return 0, xerrors.Errorf("cannot create context for endorsement key: %w", err)
+	case err == nil:
+		ok, err := isObjectPrimaryKeyWithTemplate(t.TPMContext, t.EndorsementHandleContext(), ek, tcg.EKTemplate, session)
+		if err != nil {
+			return 0, xerrors.Errorf("cannot determine if object at %v is a primary key in the endorsement hierarchy: %w", tcg.EKHandle, err)
+		}
+		if ok {
+			out |= AttrValidEK
+		}
+	}
+
+	srk, err := t.CreateResourceContextFromTPM(tcg.SRKHandle, auditSession)
+	switch {
+	case err != nil && !tpm2.IsResourceUnavailableError(err, tcg.SRKHandle):
+		// Unexpected error
+		return 0, xerrors.Errorf("cannot create context for storage root key: %w", err)
+	case err == nil:
+		ok, err := isObjectPrimaryKeyWithTemplate(t.TPMContext, t.OwnerHandleContext(), srk, selectSrkTemplate(t.TPMContext, session), session)
+		if err != nil {
+			return 0, xerrors.Errorf("cannot determine if object at %v is a primary key in the storage hierarchy: %w", tcg.SRKHandle, err)
+		}
+		if ok {
+			out |= AttrValidSRK
+		}
+	}
+
+	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyMaxAuthFail, 3, auditSession)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot fetch DA parameters: %w", err)
+	}
+	if len(props) < 3 || props[0].Property != tpm2.PropertyMaxAuthFail || props[1].Property != tpm2.PropertyLockoutInterval || props[2].Property != tpm2.PropertyLockoutRecovery {
+		return 0, errors.New("TPM returned values for the wrong properties")
+	}
+	if props[0].Value <= maxTries && props[1].Value >= recoveryTime && props[2].Value >= lockoutRecovery {
+		out |= AttrDAParamsOK
+	}
+
+	props, err = t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, auditSession)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot fetch permanent properties: %w", err)
+	}
+	if len(props) < 1 || props[0].Property != tpm2.PropertyPermanent {
+		return 0, errors.New("TPM returned value for the wrong property")
+	}
+	if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrDisableClear > 0 {
+		out |= AttrOwnerClearDisabled
+	}
+	if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrLockoutAuthSet > 0 {
+		out |= AttrLockoutAuthSet
+	}
+
+	_, err = t.CreateResourceContextFromTPM(lockNVHandle, auditSession)
+	switch {
+	case err != nil && !tpm2.IsResourceUnavailableError(err, lockNVHandle):
+		// Unexpected error
+		return 0, xerrors.Errorf("cannot create context for lock NV index: %w", err)
+	case err == nil:
+		out |= AttrLockNVIndex
+	}
+
+	return out, nil
+}
+
+// DictionaryAttackStatus contains information about the state of the TPM's
+// dictionary attack protection.
+type DictionaryAttackStatus struct {
+	// InLockout indicates that the TPM is in dictionary attack lockout
+	// mode, in which case objects that are subject to dictionary attack
+	// protection cannot be used.
+	InLockout bool
+
+	FailedTries     uint32        // The current value of the TPM's failed authorization counter
+	MaxTries        uint32        // The value of the failed authorization counter at which the TPM enters lockout mode
+	RecoveryTime    time.Duration // The interval at which the failed authorization counter is decremented
+	LockoutRecovery time.Duration // The time before the lockout hierarchy can be used again after an authorization failure
+
+	// RemainingLockoutTime is an upper bound of the time until the TPM
+	// leaves lockout mode without any intervention. It is zero if the TPM
+	// isn't in lockout mode, or if RecoveryTime is zero, in which case the
+	// TPM can only leave lockout mode with ClearLockout.
+	RemainingLockoutTime time.Duration
+}
+
+// DictionaryAttackStatus returns the current state of the TPM's dictionary attack
+// protection. This can be used to determine whether to wait for the TPM to leave
+// lockout mode or to call ClearLockout.
+func (t *Connection) DictionaryAttackStatus() (*DictionaryAttackStatus, error) {
+	session := t.HmacSession()
+	var auditSession tpm2.SessionContext
+	if session != nil {
+		auditSession = session.IncludeAttrs(tpm2.AttrAudit)
+	}
+
+	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyLockoutCounter, 4, auditSession)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot fetch DA properties: %w", err)
+	}
+	if len(props) < 4 || props[0].Property != tpm2.PropertyLockoutCounter || props[1].Property != tpm2.PropertyMaxAuthFail ||
+		props[2].Property != tpm2.PropertyLockoutInterval || props[3].Property != tpm2.PropertyLockoutRecovery {
+		return nil, errors.New("TPM returned values for the wrong properties")
+	}
+
+	status := &DictionaryAttackStatus{
+		FailedTries:     props[0].Value,
+		MaxTries:        props[1].Value,
+		RecoveryTime:    time.Duration(props[2].Value) * time.Second,
+		LockoutRecovery: time.Duration(props[3].Value) * time.Second}
+
+	props, err = t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, auditSession)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot fetch permanent properties: %w", err)
+	}
+	if len(props) < 1 || props[0].Property != tpm2.PropertyPermanent {
+		return nil, errors.New("TPM returned value for the wrong property")
+	}
+	status.InLockout = tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0
+
+	if status.InLockout && status.FailedTries >= status.MaxTries {
+		// The TPM leaves lockout mode once the failed authorization counter
+		// drops below MaxTries. It is decremented every RecoveryTime, but we
+		// don't know how long ago it was last decremented.
+		status.RemainingLockoutTime = time.Duration(status.FailedTries-status.MaxTries+1) * status.RecoveryTime
+	}
+
+	return status, nil
+}
+
+// ClearLockout takes the TPM out of dictionary attack lockout mode and resets the
+// failed authorization counter using the supplied authorization value for the
+// lockout hierarchy.
+//
+// If the supplied authorization value is incorrect, a AuthFailError error will be
+// returned. In this case, the lockout hierarchy will be unavailable for the time
+// indicated by DictionaryAttackStatus.LockoutRecovery, and any further attempts
+// during this time will result in a ErrTPMLockout error being returned.
+func (t *Connection) ClearLockout(lockoutAuth []byte) error {
+	t.LockoutHandleContext().SetAuthValue(lockoutAuth)
+
+	if err := t.DictionaryAttackLockReset(t.LockoutHandleContext(), t.HmacSession()); err != nil {
+		switch {
+		case isAuthFailError(err, tpm2.CommandDictionaryAttackLockReset, 1):
+			return AuthFailError{tpm2.HandleLockout}
+		case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandDictionaryAttackLockReset):
+			return ErrTPMLockout
+		}
+		return xerrors.Errorf("cannot reset dictionary attack lockout: %w", err)
+	}
+
+	return nil
+}
+
 // RequestTPMClearUsingPPI submits a request to the firmware to clear the TPM on the next reboot. This is the only way to clear
 // the TPM if owner clear has been disabled for the TPM, or the lockout hierarchy authorization value has been set previously but
 // is unknown.
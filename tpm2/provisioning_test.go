@@ -20,6 +20,8 @@
 package tpm2_test
 
 import (
+	"time"
+
 	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
 	tpm2_testutil "github.com/canonical/go-tpm2/testutil"
@@ -345,7 +347,8 @@ func (s *provisioningSuite) testProvisionRecreateSRK(c *C, mode ProvisionMode) {
 	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
 	c.Assert(err, IsNil)
 	expectedName := srk.Name()
-	s.EvictControl(c, tpm2.HandleOwner, srk, srk.Handle())
+	_, err = s.TPM().EvictControl(s.TPM().OwnerHandleContext(), srk, srk.Handle(), nil)
+	c.Check(err, IsNil)
 
 	c.Check(s.TPM().EnsureProvisioned(mode, lockoutAuth), IsNil)
 
@@ -490,7 +493,8 @@ func (s *provisioningSuite) testProvisionDefaultPreservesCustomSRKTemplate(c *C,
 
 	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
 	c.Assert(err, IsNil)
-	s.EvictControl(c, tpm2.HandleOwner, srk, srk.Handle())
+	_, err = s.TPM().EvictControl(s.TPM().OwnerHandleContext(), srk, srk.Handle(), nil)
+	c.Check(err, IsNil)
 
 	c.Check(s.TPM().EnsureProvisioned(mode, lockoutAuth), IsNil)
 
@@ -574,3 +578,147 @@ func (s *provisioningSuite) TestProvisionWithCustomSRKTemplateOverwritesExisting
 	c.Check(err, IsNil)
 	c.Check(tmplBytes, DeepEquals, mu.MustMarshalToBytes(&template2))
 }
+
+func (s *provisioningSimulatorSuite) TestProvisionStatusNewTPM(c *C) {
+	status, err := s.TPM().ProvisionStatus()
+	c.Check(err, IsNil)
+	c.Check(status&AttrValidSRK, Equals, ProvisionStatusAttributes(0))
+	c.Check(status&AttrDAParamsOK, Equals, ProvisionStatusAttributes(0))
+	c.Check(status&AttrOwnerClearDisabled, Equals, ProvisionStatusAttributes(0))
+	c.Check(status&AttrLockoutAuthSet, Equals, ProvisionStatusAttributes(0))
+	c.Check(status&AttrLockNVIndex, Equals, ProvisionStatusAttributes(0))
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionStatusFull(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeFull, []byte("1234")), IsNil)
+	s.AddCleanup(func() {
+		s.TPM().LockoutHandleContext().SetAuthValue([]byte("1234"))
+		c.Check(s.TPM().HierarchyChangeAuth(s.TPM().LockoutHandleContext(), nil, nil), IsNil)
+	})
+
+	status, err := s.TPM().ProvisionStatus()
+	c.Check(err, IsNil)
+	c.Check(status, Equals, AttrValidSRK|AttrValidEK|AttrDAParamsOK|AttrOwnerClearDisabled|AttrLockoutAuthSet)
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionStatusWithoutLockout(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil), Equals, ErrTPMProvisioningRequiresLockout)
+
+	status, err := s.TPM().ProvisionStatus()
+	c.Check(err, IsNil)
+	c.Check(status, Equals, AttrValidSRK|AttrValidEK)
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionStatusInvalidSRK(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil), Equals, ErrTPMProvisioningRequiresLockout)
+
+	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
+	c.Assert(err, IsNil)
+	_, err = s.TPM().EvictControl(s.TPM().OwnerHandleContext(), srk, srk.Handle(), nil)
+	c.Check(err, IsNil)
+
+	template := tpm2.Public{
+		Type:    tpm2.ObjectTypeRSA,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrNoDA |
+			tpm2.AttrRestricted | tpm2.AttrDecrypt,
+		Params: &tpm2.PublicParamsU{
+			RSADetail: &tpm2.RSAParams{
+				Symmetric: tpm2.SymDefObject{
+					Algorithm: tpm2.SymObjectAlgorithmAES,
+					KeyBits:   &tpm2.SymKeyBitsU{Sym: 256},
+					Mode:      &tpm2.SymModeU{Sym: tpm2.SymModeCFB}},
+				Scheme:   tpm2.RSAScheme{Scheme: tpm2.RSASchemeNull},
+				KeyBits:  2048,
+				Exponent: 0}}}
+	obj := s.CreatePrimary(c, tpm2.HandleOwner, &template)
+	s.EvictControl(c, tpm2.HandleOwner, obj, tcg.SRKHandle)
+
+	status, err := s.TPM().ProvisionStatus()
+	c.Check(err, IsNil)
+	c.Check(status, Equals, AttrValidEK)
+}
+
+func (s *provisioningSimulatorSuite) TestProvisionStatusLockNVIndex(c *C) {
+	nvPub := tpm2.NVPublic{
+		Index:   LockNVHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    0}
+	s.NVDefineSpace(c, tpm2.HandleOwner, nil, &nvPub)
+
+	status, err := s.TPM().ProvisionStatus()
+	c.Check(err, IsNil)
+	c.Check(status&AttrLockNVIndex, Equals, AttrLockNVIndex)
+}
+
+func (s *provisioningSuite) TestDictionaryAttackStatus(c *C) {
+	c.Check(s.TPM().DictionaryAttackParameters(s.TPM().LockoutHandleContext(), 32, 7200, 86400, nil), IsNil)
+
+	status, err := s.TPM().DictionaryAttackStatus()
+	c.Assert(err, IsNil)
+	c.Check(status, DeepEquals, &DictionaryAttackStatus{
+		MaxTries:        32,
+		RecoveryTime:    2 * time.Hour,
+		LockoutRecovery: 24 * time.Hour})
+}
+
+func (s *provisioningSuite) tripDALockout(c *C) {
+	c.Check(s.TPM().DictionaryAttackParameters(s.TPM().LockoutHandleContext(), 1, 7200, 86400, nil), IsNil)
+
+	s.HierarchyChangeAuth(c, tpm2.HandleOwner, []byte("1234"))
+	s.TPM().OwnerHandleContext().SetAuthValue(nil)
+	c.Check(s.TPM().HierarchyChangeAuth(s.TPM().OwnerHandleContext(), nil, nil), testutil.ErrorIs,
+		&tpm2.TPMSessionError{TPMError: &tpm2.TPMError{Command: tpm2.CommandHierarchyChangeAuth, Code: tpm2.ErrorAuthFail}, Index: 1})
+	s.TPM().OwnerHandleContext().SetAuthValue([]byte("1234"))
+}
+
+func (s *provisioningSuite) TestDictionaryAttackStatusInLockout(c *C) {
+	s.tripDALockout(c)
+
+	status, err := s.TPM().DictionaryAttackStatus()
+	c.Assert(err, IsNil)
+	c.Check(status, DeepEquals, &DictionaryAttackStatus{
+		InLockout:            true,
+		FailedTries:          1,
+		MaxTries:             1,
+		RecoveryTime:         2 * time.Hour,
+		LockoutRecovery:      24 * time.Hour,
+		RemainingLockoutTime: 2 * time.Hour})
+}
+
+func (s *provisioningSuite) TestClearLockout(c *C) {
+	s.tripDALockout(c)
+
+	c.Check(s.TPM().ClearLockout(nil), IsNil)
+
+	status, err := s.TPM().DictionaryAttackStatus()
+	c.Assert(err, IsNil)
+	c.Check(status.InLockout, testutil.IsFalse)
+	c.Check(status.FailedTries, Equals, uint32(0))
+	c.Check(status.RemainingLockoutTime, Equals, time.Duration(0))
+}
+
+func (s *provisioningSuite) TestClearLockoutWithAuth(c *C) {
+	s.HierarchyChangeAuth(c, tpm2.HandleLockout, []byte("5678"))
+	s.tripDALockout(c)
+
+	c.Check(s.TPM().ClearLockout([]byte("5678")), IsNil)
+
+	status, err := s.TPM().DictionaryAttackStatus()
+	c.Assert(err, IsNil)
+	c.Check(status.InLockout, testutil.IsFalse)
+}
+
+func (s *provisioningSuite) TestClearLockoutAuthFail(c *C) {
+	s.HierarchyChangeAuth(c, tpm2.HandleLockout, []byte("5678"))
+	s.tripDALockout(c)
+
+	err := s.TPM().ClearLockout([]byte("1234"))
+	c.Assert(err, testutil.ConvertibleTo, AuthFailError{})
+	c.Check(err.(AuthFailError).Handle, Equals, tpm2.HandleLockout)
+
+	c.Check(s.TPM().ClearLockout([]byte("5678")), Equals, ErrTPMLockout)
+
+	s.TPM().LockoutHandleContext().SetAuthValue([]byte("5678"))
+}
@@ -69,6 +69,37 @@ type KeyCreationParams struct {
 	// If set a key from elliptic.P256 must be used,
 	// if not set one is generated.
 	AuthKey *ecdsa.PrivateKey
+
+	// PolicyDigestAlgorithm is the name algorithm of the sealed key object, which is also the
+	// digest algorithm used to compute its authorization policy and the PCR policies created
+	// for it. If not set, tpm2.HashAlgorithmSHA256 is used. This is independent of the PCR banks
+	// that the key is sealed against, which are selected by PCRProfile.
+	PolicyDigestAlgorithm tpm2.HashAlgorithmId
+}
+
+// policyDigestAlgorithm returns the digest algorithm for the sealed key object's
+// authorization policy, checking that it is supported by this package and, if tpm
+// is not nil, by the TPM.
+func (p *KeyCreationParams) policyDigestAlgorithm(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.HashAlgorithmId, error) {
+	alg := p.PolicyDigestAlgorithm
+	if alg == tpm2.HashAlgorithmId(0) {
+		return tpm2.HashAlgorithmSHA256, nil
+	}
+	if !alg.Available() {
+		return tpm2.HashAlgorithmNull, fmt.Errorf("unsupported policy digest algorithm %v", alg)
+	}
+	if tpm == nil {
+		return alg, nil
+	}
+
+	algs, err := tpm.GetCapabilityAlgs(tpm2.AlgorithmId(alg), 1, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return tpm2.HashAlgorithmNull, xerrors.Errorf("cannot determine if policy digest algorithm is supported: %w", err)
+	}
+	if len(algs) == 0 || algs[0].Alg != tpm2.AlgorithmId(alg) {
+		return tpm2.HashAlgorithmNull, fmt.Errorf("policy digest algorithm %v is not supported by the TPM", alg)
+	}
+	return alg, nil
 }
 
 // SealKeyToExternalTPMStorageKey seals the supplied disk encryption key to the TPM storage key associated with the supplied public
@@ -107,6 +138,11 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key secboot.DiskUnlockK
 		return nil, errors.New("PCRPolicyCounter must be tpm2.HandleNull when creating an importable sealed key")
 	}
 
+	nameAlg, err := params.policyDigestAlgorithm(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	// Compute metadata.
 
 	var goAuthKey *ecdsa.PrivateKey
@@ -126,6 +162,7 @@ func SealKeyToExternalTPMStorageKey(tpmKey *tpm2.Public, key secboot.DiskUnlockK
 	authKey = goAuthKey.D.Bytes()
 
 	pub := makeImportableSealedKeyTemplate()
+	pub.NameAlg = nameAlg
 
 	// Create the initial policy data
 	policyData, authPolicy, err := newKeyDataPolicy(pub.NameAlg, authPublicKey, nil, 0)
@@ -212,6 +249,9 @@ type SealKeyRequest struct {
 // All keys will be created with the same authorization policy, and will be protected with a PCR policy computed from the
 // PCRProtectionProfile supplied via the PCRProfile field of the params argument.
 //
+// The digest algorithm for the authorization policy can be selected with the PolicyDigestAlgorithm field of the params argument.
+// If the TPM doesn't support the requested algorithm, an error will be returned before any TPM resources are created.
+//
 // If any part of this function fails, no sealed keys will be created.
 //
 // On success, this function returns the private part of the key used for authorizing PCR policy updates with
@@ -222,6 +262,31 @@ type SealKeyRequest struct {
 // The authorization key can also be chosen and provided by setting
 // AuthKey in the params argument.
 func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCreationParams) (authKey secboot.AuxiliaryKey, err error) {
+	var requests []*sealKeyToTPMRequest
+	for _, key := range keys {
+		path := key.Path
+		requests = append(requests, &sealKeyToTPMRequest{
+			key: key.Key,
+			newWriter: func() secboot.KeyDataWriter {
+				return NewFileSealedKeyObjectWriter(path)
+			},
+			remove: func() {
+				os.Remove(path)
+			}})
+	}
+	return sealKeyToTPMMultiple(tpm, requests, params)
+}
+
+// sealKeyToTPMRequest corresponds to a key that should be sealed by
+// sealKeyToTPMMultiple, along with the storage location for the sealed
+// key object.
+type sealKeyToTPMRequest struct {
+	key       secboot.DiskUnlockKey
+	newWriter func() secboot.KeyDataWriter // returns a writer for the sealed key object
+	remove    func()                       // removes the sealed key object on failure
+}
+
+func sealKeyToTPMMultiple(tpm *Connection, keys []*sealKeyToTPMRequest, params *KeyCreationParams) (authKey secboot.AuxiliaryKey, err error) {
 	// params is mandatory.
 	if params == nil {
 		return nil, errors.New("no KeyCreationParams provided")
@@ -238,6 +303,11 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 	// Use the HMAC session created when the connection was opened rather than creating a new one.
 	session := tpm.HmacSession()
 
+	nameAlg, err := params.policyDigestAlgorithm(tpm.TPMContext, session)
+	if err != nil {
+		return nil, err
+	}
+
 	// Obtain a context for the SRK now. If we're called immediately after ProvisionTPM without closing the Connection, we use the
 	// context cached by ProvisionTPM, which corresponds to the object provisioned. If not, we just unconditionally provision a new
 	// SRK as this function requires knowledge of the owner hierarchy authorization anyway. This way, we know that the primary key we
@@ -300,6 +370,7 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 	}
 
 	template := makeSealedKeyTemplate()
+	template.NameAlg = nameAlg
 
 	// Create the initial policy data
 	policyData, authPolicy, err := newKeyDataPolicy(template.NameAlg, authPublicKey, pcrPolicyCounterPub, pcrPolicyCount)
@@ -310,20 +381,20 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 	// Define the template for the sealed key object, using the computed policy digest
 	template.AuthPolicy = authPolicy
 
-	// Clean up files on failure.
+	// Clean up sealed key objects on failure.
 	defer func() {
 		if succeeded {
 			return
 		}
 		for _, key := range keys {
-			os.Remove(key.Path)
+			key.remove()
 		}
 	}()
 
 	// Seal each key.
 	for i, key := range keys {
 		// Create the sensitive data
-		sealedData, err := mu.MarshalToBytes(sealedData{Key: key.Key, AuthPrivateKey: authKey})
+		sealedData, err := mu.MarshalToBytes(sealedData{Key: key.key, AuthPrivateKey: authKey})
 		if err != nil {
 			panic(fmt.Sprintf("cannot marshal sensitive data: %v", err))
 		}
@@ -337,9 +408,9 @@ func SealKeyToTPMMultiple(tpm *Connection, keys []*SealKeyRequest, params *KeyCr
 			return nil, xerrors.Errorf("cannot create sealed data object for key: %w", err)
 		}
 
-		w := NewFileSealedKeyObjectWriter(key.Path)
+		w := key.newWriter()
 
-		// Marshal the entire object (sealed key object and auxiliary data) to disk
+		// Marshal the entire object (sealed key object and auxiliary data) to storage
 		sko := newSealedKeyObject(newKeyData(priv, pub, nil, policyData))
 
 		// Create a PCR authorization policy, only for the first key though. Subsequent keys
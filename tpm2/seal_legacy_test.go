@@ -239,6 +239,13 @@ func (s *sealLegacySuite) TestSealKeyToTPMWithProvidedAuthKey(c *C) {
 		AuthKey:                authKey})
 }
 
+func (s *sealLegacySuite) TestSealKeyToTPMWithSHA384PolicyDigestAlgorithm(c *C) {
+	s.testSealKeyToTPM(c, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		PolicyDigestAlgorithm:  tpm2.HashAlgorithmSHA384})
+}
+
 type testSealKeyToTPMMultipleData struct {
 	n      int
 	params *KeyCreationParams
@@ -373,6 +380,32 @@ func (s *sealLegacySuite) TestSealKeyToTPMMultipleWithProvidedAuthKey(c *C) {
 			AuthKey:                authKey}})
 }
 
+func (s *sealLegacySuite) TestSealKeyToTPMMultipleErrorHandlingPartialFailure(c *C) {
+	// Check that a failure to write the second key removes the first key and
+	// undefines the PCR policy counter.
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	dir := c.MkDir()
+	requests := []*SealKeyRequest{
+		{Key: key, Path: filepath.Join(dir, "key0")},
+		{Key: key, Path: filepath.Join(dir, "missing", "key1")}}
+
+	handle := s.NextAvailableHandle(c, 0x01810000)
+	_, err := SealKeyToTPMMultiple(s.TPM(), requests, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: handle})
+	c.Check(err, ErrorMatches, "cannot write key data file: .*")
+
+	for _, r := range requests {
+		_, err := os.Stat(r.Path)
+		c.Check(err, testutil.ErrorIs, os.ErrNotExist)
+	}
+
+	_, err = s.TPM().CreateResourceContextFromTPM(handle)
+	c.Check(tpm2.IsResourceUnavailableError(err, handle), testutil.IsTrue)
+}
+
 func (s *sealLegacySuite) testSealKeyToTPMErrorHandling(c *C, params *KeyCreationParams) error {
 	var origCounter tpm2.ResourceContext
 	if params != nil && params.PCRPolicyCounterHandle != tpm2.HandleNull {
@@ -475,6 +508,14 @@ func (s *sealLegacySuite) TestSealKeyToTPMErrorHandlingWrongCurve(c *C) {
 	c.Check(err, ErrorMatches, "provided AuthKey must be from elliptic.P256, no other curve is supported")
 }
 
+func (s *sealLegacySuite) TestSealKeyToTPMErrorHandlingUnsupportedPolicyDigestAlgorithm(c *C) {
+	err := s.testSealKeyToTPMErrorHandling(c, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000),
+		PolicyDigestAlgorithm:  tpm2.HashAlgorithmId(0x9999)})
+	c.Check(err, ErrorMatches, "unsupported policy digest algorithm .*")
+}
+
 func (s *sealLegacySuite) testSealKeyToExternalTPMStorageKey(c *C, params *KeyCreationParams) {
 	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
 	c.Assert(err, IsNil)
@@ -539,6 +580,13 @@ func (s *sealLegacySuite) TestSealKeyToExternalTPMStorageKeyWithProvidedAuthKey(
 		AuthKey:                authKey})
 }
 
+func (s *sealLegacySuite) TestSealKeyToExternalTPMStorageKeyWithSHA384PolicyDigestAlgorithm(c *C) {
+	s.testSealKeyToExternalTPMStorageKey(c, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewResolvedPCRProfileFromCurrentValues(c, s.TPM().TPMContext, tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PolicyDigestAlgorithm:  tpm2.HashAlgorithmSHA384})
+}
+
 func (s *sealLegacySuite) testSealKeyToExternalTPMStorageKeyErrorHandling(c *C, params *KeyCreationParams) error {
 	srk, err := s.TPM().CreateResourceContextFromTPM(tcg.SRKHandle)
 	c.Assert(err, IsNil)
@@ -596,3 +644,11 @@ func (s *sealLegacySuite) TestSealKeyToExternalTPMStorageKeyErrorHandlingWithPCR
 		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
 	c.Check(err, ErrorMatches, "PCRPolicyCounter must be tpm2.HandleNull when creating an importable sealed key")
 }
+
+func (s *sealLegacySuite) TestSealKeyToExternalTPMStorageKeyErrorHandlingUnsupportedPolicyDigestAlgorithm(c *C) {
+	err := s.testSealKeyToExternalTPMStorageKeyErrorHandling(c, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull,
+		PolicyDigestAlgorithm:  tpm2.HashAlgorithmId(0x9999)})
+	c.Check(err, ErrorMatches, "unsupported policy digest algorithm .*")
+}
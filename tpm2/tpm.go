@@ -61,6 +61,7 @@ type Connection struct {
 	*tpm2.TPMContext
 	verifiedEkCertChain      []*x509.Certificate
 	verifiedDeviceAttributes *DeviceAttributes
+	verifiedEkPublic         *tpm2.Public
 	ek                       tpm2.ResourceContext
 	provisionedSrk           tpm2.ResourceContext
 	hmacSession              tpm2.SessionContext
@@ -79,11 +80,19 @@ func (t *Connection) IsEnabled() bool {
 }
 
 // VerifiedEKCertChain returns the verified certificate chain for the endorsement key certificate obtained from this TPM. It was
-// verified using one of the built-in TPM manufacturer root CA certificates.
+// verified using one of the built-in TPM manufacturer root CA certificates, or one of the root CA certificates supplied to
+// SecureConnectToDefaultTPMWithRoots.
 func (t *Connection) VerifiedEKCertChain() []*x509.Certificate {
 	return t.verifiedEkCertChain
 }
 
+// VerifiedEKPublic returns the public area of the endorsement key for this TPM, which has been verified to correspond to the
+// public key contained in the verified endorsement key certificate. This will return nil if the connection was not created with
+// SecureConnectToDefaultTPM or SecureConnectToDefaultTPMWithRoots.
+func (t *Connection) VerifiedEKPublic() *tpm2.Public {
+	return t.verifiedEkPublic
+}
+
 // VerifiedDeviceAttributes returns the TPM device attributes for this TPM, obtained from the verified endorsement key certificate.
 func (t *Connection) VerifiedDeviceAttributes() *DeviceAttributes {
 	return t.verifiedDeviceAttributes
@@ -141,11 +150,13 @@ func createTransientEk(tpm *tpm2.TPMContext) (tpm2.ResourceContext, error) {
 // If that certificate has been verified, the ResourceContext can safely be used to encrypt secrets that can only be decrpyted and
 // used by the TPM for which the EK certificate was issued, eg, for salting an authorization session that is then used for parameter
 // encryption.
-func verifyEk(cert *x509.Certificate, ek tpm2.ResourceContext) error {
+//
+// On success, the public area that corresponds to the ResourceContext is returned.
+func verifyEk(cert *x509.Certificate, ek tpm2.ResourceContext) (*tpm2.Public, error) {
 	// Obtain the RSA public key from the endorsement certificate
 	pubKey, ok := cert.PublicKey.(*rsa.PublicKey)
 	if !ok {
-		return errors.New("cannot obtain RSA public key from certificate")
+		return nil, errors.New("cannot obtain RSA public key from certificate")
 	}
 
 	// Insert the RSA public key in to the EK template to compute the name of the EK object we expected to read back from the TPM.
@@ -177,11 +188,11 @@ func verifyEk(cert *x509.Certificate, ek tpm2.ResourceContext) error {
 			panic(fmt.Sprintf("cannot compute expected name of EK object: %v", err))
 		}
 		if !bytes.Equal(ek.Name(), expectedEkName) {
-			return errors.New("public area doesn't match certificate")
+			return nil, errors.New("public area doesn't match certificate")
 		}
 	}
 
-	return nil
+	return ekPublic, nil
 }
 
 type verificationError struct {
@@ -199,6 +210,7 @@ func (t *Connection) init() error {
 		t.hmacSession = nil
 	}
 	t.ek = nil
+	t.verifiedEkPublic = nil
 	t.provisionedSrk = nil
 
 	secureMode := len(t.verifiedEkCertChain) > 0
@@ -240,12 +252,14 @@ func (t *Connection) init() error {
 		t.FlushContext(ek)
 	}()
 
+	var ekPublic *tpm2.Public
 	if secureMode {
 		// Verify that ek is associated with the verified EK certificate. If the first attempt fails and ek references a persistent
 		// object, then try to create a transient EK with the provided authorization and make another attempt at verification, in case
 		// the persistent object isn't a valid EK.
 		rc, err := func() (tpm2.ResourceContext, error) {
-			err := verifyEk(t.verifiedEkCertChain[0], ek)
+			var err error
+			ekPublic, err = verifyEk(t.verifiedEkCertChain[0], ek)
 			if err == nil {
 				return nil, nil
 			}
@@ -257,7 +271,7 @@ func (t *Connection) init() error {
 			if err2 != nil {
 				return nil, err
 			}
-			err = verifyEk(t.verifiedEkCertChain[0], transientEk)
+			ekPublic, err = verifyEk(t.verifiedEkCertChain[0], transientEk)
 			if err == nil {
 				return transientEk, nil
 			}
@@ -315,6 +329,7 @@ func (t *Connection) init() error {
 	if ekIsPersistent() {
 		t.ek = ek
 	}
+	t.verifiedEkPublic = ekPublic
 	t.hmacSession = session
 	return nil
 }
@@ -540,11 +555,13 @@ type ekCertData struct {
 }
 
 // verifyEkCertificate verifies the provided certificate and intermediate certificates against the built-in roots, and verifies
-// that the certificate is a valid EK certificate, according to the "TCG EK Credential Profile" specification.
+// that the certificate is a valid EK certificate, according to the "TCG EK Credential Profile" specification. If trustedRoots is
+// not empty, the certificate is verified against the supplied roots instead of the built-in ones, and all of the supplied parent
+// certificates are treated as intermediates.
 //
 // On success, it returns a verified certificate chain. This function will also return success if there is no certificate and
 // it is executed inside a guest VM, in order to support fallback to a non-secure connection when using swtpm in a guest VM.
-func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *DeviceAttributes, error) {
+func verifyEkCertificate(data *ekCertData, trustedRoots []*x509.Certificate) ([]*x509.Certificate, *DeviceAttributes, error) {
 	// Parse EK cert
 	cert, err := x509.ParseCertificate(data.Cert)
 	if err != nil {
@@ -553,13 +570,16 @@ func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *DeviceAttribut
 
 	// Parse other certs, building root and intermediates store
 	roots := x509.NewCertPool()
+	for _, c := range trustedRoots {
+		roots.AddCert(c)
+	}
 	intermediates := x509.NewCertPool()
 	for _, d := range data.Parents {
 		c, err := x509.ParseCertificate(d)
 		if err != nil {
 			return nil, nil, xerrors.Errorf("cannot parse certificate: %w", err)
 		}
-		if isCertificateTrustedCA(c) {
+		if len(trustedRoots) == 0 && isCertificateTrustedCA(c) {
 			roots.AddCert(c)
 		} else {
 			intermediates.AddCert(c)
@@ -917,9 +937,72 @@ func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byt
 		}
 	}
 
-	chain, attrs, err := verifyEkCertificate(certData)
+	if err := t.secureInit(certData, nil); err != nil {
+		return nil, err
+	}
+
+	succeeded = true
+	return t, nil
+}
+
+// SecureConnectToDefaultTPMWithRoots will attempt to connect to the default TPM, verify the manufacturer issued endorsement key
+// certificate against the supplied CA roots and then verify that the TPM is the one for which the endorsement certificate was
+// issued. This is useful for verifying TPMs from manufacturers whose root CA certificates are not built-in. The built-in CA roots
+// are not used by this function, and at least one root must be supplied.
+//
+// The endorsement key certificate is read from the TPM. Any certificates required to build a chain between the endorsement key
+// certificate and one of the supplied roots should be provided via the intermediates argument.
+//
+// If the endorsement key certificate cannot be obtained from the TPM or its verification fails, a EKCertVerificationError error
+// will be returned. All other errors are the same as those returned from SecureConnectToDefaultTPM.
+//
+// On success, the verified public area of the endorsement key is available from Connection.VerifiedEKPublic.
+func SecureConnectToDefaultTPMWithRoots(roots, intermediates []*x509.Certificate, endorsementAuth []byte) (*Connection, error) {
+	if len(roots) == 0 {
+		return nil, errors.New("no root CA certificates were provided")
+	}
+
+	tpm, err := connectToDefaultTPM()
+	if err != nil {
+		return nil, err
+	}
+	tpm.EndorsementHandleContext().SetAuthValue(endorsementAuth)
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.Close()
+	}()
+
+	t := &Connection{TPMContext: tpm}
+
+	cert, err := readEkCertFromTPM(tpm)
+	if err != nil {
+		return nil, EKCertVerificationError{fmt.Sprintf("cannot obtain endorsement key certificate from TPM: %v", err)}
+	}
+
+	certData := &ekCertData{Cert: cert}
+	for _, c := range intermediates {
+		certData.Parents = append(certData.Parents, c.Raw)
+	}
+
+	if err := t.secureInit(certData, roots); err != nil {
+		return nil, err
+	}
+
+	succeeded = true
+	return t, nil
+}
+
+// secureInit verifies the supplied endorsement key certificate data against the supplied roots (or the built-in roots if
+// none are supplied), and then initializes the connection, verifying that the TPM is the one for which the endorsement
+// key certificate was issued.
+func (t *Connection) secureInit(certData *ekCertData, roots []*x509.Certificate) error {
+	chain, attrs, err := verifyEkCertificate(certData, roots)
 	if err != nil {
-		return nil, EKCertVerificationError{err.Error()}
+		return EKCertVerificationError{err.Error()}
 	}
 
 	t.verifiedEkCertChain = chain
@@ -927,17 +1010,16 @@ func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byt
 
 	if err := t.init(); err != nil {
 		if tpm2.IsResourceUnavailableError(err, tpm2.AnyHandle) {
-			return nil, ErrTPMProvisioning
+			return ErrTPMProvisioning
 		}
 		var verifyErr verificationError
 		if xerrors.As(err, &verifyErr) {
-			return nil, TPMVerificationError{err.Error()}
+			return TPMVerificationError{err.Error()}
 		}
-		return nil, xerrors.Errorf("cannot initialize TPM connection: %w", err)
+		return xerrors.Errorf("cannot initialize TPM connection: %w", err)
 	}
 
-	succeeded = true
-	return t, nil
+	return nil
 }
 
 // ConnectToTPM will attempt to connect to a TPM using the currently
@@ -21,6 +21,7 @@ package tpm2_test
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"crypto/x509"
 	"io"
 	"os"
@@ -111,6 +112,7 @@ func (s *tpmSuiteCommon) testConnectToDefaultTPM(c *C, hasEk bool) {
 
 	c.Check(tpm.VerifiedEKCertChain(), HasLen, 0)
 	c.Check(tpm.VerifiedDeviceAttributes(), IsNil)
+	c.Check(tpm.VerifiedEKPublic(), IsNil)
 
 	ek, err := tpm.EndorsementKey()
 	if !hasEk {
@@ -213,6 +215,9 @@ func (s *tpmSuiteSimulator) testSecureConnectToDefaultTPM(c *C, data *testSecure
 	c.Check(tpm.VerifiedDeviceAttributes().Model, Equals, "FakeTPM")
 	c.Check(tpm.VerifiedDeviceAttributes().FirmwareVersion, Equals, uint32(0x00010002))
 
+	c.Assert(tpm.VerifiedEKPublic(), NotNil)
+	c.Check(tpm.VerifiedEKPublic().Unique.RSA, DeepEquals, tpm2.PublicKeyRSA(s.ekCert(c).PublicKey.(*rsa.PublicKey).N.Bytes()))
+
 	ek, err := tpm.EndorsementKey()
 	if !data.expectEk {
 		c.Check(ek, IsNil)
@@ -354,3 +359,43 @@ func (s *tpmSuiteSimulator) TestSecureConnectToDefaultTPMIncorrectPersistentEKWi
 	c.Check(err, ErrorMatches, "cannot verify that the TPM is the device for which the supplied EK certificate was issued: "+
 		"cannot verify public area of endorsement key read from the TPM: public area doesn't match certificate")
 }
+
+func (s *tpmSuiteSimulator) TestSecureConnectToDefaultTPMWithRoots(c *C) {
+	c.Check(s.TPM().EnsureProvisioned(ProvisionModeWithoutLockout, nil), Equals, ErrTPMProvisioningRequiresLockout)
+
+	tpm, err := SecureConnectToDefaultTPMWithRoots([]*x509.Certificate{s.caCert(c)}, nil, nil)
+	c.Assert(err, IsNil)
+	s.AddCleanup(func() {
+		c.Check(tpm.Close(), IsNil)
+	})
+
+	c.Check(tpm.VerifiedEKCertChain(), HasLen, 2)
+	c.Check(tpm.VerifiedEKCertChain()[0].Raw, DeepEquals, testEkCert)
+	c.Check(tpm.VerifiedEKCertChain()[1].Raw, DeepEquals, testCACert)
+
+	c.Check(tpm.VerifiedDeviceAttributes(), NotNil)
+	c.Check(tpm.VerifiedDeviceAttributes().Manufacturer, Equals, tpm2.TPMManufacturerIBM)
+
+	c.Assert(tpm.VerifiedEKPublic(), NotNil)
+	c.Check(tpm.VerifiedEKPublic().Unique.RSA, DeepEquals, tpm2.PublicKeyRSA(s.ekCert(c).PublicKey.(*rsa.PublicKey).N.Bytes()))
+
+	ek, err := tpm.EndorsementKey()
+	c.Assert(err, IsNil)
+	c.Check(ek.Handle(), Equals, tcg.EKHandle)
+}
+
+func (s *tpmSuiteSimulator) TestSecureConnectToDefaultTPMWithRootsUnknownIssuer(c *C) {
+	// Test that the built-in roots aren't used when the caller supplies roots
+	caCertRaw, _, err := tpm2test.CreateTestCA()
+	c.Assert(err, IsNil)
+	caCert, _ := x509.ParseCertificate(caCertRaw)
+
+	_, err = SecureConnectToDefaultTPMWithRoots([]*x509.Certificate{caCert}, nil, nil)
+	c.Check(err, testutil.ConvertibleTo, EKCertVerificationError{})
+	c.Check(err, ErrorMatches, "cannot verify the endorsement key certificate: certificate verification failed: x509: certificate signed by unknown authority")
+}
+
+func (s *tpmSuiteSimulator) TestSecureConnectToDefaultTPMWithRootsNoRoots(c *C) {
+	_, err := SecureConnectToDefaultTPMWithRoots(nil, nil, nil)
+	c.Check(err, ErrorMatches, "no root CA certificates were provided")
+}
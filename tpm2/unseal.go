@@ -20,6 +20,7 @@
 package tpm2
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/canonical/go-tpm2"
@@ -99,7 +100,33 @@ func (k *SealedKeyObject) loadForUnseal(tpm *tpm2.TPMContext, session tpm2.Sessi
 	return nil, lastError
 }
 
-func (k *SealedKeyObject) unsealDataFromTPM(tpm *tpm2.TPMContext, hmacSession tpm2.SessionContext) (data []byte, err error) {
+// checkPolicySession checks that the supplied session can be used to satisfy
+// the authorization policy of this sealed key object.
+func (k *SealedKeyObject) checkPolicySession(session tpm2.SessionContext) error {
+	if session.Handle().Type() != tpm2.HandleTypePolicySession {
+		return fmt.Errorf("invalid policy session: handle %v is not a policy session", session.Handle())
+	}
+	if session.HashAlg() != k.data.Public().NameAlg {
+		return fmt.Errorf("invalid policy session: session digest algorithm %v does not match the sealed object's name algorithm %v",
+			session.HashAlg(), k.data.Public().NameAlg)
+	}
+	return nil
+}
+
+// unsealDataFromTPM loads the sealed key object in to the TPM and unseals it. If
+// pcrValues is not nil, it is populated with the values of the PCRs that were
+// used to satisfy the PCR policy.
+//
+// If policySession is not nil, it is restarted and used to execute the policy
+// assertions instead of starting a new session. It is not flushed from the TPM
+// by this function.
+func (k *SealedKeyObject) unsealDataFromTPM(tpm *tpm2.TPMContext, hmacSession, policySession tpm2.SessionContext, pcrValues *tpm2.PCRValues) (data []byte, err error) {
+	if policySession != nil {
+		if err := k.checkPolicySession(policySession); err != nil {
+			return nil, err
+		}
+	}
+
 	// Check if the TPM is in lockout mode
 	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
 	if err != nil {
@@ -117,11 +144,32 @@ func (k *SealedKeyObject) unsealDataFromTPM(tpm *tpm2.TPMContext, hmacSession tp
 	defer tpm.FlushContext(keyObject)
 
 	// Begin and execute policy session
-	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.Public().NameAlg)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot start policy session: %w", err)
+	if policySession == nil {
+		policySession, err = tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.Public().NameAlg)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot start policy session: %w", err)
+		}
+		defer tpm.FlushContext(policySession)
+	} else {
+		// Discard any assertions from a previous use of the supplied
+		// session, and make sure that it isn't flushed from the TPM
+		// by TPM2_Unseal so that the caller can use it again.
+		if err := tpm.PolicyRestart(policySession); err != nil {
+			return nil, xerrors.Errorf("cannot restart policy session: %w", err)
+		}
+		policySession = policySession.IncludeAttrs(tpm2.AttrContinueSession)
+	}
+
+	// Record the PCR update counter before executing the policy so that we can
+	// detect if any PCRs change before we read back the values that were used
+	// to satisfy it.
+	var pcrUpdateCounter uint32
+	if pcrValues != nil {
+		pcrUpdateCounter, _, err = tpm.PCRRead(k.data.Policy().PCRSelection())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read PCR values: %w", err)
+		}
 	}
-	defer tpm.FlushContext(policySession)
 
 	if err := k.data.Policy().ExecutePCRPolicy(tpm, policySession, hmacSession); err != nil {
 		err = xerrors.Errorf("cannot complete authorization policy assertions: %w", err)
@@ -143,5 +191,16 @@ func (k *SealedKeyObject) unsealDataFromTPM(tpm *tpm2.TPMContext, hmacSession tp
 		return nil, xerrors.Errorf("cannot unseal key: %w", err)
 	}
 
+	if pcrValues != nil {
+		counter, values, err := tpm.PCRRead(k.data.Policy().PCRSelection())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read PCR values: %w", err)
+		}
+		if counter != pcrUpdateCounter {
+			return nil, errors.New("cannot determine the PCR values used to satisfy the PCR policy because they were modified during unsealing")
+		}
+		*pcrValues = values
+	}
+
 	return data, nil
 }
@@ -20,6 +20,9 @@
 package tpm2
 
 import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
 	"github.com/canonical/go-tpm2/mu"
 
 	"github.com/snapcore/secboot"
@@ -73,11 +76,63 @@ import (
 // private part of the key used for authorizing PCR policy updates with
 // SealedKeyObject.UpdatePCRProtectionPolicy is returned as the second return value.
 func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection) (key secboot.DiskUnlockKey, authKey secboot.AuxiliaryKey, err error) {
-	data, err := k.unsealDataFromTPM(tpm.TPMContext, tpm.HmacSession())
+	data, err := k.unsealDataFromTPM(tpm.TPMContext, tpm.HmacSession(), nil, nil)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	return k.unmarshalUnsealedData(data)
+}
+
+// UnsealFromTPMWithPCRs behaves the same as UnsealFromTPM, but on success it
+// additionally returns the values of the PCRs that were used to satisfy the PCR
+// policy. Where the PCR policy permits multiple combinations of PCR values, this
+// can be used to determine which of these combinations the current boot matched.
+//
+// If any of the selected PCRs are modified during unsealing, then an error will
+// be returned.
+func (k *SealedKeyObject) UnsealFromTPMWithPCRs(tpm *Connection) (key secboot.DiskUnlockKey, authKey secboot.AuxiliaryKey, pcrValues tpm2.PCRValues, err error) {
+	data, err := k.unsealDataFromTPM(tpm.TPMContext, tpm.HmacSession(), nil, &pcrValues)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	key, authKey, err = k.unmarshalUnsealedData(data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return key, authKey, pcrValues, nil
+}
+
+// UnsealFromTPMWithSession behaves the same as UnsealFromTPM, but uses the
+// supplied policy session to satisfy the authorization policy of the sealed
+// object instead of starting and flushing a new session for each call. This
+// avoids the cost of creating a new session when unsealing repeatedly.
+//
+// The supplied session must be a policy session started with
+// Connection.StartAuthSession, with a digest algorithm that matches the name
+// algorithm of the sealed object. If it isn't, an error will be returned
+// without attempting to unseal the key.
+//
+// The session is restarted with TPM2_PolicyRestart before the PCR policy
+// assertions are executed on it, so any assertions already executed on it by
+// the caller are discarded. The session remains loaded in the TPM after this
+// function returns, and the caller is responsible for flushing it.
+func (k *SealedKeyObject) UnsealFromTPMWithSession(tpm *Connection, session tpm2.SessionContext) (key secboot.DiskUnlockKey, authKey secboot.AuxiliaryKey, err error) {
+	if session == nil {
+		return nil, nil, errors.New("no policy session supplied")
+	}
+
+	data, err := k.unsealDataFromTPM(tpm.TPMContext, tpm.HmacSession(), session, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return k.unmarshalUnsealedData(data)
+}
+
+func (k *SealedKeyObject) unmarshalUnsealedData(data []byte) (key secboot.DiskUnlockKey, authKey secboot.AuxiliaryKey, err error) {
 	if k.data.Version() == 0 {
 		return secboot.DiskUnlockKey(data), nil, nil
 	}
@@ -89,3 +144,39 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *Connection) (key secboot.DiskUnlock
 
 	return sealedData.Key, sealedData.AuthPrivateKey, nil
 }
+
+// VerifySealedKeyUnsealable reads the sealed key object from the file created by
+// SealKeyToTPM at the specified path and checks that it can be unsealed by the TPM
+// in the current boot state, without returning the unsealed key to the caller. This
+// can be used immediately after sealing a key, eg, during installation, in order to
+// detect a PCR profile that is not consistent with the current boot rather than
+// discovering this on the next boot.
+//
+// The unsealed key material is cleared from memory before this function returns.
+// Note that the key can only be unsealed if the PCR profile is consistent with the
+// current boot, so this check isn't meaningful for a key that is sealed with a PCR
+// profile that only permits future boot configurations.
+//
+// If the file cannot be opened, an *os.PathError error is returned. If the file cannot
+// be deserialized successfully, an InvalidKeyDataError error will be returned. If the
+// key cannot be unsealed, the same errors as SealedKeyObject.UnsealFromTPM are returned.
+func VerifySealedKeyUnsealable(tpm *Connection, keyFile string) error {
+	k, err := ReadSealedKeyObjectFromFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	key, authKey, err := k.UnsealFromTPM(tpm)
+	if err != nil {
+		return err
+	}
+
+	for i := range key {
+		key[i] = 0
+	}
+	for i := range authKey {
+		authKey[i] = 0
+	}
+
+	return nil
+}
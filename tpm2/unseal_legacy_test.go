@@ -20,7 +20,9 @@
 package tpm2_test
 
 import (
+	"crypto/sha256"
 	"math/rand"
+	"os"
 	"path/filepath"
 
 	"github.com/canonical/go-tpm2"
@@ -89,6 +91,152 @@ func (s *unsealSuite) TestUnsealFromTPMNoPCRPolicyCounter(c *C) {
 		PCRPolicyCounterHandle: tpm2.HandleNull})
 }
 
+func (s *unsealSuite) TestUnsealFromTPMMultipleBranches(c *C) {
+	// Create a profile that is valid for the current value of PCR 23 and
+	// for the value after it has been extended with a known event.
+	event := sha256.Sum256([]byte("foo"))
+	profile := tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}).
+		AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23),
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 23, event[:]))
+
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+
+	_, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181fff0)})
+	c.Assert(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	keyUnsealed, _, err := k.UnsealFromTPM(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	keyUnsealed, _, err = k.UnsealFromTPM(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	_, _, err = k.UnsealFromTPM(s.TPM())
+	c.Check(err, testutil.ConvertibleTo, InvalidKeyDataError{})
+}
+
+func (s *unsealSuite) TestUnsealFromTPMWithPCRs(c *C) {
+	event := sha256.Sum256([]byte("foo"))
+	profile := tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}).
+		AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23),
+			NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23).
+				ExtendPCR(tpm2.HashAlgorithmSHA256, 23, event[:]))
+
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+
+	authKey, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{
+		PCRProfile:             profile,
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	readPcrSelection := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 23}}}
+
+	_, expectedPcrValues, err := s.TPM().PCRRead(readPcrSelection)
+	c.Assert(err, IsNil)
+
+	keyUnsealed, authKeyUnsealed, pcrValues, err := k.UnsealFromTPMWithPCRs(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+	c.Check(authKeyUnsealed, DeepEquals, authKey)
+	c.Check(pcrValues, DeepEquals, expectedPcrValues)
+
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	_, expectedPcrValues, err = s.TPM().PCRRead(readPcrSelection)
+	c.Assert(err, IsNil)
+
+	keyUnsealed, _, pcrValues, err = k.UnsealFromTPMWithPCRs(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+	c.Check(pcrValues, DeepEquals, expectedPcrValues)
+}
+
+func (s *unsealSuite) TestUnsealFromTPMWithSession(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+
+	authKey, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181fff0)})
+	c.Assert(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+
+	// The session should remain loaded after the first call so that it can
+	// be used again.
+	for i := 0; i < 2; i++ {
+		keyUnsealed, authKeyUnsealed, err := k.UnsealFromTPMWithSession(s.TPM(), session)
+		c.Check(err, IsNil)
+		c.Check(keyUnsealed, DeepEquals, key)
+		c.Check(authKeyUnsealed, DeepEquals, authKey)
+	}
+}
+
+func (s *unsealSuite) testUnsealFromTPMWithInvalidSession(c *C, session tpm2.SessionContext) error {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+
+	_, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Assert(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	_, _, err = k.UnsealFromTPMWithSession(s.TPM(), session)
+	return err
+}
+
+func (s *unsealSuite) TestUnsealFromTPMWithSessionHMACSession(c *C) {
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256)
+	err := s.testUnsealFromTPMWithInvalidSession(c, session)
+	c.Check(err, ErrorMatches, `invalid policy session: handle 0x02[[:xdigit:]]{6} is not a policy session`)
+}
+
+func (s *unsealSuite) TestUnsealFromTPMWithSessionWrongDigestAlgorithm(c *C) {
+	session := s.StartAuthSession(c, nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA1)
+	err := s.testUnsealFromTPMWithInvalidSession(c, session)
+	c.Check(err, ErrorMatches, `invalid policy session: session digest algorithm SHA1 does not match the sealed object's name algorithm SHA256`)
+}
+
+func (s *unsealSuite) TestUnsealFromTPMWithSessionNil(c *C) {
+	err := s.testUnsealFromTPMWithInvalidSession(c, nil)
+	c.Check(err, ErrorMatches, `no policy session supplied`)
+}
+
 func (s *unsealSuite) testUnsealFromTPMNoValidSRK(c *C, prepareSrk func()) {
 	key := make(secboot.DiskUnlockKey, 32)
 	rand.Read(key)
@@ -226,3 +374,48 @@ func (s *unsealSuite) TestUnsealFromTPMErrorHandlingSealedKeyAccessLocked(c *C)
 	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
 		"cannot execute PolicyOR assertions: current session digest not found in policy data")
 }
+
+func (s *unsealSuite) TestVerifySealedKeyUnsealable(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+	_, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181fff0)})
+	c.Assert(err, IsNil)
+
+	c.Check(VerifySealedKeyUnsealable(s.TPM(), path), IsNil)
+
+	// Check that the key can still be unsealed afterwards.
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+	keyUnsealed, _, err := k.UnsealFromTPM(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(keyUnsealed, DeepEquals, key)
+}
+
+func (s *unsealSuite) TestVerifySealedKeyUnsealableInvalidPCRProfile(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+	_, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x0181fff0)})
+	c.Assert(err, IsNil)
+
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	err = VerifySealedKeyUnsealable(s.TPM(), path)
+	c.Check(err, testutil.ConvertibleTo, InvalidKeyDataError{})
+	c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
+		"cannot execute PolicyOR assertions: current session digest not found in policy data")
+}
+
+func (s *unsealSuite) TestVerifySealedKeyUnsealableMissingFile(c *C) {
+	err := VerifySealedKeyUnsealable(s.TPM(), filepath.Join(c.MkDir(), "key"))
+	c.Check(err, ErrorMatches, "open .*/key: no such file or directory")
+	c.Check(err, FitsTypeOf, &os.PathError{})
+}
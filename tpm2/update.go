@@ -241,3 +241,39 @@ func (k *SealedKeyObject) UpdatePCRProtectionPolicy(tpm *Connection, authKey sec
 func (k *SealedKeyObject) RevokeOldPCRProtectionPolicies(tpm *Connection, authKey secboot.AuxiliaryKey) error {
 	return k.revokeOldPCRProtectionPoliciesImpl(tpm.TPMContext, authKey, tpm.HmacSession())
 }
+
+// ReadPCRPolicyCounter returns the current value of the PCR policy counter associated with this sealed key object.
+// PCR policies with a sequence number (see SealedKeyObject.PCRPolicySequence) lower than this value have been revoked.
+// If the returned value is lower than the current sequence number, then older PCR policies can be revoked with
+// RevokeOldPCRProtectionPolicies.
+//
+// If the key data was not created with a PCR policy counter, then an error will be returned.
+//
+// If validation of the key data fails, a InvalidKeyDataError error will be returned.
+func (k *SealedKeyObject) ReadPCRPolicyCounter(tpm *Connection) (uint64, error) {
+	session := tpm.HmacSession()
+
+	pcrPolicyCounterPub, err := k.validateData(tpm.TPMContext, session)
+	if err != nil {
+		if isKeyDataError(err) {
+			return 0, InvalidKeyDataError{err.Error()}
+		}
+		return 0, xerrors.Errorf("cannot validate key data: %w", err)
+	}
+
+	if pcrPolicyCounterPub == nil {
+		return 0, errors.New("sealed key object has no PCR policy counter")
+	}
+
+	context, err := k.data.Policy().PCRPolicyCounterContext(tpm.TPMContext, pcrPolicyCounterPub, session)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot create context for PCR policy counter: %w", err)
+	}
+
+	value, err := context.Get()
+	if err != nil {
+		return 0, xerrors.Errorf("cannot read current value: %w", err)
+	}
+
+	return value, nil
+}
@@ -22,7 +22,11 @@ package tpm2
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
 
 	"golang.org/x/xerrors"
 
@@ -108,3 +112,64 @@ func UpdateKeyPCRProtectionPolicyMultiple(tpm *Connection, keys []*SealedKeyObje
 
 	return updateKeyPCRProtectionPolicyCommon(tpm.TPMContext, keys, authKey, pcrProfile, tpm.HmacSession())
 }
+
+// UpdateKeyPCRProtectionPolicyFiles updates the PCR protection policy for the sealed key data files at the
+// supplied paths to the profile defined by the pcrProfile argument, and persists the updated key data. The
+// keys must all be related (ie, they were created using SealKeyToTPMMultiple). The new PCR policy is computed
+// once and shared by all of the keys.
+//
+// All of the key data files are read and updated in memory before any of them are written, so an invalid or
+// unrelated key data file will not result in any file being modified. If writing one of the files fails, the
+// files that have already been written are restored to their original contents, and any errors encountered
+// whilst restoring them are included in the returned error.
+//
+// Once all of the files have been written, old PCR policies are revoked by incrementing the PCR policy counter
+// on the TPM. As related keys share the same PCR policy counter, this is only done once for the whole set.
+//
+// If validation of any sealed key object fails, a InvalidKeyDataError error will be returned.
+func UpdateKeyPCRProtectionPolicyFiles(tpm *Connection, keyPaths []string, authKey secboot.AuxiliaryKey, pcrProfile *PCRProtectionProfile) error {
+	if len(keyPaths) == 0 {
+		return errors.New("no sealed key files supplied")
+	}
+
+	var keys []*SealedKeyObject
+	var origData [][]byte
+	for _, path := range keyPaths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return xerrors.Errorf("cannot read key data file: %w", err)
+		}
+		origData = append(origData, data)
+
+		k, err := ReadSealedKeyObjectFromFile(path)
+		if err != nil {
+			return xerrors.Errorf("cannot read sealed key object from %s: %w", path, err)
+		}
+		keys = append(keys, k)
+	}
+
+	if err := UpdateKeyPCRProtectionPolicyMultiple(tpm, keys, authKey, pcrProfile); err != nil {
+		return err
+	}
+
+	for i, k := range keys {
+		if err := k.WriteAtomic(NewFileSealedKeyObjectWriter(keyPaths[i])); err != nil {
+			var restoreErrs []string
+			for j := 0; j < i; j++ {
+				if err := osutil.AtomicWriteFile(keyPaths[j], origData[j], 0600, 0); err != nil {
+					restoreErrs = append(restoreErrs, fmt.Sprintf("cannot restore %s: %v", keyPaths[j], err))
+				}
+			}
+			if len(restoreErrs) > 0 {
+				return xerrors.Errorf("cannot write key data file %s: %w (%s)", keyPaths[i], err, strings.Join(restoreErrs, "; "))
+			}
+			return xerrors.Errorf("cannot write key data file %s: %w", keyPaths[i], err)
+		}
+	}
+
+	if err := keys[0].revokeOldPCRProtectionPoliciesImpl(tpm.TPMContext, authKey, tpm.HmacSession()); err != nil {
+		return xerrors.Errorf("cannot revoke old PCR policies: %w", err)
+	}
+
+	return nil
+}
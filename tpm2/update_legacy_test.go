@@ -23,6 +23,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"path/filepath"
 
@@ -165,3 +166,97 @@ func (s *updateLegacySuite) TestUpdateKeyPCRProtectionPolicyMultipleUnrelated2(c
 	err = UpdateKeyPCRProtectionPolicyMultiple(s.TPM(), keys, authKey, nil)
 	c.Check(err, ErrorMatches, "invalid key data: key data at index 0 is not related to the primary key data")
 }
+
+func (s *updateLegacySuite) TestUpdateKeyPCRProtectionPolicyFiles(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	dir := c.MkDir()
+
+	var requests []*SealKeyRequest
+	var paths []string
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("key%d", i))
+		requests = append(requests, &SealKeyRequest{Key: key, Path: path})
+		paths = append(paths, path)
+	}
+
+	authKey, err := SealKeyToTPMMultiple(s.TPM(), requests, &KeyCreationParams{PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)})
+	c.Check(err, IsNil)
+
+	var origKeys []*SealedKeyObject
+	for _, path := range paths {
+		k, err := ReadSealedKeyObjectFromFile(path)
+		c.Assert(err, IsNil)
+		origKeys = append(origKeys, k)
+	}
+
+	c.Check(UpdateKeyPCRProtectionPolicyFiles(s.TPM(), paths, authKey, tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23})), IsNil)
+
+	var keys []*SealedKeyObject
+	for _, path := range paths {
+		k, err := ReadSealedKeyObjectFromFile(path)
+		c.Assert(err, IsNil)
+		keys = append(keys, k)
+
+		_, _, err = k.UnsealFromTPM(s.TPM())
+		c.Check(err, IsNil)
+	}
+
+	// The old PCR policies should have been revoked for all of the keys.
+	for _, k := range origKeys {
+		_, _, err := k.UnsealFromTPM(s.TPM())
+		c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: the PCR policy has been revoked")
+	}
+
+	_, err = s.TPM().PCREvent(s.TPM().PCRHandleContext(23), []byte("foo"), nil)
+	c.Check(err, IsNil)
+
+	for _, k := range keys {
+		_, _, err = k.UnsealFromTPM(s.TPM())
+		c.Check(err, ErrorMatches, "invalid key data: cannot complete authorization policy assertions: cannot execute PCR assertions: "+
+			"cannot execute PolicyOR assertions: current session digest not found in policy data")
+	}
+}
+
+func (s *updateLegacySuite) TestUpdateKeyPCRProtectionPolicyFilesUnrelated(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	dir := c.MkDir()
+
+	params := &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7}),
+		PCRPolicyCounterHandle: tpm2.HandleNull}
+
+	var paths []string
+	var origData [][]byte
+	var authKey secboot.AuxiliaryKey
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("key%d", i))
+		k, err := SealKeyToTPM(s.TPM(), key, path, params)
+		c.Check(err, IsNil)
+		if i == 0 {
+			authKey = k
+		}
+
+		data, err := ioutil.ReadFile(path)
+		c.Assert(err, IsNil)
+
+		paths = append(paths, path)
+		origData = append(origData, data)
+	}
+
+	err := UpdateKeyPCRProtectionPolicyFiles(s.TPM(), paths, authKey, nil)
+	c.Check(err, ErrorMatches, "invalid key data: key data at index 0 is not related to the primary key data")
+
+	for i, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		c.Check(err, IsNil)
+		c.Check(data, DeepEquals, origData[i])
+	}
+}
+
+func (s *updateLegacySuite) TestUpdateKeyPCRProtectionPolicyFilesNoFiles(c *C) {
+	c.Check(UpdateKeyPCRProtectionPolicyFiles(s.TPM(), nil, nil, nil), ErrorMatches, "no sealed key files supplied")
+}
@@ -151,3 +151,54 @@ func (s *updateSuite) TestRevokeOldPCRProtectionPoliciesWithoutPCRPolicyCounter(
 		PCRPolicyCounterHandle: tpm2.HandleNull})
 	c.Check(err, IsNil)
 }
+
+func (s *updateSuite) TestReadPCRPolicyCounter(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+
+	params := &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: s.NextAvailableHandle(c, 0x01810000)}
+	authKey, err := SealKeyToTPM(s.TPM(), key, path, params)
+	c.Check(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	initial, err := k.ReadPCRPolicyCounter(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(k.PCRPolicySequence(), Equals, initial)
+
+	c.Check(k.UpdatePCRProtectionPolicy(s.TPM(), authKey, params.PCRProfile), IsNil)
+	c.Check(k.PCRPolicySequence(), Equals, initial+1)
+
+	value, err := k.ReadPCRPolicyCounter(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(value, Equals, initial)
+
+	c.Check(k.RevokeOldPCRProtectionPolicies(s.TPM(), authKey), IsNil)
+
+	value, err = k.ReadPCRPolicyCounter(s.TPM())
+	c.Check(err, IsNil)
+	c.Check(value, Equals, initial+1)
+}
+
+func (s *updateSuite) TestReadPCRPolicyCounterWithoutPCRPolicyCounter(c *C) {
+	key := make(secboot.DiskUnlockKey, 32)
+	rand.Read(key)
+
+	path := filepath.Join(c.MkDir(), "key")
+
+	_, err := SealKeyToTPM(s.TPM(), key, path, &KeyCreationParams{
+		PCRProfile:             tpm2test.NewPCRProfileFromCurrentValues(tpm2.HashAlgorithmSHA256, []int{7, 23}),
+		PCRPolicyCounterHandle: tpm2.HandleNull})
+	c.Check(err, IsNil)
+
+	k, err := ReadSealedKeyObjectFromFile(path)
+	c.Assert(err, IsNil)
+
+	_, err = k.ReadPCRPolicyCounter(s.TPM())
+	c.Check(err, ErrorMatches, "sealed key object has no PCR policy counter")
+}